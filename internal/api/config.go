@@ -0,0 +1,261 @@
+// Package api sets up and runs the REST API server for NSM.
+package api
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nexus/nsm/internal/core"
+)
+
+// ServerConfig holds everything the API server needs to run.
+// It is usually loaded from the environment with LoadServerConfig.
+type ServerConfig struct {
+	// PayPal credentials used by the payment handler.
+	PayPalClientID string
+	PayPalSecret   string
+	PayPalLive     bool // Use the live PayPal API instead of the sandbox.
+	// PayPalWebhookID is the id of the webhook registered with PayPal, which its
+	// deliveries are signed for. Without it, every webhook delivery is rejected.
+	PayPalWebhookID string
+
+	// MarketplaceURL is the public base URL of this marketplace.
+	MarketplaceURL string
+
+	// StorageBackend selects where archives are stored. Only "local" is supported.
+	StorageBackend string
+	// ArchiveDir is the directory holding stored archives for the local backend.
+	ArchiveDir string
+	// StateDir holds server-side state such as the token file. Defaults to ArchiveDir.
+	StateDir string
+
+	// APIKeys lists the keys accepted by authenticated endpoints.
+	// With no keys configured, those endpoints reject every request.
+	APIKeys []string
+
+	// RateLimitRPS and RateLimitBurst configure per-client request rate limiting.
+	// A zero RPS disables rate limiting.
+	RateLimitRPS   float64
+	RateLimitBurst int
+
+	// BytesPerToken sets the pricing of creates: one token per started BytesPerToken
+	// of uncompressed input. Defaults to 1 GiB.
+	BytesPerToken int64
+
+	// CompressionMemoryBudget bounds the estimated memory, in bytes, of the compressions
+	// running at once. Compressions that don't fit are queued until memory is released,
+	// on top of the CPU-based limit on their number. Zero removes the bound; defaults
+	// to 1 GiB.
+	CompressionMemoryBudget int64
+
+	// MaxExtractSize and MaxExtractRatio guard against decompression bombs: reading
+	// an archive is aborted once it has decompressed more than MaxExtractSize bytes, or
+	// once a file expands to more than MaxExtractRatio times its compressed size.
+	// Zero removes a limit; they default to 10 GiB and 1000.
+	MaxExtractSize  int64
+	MaxExtractRatio float64
+
+	// MaxUploadSize bounds the request body of a create, in bytes; larger uploads are
+	// answered with 413. Zero removes the bound; defaults to 1 GiB.
+	MaxUploadSize int64
+
+	// TempDir is where the engine buffers intermediate data. Defaults to the
+	// system temp directory.
+	TempDir string
+
+	// CORSOrigins lists the origins allowed to call the API from a browser.
+	// An empty list allows any origin.
+	CORSOrigins []string
+
+	// TLSCertFile and TLSKeyFile enable HTTPS when both are set.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// DatabaseDSN is the connection string of the account database.
+	DatabaseDSN string
+
+	// ShutdownTimeout is how long a shutdown waits for the archive operations in
+	// progress, such as creates from uploads, before cancelling them. Zero cancels them
+	// at once; defaults to 30 seconds.
+	ShutdownTimeout time.Duration
+
+	// MetricsAddr, if set, is the address the metrics are served on instead of the
+	// API's /metrics, for example an internal interface scrapers reach but clients
+	// don't. The metrics need no API key either way.
+	MetricsAddr string
+}
+
+// Environment variables read by LoadServerConfig.
+const (
+	EnvPayPalClientID          = "NSM_PAYPAL_CLIENT_ID"
+	EnvPayPalSecret            = "NSM_PAYPAL_SECRET"
+	EnvPayPalLive              = "NSM_PAYPAL_LIVE"
+	EnvPayPalWebhookID         = "NSM_PAYPAL_WEBHOOK_ID"
+	EnvMarketplaceURL          = "NSM_MARKETPLACE_URL"
+	EnvStorageBackend          = "NSM_STORAGE_BACKEND"
+	EnvArchiveDir              = "NSM_ARCHIVE_DIR"
+	EnvStateDir                = "NSM_STATE_DIR"
+	EnvAPIKeys                 = "NSM_API_KEYS"
+	EnvRateLimitRPS            = "NSM_RATE_LIMIT_RPS"
+	EnvRateLimitBurst          = "NSM_RATE_LIMIT_BURST"
+	EnvBytesPerToken           = "NSM_BYTES_PER_TOKEN"
+	EnvCompressionMemoryBudget = "NSM_COMPRESSION_MEMORY_BUDGET"
+	EnvMaxExtractSize          = "NSM_MAX_EXTRACT_SIZE"
+	EnvMaxExtractRatio         = "NSM_MAX_EXTRACT_RATIO"
+	EnvMaxUploadSize           = "NSM_MAX_UPLOAD_SIZE"
+	EnvTempDir                 = core.EnvTempDir
+	EnvCORSOrigins             = "NSM_CORS_ORIGINS"
+	EnvTLSCertFile             = "NSM_TLS_CERT_FILE"
+	EnvTLSKeyFile              = "NSM_TLS_KEY_FILE"
+	EnvDatabaseDSN             = "NSM_DATABASE_DSN"
+	EnvMetricsAddr             = "NSM_METRICS_ADDR"
+	EnvShutdownTimeout         = "NSM_SHUTDOWN_TIMEOUT"
+)
+
+// LoadServerConfig reads the server configuration from environment variables,
+// applying defaults for optional settings. The result still needs Validate.
+func LoadServerConfig() (ServerConfig, error) {
+	cfg := ServerConfig{
+		PayPalClientID:          os.Getenv(EnvPayPalClientID),
+		PayPalSecret:            os.Getenv(EnvPayPalSecret),
+		PayPalWebhookID:         os.Getenv(EnvPayPalWebhookID),
+		MarketplaceURL:          os.Getenv(EnvMarketplaceURL),
+		StorageBackend:          envOrDefault(EnvStorageBackend, "local"),
+		ArchiveDir:              envOrDefault(EnvArchiveDir, "./archives"),
+		StateDir:                os.Getenv(EnvStateDir),
+		RateLimitBurst:          20,
+		RateLimitRPS:            10,
+		BytesPerToken:           1 << 30,
+		CompressionMemoryBudget: 1 << 30,
+		MaxExtractSize:          10 << 30,
+		MaxExtractRatio:         1000,
+		MaxUploadSize:           1 << 30,
+		ShutdownTimeout:         30 * time.Second,
+		TempDir:                 os.Getenv(EnvTempDir),
+		TLSCertFile:             os.Getenv(EnvTLSCertFile),
+		TLSKeyFile:              os.Getenv(EnvTLSKeyFile),
+		DatabaseDSN:             os.Getenv(EnvDatabaseDSN),
+		MetricsAddr:             os.Getenv(EnvMetricsAddr),
+	}
+
+	var err error
+	if v := os.Getenv(EnvPayPalLive); v != "" {
+		if cfg.PayPalLive, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("%s must be a boolean: %w", EnvPayPalLive, err)
+		}
+	}
+	if v := os.Getenv(EnvRateLimitRPS); v != "" {
+		if cfg.RateLimitRPS, err = strconv.ParseFloat(v, 64); err != nil {
+			return cfg, fmt.Errorf("%s must be a number: %w", EnvRateLimitRPS, err)
+		}
+	}
+	if v := os.Getenv(EnvRateLimitBurst); v != "" {
+		if cfg.RateLimitBurst, err = strconv.Atoi(v); err != nil {
+			return cfg, fmt.Errorf("%s must be an integer: %w", EnvRateLimitBurst, err)
+		}
+	}
+	if v := os.Getenv(EnvBytesPerToken); v != "" {
+		if cfg.BytesPerToken, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return cfg, fmt.Errorf("%s must be an integer: %w", EnvBytesPerToken, err)
+		}
+	}
+	if v := os.Getenv(EnvCompressionMemoryBudget); v != "" {
+		if cfg.CompressionMemoryBudget, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return cfg, fmt.Errorf("%s must be an integer: %w", EnvCompressionMemoryBudget, err)
+		}
+	}
+	if v := os.Getenv(EnvMaxExtractSize); v != "" {
+		if cfg.MaxExtractSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return cfg, fmt.Errorf("%s must be an integer: %w", EnvMaxExtractSize, err)
+		}
+	}
+	if v := os.Getenv(EnvMaxExtractRatio); v != "" {
+		if cfg.MaxExtractRatio, err = strconv.ParseFloat(v, 64); err != nil {
+			return cfg, fmt.Errorf("%s must be a number: %w", EnvMaxExtractRatio, err)
+		}
+	}
+	if v := os.Getenv(EnvMaxUploadSize); v != "" {
+		if cfg.MaxUploadSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return cfg, fmt.Errorf("%s must be an integer: %w", EnvMaxUploadSize, err)
+		}
+	}
+	if v := os.Getenv(EnvShutdownTimeout); v != "" {
+		if cfg.ShutdownTimeout, err = time.ParseDuration(v); err != nil {
+			return cfg, fmt.Errorf("%s must be a duration such as 30s: %w", EnvShutdownTimeout, err)
+		}
+	}
+	cfg.CORSOrigins = splitList(os.Getenv(EnvCORSOrigins))
+	cfg.APIKeys = splitList(os.Getenv(EnvAPIKeys))
+	return cfg, nil
+}
+
+// Validate checks that all required settings are present and consistent.
+// The error lists every problem so they can be fixed in one go.
+func (c ServerConfig) Validate() error {
+	var problems []string
+	if c.PayPalClientID == "" {
+		problems = append(problems, EnvPayPalClientID+" is required")
+	}
+	if c.PayPalSecret == "" {
+		problems = append(problems, EnvPayPalSecret+" is required")
+	}
+	if c.StorageBackend != "local" {
+		problems = append(problems, fmt.Sprintf("unsupported storage backend %q (supported: local)", c.StorageBackend))
+	}
+	if c.ArchiveDir == "" {
+		problems = append(problems, EnvArchiveDir+" is required")
+	}
+	if c.RateLimitRPS < 0 || c.RateLimitBurst < 0 {
+		problems = append(problems, "rate limits must not be negative")
+	} else if c.RateLimitRPS > 0 && c.RateLimitBurst == 0 {
+		problems = append(problems, EnvRateLimitBurst+" must be at least 1 when rate limiting is enabled")
+	}
+	if c.BytesPerToken < 0 {
+		problems = append(problems, EnvBytesPerToken+" must not be negative")
+	}
+	if c.CompressionMemoryBudget < 0 {
+		problems = append(problems, EnvCompressionMemoryBudget+" must not be negative")
+	}
+	if c.MaxExtractSize < 0 {
+		problems = append(problems, EnvMaxExtractSize+" must not be negative")
+	}
+	if c.MaxExtractRatio < 0 {
+		problems = append(problems, EnvMaxExtractRatio+" must not be negative")
+	}
+	if c.MaxUploadSize < 0 {
+		problems = append(problems, EnvMaxUploadSize+" must not be negative")
+	}
+	if c.ShutdownTimeout < 0 {
+		problems = append(problems, EnvShutdownTimeout+" must not be negative")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problems = append(problems, EnvTLSCertFile+" and "+EnvTLSKeyFile+" must be set together")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid server configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// splitList splits a comma-separated environment value, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envOrDefault returns the value of the environment variable, or def if it is unset.
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
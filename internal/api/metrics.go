@@ -0,0 +1,329 @@
+// Package api sets up and runs the REST API server for NSM.
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nexus/nsm/internal/auth"
+	"github.com/nexus/nsm/internal/core"
+)
+
+// MetricsPath is where the server exposes its metrics, in the Prometheus text format.
+const MetricsPath = "/metrics"
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency histogram:
+// the Prometheus defaults, which cover quick lookups to large uploads.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Archive operations counted by serverMetrics.
+const (
+	operationCreate  = "create"
+	operationExtract = "extract"
+	operationSearch  = "search"
+)
+
+type requestKey struct {
+	method, route string
+	status        int
+}
+
+type routeKey struct {
+	method, route string
+}
+
+type operationKey struct {
+	operation, result string
+}
+
+// histogram counts observations in latencyBuckets.
+type histogram struct {
+	buckets []int64 // Observations per bucket, not cumulative.
+	count   int64
+	sum     float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.buckets == nil {
+		h.buckets = make([]int64, len(latencyBuckets))
+	}
+	h.count++
+	h.sum += v
+	if i := sort.SearchFloat64s(latencyBuckets, v); i < len(latencyBuckets) {
+		h.buckets[i]++
+	}
+}
+
+// serverMetrics collects what the server exposes on MetricsPath. There is no metrics
+// library behind it: the few metric types needed are kept here and written out in the
+// text exposition format when scraped.
+type serverMetrics struct {
+	mu         sync.Mutex
+	requests   map[requestKey]int64
+	latencies  map[routeKey]*histogram
+	operations map[operationKey]int64
+
+	inFlight       atomic.Int64
+	tokensConsumed atomic.Int64
+	tokensRefunded atomic.Int64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests:   make(map[requestKey]int64),
+		latencies:  make(map[routeKey]*histogram),
+		operations: make(map[operationKey]int64),
+	}
+}
+
+// observeRequest records a request answered with status after d.
+func (m *serverMetrics) observeRequest(method, route string, status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{method, route, status}]++
+	h := m.latencies[routeKey{method, route}]
+	if h == nil {
+		h = &histogram{}
+		m.latencies[routeKey{method, route}] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// archiveOperation records an archive operation, failed if err is not nil.
+func (m *serverMetrics) archiveOperation(operation string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.mu.Lock()
+	m.operations[operationKey{operation, result}]++
+	m.mu.Unlock()
+}
+
+// metricsMiddleware counts the requests of the routes it wraps and times them, labelled
+// with the route template rather than the path, so archive ids don't make a new series
+// each.
+func metricsMiddleware(m *serverMetrics) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.inFlight.Add(1)
+			defer m.inFlight.Add(-1)
+			route := "unknown"
+			if current := mux.CurrentRoute(r); current != nil {
+				if tmpl, err := current.GetPathTemplate(); err == nil {
+					route = tmpl
+				}
+			}
+			rec := &statusRecorder{ResponseWriter: w}
+			start := time.Now()
+			next.ServeHTTP(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK // Nothing written, which net/http sends as 200.
+			}
+			m.observeRequest(r.Method, route, rec.status, time.Since(start))
+		})
+	}
+}
+
+// statusRecorder remembers the status code of the response written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// meteredTokens is the token source of the engine: the server's token manager, with
+// the tokens taken and given back counted. Embedding keeps LogUsage, so the engine
+// still logs what tokens were spent on.
+type meteredTokens struct {
+	*auth.TokenManager
+	metrics *serverMetrics
+}
+
+func (t meteredTokens) ConsumeN(n int) error {
+	if err := t.TokenManager.ConsumeN(n); err != nil {
+		return err
+	}
+	t.metrics.tokensConsumed.Add(int64(n))
+	return nil
+}
+
+func (t meteredTokens) RefundN(n int) error {
+	if err := t.TokenManager.RefundN(n); err != nil {
+		return err
+	}
+	t.metrics.tokensRefunded.Add(int64(n))
+	return nil
+}
+
+// MetricsHandler returns the handler serving the server's metrics. It is mounted on
+// MetricsPath of Handler, unless ServerConfig.MetricsAddr moves it to a listener of
+// its own. It needs no API key: keep it away from untrusted networks.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(s.handleMetrics)
+}
+
+// handleMetrics writes every metric in the Prometheus text exposition format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	m := s.metrics
+	m.mu.Lock()
+	writeHeader(&b, "nsm_http_requests_total", "counter", "HTTP requests answered, by method, route and status.")
+	requests := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requests = append(requests, k)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, c := requests[i], requests[j]
+		if a.route != c.route {
+			return a.route < c.route
+		}
+		if a.method != c.method {
+			return a.method < c.method
+		}
+		return a.status < c.status
+	})
+	for _, k := range requests {
+		writeSample(&b, "nsm_http_requests_total", labels("method", k.method, "route", k.route, "status", strconv.Itoa(k.status)), float64(m.requests[k]))
+	}
+
+	writeHeader(&b, "nsm_http_request_duration_seconds", "histogram", "Time taken to answer HTTP requests, by method and route.")
+	routes := make([]routeKey, 0, len(m.latencies))
+	for k := range m.latencies {
+		routes = append(routes, k)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].method < routes[j].method
+	})
+	for _, k := range routes {
+		h := m.latencies[k]
+		var cumulative int64
+		for i, le := range latencyBuckets {
+			cumulative += h.buckets[i]
+			writeSample(&b, "nsm_http_request_duration_seconds_bucket", labels("method", k.method, "route", k.route, "le", formatFloat(le)), float64(cumulative))
+		}
+		writeSample(&b, "nsm_http_request_duration_seconds_bucket", labels("method", k.method, "route", k.route, "le", "+Inf"), float64(h.count))
+		writeSample(&b, "nsm_http_request_duration_seconds_sum", labels("method", k.method, "route", k.route), h.sum)
+		writeSample(&b, "nsm_http_request_duration_seconds_count", labels("method", k.method, "route", k.route), float64(h.count))
+	}
+
+	writeHeader(&b, "nsm_archive_operations_total", "counter", "Archive operations run by the server, by operation and result.")
+	operations := make([]operationKey, 0, len(m.operations))
+	for k := range m.operations {
+		operations = append(operations, k)
+	}
+	sort.Slice(operations, func(i, j int) bool {
+		if operations[i].operation != operations[j].operation {
+			return operations[i].operation < operations[j].operation
+		}
+		return operations[i].result < operations[j].result
+	})
+	for _, k := range operations {
+		writeSample(&b, "nsm_archive_operations_total", labels("operation", k.operation, "result", k.result), float64(m.operations[k]))
+	}
+	m.mu.Unlock()
+
+	writeHeader(&b, "nsm_http_requests_in_flight", "gauge", "HTTP requests being answered.")
+	writeSample(&b, "nsm_http_requests_in_flight", "", float64(m.inFlight.Load()))
+
+	writeHeader(&b, "nsm_tokens_consumed_total", "counter", "Tokens taken to pay for archives.")
+	writeSample(&b, "nsm_tokens_consumed_total", "", float64(m.tokensConsumed.Load()))
+	writeHeader(&b, "nsm_tokens_refunded_total", "counter", "Tokens given back for archives that were not created.")
+	writeSample(&b, "nsm_tokens_refunded_total", "", float64(m.tokensRefunded.Load()))
+	writeHeader(&b, "nsm_tokens_available", "gauge", "Tokens left to pay for archives.")
+	writeSample(&b, "nsm_tokens_available", "", float64(s.tokenManager.AvailableTokens()))
+
+	writeCompressorStats(&b, s.engine.CompressorStats())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// writeCompressorStats writes the statistics of the engine's compressor, see
+// core.Compressor.Stats.
+func writeCompressorStats(b *bytes.Buffer, stats core.CompressorStats) {
+	ops := []struct {
+		name  string
+		stats core.OperationStats
+	}{
+		{"compress", stats.Compress},
+		{"decompress", stats.Decompress},
+	}
+	metrics := []struct {
+		name, help string
+		value      func(core.OperationStats) float64
+	}{
+		{"nsm_compressor_calls_total", "Compressions and decompressions run.", func(s core.OperationStats) float64 { return float64(s.Calls) }},
+		{"nsm_compressor_errors_total", "Compressions and decompressions that failed.", func(s core.OperationStats) float64 { return float64(s.Errors) }},
+		{"nsm_compressor_read_bytes_total", "Bytes read by compressions and decompressions.", func(s core.OperationStats) float64 { return float64(s.BytesIn) }},
+		{"nsm_compressor_written_bytes_total", "Bytes written by compressions and decompressions.", func(s core.OperationStats) float64 { return float64(s.BytesOut) }},
+		{"nsm_compressor_seconds_total", "Time spent streaming data through the compressor.", func(s core.OperationStats) float64 { return s.Duration.Seconds() }},
+		{"nsm_compressor_wait_seconds_total", "Time spent queued for a compressor worker or memory.", func(s core.OperationStats) float64 { return s.Wait.Seconds() }},
+	}
+	for _, metric := range metrics {
+		writeHeader(b, metric.name, "counter", metric.help)
+		for _, op := range ops {
+			writeSample(b, metric.name, labels("operation", op.name), metric.value(op.stats))
+		}
+	}
+}
+
+func writeHeader(b *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSample(b *bytes.Buffer, name, labels string, value float64) {
+	fmt.Fprintf(b, "%s%s %s\n", name, labels, formatFloat(value))
+}
+
+// labels formats name and value pairs as a label set.
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
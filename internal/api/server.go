@@ -2,40 +2,129 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/nexus/nsm/internal/auth"
+	"github.com/nexus/nsm/internal/core"
 	"github.com/nexus/nsm/internal/web" // For payment handlers
 	"github.com/sirupsen/logrus"
-	// For rate limiting, a library like "golang.org/x/time/rate" would be used.
+	"golang.org/x/time/rate"
 )
 
 // Server holds the dependencies for the API server.
 type Server struct {
 	router *mux.Router
 	log    *logrus.Entry
-	// Add dependencies like a database connection, core engine, etc.
+	config ServerConfig
+	// engine is shared by all handlers; creates are charged to tokenManager.
+	engine         *core.Engine
 	paymentHandler *web.PaymentHandler
+	tokenManager   *auth.TokenManager
+	metrics        *serverMetrics
+
+	// Archive operations in progress, which Shutdown waits for.
+	jobMu      sync.Mutex
+	jobs       sync.WaitGroup
+	draining   bool            // Set by Shutdown: no more operations are started.
+	jobCtx     context.Context // Cancelled when Shutdown gives up waiting.
+	cancelJobs context.CancelFunc
+
+	digestMu sync.Mutex
+	digests  map[string]archiveDigest // Digest header values by archive id.
+}
+
+// archiveDigest is the cached digest of an archive, valid while its ETag is unchanged.
+type archiveDigest struct {
+	etag  string
+	value string
 }
 
+// archiveIDPattern restricts archive ids to characters that are safe to use in file names.
+var archiveIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 // NewServer creates and configures a new API server instance.
-func NewServer() (*Server, error) {
-	// In a real application, these would be initialized with proper configuration.
-	// For example, loading PayPal credentials from environment variables.
-	payPalClient := &web.PayPalClient{ /* ... */ }
-	paymentHandler := web.NewPaymentHandler(payPalClient, nil) // TokenManager would be initialized here.
+// It fails fast if the configuration is incomplete.
+func NewServer(cfg ServerConfig) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.StateDir == "" {
+		cfg.StateDir = cfg.ArchiveDir
+	}
+	for _, dir := range []string{cfg.ArchiveDir, cfg.StateDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+
+	tokenManager, err := auth.NewTokenManager(cfg.StateDir, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize token manager: %w", err)
+	}
 
+	metrics := newServerMetrics()
+	var costPolicy core.CostPolicy = core.DefaultCostPolicy
+	if cfg.BytesPerToken > 0 {
+		costPolicy = core.SizeCostPolicy{BytesPerToken: cfg.BytesPerToken}
+	}
+	engine, err := core.NewEngine(&core.Config{
+		Tokens:                  meteredTokens{TokenManager: tokenManager, metrics: metrics},
+		CostPolicy:              costPolicy,
+		TempDir:                 cfg.TempDir,
+		CompressionMemoryBudget: cfg.CompressionMemoryBudget,
+		MaxExtractSize:          cfg.MaxExtractSize,
+		MaxExtractRatio:         cfg.MaxExtractRatio,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize core engine: %w", err)
+	}
+
+	payPalClient := &web.PayPalClient{
+		ClientID:  cfg.PayPalClientID,
+		Secret:    cfg.PayPalSecret,
+		IsProd:    cfg.PayPalLive,
+		WebhookID: cfg.PayPalWebhookID,
+	}
+
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
 	s := &Server{
 		router:         mux.NewRouter(),
 		log:            logrus.WithField("component", "api_server"),
-		paymentHandler: paymentHandler,
+		config:         cfg,
+		engine:         engine,
+		paymentHandler: web.NewPaymentHandler(payPalClient, tokenManager),
+		tokenManager:   tokenManager,
+		metrics:        metrics,
+		jobCtx:         jobCtx,
+		cancelJobs:     cancelJobs,
+		digests:        make(map[string]archiveDigest),
 	}
 
+	if cfg.PayPalWebhookID == "" {
+		s.log.Warn(EnvPayPalWebhookID + " is not set: PayPal webhook deliveries will be rejected")
+	}
 	s.setupRoutes()
 	return s, nil
 }
@@ -45,32 +134,71 @@ func (s *Server) setupRoutes() {
 	r := s.router
 	
 	// Apply middlewares to all routes.
+	r.Use(metricsMiddleware(s.metrics))
 	r.Use(loggingMiddleware)
-	r.Use(corsMiddleware)
-	// r.Use(authMiddleware) // Placeholder for API key authentication
+	r.Use(corsMiddleware(s.config.CORSOrigins))
 
 	apiV1 := r.PathPrefix("/api/v1").Subrouter()
 
+	// Endpoints on this subrouter require an API key and are rate limited per key.
+	authed := apiV1.NewRoute().Subrouter()
+	authed.Use(authMiddleware(s.config.APIKeys))
+	authed.Use(rateLimitMiddleware(s.config.RateLimitRPS, s.config.RateLimitBurst))
+
 	// Token and Payment Endpoints
 	apiV1.HandleFunc("/tokens/purchase", s.paymentHandler.HandleCreateOrder).Methods("POST")
+	apiV1.HandleFunc("/tokens/capture", s.paymentHandler.HandleCaptureOrder).Methods("POST")
 	apiV1.HandleFunc("/tokens/validate", s.handleValidateToken).Methods("GET") // Placeholder
+	apiV1.HandleFunc("/tokens/orders/{id}", s.paymentHandler.HandleOrderStatus).Methods("GET")
+	apiV1.HandleFunc("/tokens/orders/{id}/cancel", s.paymentHandler.HandleCancelOrder).Methods("POST")
 
 	// PayPal Webhook
 	r.HandleFunc("/webhooks/paypal", s.paymentHandler.HandleWebhook).Methods("POST")
 
 	// Core Functionality Endpoints
-	apiV1.HandleFunc("/create", s.handleCreateArchive).Methods("POST")
-	apiV1.HandleFunc("/extract/{id}", s.handleExtractArchive).Methods("GET") // ID would be a transaction/file ID
-	apiV1.HandleFunc("/search", s.handleSearchArchive).Methods("POST")
+	authed.HandleFunc("/create", s.handleCreateArchive).Methods("POST")
+	authed.HandleFunc("/extract/{id}", s.handleExtractArchive).Methods("GET") // ID would be a transaction/file ID
+	authed.HandleFunc("/search", s.handleSearchArchive).Methods("POST")
+	authed.HandleFunc("/estimate", s.handleEstimate).Methods("POST")
+
+	// Metrics are served here unless they have an address of their own.
+	if s.config.MetricsAddr == "" {
+		r.Handle(MetricsPath, s.MetricsHandler()).Methods("GET")
+	}
 }
 
-// Run starts the HTTP server and handles graceful shutdown.
+// Handler returns the root HTTP handler, with all routes and middlewares applied.
+func (s *Server) Handler() http.Handler {
+	return s.router
+}
+
+// Run starts the HTTP server and handles graceful shutdown. With
+// ServerConfig.MetricsAddr set, the metrics are served over plain HTTP on that address
+// too, until the server shuts down.
 func (s *Server) Run(addr string) error {
 	srv := &http.Server{
 		Addr:    addr,
 		Handler: s.router,
 	}
 
+	var metricsSrv *http.Server
+	if s.config.MetricsAddr != "" {
+		// Listening first reports an address in use before the API server starts.
+		ln, err := net.Listen("tcp", s.config.MetricsAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen for metrics on %s: %w", s.config.MetricsAddr, err)
+		}
+		routes := http.NewServeMux()
+		routes.Handle(MetricsPath, s.MetricsHandler())
+		metricsSrv = &http.Server{Handler: routes}
+		go func() {
+			if err := metricsSrv.Serve(ln); err != http.ErrServerClosed {
+				s.log.WithError(err).Error("Metrics server failed")
+			}
+		}()
+		s.log.WithField("address", s.config.MetricsAddr).Info("Metrics server listening")
+	}
+
 	// Graceful shutdown logic
 	idleConnsClosed := make(chan struct{})
 	go func() {
@@ -78,19 +206,31 @@ func (s *Server) Run(addr string) error {
 		signal.Notify(sigint, syscall.SIGINT, syscall.SIGTERM)
 		<-sigint
 
-		s.log.Info("Shutdown signal received, gracefully shutting down...")
+		s.log.WithField("timeout", s.config.ShutdownTimeout).Info("Shutdown signal received, gracefully shutting down...")
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
 		defer cancel()
 
+		// No new requests are accepted from here on; those being answered, archive
+		// operations included, get until the timeout to finish.
 		if err := srv.Shutdown(ctx); err != nil {
 			s.log.WithError(err).Error("Error during server shutdown")
 		}
+		s.Shutdown(ctx)
+		if metricsSrv != nil {
+			metricsSrv.Shutdown(ctx)
+		}
 		close(idleConnsClosed)
 	}()
 
 	s.log.WithField("address", addr).Info("API server listening")
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+	var err error
+	if s.config.TLSCertFile != "" {
+		err = srv.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		return err
 	}
 
@@ -99,6 +239,87 @@ func (s *Server) Run(addr string) error {
 	return nil
 }
 
+// jobCancelGrace is how long Shutdown waits for the archive operations it cancelled
+// to return.
+const jobCancelGrace = 5 * time.Second
+
+// partialArchiveSuffix is added to the name of an archive being created from an
+// upload, until it is complete.
+const partialArchiveSuffix = ".part"
+
+// Shutdown stops the server from starting archive operations, which are answered with
+// 503 from then on, and waits for those in progress until ctx is done. The ones still
+// running then are cancelled, and the archives left half written are removed. Run
+// calls it on SIGINT or SIGTERM once the HTTP server stopped accepting requests.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.jobMu.Lock()
+	s.draining = true
+	s.jobMu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		s.jobs.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.log.Warn("Shutdown timeout reached, cancelling the archive operations in progress")
+	s.cancelJobs()
+	select {
+	case <-finished:
+	case <-time.After(jobCancelGrace):
+		s.log.Error("Archive operations still running after being cancelled")
+	}
+	s.removePartialArchives()
+	return ctx.Err()
+}
+
+// startJob registers an archive operation answering r, so Shutdown waits for it. It
+// returns the context of the operation, cancelled with the request or when Shutdown
+// gives up waiting, and the function to call once it ends. Once shutdown has begun,
+// it answers 503 instead and returns false.
+func (s *Server) startJob(w http.ResponseWriter, r *http.Request) (context.Context, func(), bool) {
+	s.jobMu.Lock()
+	if s.draining {
+		s.jobMu.Unlock()
+		w.Header().Set("Connection", "close")
+		web.WriteError(w, http.StatusServiceUnavailable, web.ErrorResponse{Error: "server is shutting down"})
+		return nil, nil, false
+	}
+	s.jobs.Add(1)
+	s.jobMu.Unlock()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		select {
+		case <-s.jobCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		s.jobs.Done()
+	}, true
+}
+
+// removePartialArchives removes the archives left half written by creates that were
+// cancelled.
+func (s *Server) removePartialArchives() {
+	partial, _ := filepath.Glob(filepath.Join(s.config.ArchiveDir, "*.nsm"+partialArchiveSuffix))
+	for _, path := range partial {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			s.log.WithError(err).WithField("path", path).Error("Failed to remove partial archive")
+			continue
+		}
+		s.log.WithField("path", path).Info("Removed partial archive")
+	}
+}
+
 // --- Middleware Definitions ---
 
 func loggingMiddleware(next http.Handler) http.Handler {
@@ -113,17 +334,153 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*") // Be more restrictive in production
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+// corsMiddleware allows browser requests from the given origins, or from any
+// origin when the list is empty.
+func corsMiddleware(origins []string) mux.MiddlewareFunc {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(allowed) == 0 {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else if origin := r.Header.Get("Origin"); allowed[origin] {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiKeyFromRequest returns the API key sent as "Authorization: Bearer <key>", or "".
+func apiKeyFromRequest(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return strings.TrimSpace(auth[len(prefix):])
+	}
+	return ""
+}
+
+// authMiddleware rejects requests that don't carry one of the given API keys.
+func authMiddleware(keys []string) mux.MiddlewareFunc {
+	valid := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		valid[key] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !valid[apiKeyFromRequest(r)] {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="nsm"`)
+				web.WriteError(w, http.StatusUnauthorized, web.ErrorResponse{Error: "a valid API key is required"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// LimiterSweepInterval is how often a RateLimiter drops the limiters of idle keys.
+const LimiterSweepInterval = time.Minute
+
+// RateLimiter allows each API key a number of requests per second, with a burst. The
+// limiters of keys idle long enough to have their full burst back are dropped every
+// LimiterSweepInterval, so memory doesn't grow with every key ever seen.
+type RateLimiter struct {
+	rps   float64
+	burst int
+	// refill is how long a limiter takes to get its full burst back. A limiter idle
+	// that long is as good as a new one, so dropping it changes no decision.
+	refill time.Duration
+
+	mu        sync.Mutex
+	limiters  map[string]*keyLimiter
+	lastSweep time.Time
+}
+
+// keyLimiter is the rate limiter of an API key.
+type keyLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing each key rps requests per second with
+// the given burst.
+func NewRateLimiter(rps float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rps:       rps,
+		burst:     burst,
+		refill:    time.Duration(float64(burst) / rps * float64(time.Second)),
+		limiters:  make(map[string]*keyLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// Reserve counts a request of key made at now. It returns zero if the request may go
+// ahead, or else how long the caller should wait before trying again; the refused
+// request isn't counted.
+func (l *RateLimiter) Reserve(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) >= LimiterSweepInterval {
+		for k, kl := range l.limiters {
+			if now.Sub(kl.lastSeen) > l.refill {
+				delete(l.limiters, k)
+			}
 		}
-		next.ServeHTTP(w, r)
-	})
+		l.lastSweep = now
+	}
+	kl, ok := l.limiters[key]
+	if !ok {
+		kl = &keyLimiter{limiter: rate.NewLimiter(rate.Limit(l.rps), l.burst)}
+		l.limiters[key] = kl
+	}
+	kl.lastSeen = now
+	limiter := kl.limiter
+	l.mu.Unlock()
+
+	res := limiter.ReserveN(now, 1)
+	delay := res.DelayFrom(now)
+	if delay > 0 {
+		res.CancelAt(now)
+	}
+	return delay
+}
+
+// Keys returns the number of API keys the limiter currently tracks.
+func (l *RateLimiter) Keys() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.limiters)
+}
+
+// rateLimitMiddleware allows each API key rps requests per second with the given burst,
+// answering 429 with a Retry-After header beyond that. A zero rps disables limiting.
+func rateLimitMiddleware(rps float64, burst int) mux.MiddlewareFunc {
+	if rps == 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	limiter := NewRateLimiter(rps, burst)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if delay := limiter.Reserve(apiKeyFromRequest(r), time.Now()); delay > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				web.WriteError(w, http.StatusTooManyRequests, web.ErrorResponse{Error: "rate limit exceeded"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
 // --- Handler Stubs ---
@@ -133,21 +490,489 @@ func (s *Server) handleValidateToken(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{"is_valid": true, "available_tokens": 10})
 }
 
+// CreateResponse is the JSON body returned by the create endpoint.
+type CreateResponse struct {
+	ArchiveID string `json:"archive_id"`
+	Files     int    `json:"files"`
+	Size      int64  `json:"size"` // Size of the archive in bytes.
+}
+
+// handleCreateArchive archives the files uploaded as multipart/form-data: every part
+// with a file name is stored under its base name. The parts are streamed to a temporary
+// directory, archived by the shared engine, which charges the token manager, and the
+// archive is then stored under a new random id. A body larger than MaxUploadSize is
+// answered with 413, and 402 when the tokens don't cover the archive.
 func (s *Server) handleCreateArchive(w http.ResponseWriter, r *http.Request) {
-	// Placeholder: handle multipart/form-data file upload, call core.Engine.Create
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(map[string]string{"status": "processing", "archive_id": "new-archive-123"})
+	ctx, done, ok := s.startJob(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+	// Fail before reading a possibly large upload when the caller can't pay anyway.
+	if s.tokenManager.AvailableTokens() == 0 {
+		web.WriteError(w, http.StatusPaymentRequired, web.ErrorResponse{Error: "no tokens available"})
+		return
+	}
+	if s.config.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxUploadSize)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		web.WriteError(w, http.StatusBadRequest, web.ErrorResponse{Error: "expected a multipart/form-data upload"})
+		return
+	}
+
+	uploadDir, err := os.MkdirTemp(s.config.TempDir, "nsm-upload-*")
+	if err != nil {
+		s.log.WithError(err).Error("Failed to create upload directory")
+		web.WriteError(w, http.StatusInternalServerError, web.ErrorResponse{Error: "failed to store upload"})
+		return
+	}
+	defer os.RemoveAll(uploadDir)
+
+	var inputs []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.writeUploadError(w, err)
+			return
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		name := filepath.Base(filepath.FromSlash(part.FileName()))
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			web.WriteError(w, http.StatusBadRequest, web.ErrorResponse{Error: "invalid file name " + strconv.Quote(part.FileName())})
+			return
+		}
+		path := filepath.Join(uploadDir, name)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			web.WriteError(w, http.StatusBadRequest, web.ErrorResponse{Error: "file " + name + " was uploaded twice"})
+			return
+		}
+		if err != nil {
+			s.log.WithError(err).Error("Failed to create upload file")
+			web.WriteError(w, http.StatusInternalServerError, web.ErrorResponse{Error: "failed to store upload"})
+			return
+		}
+		_, err = io.Copy(f, part)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		part.Close()
+		if err != nil {
+			s.writeUploadError(w, err)
+			return
+		}
+		inputs = append(inputs, path)
+	}
+	if len(inputs) == 0 {
+		web.WriteError(w, http.StatusBadRequest, web.ErrorResponse{Error: "no files uploaded"})
+		return
+	}
+
+	id, err := newArchiveID()
+	if err != nil {
+		s.log.WithError(err).Error("Failed to generate archive id")
+		web.WriteError(w, http.StatusInternalServerError, web.ErrorResponse{Error: "failed to create archive"})
+		return
+	}
+	archivePath := filepath.Join(s.config.ArchiveDir, id+".nsm")
+	// The archive is written under a temporary name, so it can't be downloaded half done.
+	tmpPath := archivePath + partialArchiveSuffix
+	_, err = s.engine.CreateContext(ctx, tmpPath, inputs)
+	s.metrics.archiveOperation(operationCreate, err)
+	if err != nil {
+		var coreErr *core.CoreError
+		switch {
+		case errors.Is(err, auth.ErrNoTokens):
+			web.WriteError(w, http.StatusPaymentRequired, web.ErrorResponse{Error: "not enough tokens: " + err.Error()})
+		case errors.As(err, &coreErr) && coreErr.Code == core.ErrInvalidInput:
+			web.WriteError(w, http.StatusBadRequest, web.ErrorResponse{Error: coreErr.Message})
+		default:
+			s.log.WithError(err).Error("Create failed")
+			web.WriteError(w, http.StatusInternalServerError, web.ErrorResponse{Error: "failed to create archive"})
+		}
+		return
+	}
+	info, err := os.Stat(tmpPath)
+	if err == nil {
+		err = os.Rename(tmpPath, archivePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		s.log.WithError(err).Error("Failed to store archive")
+		web.WriteError(w, http.StatusInternalServerError, web.ErrorResponse{Error: "failed to create archive"})
+		return
+	}
+
+	s.log.WithFields(logrus.Fields{"id": id, "files": len(inputs), "size": info.Size()}).Info("Archive created from upload")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/v1/extract/"+id)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateResponse{ArchiveID: id, Files: len(inputs), Size: info.Size()})
+}
+
+// writeUploadError answers a failure reading an upload: 413 if it is too large, 400
+// otherwise.
+func (s *Server) writeUploadError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		web.WriteError(w, http.StatusRequestEntityTooLarge, web.ErrorResponse{
+			Error: fmt.Sprintf("upload exceeds the limit of %d bytes", maxBytesErr.Limit),
+		})
+		return
+	}
+	s.log.WithError(err).Warn("Failed to read upload")
+	web.WriteError(w, http.StatusBadRequest, web.ErrorResponse{Error: "failed to read upload"})
 }
 
+// newArchiveID returns a random id for a new archive.
+func newArchiveID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// handleExtractArchive sends a stored archive, resumable with Range requests, or with
+// ?format=tar the files it contains as a tar stream.
 func (s *Server) handleExtractArchive(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	// Placeholder: retrieve archive by ID and stream it back
-	s.log.WithField("id", id).Info("Extract request received")
-	w.WriteHeader(http.StatusOK)
+	if !archiveIDPattern.MatchString(id) {
+		http.Error(w, "Invalid archive id", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "nsm" && format != "tar" {
+		http.Error(w, "Unknown format (want nsm or tar)", http.StatusBadRequest)
+		return
+	}
+	s.log.WithFields(logrus.Fields{"id": id, "format": format}).Info("Extract request received")
+
+	_, done, ok := s.startJob(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	archivePath := filepath.Join(s.config.ArchiveDir, id+".nsm")
+	if format == "tar" {
+		s.streamTar(w, id, archivePath)
+		return
+	}
+	f, err := os.Open(archivePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Archive not found", http.StatusNotFound)
+			return
+		}
+		s.log.WithError(err).Error("Failed to open archive")
+		http.Error(w, "Failed to open archive", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		s.log.WithError(err).Error("Failed to stat archive")
+		http.Error(w, "Failed to open archive", http.StatusInternalServerError)
+		return
+	}
+
+	// A strong ETag lets resuming clients send If-Range, so a replaced archive
+	// is sent in full instead of being spliced onto a stale partial download.
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+	w.Header().Set("ETag", etag)
+	// The digest covers the whole archive, even in a partial response, so clients can
+	// check a download assembled from several ranges.
+	digest, err := s.archiveDigest(id, etag, f)
+	if err != nil {
+		s.log.WithError(err).Error("Failed to hash archive")
+		http.Error(w, "Failed to read archive", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Digest", digest)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".nsm"))
+
+	// ServeContent handles Range and If-Range, answers with 206 or 416 as
+	// appropriate and advertises Accept-Ranges: bytes.
+	http.ServeContent(w, r, id+".nsm", info.ModTime(), f)
+	s.metrics.archiveOperation(operationExtract, nil)
+}
+
+// streamTar sends the files of an archive as a tar stream. It is generated on the fly,
+// so unlike the archive itself it can't be fetched in ranges.
+func (s *Server) streamTar(w http.ResponseWriter, id, archivePath string) {
+	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+		http.Error(w, "Archive not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".tar"))
+	sw := &startedWriter{w: w}
+	err := s.engine.ExtractToTar(archivePath, sw)
+	s.metrics.archiveOperation(operationExtract, err)
+	if err != nil {
+		s.log.WithError(err).WithField("id", id).Error("Failed to stream archive as tar")
+		if !sw.started {
+			// Nothing was sent yet, so the client can still be told.
+			w.Header().Del("Content-Disposition")
+			http.Error(w, "Failed to read archive", http.StatusInternalServerError)
+		}
+		// Otherwise the response is cut short, which a tar reader detects.
+	}
+}
+
+// startedWriter records whether anything was written through it.
+type startedWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (sw *startedWriter) Write(p []byte) (int, error) {
+	sw.started = true
+	return sw.w.Write(p)
+}
+
+// archiveDigest returns the RFC 3230 Digest header value of an archive, hashing f only
+// when the archive changed since it was last served. f is left positioned at the start.
+func (s *Server) archiveDigest(id, etag string, f io.ReadSeeker) (string, error) {
+	s.digestMu.Lock()
+	cached, ok := s.digests[id]
+	s.digestMu.Unlock()
+	if ok && cached.etag == etag {
+		return cached.value, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	value := auth.DigestSHA256 + "=" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	s.digestMu.Lock()
+	s.digests[id] = archiveDigest{etag: etag, value: value}
+	s.digestMu.Unlock()
+	return value, nil
+}
+
+// SearchRequest is the JSON body accepted by the search endpoint.
+type SearchRequest struct {
+	ArchiveID string `json:"archive_id"`
+	Query     string `json:"query"`
+}
+
+// Validate checks the request fields and returns the problems keyed by JSON field name.
+func (r SearchRequest) Validate() map[string]string {
+	fields := map[string]string{}
+	if r.ArchiveID == "" {
+		fields["archive_id"] = "is required"
+	} else if !archiveIDPattern.MatchString(r.ArchiveID) {
+		fields["archive_id"] = "may only contain letters, digits, '-' and '_'"
+	}
+	if strings.TrimSpace(r.Query) == "" {
+		fields["query"] = "is required"
+	}
+	return fields
+}
+
+// SearchMatch is a file matching a search query.
+type SearchMatch struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
 }
 
+// SkippedFile is a file that could not be searched, for example because it is corrupt.
+type SkippedFile struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// Pagination of search results, see handleSearchArchive.
+const (
+	DefaultSearchLimit = 100
+	MaxSearchLimit     = 1000
+)
+
+// SearchResponse is the JSON body returned by the search endpoint. Matches from the
+// readable files are returned even when some files had to be skipped. Matches holds
+// one page of results; Total counts all of them.
+type SearchResponse struct {
+	ArchiveID string        `json:"archive_id"`
+	Matches   []SearchMatch `json:"matches"`
+	Total     int           `json:"total"`
+	Offset    int           `json:"offset"`
+	Limit     int           `json:"limit"`
+	Skipped   []SkippedFile `json:"skipped,omitempty"`
+
+	// Method is "index" if the search index was used and "scan" if every file had to
+	// be decompressed, which FilesDecompressed counts.
+	Method            string `json:"method"`
+	FilesDecompressed int    `json:"files_decompressed"`
+}
+
+// handleSearchArchive searches a stored archive. The matches are paged with the limit
+// (DefaultSearchLimit, at most MaxSearchLimit) and offset query parameters.
 func (s *Server) handleSearchArchive(w http.ResponseWriter, r *http.Request) {
-	// Placeholder: get archive and query from request, call core.Engine.Search
-	w.WriteHeader(http.StatusOK)
+	limit, offset, fields := pageParams(r)
+	if len(fields) > 0 {
+		web.WriteError(w, http.StatusBadRequest, web.ErrorResponse{Error: "invalid pagination", Fields: fields})
+		return
+	}
+	var req SearchRequest
+	if !web.DecodeAndValidate(w, r, &req) {
+		return
+	}
+
+	archivePath := filepath.Join(s.config.ArchiveDir, req.ArchiveID+".nsm")
+	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+		web.WriteError(w, http.StatusNotFound, web.ErrorResponse{Error: "archive not found"})
+		return
+	}
+	_, done, ok := s.startJob(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	matches, skipped, stats, err := s.engine.SearchWithStats(archivePath, req.Query)
+	s.metrics.archiveOperation(operationSearch, err)
+	if err != nil {
+		s.log.WithError(err).WithField("id", req.ArchiveID).Error("Search failed")
+		web.WriteError(w, http.StatusInternalServerError, web.ErrorResponse{Error: "search failed"})
+		return
+	}
+
+	resp := SearchResponse{
+		ArchiveID:         req.ArchiveID,
+		Total:             len(matches),
+		Offset:            offset,
+		Limit:             limit,
+		Method:            stats.Method,
+		FilesDecompressed: stats.FilesDecompressed,
+	}
+	if offset > len(matches) {
+		offset = len(matches)
+	}
+	if end := offset + limit; end < len(matches) {
+		matches = matches[:end]
+	}
+	resp.Matches = make([]SearchMatch, 0, len(matches)-offset)
+	for _, m := range matches[offset:] {
+		resp.Matches = append(resp.Matches, SearchMatch{Path: m.Path, Size: m.Size})
+	}
+	for _, f := range skipped {
+		resp.Skipped = append(resp.Skipped, SkippedFile{Path: f.Path, Error: f.Err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// pageParams reads the limit and offset query parameters of a paged request, and
+// returns the problems keyed by parameter name.
+func pageParams(r *http.Request) (limit, offset int, fields map[string]string) {
+	fields = map[string]string{}
+	limit = DefaultSearchLimit
+	q := r.URL.Query()
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxSearchLimit {
+			fields["limit"] = fmt.Sprintf("must be an integer from 1 to %d", MaxSearchLimit)
+		}
+		limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			fields["offset"] = "must be a non-negative integer"
+		}
+		offset = n
+	}
+	return limit, offset, fields
+}
+
+// EstimateFile describes one file of a planned archive.
+type EstimateFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// EstimateRequest is the JSON body accepted by the estimate endpoint. Sample is an
+// optional base64-encoded excerpt of the data used to predict the compression ratio.
+type EstimateRequest struct {
+	Files  []EstimateFile `json:"files"`
+	Sample []byte         `json:"sample"`
+}
+
+// Validate checks the request fields and returns the problems keyed by JSON field name.
+func (r EstimateRequest) Validate() map[string]string {
+	fields := map[string]string{}
+	if len(r.Files) == 0 {
+		fields["files"] = "at least one file is required"
+	}
+	for _, f := range r.Files {
+		if f.Size < 0 {
+			fields["files"] = "sizes must not be negative"
+			break
+		}
+	}
+	if len(r.Sample) > core.MaxEstimateSampleSize {
+		fields["sample"] = fmt.Sprintf("must be at most %d bytes", core.MaxEstimateSampleSize)
+	}
+	return fields
+}
+
+// EstimateResponse is the predicted cost and size of creating an archive.
+type EstimateResponse struct {
+	Files            int     `json:"files"`
+	UncompressedSize int64   `json:"uncompressed_size"`
+	EstimatedSize    int64   `json:"estimated_size"`
+	Ratio            float64 `json:"ratio"`
+	Tokens           int     `json:"tokens"`
+}
+
+// handleEstimate predicts the token cost and archive size of a create without
+// creating anything or charging tokens.
+func (s *Server) handleEstimate(w http.ResponseWriter, r *http.Request) {
+	var req EstimateRequest
+	if !web.DecodeAndValidate(w, r, &req) {
+		return
+	}
+
+	var total int64
+	for _, f := range req.Files {
+		total += f.Size
+	}
+	var sample io.Reader
+	if len(req.Sample) > 0 {
+		sample = bytes.NewReader(req.Sample)
+	}
+
+	est, err := s.engine.EstimateCreate(len(req.Files), total, sample)
+	if err != nil {
+		s.log.WithError(err).Error("Estimate failed")
+		web.WriteError(w, http.StatusInternalServerError, web.ErrorResponse{Error: "estimate failed"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EstimateResponse{
+		Files:            est.Files,
+		UncompressedSize: est.UncompressedSize,
+		EstimatedSize:    est.EstimatedSize,
+		Ratio:            est.Ratio,
+		Tokens:           est.Tokens,
+	})
 }
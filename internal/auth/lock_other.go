@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package auth
+
+// lockFile does nothing, since files can't be locked on this platform: the token file
+// is still written atomically, but concurrent processes may lose each other's changes.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
@@ -3,20 +3,50 @@ package auth
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
 	"time"
 
+	"github.com/nexus/nsm/internal/version"
 	"github.com/sirupsen/logrus"
 )
 
+// ClientIDHeader is the request header carrying MarketplaceClient.ClientID.
+const ClientIDHeader = "X-NSM-Client-ID"
+
+// DefaultUserAgent returns the User-Agent sent to the marketplace by default, such as
+// "nsm/1.4.0 (linux/amd64)".
+func DefaultUserAgent() string {
+	return fmt.Sprintf("nsm/%s (%s/%s)", version.Version, runtime.GOOS, runtime.GOARCH)
+}
+
 // MarketplaceClient is a client for interacting with the NSM marketplace API.
 type MarketplaceClient struct {
 	BaseURL    string
 	APIKey     string
 	HTTPClient *http.Client
-	log        *logrus.Entry
+	// MaxRetries is how many times Download resumes, and CaptureOrder retries, after a
+	// transient failure.
+	MaxRetries int
+	// RetryDelay is the base delay between retries. It grows linearly with each attempt
+	// of Download, and doubles with each attempt of CaptureOrder.
+	RetryDelay time.Duration
+	// UserAgent is sent with every request. NewMarketplaceClient sets it to
+	// DefaultUserAgent; an empty value leaves Go's default.
+	UserAgent string
+	// ClientID, if set, is sent in the ClientIDHeader header of every request so support
+	// can correlate the requests of one installation. See TokenManager.ClientID.
+	ClientID string
+	log      *logrus.Entry
 }
 
 // NewMarketplaceClient creates a new client for the NSM marketplace.
@@ -27,15 +57,30 @@ func NewMarketplaceClient(baseURL, apiKey string) *MarketplaceClient {
 		HTTPClient: &http.Client{
 			Timeout: 15 * time.Second,
 		},
-		log: logrus.WithField("component", "marketplace_client"),
+		MaxRetries: 5,
+		RetryDelay: time.Second,
+		UserAgent:  DefaultUserAgent(),
+		log:        logrus.WithField("component", "marketplace_client"),
 	}
 }
 
+// MaxTokensPerPurchase is the largest number of tokens that can be bought in one order.
+const MaxTokensPerPurchase = 1000
+
 // PurchaseRequest defines the payload for requesting a token purchase.
 type PurchaseRequest struct {
 	TokenCount int `json:"token_count"`
 }
 
+// Validate checks the request fields and returns the problems keyed by JSON field name.
+func (r PurchaseRequest) Validate() map[string]string {
+	fields := map[string]string{}
+	if r.TokenCount <= 0 || r.TokenCount > MaxTokensPerPurchase {
+		fields["token_count"] = fmt.Sprintf("is required and must be between 1 and %d", MaxTokensPerPurchase)
+	}
+	return fields
+}
+
 // PurchaseResponse defines the expected response after initiating a purchase.
 type PurchaseResponse struct {
 	PaymentURL string `json:"payment_url"` // URL to redirect the user to for PayPal payment
@@ -60,7 +105,7 @@ func (c *MarketplaceClient) InitiatePurchase(count int) (*PurchaseResponse, erro
 		return nil, fmt.Errorf("failed to create http request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	c.setHeaders(req)
 
 	c.log.WithField("endpoint", endpoint).Info("Initiating token purchase")
 
@@ -82,6 +127,17 @@ func (c *MarketplaceClient) InitiatePurchase(count int) (*PurchaseResponse, erro
 	return &purchaseResp, nil
 }
 
+// setHeaders adds the authentication and client identification headers to req.
+func (c *MarketplaceClient) setHeaders(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	if c.ClientID != "" {
+		req.Header.Set(ClientIDHeader, c.ClientID)
+	}
+}
+
 // ValidationResponse defines the structure of a successful key validation.
 type ValidationResponse struct {
 	IsValid         bool      `json:"is_valid"`
@@ -90,30 +146,448 @@ type ValidationResponse struct {
 }
 
 // ValidateAPIKey checks an API key against the marketplace and returns its token status.
+// Failing to reach the marketplace, an error status and an unreadable response are
+// reported with ErrValidationFailed.
 func (c *MarketplaceClient) ValidateAPIKey() (*ValidationResponse, error) {
 	endpoint := fmt.Sprintf("%s/api/v1/tokens/validate", c.BaseURL)
 	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create validation request: %w", err)
 	}
-	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	c.setHeaders(req)
 
 	c.log.Info("Validating API key with marketplace")
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to communicate with marketplace: %w", err)
+		return nil, fmt.Errorf("%w: failed to communicate with marketplace: %w", ErrValidationFailed, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("marketplace returned an error (status %d)", resp.StatusCode)
+		return nil, fmt.Errorf("%w: marketplace returned an error (status %d)", ErrValidationFailed, resp.StatusCode)
 	}
 
 	var validationResp ValidationResponse
 	if err := json.NewDecoder(resp.Body).Decode(&validationResp); err != nil {
-		return nil, fmt.Errorf("failed to decode validation response: %w", err)
+		return nil, fmt.Errorf("%w: failed to decode validation response: %w", ErrValidationFailed, err)
 	}
 
 	return &validationResp, nil
 }
+
+// ErrInvalidLicense means the marketplace doesn't accept the license key.
+var ErrInvalidLicense = errors.New("license key rejected by the marketplace")
+
+// SyncTokens validates the license key with the marketplace and stores the balance it
+// reports in tm. A key the marketplace doesn't accept fails with ErrInvalidLicense and
+// leaves tm unchanged.
+func (c *MarketplaceClient) SyncTokens(tm *TokenManager) (*ValidationResponse, error) {
+	resp, err := c.ValidateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsValid {
+		return nil, ErrInvalidLicense
+	}
+	if resp.LastSync.IsZero() {
+		resp.LastSync = time.Now()
+	}
+	if err := tm.SyncBalance(resp.AvailableTokens, resp.LastSync); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Token order statuses reported by the marketplace. An order is approved once the
+// buyer has paid, and completed once the payment is captured and the tokens credited.
+const (
+	OrderPending   = "PENDING"
+	OrderApproved  = "APPROVED"
+	OrderCompleted = "COMPLETED"
+	OrderCancelled = "CANCELLED"
+)
+
+// ErrPendingOrder means an earlier token purchase is still awaiting payment.
+var ErrPendingOrder = errors.New("a previous token purchase is still pending")
+
+// OrderStatus describes the state of a token purchase.
+type OrderStatus struct {
+	OrderID    string `json:"order_id"`
+	Status     string `json:"status"` // One of the Order* constants.
+	TokenCount int    `json:"token_count"`
+	// TransactionID identifies the payment of a completed order.
+	TransactionID string `json:"transaction_id,omitempty"`
+}
+
+// GetOrder returns the status of a token purchase.
+func (c *MarketplaceClient) GetOrder(orderID string) (*OrderStatus, error) {
+	endpoint := fmt.Sprintf("%s/api/v1/tokens/orders/%s", c.BaseURL, url.PathEscape(orderID))
+	var status OrderStatus
+	if err := c.doJSON("GET", endpoint, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// CancelOrder cancels a token purchase that hasn't been paid.
+func (c *MarketplaceClient) CancelOrder(orderID string) error {
+	endpoint := fmt.Sprintf("%s/api/v1/tokens/orders/%s/cancel", c.BaseURL, url.PathEscape(orderID))
+	return c.doJSON("POST", endpoint, nil)
+}
+
+// CaptureRequest is the payload capturing the payment of an approved order.
+type CaptureRequest struct {
+	OrderID string `json:"order_id"`
+}
+
+// Validate checks the request fields and returns the problems keyed by JSON field name.
+func (r CaptureRequest) Validate() map[string]string {
+	fields := map[string]string{}
+	if r.OrderID == "" {
+		fields["order_id"] = "is required"
+	}
+	return fields
+}
+
+// ErrCaptureIncomplete means the marketplace answered a capture without completing the
+// order, so its tokens were not credited.
+var ErrCaptureIncomplete = errors.New("the payment capture did not complete the order")
+
+// CaptureResponse is the result of capturing the payment of an order.
+type CaptureResponse struct {
+	OrderID        string `json:"order_id"`
+	Status         string `json:"status"` // One of the Order* constants.
+	TokensCredited int    `json:"tokens_credited"`
+	TransactionID  string `json:"transaction_id"`
+}
+
+// CaptureOrder captures the payment of an order the buyer approved, which credits its
+// tokens. The payment would be lost if a transient failure went unnoticed, so network
+// errors and 5xx responses are retried up to MaxRetries times, waiting RetryDelay and
+// then twice as long after each attempt. The marketplace captures an order once, and
+// answers a repeated capture with the original result, so a retry is never charged
+// twice. A capture that leaves the order in any status but OrderCompleted returns
+// ErrCaptureIncomplete.
+func (c *MarketplaceClient) CaptureOrder(orderID string) (*CaptureResponse, error) {
+	body, err := json.Marshal(CaptureRequest{OrderID: orderID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture request body: %w", err)
+	}
+	endpoint := fmt.Sprintf("%s/api/v1/tokens/capture", c.BaseURL)
+
+	var lastErr error
+	delay := c.RetryDelay
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		if attempt > 0 {
+			c.log.WithFields(logrus.Fields{
+				"attempt":  attempt,
+				"order_id": orderID,
+			}).WithError(lastErr).Warn("Capture failed, retrying")
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		capture, retry, err := c.capture(endpoint, body)
+		if err == nil {
+			if capture.Status != OrderCompleted {
+				return nil, fmt.Errorf("%w: order %s is %s", ErrCaptureIncomplete, orderID, capture.Status)
+			}
+			c.log.WithFields(logrus.Fields{
+				"order_id":       orderID,
+				"transaction_id": capture.TransactionID,
+				"tokens":         capture.TokensCredited,
+			}).Info("Payment captured")
+			return capture, nil
+		}
+		if !retry {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("capture of order %s failed after %d attempts: %w", orderID, c.MaxRetries+1, lastErr)
+}
+
+// capture performs a single capture attempt. It reports whether a failure is transient
+// and worth retrying.
+func (c *MarketplaceClient) capture(endpoint string, body []byte) (*CaptureResponse, bool, error) {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create http request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.setHeaders(req)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to communicate with marketplace: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, true, fmt.Errorf("marketplace returned an error (status %d)", resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("marketplace returned an error (status %d)", resp.StatusCode)
+	}
+	var capture CaptureResponse
+	if err := json.NewDecoder(resp.Body).Decode(&capture); err != nil {
+		return nil, false, fmt.Errorf("failed to decode capture response: %w", err)
+	}
+	return &capture, false, nil
+}
+
+// doJSON sends an authenticated request and decodes the JSON response into out,
+// unless out is nil.
+func (c *MarketplaceClient) doJSON(method, endpoint string, out interface{}) error {
+	req, err := http.NewRequest(method, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create http request: %w", err)
+	}
+	c.setHeaders(req)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to communicate with marketplace: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("marketplace returned an error (status %d)", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode marketplace response: %w", err)
+	}
+	return nil
+}
+
+// StartPurchase initiates a purchase of count tokens and records it in tm as pending
+// before returning it, so the order survives an interruption. If tm already holds a
+// pending order, nothing is bought and ErrPendingOrder is returned: resume the order
+// with CheckPendingOrder or drop it with CancelPendingOrder first.
+func (c *MarketplaceClient) StartPurchase(tm *TokenManager, count int) (*PendingOrder, error) {
+	if pending := tm.PendingOrder(); pending != nil {
+		return nil, fmt.Errorf("%w: order %s for %d token(s), created %s",
+			ErrPendingOrder, pending.OrderID, pending.TokenCount, pending.CreatedAt.Format(time.RFC3339))
+	}
+
+	resp, err := c.InitiatePurchase(count)
+	if err != nil {
+		return nil, err
+	}
+	order := &PendingOrder{
+		OrderID:    resp.OrderID,
+		PaymentURL: resp.PaymentURL,
+		TokenCount: count,
+		CreatedAt:  time.Now(),
+	}
+	if err := tm.SetPendingOrder(order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// CheckPendingOrder asks the marketplace about the pending order of tm. An approved
+// order is captured with CaptureOrder; if that fails, the order stays pending and the
+// next check captures it again. Once it is completed, the token balance is synced and
+// the order cleared; a cancelled order is cleared too. It returns nil if there is no
+// pending order.
+func (c *MarketplaceClient) CheckPendingOrder(tm *TokenManager) (*OrderStatus, error) {
+	pending := tm.PendingOrder()
+	if pending == nil {
+		return nil, nil
+	}
+	status, err := c.GetOrder(pending.OrderID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch status.Status {
+	case OrderApproved:
+		capture, err := c.CaptureOrder(pending.OrderID)
+		if err != nil {
+			return nil, err
+		}
+		status.Status = capture.Status
+		status.TransactionID = capture.TransactionID
+		fallthrough
+	case OrderCompleted:
+		if err := tm.ValidateOnline(c); err != nil {
+			return nil, err
+		}
+		fallthrough
+	case OrderCancelled:
+		if err := tm.SetPendingOrder(nil); err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
+
+// CancelPendingOrder cancels the pending order of tm with the marketplace and clears it.
+func (c *MarketplaceClient) CancelPendingOrder(tm *TokenManager) error {
+	pending := tm.PendingOrder()
+	if pending == nil {
+		return nil
+	}
+	if err := c.CancelOrder(pending.OrderID); err != nil {
+		return err
+	}
+	c.log.WithField("order_id", pending.OrderID).Info("Pending order cancelled")
+	return tm.SetPendingOrder(nil)
+}
+
+// DigestSHA256 is the algorithm name of a SHA-256 digest in an RFC 3230 Digest header.
+const DigestSHA256 = "SHA-256"
+
+// ErrDigestMismatch means a downloaded archive doesn't match the digest the server
+// advertised, typically because it was corrupted in transit.
+var ErrDigestMismatch = errors.New("downloaded archive does not match the server's digest")
+
+// Download streams the stored archive with the given id into w.
+// If the transfer is interrupted, it resumes from the last received byte with an
+// HTTP Range request, using If-Range so a replaced archive is never spliced onto
+// a stale partial download.
+// If the server sends a SHA-256 Digest header, the received bytes are checked against
+// it and ErrDigestMismatch is returned on a mismatch; w then holds corrupt data and
+// should be discarded.
+func (c *MarketplaceClient) Download(id string, w io.Writer) error {
+	endpoint := fmt.Sprintf("%s/api/v1/extract/%s", c.BaseURL, url.PathEscape(id))
+	dl := &download{endpoint: endpoint, dst: w, hash: sha256.New()}
+
+	var lastErr error
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		if attempt > 0 {
+			c.log.WithFields(logrus.Fields{
+				"attempt": attempt,
+				"offset":  dl.written,
+			}).WithError(lastErr).Warn("Download interrupted, resuming")
+			time.Sleep(time.Duration(attempt) * c.RetryDelay)
+		}
+
+		retry, err := c.downloadRange(dl)
+		if err == nil {
+			if err := dl.verify(); err != nil {
+				return err
+			}
+			c.log.WithField("bytes", dl.written).Info("Download complete")
+			return nil
+		}
+		if !retry {
+			return err
+		}
+		lastErr = err
+	}
+	return fmt.Errorf("download failed after %d attempts: %w", c.MaxRetries+1, lastErr)
+}
+
+// download tracks the progress of a resumable transfer across attempts.
+type download struct {
+	endpoint  string
+	dst       io.Writer
+	written   int64  // Bytes successfully written to dst so far.
+	validator string // ETag or Last-Modified of the first response, sent as If-Range.
+	writeErr  error  // Set when dst itself failed, which is never retried.
+	hash      hash.Hash
+	digest    []byte // SHA-256 advertised by the server, if any.
+}
+
+func (d *download) Write(p []byte) (int, error) {
+	n, err := d.dst.Write(p)
+	d.hash.Write(p[:n])
+	d.written += int64(n)
+	if err != nil {
+		d.writeErr = err
+	}
+	return n, err
+}
+
+// verify checks the received bytes against the digest advertised by the server.
+func (d *download) verify() error {
+	if d.digest == nil {
+		return nil
+	}
+	if !bytes.Equal(d.hash.Sum(nil), d.digest) {
+		return ErrDigestMismatch
+	}
+	return nil
+}
+
+// parseDigest extracts the SHA-256 value of an RFC 3230 Digest header, such as
+// "SHA-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=". It returns nil if the header
+// has no usable SHA-256 digest.
+func parseDigest(header string) []byte {
+	for _, part := range strings.Split(header, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || !strings.EqualFold(alg, DigestSHA256) {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err == nil && len(sum) == sha256.Size {
+			return sum
+		}
+	}
+	return nil
+}
+
+// downloadRange performs a single attempt, requesting the bytes from d.written onwards.
+// It reports whether a failure is transient and worth retrying.
+func (c *MarketplaceClient) downloadRange(d *download) (bool, error) {
+	req, err := http.NewRequest("GET", d.endpoint, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create download request: %w", err)
+	}
+	c.setHeaders(req)
+	if d.written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.written))
+		if d.validator != "" {
+			req.Header.Set("If-Range", d.validator)
+		}
+	}
+
+	// Large archives take longer than the client-wide timeout allows, so the
+	// download runs without one; a dropped connection is resumed instead.
+	httpClient := *c.HTTPClient
+	httpClient.Timeout = 0
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed to communicate with marketplace: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case d.written == 0 && resp.StatusCode == http.StatusOK:
+		d.validator = resp.Header.Get("ETag")
+		if d.validator == "" {
+			d.validator = resp.Header.Get("Last-Modified")
+		}
+		d.digest = parseDigest(resp.Header.Get("Digest"))
+	case d.written > 0 && resp.StatusCode == http.StatusPartialContent:
+		// Resuming where the previous attempt stopped.
+	case d.written > 0 && resp.StatusCode == http.StatusOK:
+		// The server ignored the range, typically because the archive changed.
+		return false, fmt.Errorf("archive changed on the server during download")
+	case d.written > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// Everything was received before the connection dropped.
+		if resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", d.written) {
+			return false, nil
+		}
+		return false, fmt.Errorf("marketplace rejected resume offset %d", d.written)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return true, fmt.Errorf("marketplace returned an error (status %d)", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("marketplace returned an error (status %d)", resp.StatusCode)
+	}
+
+	if _, err := io.Copy(d, resp.Body); err != nil {
+		if d.writeErr != nil {
+			return false, fmt.Errorf("failed to write download: %w", d.writeErr)
+		}
+		return true, fmt.Errorf("download stream interrupted: %w", err)
+	}
+	return false, nil
+}
@@ -2,12 +2,15 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"net/http"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -18,6 +21,9 @@ const (
 	DefaultFreeTokens = 1
 	// TokenFileName is the name of the local file used to persist token state.
 	TokenFileName = ".nsm-tokens"
+	// LockFileName is the name of the file locked while the token file is updated, next
+	// to it.
+	LockFileName = TokenFileName + ".lock"
 )
 
 var (
@@ -31,15 +37,38 @@ type TokenState struct {
 	LicenseKey     string    `json:"license_key"`
 	AvailableTokens int       `json:"available_tokens"`
 	LastSync       time.Time `json:"last_sync"`
+	// PendingOrder is a purchase that was started but not yet paid or cancelled.
+	PendingOrder *PendingOrder `json:"pending_order,omitempty"`
+	// ClientID is a random identifier of this installation, see TokenManager.ClientID.
+	ClientID string `json:"client_id,omitempty"`
+	// Transactions holds the payment transactions already credited, with when they
+	// were, see TokenManager.AddTokensForTransaction.
+	Transactions map[string]time.Time `json:"transactions,omitempty"`
+}
+
+// PendingOrder records a token purchase awaiting payment, so an interrupted purchase
+// can be resumed or cancelled instead of being orphaned.
+type PendingOrder struct {
+	OrderID    string    `json:"order_id"`
+	PaymentURL string    `json:"payment_url"`
+	TokenCount int       `json:"token_count"`
+	CreatedAt  time.Time `json:"created_at"`
 }
 
 // TokenManager provides a thread-safe way to manage user tokens.
+// Several processes can share a token file: every change is made to the latest state
+// read from the file while holding a lock, and written atomically, so a crash never
+// leaves a partial file and concurrent changes aren't lost.
 type TokenManager struct {
-	state    *TokenState
-	filePath string
-	log      *logrus.Entry
-	mu       sync.Mutex // Protects access to the state.
-	client   *http.Client // HTTP client for online validation.
+	state      *TokenState
+	filePath   string
+	licenseKey string // Overrides the license key of the file, if set.
+	log        *logrus.Entry
+	mu         sync.Mutex // Protects access to the state.
+
+	// available mirrors state.AvailableTokens so AvailableTokens can read it without
+	// taking mu. It is only written while mu is held, once a change has been persisted.
+	available atomic.Int64
 }
 
 // NewTokenManager creates a new manager. It tries to load state from the local
@@ -49,9 +78,9 @@ func NewTokenManager(homeDir, licenseKey string) (*TokenManager, error) {
 	log := logrus.WithField("component", "token_manager")
 
 	tm := &TokenManager{
-		filePath: path,
-		log:      log,
-		client:   &http.Client{Timeout: 10 * time.Second},
+		filePath:   path,
+		licenseKey: licenseKey,
+		log:        log,
 		state: &TokenState{
 			LicenseKey:     licenseKey,
 			AvailableTokens: 0, // Default to 0 before loading/creating.
@@ -62,11 +91,12 @@ func NewTokenManager(homeDir, licenseKey string) (*TokenManager, error) {
 	err := tm.loadState()
 	if err != nil {
 		if os.IsNotExist(err) {
-			// File doesn't exist, this is a first-time run.
+			// File doesn't exist, this is a first-time run. If another process creates
+			// it first, update picks its state up instead.
 			log.Info("No local token file found. Creating a new one with a free token.")
 			tm.state.AvailableTokens = DefaultFreeTokens
 			tm.state.LastSync = time.Now()
-			if saveErr := tm.saveState(); saveErr != nil {
+			if saveErr := tm.update(func(*TokenState) error { return nil }); saveErr != nil {
 				return nil, saveErr
 			}
 		} else {
@@ -86,76 +116,328 @@ func NewTokenManager(homeDir, licenseKey string) (*TokenManager, error) {
 		// go tm.ValidateOnline()
 	}
 
+	tm.publish()
 	return tm, nil
 }
 
 // ConsumeToken checks for an available token, decrements the count, and persists the change.
-// This operation is thread-safe.
+// It is ConsumeN(1). This operation is thread-safe.
 func (tm *TokenManager) ConsumeToken() error {
+	return tm.ConsumeN(1)
+}
+
+// ConsumeN atomically takes n tokens and persists the change. If fewer than n tokens
+// are available, nothing is consumed and ErrNoTokens is returned; if the change can't
+// be persisted, nothing is consumed either.
+// This operation is thread-safe. Together with RefundN it makes TokenManager a core.TokenSource.
+func (tm *TokenManager) ConsumeN(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("token count must be positive, got %d", n)
+	}
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
-	if tm.state.AvailableTokens <= 0 {
-		tm.log.Warn("Attempted to use token, but none are available.")
-		// Optionally, trigger an online check to see if more tokens were purchased.
-		// go tm.ValidateOnline()
-		return ErrNoTokens
+	// If the change can't be persisted, the tokens stay available, so callers never
+	// see an error for a consumption that actually happened.
+	err := tm.update(func(s *TokenState) error {
+		if s.AvailableTokens < n {
+			tm.log.WithFields(logrus.Fields{
+				"requested": n,
+				"available": s.AvailableTokens,
+			}).Warn("Attempted to use tokens, but not enough are available.")
+			// Optionally, trigger an online check to see if more tokens were purchased.
+			// go tm.ValidateOnline()
+			return ErrNoTokens
+		}
+		s.AvailableTokens -= n
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tm.log.WithField("tokens_remaining", tm.state.AvailableTokens).Info("Tokens consumed.")
+	return nil
+}
+
+// RefundToken returns a token taken by ConsumeToken for an operation that failed, and
+// persists the change. It is RefundN(1). This operation is thread-safe.
+func (tm *TokenManager) RefundToken() error {
+	return tm.RefundN(1)
+}
+
+// RefundN returns n tokens taken by ConsumeN for an operation that failed, and persists the change.
+// This operation is thread-safe.
+func (tm *TokenManager) RefundN(n int) error {
+	return tm.add(n, "Tokens refunded.")
+}
+
+// AddTokens credits n newly bought tokens and persists the change.
+// This operation is thread-safe.
+func (tm *TokenManager) AddTokens(n int) error {
+	return tm.add(n, "Tokens credited.")
+}
+
+// AddTokensForTransaction is like AddTokens for tokens paid by the payment
+// transactionID, which is recorded in the token file with the new balance. It returns
+// false without crediting anything if the transaction was credited before, so a
+// payment notification delivered twice can't credit its tokens twice.
+// This operation is thread-safe.
+func (tm *TokenManager) AddTokensForTransaction(transactionID string, n int) (bool, error) {
+	if transactionID == "" {
+		return false, fmt.Errorf("a transaction id is required")
+	}
+	if n <= 0 {
+		return false, fmt.Errorf("token count must be positive, got %d", n)
+	}
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	err := tm.update(func(s *TokenState) error {
+		if _, ok := s.Transactions[transactionID]; ok {
+			return errUnchanged
+		}
+		if s.Transactions == nil {
+			s.Transactions = make(map[string]time.Time)
+		}
+		s.AvailableTokens += n
+		s.Transactions[transactionID] = time.Now()
+		return nil
+	})
+	if err == errUnchanged {
+		tm.log.WithField("transaction_id", transactionID).Info("Transaction already credited.")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
 	}
+	tm.log.WithFields(logrus.Fields{
+		"transaction_id":   transactionID,
+		"tokens_remaining": tm.state.AvailableTokens,
+	}).Info("Tokens credited.")
+	return true, nil
+}
 
-	tm.state.AvailableTokens--
-	tm.log.WithField("tokens_remaining", tm.state.AvailableTokens).Info("Token consumed.")
+// add implements RefundN and AddTokens, logging msg once the change is persisted.
+func (tm *TokenManager) add(n int, msg string) error {
+	if n <= 0 {
+		return fmt.Errorf("token count must be positive, got %d", n)
+	}
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
 
-	// Persist the new state to the file.
-	return tm.saveState()
+	err := tm.update(func(s *TokenState) error {
+		s.AvailableTokens += n
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tm.log.WithField("tokens_remaining", tm.state.AvailableTokens).Info(msg)
+	return nil
 }
 
 // AvailableTokens returns the current number of available tokens.
+// It doesn't lock, so it is cheap to poll, and it only ever reports persisted balances.
 func (tm *TokenManager) AvailableTokens() int {
+	return int(tm.available.Load())
+}
+
+// publish makes the current balance visible to AvailableTokens.
+// It must be called with mu held, after every change to the balance has been persisted.
+func (tm *TokenManager) publish() {
+	tm.available.Store(int64(tm.state.AvailableTokens))
+}
+
+// LastSync returns when the balance was last synced with the marketplace, as recorded
+// in the token file; it is the zero time if it never was.
+func (tm *TokenManager) LastSync() time.Time {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
-	return tm.state.AvailableTokens
+	return tm.state.LastSync
 }
 
-// ValidateOnline contacts the marketplace API to sync the token count.
-// This is a placeholder for the actual API call.
-func (tm *TokenManager) ValidateOnline() error {
+// SyncBalance replaces the balance with available, as reported by the marketplace at
+// syncedAt, and persists the change.
+func (tm *TokenManager) SyncBalance(available int, syncedAt time.Time) error {
+	if available < 0 {
+		return fmt.Errorf("token count cannot be negative, got %d", available)
+	}
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
-	if tm.state.LicenseKey == "" {
+	err := tm.update(func(s *TokenState) error {
+		s.AvailableTokens = available
+		s.LastSync = syncedAt
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tm.log.WithField("tokens_remaining", available).Info("Token balance synced with the marketplace.")
+	return nil
+}
+
+// PendingOrder returns a copy of the pending purchase, or nil if there is none.
+func (tm *TokenManager) PendingOrder() *PendingOrder {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.state.PendingOrder == nil {
+		return nil
+	}
+	order := *tm.state.PendingOrder
+	return &order
+}
+
+// ClientID returns the anonymous identifier of this installation, generating and
+// persisting it on first use. It is random, so it carries nothing about the user or
+// machine, but stays the same across runs for support to correlate requests.
+func (tm *TokenManager) ClientID() (string, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.state.ClientID != "" {
+		return tm.state.ClientID, nil
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate client id: %w", err)
+	}
+	err := tm.update(func(s *TokenState) error {
+		// Another process may have generated it since the file was read.
+		if s.ClientID != "" {
+			return errUnchanged
+		}
+		s.ClientID = hex.EncodeToString(id)
+		return nil
+	})
+	if err != nil && err != errUnchanged {
+		return "", err
+	}
+	return tm.state.ClientID, nil
+}
+
+// SetPendingOrder records the pending purchase, or clears it if order is nil, and
+// persists the change. This operation is thread-safe.
+func (tm *TokenManager) SetPendingOrder(order *PendingOrder) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if order != nil {
+		copied := *order
+		order = &copied
+	}
+	return tm.update(func(s *TokenState) error {
+		s.PendingOrder = order
+		return nil
+	})
+}
+
+// ValidateOnline syncs the token count with the marketplace through client, which
+// must be authenticated with the license key: the balance and LastSync are replaced by
+// the ones the marketplace reports. It does nothing without a license key. If the
+// marketplace can't be reached or answers with an error or an unreadable response,
+// ErrValidationFailed is returned and the cached balance is kept.
+func (tm *TokenManager) ValidateOnline(client *MarketplaceClient) error {
+	tm.mu.Lock()
+	licenseKey := tm.state.LicenseKey
+	tm.mu.Unlock()
+	if licenseKey == "" {
 		tm.log.Info("Skipping online validation: no license key.")
 		return nil
 	}
 
 	tm.log.Info("Contacting marketplace API for token validation...")
-	// --- Placeholder for API call logic ---
-	// resp, err := tm.client.Get("https://your-marketplace.com/api/validate?key=" + tm.state.LicenseKey)
-	// if err != nil { return ErrValidationFailed }
-	// defer resp.Body.Close()
-	// var apiResponse struct { Tokens int `json:"tokens"` }
-	// if err := json.NewDecoder(resp.Body).Decode(&apiResponse); err != nil { ... }
-	// tm.state.AvailableTokens = apiResponse.Tokens
-	// tm.state.LastSync = time.Now()
-	// ------------------------------------
-
-	// Simulate a successful API call that grants 5 tokens.
-	tm.log.Info("Simulated API sync successful. Token count updated.")
-	tm.state.AvailableTokens = 5
-	tm.state.LastSync = time.Now()
-
-	return tm.saveState()
-}
-
-// saveState writes the current token state to the JSON file.
-func (tm *TokenManager) saveState() error {
-	data, err := json.MarshalIndent(tm.state, "", "  ")
+	if _, err := client.SyncTokens(tm); err != nil {
+		tm.log.WithError(err).Warn("Online token validation failed; keeping the cached balance.")
+		return err
+	}
+	return nil
+}
+
+// errUnchanged is returned by the function given to update when the state needs no
+// change, so nothing is written.
+var errUnchanged = errors.New("token state unchanged")
+
+// update applies change to the latest token state and persists the result, holding
+// the lock file so other processes wait. The state is read from the file again first,
+// since another process may have changed it; if there is no file yet, change applies
+// to the state in memory. If change fails, or the result can't be persisted, nothing
+// is changed; if it returns errUnchanged, the state read is adopted without writing.
+// It must be called with mu held.
+func (tm *TokenManager) update(change func(s *TokenState) error) error {
+	unlock, err := lockFile(filepath.Join(filepath.Dir(tm.filePath), LockFileName))
+	if err != nil {
+		tm.log.WithError(err).Error("Failed to lock token file.")
+		return ErrPersistence
+	}
+	defer unlock()
+
+	state, err := tm.readState()
+	switch {
+	case os.IsNotExist(err):
+		if state, err = tm.state.clone(); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+	if tm.licenseKey != "" {
+		state.LicenseKey = tm.licenseKey
+	}
+
+	err = change(state)
+	if err == nil {
+		err = tm.writeState(state)
+	}
+	if err != nil && err != errUnchanged {
+		return err
+	}
+	tm.state = state
+	tm.publish()
+	return err
+}
+
+// clone returns a deep copy of the state.
+func (s *TokenState) clone() (*TokenState, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, ErrPersistence
+	}
+	c := &TokenState{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, ErrPersistence
+	}
+	return c, nil
+}
+
+// writeState writes state to the token file atomically: it is written to a temporary
+// file in the same directory, which then replaces the token file, so an interrupted
+// write leaves the previous file intact.
+func (tm *TokenManager) writeState(state *TokenState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
 		tm.log.WithError(err).Error("Failed to marshal token state.")
 		return ErrPersistence
 	}
 
-	// Write with permissions that restrict access to the current user.
-	if err := os.WriteFile(tm.filePath, data, 0600); err != nil {
+	// CreateTemp restricts access to the current user.
+	tmp, err := os.CreateTemp(filepath.Dir(tm.filePath), TokenFileName+"-*.tmp")
+	if err != nil {
+		tm.log.WithError(err).Error("Failed to write token file.")
+		return ErrPersistence
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), tm.filePath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
 		tm.log.WithError(err).Error("Failed to write token file.")
 		return ErrPersistence
 	}
@@ -164,18 +446,26 @@ func (tm *TokenManager) saveState() error {
 
 // loadState reads the token state from the JSON file.
 func (tm *TokenManager) loadState() error {
-	data, err := os.ReadFile(tm.filePath)
+	state, err := tm.readState()
 	if err != nil {
 		return err // Return original error to check for os.IsNotExist
 	}
+	tm.state = state
+	tm.log.WithField("tokens_loaded", tm.state.AvailableTokens).Info("Token state loaded from file.")
+	return nil
+}
 
-	newState := &TokenState{}
-	if err := json.Unmarshal(data, newState); err != nil {
-		tm.log.WithError(err).Error("Failed to unmarshal token file. The file might be corrupted.")
-		return ErrPersistence
+// readState reads the token state from the JSON file.
+func (tm *TokenManager) readState() (*TokenState, error) {
+	data, err := os.ReadFile(tm.filePath)
+	if err != nil {
+		return nil, err // Return original error to check for os.IsNotExist
 	}
 
-	tm.state = newState
-	tm.log.WithField("tokens_loaded", tm.state.AvailableTokens).Info("Token state loaded from file.")
-	return nil
+	state := &TokenState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		tm.log.WithError(err).Error("Failed to unmarshal token file. The file might be corrupted.")
+		return nil, ErrPersistence
+	}
+	return state, nil
 }
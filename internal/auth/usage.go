@@ -0,0 +1,96 @@
+// Package auth handles token management, validation, and persistence.
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// UsageLogFileName is the name of the file, next to the token file, recording what
+// tokens were spent on.
+const UsageLogFileName = TokenFileName + ".log"
+
+// UsageRecord is an entry of the token usage log: tokens were spent on operation for
+// archive at Timestamp, leaving TokensRemaining.
+type UsageRecord struct {
+	Timestamp       time.Time `json:"timestamp"`
+	Operation       string    `json:"operation"`
+	Archive         string    `json:"archive"` // Absolute path; empty for an archive written to a stream.
+	TokensRemaining int       `json:"tokens_remaining"`
+}
+
+// LogUsage appends a record of tokens spent on operation for archive to the usage log,
+// with the balance left. The log is only ever appended to, one JSON object per line.
+// It makes TokenManager a core.UsageLogger, so every archive charged for is recorded.
+func (tm *TokenManager) LogUsage(operation, archive string) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	// Archives written to a stream have no path.
+	if abs, err := filepath.Abs(archive); err == nil && archive != "" {
+		archive = abs
+	}
+	line, err := json.Marshal(UsageRecord{
+		Timestamp:       time.Now(),
+		Operation:       operation,
+		Archive:         archive,
+		TokensRemaining: tm.state.AvailableTokens,
+	})
+	if err != nil {
+		return ErrPersistence
+	}
+
+	f, err := os.OpenFile(tm.usageLogPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		tm.log.WithError(err).Error("Failed to open token usage log.")
+		return ErrPersistence
+	}
+	// A single write, so records appended by several processes don't interleave.
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		tm.log.WithError(err).Error("Failed to write token usage log.")
+		return ErrPersistence
+	}
+	return nil
+}
+
+// UsageHistory returns the records of the usage log, oldest first; none if nothing was
+// logged yet. Lines that can't be read, such as one cut short by a crash, are skipped.
+func (tm *TokenManager) UsageHistory() ([]UsageRecord, error) {
+	data, err := os.ReadFile(tm.usageLogPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		tm.log.WithError(err).Error("Failed to read token usage log.")
+		return nil, ErrPersistence
+	}
+
+	var records []UsageRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			tm.log.WithField("line", n).WithError(err).Warn("Skipping unreadable token usage record.")
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// usageLogPath returns the path of the usage log.
+func (tm *TokenManager) usageLogPath() string {
+	return filepath.Join(filepath.Dir(tm.filePath), UsageLogFileName)
+}
@@ -2,16 +2,28 @@
 package cli
 
 import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/nexus/nsm/internal/api"
 	"github.com/nexus/nsm/internal/auth"
+	"github.com/nexus/nsm/internal/config"
 	"github.com/nexus/nsm/internal/core"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	// For progress bars, a library like "github.com/vbauerster/mpb/v8" would be used.
 )
 
 // NewRootCmd creates the root command and adds all subcommands to it.
@@ -23,135 +35,1959 @@ func NewRootCmd() *cobra.Command {
 featuring a token-based usage system and an integrated marketplace.`,
 	}
 
+	rootCmd.PersistentFlags().String("index-key-file", "", "File holding the 256-bit key (hex or raw) that encrypts archive indexes")
+	rootCmd.PersistentFlags().String("keyfile", "", "File holding exactly 32 raw bytes that encrypt archive data; with --encrypt, the data needs both the key file and the passphrase")
+	rootCmd.PersistentFlags().String("password-file", "", "File holding the passphrase of archives created with --encrypt (default $"+PasswordEnv+", or a prompt)")
+	rootCmd.PersistentFlags().String("password", "", "Passphrase of archives created with --encrypt; other users may see it in the process list, so prefer --password-file")
+	rootCmd.PersistentFlags().String("output", OutputText, "Output format: "+OutputText+" for people, or "+OutputJSON+" for a single JSON value for scripts")
+	rootCmd.PersistentFlags().StringArray("config", nil, "Additional config file, merged over "+config.SystemConfigPath+" and ~/"+config.UserConfigName+" (repeatable; later files win)")
+
 	// Add subcommands
 	rootCmd.AddCommand(createCreateCmd())
 	rootCmd.AddCommand(createExtractCmd())
+	rootCmd.AddCommand(createListCmd())
+	rootCmd.AddCommand(createInfoCmd())
 	rootCmd.AddCommand(createSearchCmd())
+	rootCmd.AddCommand(createExtractMatchingCmd())
+	rootCmd.AddCommand(createUpgradeCmd())
+	rootCmd.AddCommand(createMigrateCmd())
+	rootCmd.AddCommand(createRecompressCmd())
+	rootCmd.AddCommand(createRemoveCmd())
+	rootCmd.AddCommand(createVerifyCmd())
+	rootCmd.AddCommand(createCompareCmd())
+	rootCmd.AddCommand(createWatchCmd())
+	rootCmd.AddCommand(createRewrapIndexCmd())
 	rootCmd.AddCommand(createBuyTokensCmd())
+	rootCmd.AddCommand(createTokensCmd())
 	rootCmd.AddCommand(createServerCmd())
+	rootCmd.AddCommand(createConfigCmd())
 
 	return rootCmd
 }
 
+// loadConfig merges the default config files that exist with the files given by --config.
+func loadConfig(cmd *cobra.Command) (*config.Config, error) {
+	extra, _ := cmd.Flags().GetStringArray("config")
+	cfg, err := config.Load(append(config.DefaultPaths(), extra...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// readKeyFile reads a 256-bit key stored either as 64 hex digits or as 32 raw bytes.
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if text := strings.TrimSpace(string(data)); len(text) == 2*core.IndexKeySize {
+		if key, err := hex.DecodeString(text); err == nil {
+			return key, nil
+		}
+	}
+	if len(data) != core.IndexKeySize {
+		return nil, fmt.Errorf("key file %s must hold %d bytes or %d hex digits", path, core.IndexKeySize, 2*core.IndexKeySize)
+	}
+	return data, nil
+}
+
+// keyFilePath returns the path of the data key file given by --keyfile, if any.
+func keyFilePath(cmd *cobra.Command) string {
+	path, _ := cmd.Flags().GetString("keyfile")
+	return path
+}
+
+// readIndexKey returns the key given by --index-key-file, or nil if there is none.
+func readIndexKey(cmd *cobra.Command) ([]byte, error) {
+	path, _ := cmd.Flags().GetString("index-key-file")
+	if path == "" {
+		return nil, nil
+	}
+	return readKeyFile(path)
+}
+
+// excludePatterns returns the patterns given by --exclude and read from the files of
+// --exclude-from.
+func excludePatterns(cmd *cobra.Command) ([]string, error) {
+	patterns, _ := cmd.Flags().GetStringArray("exclude")
+	files, _ := cmd.Flags().GetStringArray("exclude-from")
+	for _, file := range files {
+		more, err := core.ReadExcludeFile(file)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, more...)
+	}
+	return patterns, nil
+}
+
+// addExcludeFlags adds the --exclude and --exclude-from flags read by excludePatterns.
+func addExcludeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArray("exclude", nil, "Skip paths matching this glob: a name such as '*.tmp' or 'node_modules' matches at any depth, a path such as 'build/**/*.o' from the input directory (repeatable)")
+	cmd.Flags().StringArray("exclude-from", nil, "Read --exclude patterns from this file, one per line as in .gitignore (repeatable)")
+}
+
+// compressionLevelFlag returns the level given by --level, as a number or preset name.
+func compressionLevelFlag(cmd *cobra.Command) (int, error) {
+	level, _ := cmd.Flags().GetString("level")
+	return core.ParseCompressionLevel(level)
+}
+
+// defaultMarketplaceURL is the base URL of the marketplace API unless configured.
+const defaultMarketplaceURL = "http://localhost:8080"
+
+// marketplaceURL returns the base URL of the marketplace API configured in cfg.
+func marketplaceURL(cfg *config.Config) string {
+	if cfg.Marketplace.URL != "" {
+		return strings.TrimRight(cfg.Marketplace.URL, "/")
+	}
+	return defaultMarketplaceURL
+}
+
+// newMarketplaceClient returns a marketplace client identified as configured: with the
+// configured User-Agent, if any, and the installation's client id unless disabled.
+func newMarketplaceClient(cfg *config.Config, baseURL, apiKey string, tokens *auth.TokenManager) (*auth.MarketplaceClient, error) {
+	client := auth.NewMarketplaceClient(baseURL, apiKey)
+	if cfg.Marketplace.UserAgent != "" {
+		client.UserAgent = cfg.Marketplace.UserAgent
+	}
+	if !cfg.Marketplace.DisableClientID {
+		id, err := tokens.ClientID()
+		if err != nil {
+			return nil, err
+		}
+		client.ClientID = id
+	}
+	return client, nil
+}
+
+// readFileList reads the file list given by --files-from, "-" meaning standard input.
+func readFileList(name string, nul bool) ([]string, error) {
+	r := io.Reader(os.Stdin)
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file list: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	return core.ReadFileList(r, nul)
+}
+
 // createCreateCmd defines the 'create' command.
 func createCreateCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "create <output.nsm> <input_file...>",
+	cmd := &cobra.Command{
+		Use:   "create <output.nsm> <input_file...|->",
 		Short: "Create a compressed .nsm archive from one or more files.",
-		Args:  cobra.MinimumNArgs(2),
+		Long: `Create a compressed .nsm archive from one or more files.
+
+Inputs are given as arguments, as - to archive standard input, or with --files-from
+as a list of paths, one per line (NUL-separated with --files-from0), for example:
+
+  find src -name '*.go' | nsm create out.nsm --files-from -
+
+With --from-archive, the files of a .tar, .tar.gz or .zip archive are re-packed
+instead, without extracting them to disk:
+
+  nsm create backup.nsm --from-archive backup.tar.gz`,
+		Args: cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			outputFile := args[0]
 			inputFiles := args[1:]
+			filesFrom, _ := cmd.Flags().GetString("files-from")
+			filesFrom0, _ := cmd.Flags().GetBool("files-from0")
+			fromArchive, _ := cmd.Flags().GetString("from-archive")
+			switch {
+			case filesFrom != "" && len(inputFiles) > 0:
+				return fmt.Errorf("--files-from cannot be combined with input arguments")
+			case fromArchive != "" && (filesFrom != "" || len(inputFiles) > 0):
+				return fmt.Errorf("--from-archive cannot be combined with other inputs")
+			case fromArchive != "":
+			case filesFrom == "" && len(inputFiles) == 0:
+				return fmt.Errorf("no inputs given")
+			case filesFrom == "" && filesFrom0:
+				return fmt.Errorf("--files-from0 needs --files-from")
+			}
+			dictionary, _ := cmd.Flags().GetBool("dictionary")
+			if dictionary && (fromArchive != "" || filesFrom != "" || (len(inputFiles) == 1 && inputFiles[0] == "-")) {
+				return fmt.Errorf("--dictionary needs the inputs given as arguments")
+			}
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			if dryRun && (fromArchive != "" || (len(inputFiles) == 1 && inputFiles[0] == "-")) {
+				return fmt.Errorf("--dry-run needs the inputs given as arguments or with --files-from")
+			}
+
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			cfg, err := loadConfig(cmd)
+			if err != nil {
+				return err
+			}
+
+			creator, _ := cmd.Flags().GetString("creator")
+			reproducible, _ := cmd.Flags().GetBool("reproducible")
+			excludeVCS, _ := cmd.Flags().GetBool("exclude-vcs")
+			noDefaultIgnores, _ := cmd.Flags().GetBool("no-default-ignores")
+			keepGoing, _ := cmd.Flags().GetBool("keep-going")
+			followSymlinks, _ := cmd.Flags().GetBool("follow-symlinks")
+			tempDir, _ := cmd.Flags().GetString("temp-dir")
+			indexCompression, _ := cmd.Flags().GetString("index-compression")
+			groupSmallFiles, _ := cmd.Flags().GetBool("group-small-files")
+			adaptive, _ := cmd.Flags().GetBool("adaptive")
+			dedup, _ := cmd.Flags().GetBool("dedup")
+			chunking, _ := cmd.Flags().GetBool("chunking")
+			cipherName, _ := cmd.Flags().GetString("cipher")
+			windowLog, _ := cmd.Flags().GetInt("window-log")
+			long, _ := cmd.Flags().GetBool("long")
+			levelName, _ := cmd.Flags().GetString("level")
+			if !cmd.Flags().Changed("level") && cfg.Create.Level != "" {
+				levelName = cfg.Create.Level
+			}
+			level, err := core.ParseCompressionLevel(levelName)
+			if err != nil {
+				return err
+			}
+			targetRate, _ := cmd.Flags().GetFloat64("target-rate")
+			if targetRate < 0 {
+				return fmt.Errorf("--target-rate must not be negative")
+			}
+			storeExts := cfg.Create.StoreExtensions // nil keeps the default list.
+			if cmd.Flags().Changed("store-ext") {
+				storeExts, _ = cmd.Flags().GetStringSlice("store-ext")
+				if storeExts == nil {
+					storeExts = []string{}
+				}
+			}
+			// Flags that weren't given fall back to the config files.
+			if !cmd.Flags().Changed("creator") && cfg.Create.Creator != "" {
+				creator = cfg.Create.Creator
+			}
+			if !cmd.Flags().Changed("exclude-vcs") {
+				excludeVCS = excludeVCS || cfg.Create.ExcludeVCS
+			}
+			if !cmd.Flags().Changed("temp-dir") && tempDir == "" {
+				tempDir = cfg.TempDir
+			}
+			if !cmd.Flags().Changed("index-compression") && cfg.Create.IndexCompression != "" {
+				indexCompression = cfg.Create.IndexCompression
+			}
+			if !cmd.Flags().Changed("group-small-files") {
+				groupSmallFiles = groupSmallFiles || cfg.Create.GroupSmallFiles
+			}
+			if !cmd.Flags().Changed("cipher") && cfg.Create.Cipher != "" {
+				cipherName = cfg.Create.Cipher
+			}
+			extraStoreExts, _ := cmd.Flags().GetStringSlice("store-ext-add")
+			exclude, err := excludePatterns(cmd)
+			if err != nil {
+				return err
+			}
+
+			var onlyNewer time.Time
+			if ref, _ := cmd.Flags().GetString("only-newer"); ref != "" {
+				t, err := core.ParseReferenceTime(ref)
+				if err != nil {
+					return fmt.Errorf("invalid --only-newer reference: %w", err)
+				}
+				onlyNewer = t
+			}
+
+			searchIndex := core.SearchIndexEmbedded
+			if cfg.Create.SearchIndex != "" {
+				searchIndex = core.SearchIndexMode(cfg.Create.SearchIndex)
+			}
+			sidecar, _ := cmd.Flags().GetBool("index-sidecar")
+			noIndex, _ := cmd.Flags().GetBool("no-search-index")
+			switch {
+			case sidecar && noIndex:
+				return fmt.Errorf("--index-sidecar and --no-search-index are mutually exclusive")
+			case sidecar:
+				searchIndex = core.SearchIndexSidecar
+			case noIndex:
+				searchIndex = core.SearchIndexNone
+			}
+
+			homeDir, err := os.UserHomeDir()
+			if err != nil {
+				return fmt.Errorf("failed to get user home directory: %w", err)
+			}
+			tokens, err := auth.NewTokenManager(homeDir, cfg.LicenseKey)
+			if err != nil {
+				return fmt.Errorf("failed to initialize token manager: %w", err)
+			}
+
+			indexKey, err := readIndexKey(cmd)
+			if err != nil {
+				return err
+			}
+			kdf, err := readKDFParams(cmd)
+			if err != nil {
+				return err
+			}
+			var passphrase []byte
+			encrypt, _ := cmd.Flags().GetBool("encrypt")
+			if !cmd.Flags().Changed("encrypt") && indexKey == nil {
+				encrypt = cfg.Create.Encrypt
+			}
+			// A passphrase on the command line is only ever given to be used. A dry run
+			// encrypts nothing, so it doesn't prompt for one.
+			if (encrypt || cmd.Flags().Changed("password")) && !dryRun {
+				if indexKey != nil {
+					return fmt.Errorf("--encrypt and --password are mutually exclusive with --index-key-file")
+				}
+				if passphrase, err = readPassphrase(cmd, true); err != nil {
+					return err
+				}
+			}
+
+			coreCfg := &core.Config{
+				LicenseKey:       cfg.LicenseKey,
+				IndexKey:         indexKey,
+				Passphrase:       passphrase,
+				KeyFile:          keyFilePath(cmd),
+				KDF:              kdf,
+				EncryptionAlgo:   cipherName,
+				Tokens:           tokens,
+				DefaultAlgo:      cfg.Create.Algorithm,
+				Creator:          creator,
+				Reproducible:     reproducible,
+				ExcludeVCS:       excludeVCS,
+				Exclude:          exclude,
+				NoDefaultIgnores: noDefaultIgnores,
+				KeepGoing:        keepGoing,
+				FollowSymlinks:   followSymlinks,
+				OnlyNewer:        onlyNewer,
+				SearchIndex:      searchIndex,
+				TempDir:          tempDir,
 
-			// Placeholder for core engine initialization
-			engine, err := core.NewEngine(&core.Config{}) // Config would be loaded from file
+				StoreExtensions:      storeExts,
+				ExtraStoreExtensions: extraStoreExts,
+				AdaptiveAlgo:         adaptive,
+				Dedup:                dedup,
+				Chunking:             chunking,
+				IndexCompression:     core.IndexCompressionMode(indexCompression),
+				GroupSmallFiles:      groupSmallFiles,
+				WindowLog:            windowLog,
+				LongDistance:         long,
+				CompressionLevel:     level,
+				TargetRate:           targetRate * 1e6,
+				Progress:             newProgressBar("Compressing"),
+			}
+			engine, err := core.NewEngine(coreCfg)
 			if err != nil {
 				return fmt.Errorf("failed to initialize core engine: %w", err)
 			}
+			if dryRun {
+				var inputs *core.InputSet
+				if filesFrom != "" {
+					var paths []string
+					if paths, err = readFileList(filesFrom, filesFrom0); err != nil {
+						return err
+					}
+					inputs, err = engine.CollectListedInputs(paths)
+				} else {
+					inputs, err = engine.CollectInputs(inputFiles)
+				}
+				if err != nil {
+					return err
+				}
+				est, err := engine.EstimateInputs(inputs)
+				if err != nil {
+					return err
+				}
+				return printer.Print(newDryRun(inputs, est), func(w io.Writer) error {
+					printDryRun(w, inputs, est)
+					return nil
+				})
+			}
+			if dictionary {
+				// The engine only reads its config once it is used, so the trained
+				// dictionary can still be set.
+				if coreCfg.Dictionary, err = engine.TrainDictionary(inputFiles); err != nil {
+					return fmt.Errorf("failed to train dictionary: %w", err)
+				}
+			}
 
 			logrus.WithFields(logrus.Fields{
 				"output": outputFile,
 				"inputs": len(inputFiles),
 			}).Info("Starting archive creation")
 
-			// Here you would initialize a progress bar.
-			// e.g., p := mpb.New( ... )
-			// bar := p.AddBar( ... )
-
-			if err := engine.Create(outputFile, inputFiles); err != nil {
-				// The actual implementation in engine.Create would update the progress bar.
+			var result *core.CreateResult
+			if fromArchive != "" {
+				result, err = engine.CreateFromArchive(outputFile, fromArchive)
+			} else if filesFrom != "" {
+				var paths []string
+				if paths, err = readFileList(filesFrom, filesFrom0); err != nil {
+					return err
+				}
+				result, err = engine.CreateFromList(outputFile, paths)
+			} else if len(inputFiles) == 1 && inputFiles[0] == "-" {
+				stdinName, _ := cmd.Flags().GetString("stdin-name")
+				result, err = engine.CreateFromReader(outputFile, stdinName, os.Stdin)
+			} else {
+				result, err = engine.Create(outputFile, inputFiles)
+			}
+			if err != nil {
 				return fmt.Errorf("archive creation failed: %w", err)
 			}
 
-			fmt.Println("Archive created successfully:", outputFile)
-			return nil
+			return printer.Print(result, func(w io.Writer) error {
+				fmt.Fprintln(w, "Archive created successfully:", outputFile)
+				printCreateResult(w, result)
+				return nil
+			})
 		},
 	}
+	cmd.Flags().Bool("dry-run", false, "List the files that would be archived and estimate the archive size, without writing it or spending tokens")
+	cmd.Flags().Bool("encrypt", false, "Encrypt the archive data and index with keys derived from a passphrase (see --password-file)")
+	cmd.Flags().String("cipher", core.CipherAES256GCM, "Cipher of the encrypted data: "+core.CipherAES256GCM+" or "+core.CipherChaCha20Poly1305+" (faster without AES hardware support)")
+	cmd.Flags().Uint8("kdf-time", core.DefaultKDFParams.Time, "Argon2id passes deriving the keys from the --encrypt passphrase; more is slower to brute-force and to open")
+	cmd.Flags().Uint16("kdf-memory", core.DefaultKDFParams.Memory, fmt.Sprintf("Argon2id memory in MiB deriving the keys from the --encrypt passphrase, at most %d; opening the archive needs as much", core.MaxKDFMemory))
+	cmd.Flags().Uint8("kdf-threads", core.DefaultKDFParams.Threads, "Argon2id parallelism deriving the keys from the --encrypt passphrase")
+	cmd.Flags().String("creator", "", "Optional label recorded in the archive metadata")
+	cmd.Flags().Bool("reproducible", false, "Omit host and user details from the archive metadata")
+	cmd.Flags().Bool("exclude-vcs", false, "Skip version-control directories (.git, .svn, .hg, ...)")
+	cmd.Flags().Bool("no-default-ignores", false, "Also archive OS artifacts such as .DS_Store and Thumbs.db")
+	addExcludeFlags(cmd)
+	cmd.Flags().Bool("keep-going", false, "Skip and report unreadable files instead of aborting")
+	cmd.Flags().Bool("follow-symlinks", false, "Archive the targets of symbolic links in input directories instead of skipping them")
+	cmd.Flags().String("only-newer", "", "Only include files modified after this archive's creation time or timestamp")
+	cmd.Flags().Bool("index-sidecar", false, "Write the search index to a separate <archive>"+core.SidecarExtension+" file, which is not encrypted (not allowed with encryption)")
+	cmd.Flags().Bool("no-search-index", false, "Do not build a search index")
+	cmd.Flags().Bool("group-small-files", false, "Compress small files together in shared frames to save space on many tiny files")
+	cmd.Flags().Int("window-log", 0, fmt.Sprintf("Use a 2^N byte zstd window (%d-%d) to find repetitions further apart; extracting needs as much memory (default: the level's window)", core.MinWindowLog, core.MaxWindowLog))
+	cmd.Flags().Bool("long", false, "Enable long-distance matching (128 MiB window unless --window-log is set) for redundancy spread far apart; compressing and extracting need that much more memory")
+	cmd.Flags().Bool("dictionary", false, "Train a zstd dictionary on samples of the inputs and compress with it, which helps archives of many small similar files")
+	cmd.Flags().String("level", "", "Compression level on the algorithm's own scale (zstd 1-22, gzip -2-9), or a zstd preset: fastest, default, better, best")
+	cmd.Flags().Float64("target-rate", 0, "Adapt the zstd level to keep compressing at this many MB/s, starting at --level and going lower while it can't keep up (0 to disable)")
+	cmd.Flags().String("index-compression", string(core.IndexCompressionAuto), "Compress the archive index: auto (large indexes only), always or never")
+	cmd.Flags().StringSlice("store-ext", core.DefaultStoreExtensions, "Extensions of already-compressed files to store without compression (replaces the list; empty to compress everything)")
+	cmd.Flags().StringSlice("store-ext-add", nil, "Extensions to store without compression in addition to --store-ext")
+	cmd.Flags().Bool("dedup", false, "Store the data of identical files once")
+	cmd.Flags().Bool("chunking", false, "Split large files into content-defined chunks and store repeated chunks once")
+	cmd.Flags().Bool("adaptive", false, "Choose each file's algorithm from a sample of its content: store compressed data, LZ4 for binaries, zstd at a higher level for text")
+	cmd.Flags().String("files-from", "", "Read the paths to archive from this file, one per line (- for standard input)")
+	cmd.Flags().Bool("files-from0", false, "The --files-from list is NUL-separated, as written by find -print0")
+	cmd.Flags().String("from-archive", "", "Import the files of this .tar, .tar.gz or .zip archive instead of files on disk")
+	cmd.Flags().String("stdin-name", "stdin", "File name recorded for standard input when the input is -")
+	cmd.Flags().String("temp-dir", os.Getenv(core.EnvTempDir), "Directory for temporary buffers (default $"+core.EnvTempDir+" or the system temp directory)")
+	return cmd
 }
 
 // createExtractCmd defines the 'extract' command.
 func createExtractCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "extract <archive.nsm> <destination_path>",
 		Short: "Extract files from a .nsm archive.",
-		Args:  cobra.ExactArgs(2),
+		Long: `Extract files from a .nsm archive.
+
+With --check, every file is decompressed and verified but nothing is written
+to disk, and no destination is needed. Use it to validate backups.
+
+With --list-only, the archive's contents are printed without extracting
+anything. Archives written with older index formats are supported.
+
+With --file, only that file is extracted, reading none of the others. It is
+written into the destination if that is a directory, and to the destination
+path otherwise.
+
+With --resume, files already in the destination with the right size and checksum,
+left by an interrupted extraction, are kept and only the others are extracted.
+
+With --to-tar, or a destination of "-", the files are written as a tar stream
+to the destination file, or to standard output for "-", instead of to disk:
+'nsm extract archive.nsm - | tar -x'.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			check, _ := cmd.Flags().GetBool("check")
+			listOnly, _ := cmd.Flags().GetBool("list-only")
+			if check || listOnly {
+				return cobra.ExactArgs(1)(cmd, args)
+			}
+			return cobra.ExactArgs(2)(cmd, args)
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// Placeholder for core engine logic
-			fmt.Println("Placeholder: Archive extraction logic goes here.")
-			return nil
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			indexKey, err := readIndexKey(cmd)
+			if err != nil {
+				return err
+			}
+			passphrase, err := archivePassphrase(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			engine, err := core.NewEngine(&core.Config{IndexKey: indexKey, Passphrase: passphrase, KeyFile: keyFilePath(cmd), Progress: newProgressBar("Extracting")})
+			if err != nil {
+				return fmt.Errorf("failed to initialize core engine: %w", err)
+			}
+
+			if check, _ := cmd.Flags().GetBool("check"); check {
+				return runExtractCheck(printer, engine, args[0])
+			}
+			if listOnly, _ := cmd.Flags().GetBool("list-only"); listOnly {
+				entries, err := engine.List(args[0])
+				if err != nil {
+					return fmt.Errorf("failed to list archive: %w", err)
+				}
+				return printer.Print(newListedFiles(entries), func(w io.Writer) error {
+					for _, entry := range entries {
+						fmt.Fprintf(w, "%12d  %s\n", entry.UncompressedSize, entry.Path)
+					}
+					return nil
+				})
+			}
+
+			if file, _ := cmd.Flags().GetString("file"); file != "" {
+				target := args[1]
+				if info, err := os.Stat(target); err == nil && info.IsDir() {
+					target = filepath.Join(target, path.Base(file))
+				}
+				if err := engine.ExtractFile(args[0], file, target); err != nil {
+					return fmt.Errorf("file extraction failed: %w", err)
+				}
+				out := map[string]interface{}{"archive": args[0], "file": file, "target": target}
+				return printer.Print(out, func(w io.Writer) error {
+					_, err := fmt.Fprintln(w, "File extracted successfully to", target)
+					return err
+				})
+			}
+			if toTar, _ := cmd.Flags().GetBool("to-tar"); toTar || args[1] == "-" {
+				return extractToTar(printer, engine, args[0], args[1])
+			}
+			extract := engine.Extract
+			if resume, _ := cmd.Flags().GetBool("resume"); resume {
+				extract = engine.ExtractResume
+			}
+			if err := extract(args[0], args[1]); err != nil {
+				return fmt.Errorf("archive extraction failed: %w", err)
+			}
+			out := map[string]interface{}{"archive": args[0], "destination": args[1]}
+			return printer.Print(out, func(w io.Writer) error {
+				_, err := fmt.Fprintln(w, "Archive extracted successfully to", args[1])
+				return err
+			})
 		},
 	}
+	cmd.Flags().Bool("check", false, "Verify every file by decompressing it, without writing anything to disk")
+	cmd.Flags().Bool("list-only", false, "List the archive's contents instead of extracting them")
+	cmd.Flags().String("file", "", "Extract only this file, given by its path in the archive")
+	cmd.Flags().Bool("to-tar", false, "Write the files as a tar stream to the destination (\"-\" for standard output)")
+	cmd.Flags().Bool("resume", false, "Continue an interrupted extraction: keep the files already extracted intact and extract the rest")
+	cmd.MarkFlagsMutuallyExclusive("check", "list-only", "file", "to-tar", "resume")
+	return cmd
 }
 
-// createSearchCmd defines the 'search' command.
-func createSearchCmd() *cobra.Command {
+// extractToTar writes the files of archive as a tar stream to dest, or to standard
+// output if dest is "-", in which case nothing else is printed there.
+func extractToTar(printer *Printer, engine *core.Engine, archive, dest string) error {
+	if dest == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		if err := engine.ExtractToTar(archive, w); err != nil {
+			return fmt.Errorf("archive extraction failed: %w", err)
+		}
+		return w.Flush()
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dest, err)
+	}
+	if err := engine.ExtractToTar(archive, f); err != nil {
+		f.Close()
+		os.Remove(dest)
+		return fmt.Errorf("archive extraction failed: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dest, err)
+	}
+	out := map[string]interface{}{"archive": archive, "destination": dest}
+	return printer.Print(out, func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, "Archive extracted to tar file", dest)
+		return err
+	})
+}
+
+// createListCmd defines the 'list' command.
+func createListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list <archive.nsm>",
+		Short: "List the files of a .nsm archive without extracting them.",
+		Long: `List the files of an archive with their sizes and modification times, reading
+only its header and index. Grouped small files show the size of the frame they
+share. With --output json the list is printed as a JSON array. No token is consumed.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			indexKey, err := readIndexKey(cmd)
+			if err != nil {
+				return err
+			}
+			passphrase, err := archivePassphrase(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			engine, err := core.NewEngine(&core.Config{IndexKey: indexKey, Passphrase: passphrase})
+			if err != nil {
+				return fmt.Errorf("failed to initialize core engine: %w", err)
+			}
+
+			entries, err := engine.List(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to list archive: %w", err)
+			}
+			return printer.Print(newListedFiles(entries), func(w io.Writer) error {
+				return printFileList(w, entries)
+			})
+		},
+	}
+	cmd.Flags().Bool("json", false, "Print the list as JSON, like --output json")
+	return cmd
+}
+
+// listedFile is the JSON form of an archived file printed by 'list'.
+type listedFile struct {
+	Path             string    `json:"path"`
+	UncompressedSize int64     `json:"uncompressed_size"`
+	CompressedSize   int64     `json:"compressed_size"`
+	ModTime          time.Time `json:"mod_time"`
+	Mode             string    `json:"mode"`
+	Checksum         string    `json:"checksum,omitempty"` // Hex SHA-256; empty for older archives.
+}
+
+// newListedFiles returns the JSON form of entries.
+func newListedFiles(entries []core.FileMetadata) []listedFile {
+	listed := make([]listedFile, len(entries))
+	for i, entry := range entries {
+		listed[i] = newListedFile(entry)
+	}
+	return listed
+}
+
+func newListedFile(entry core.FileMetadata) listedFile {
+	f := listedFile{
+		Path:             entry.Path,
+		UncompressedSize: entry.UncompressedSize,
+		CompressedSize:   entry.CompressedSize,
+		ModTime:          entry.ModTime,
+		Mode:             os.FileMode(entry.Mode).String(),
+	}
+	if entry.Checksum != ([32]byte{}) {
+		f.Checksum = hex.EncodeToString(entry.Checksum[:])
+	}
+	return f
+}
+
+// printFileList prints archived files as a table with a total.
+func printFileList(w io.Writer, entries []core.FileMetadata) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "SIZE\tCOMPRESSED\tMODIFIED\t\tPATH")
+	var total int64
+	for _, entry := range entries {
+		fmt.Fprintf(tw, "%d\t%d\t%s\t\t%s\n", entry.UncompressedSize, entry.CompressedSize, entry.ModTime.Local().Format("2006-01-02 15:04"), entry.Path)
+		total += entry.UncompressedSize
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d file(s), %d bytes\n", len(entries), total)
+	return err
+}
+
+// createInfoCmd defines the 'info' command.
+func createInfoCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "info <archive.nsm>",
+		Aliases: []string{"stat"},
+		Short:   "Show the format, compression and sizes of a .nsm archive.",
+		Long: `Show archive-level details: format version, compression algorithm and level,
+encryption, file count, total sizes, compression ratio and creation time. Only
+the header and index are read, and no token is consumed.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			indexKey, err := readIndexKey(cmd)
+			if err != nil {
+				return err
+			}
+			passphrase, err := archivePassphrase(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			engine, err := core.NewEngine(&core.Config{IndexKey: indexKey, Passphrase: passphrase})
+			if err != nil {
+				return fmt.Errorf("failed to initialize core engine: %w", err)
+			}
+
+			info, err := engine.Info(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to read archive: %w", err)
+			}
+			return printer.Print(info, func(w io.Writer) error {
+				return printArchiveInfo(w, info)
+			})
+		},
+	}
+	cmd.Flags().Bool("json", false, "Print the details as JSON, like --output json")
+	return cmd
+}
+
+// printArchiveInfo prints archive details as aligned "name: value" lines.
+func printArchiveInfo(w io.Writer, info *core.ArchiveInfo) error {
+	level := "default"
+	if info.Level != core.DefaultLevel {
+		level = strconv.Itoa(info.Level)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "Format version:\t%d\n", info.FormatVersion)
+	fmt.Fprintf(tw, "Compression:\t%s (level %s)\n", info.Compression, level)
+	fmt.Fprintf(tw, "Encryption:\t%s\n", info.Encryption)
+	fmt.Fprintf(tw, "Index encrypted:\t%t\n", info.IndexEncrypted)
+	fmt.Fprintf(tw, "Files:\t%d\n", info.Files)
+	fmt.Fprintf(tw, "Uncompressed size:\t%d bytes (%s)\n", info.UncompressedSize, formatSize(info.UncompressedSize))
+	fmt.Fprintf(tw, "Compressed size:\t%d bytes (%s)\n", info.CompressedSize, formatSize(info.CompressedSize))
+	fmt.Fprintf(tw, "Ratio:\t%.3f\n", info.Ratio)
+	if info.DictionarySize > 0 {
+		fmt.Fprintf(tw, "Dictionary:\t%d bytes\n", info.DictionarySize)
+	}
+	fmt.Fprintf(tw, "Created:\t%s\n", info.Created.Local().Format(time.RFC3339))
+	if meta := info.Metadata; meta != nil {
+		fmt.Fprintf(tw, "Created by:\tnsm %s (%s/%s)\n", meta.ToolVersion, meta.OS, meta.Arch)
+		if meta.Creator != "" {
+			fmt.Fprintf(tw, "Creator:\t%s\n", meta.Creator)
+		}
+	}
+	return tw.Flush()
+}
+
+// createUpgradeCmd defines the 'upgrade' command.
+func createUpgradeCmd() *cobra.Command {
 	return &cobra.Command{
-		Use:   "search <archive.nsm> <query>",
-		Short: "Perform a full-text search within a .nsm archive.",
-		Args:  cobra.ExactArgs(2),
+		Use:   "upgrade <archive.nsm>",
+		Short: "Rewrite an archive's index in the current format.",
+		Long: `Rewrite the index of an archive created by an older version of nsm in the
+current format. The compressed data is left untouched and no token is used.`,
+		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// Placeholder for core engine logic
-			fmt.Println("Placeholder: Full-text search logic goes here.")
-			return nil
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			indexKey, err := readIndexKey(cmd)
+			if err != nil {
+				return err
+			}
+			passphrase, err := archivePassphrase(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			engine, err := core.NewEngine(&core.Config{IndexKey: indexKey, Passphrase: passphrase})
+			if err != nil {
+				return fmt.Errorf("failed to initialize core engine: %w", err)
+			}
+
+			upgraded, err := engine.Upgrade(args[0])
+			if err != nil {
+				return fmt.Errorf("archive upgrade failed: %w", err)
+			}
+			out := map[string]interface{}{"archive": args[0], "upgraded": upgraded, "format_version": core.FormatVersion}
+			return printer.Print(out, func(w io.Writer) error {
+				if upgraded {
+					fmt.Fprintln(w, "Archive upgraded to format version", core.FormatVersion)
+				} else {
+					fmt.Fprintln(w, "Archive is already in the current format")
+				}
+				return nil
+			})
 		},
 	}
 }
 
-// createBuyTokensCmd defines the 'buy-tokens' command.
-func createBuyTokensCmd() *cobra.Command {
+// createMigrateCmd defines the 'migrate' command.
+func createMigrateCmd() *cobra.Command {
 	return &cobra.Command{
-		Use:   "buy-tokens <count>",
-		Short: "Purchase more compression tokens from the marketplace.",
-		Args:  cobra.ExactArgs(1),
+		Use:   "migrate <old.nsm> <new.nsm>",
+		Short: "Write a copy of an archive in the current format.",
+		Long: `Write a copy of an archive created by any supported version of nsm in the
+current format, leaving the original as it is. The compressed data is copied
+untouched and no token is used.`,
+		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			count, err := strconv.Atoi(args[0])
-			if err != nil || count <= 0 {
-				return fmt.Errorf("invalid token count: must be a positive number")
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			indexKey, err := readIndexKey(cmd)
+			if err != nil {
+				return err
+			}
+			passphrase, err := archivePassphrase(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			engine, err := core.NewEngine(&core.Config{IndexKey: indexKey, Passphrase: passphrase})
+			if err != nil {
+				return fmt.Errorf("failed to initialize core engine: %w", err)
 			}
 
-			// In a real app, baseURL and apiKey would come from config.
-			marketplaceURL := "http://localhost:8080"
-			apiKey, _ := cmd.Flags().GetString("license-key")
-			if apiKey == "" {
-				return fmt.Errorf("a license key is required to buy tokens. Use --license-key")
+			if err := engine.Migrate(args[0], args[1]); err != nil {
+				return fmt.Errorf("archive migration failed: %w", err)
 			}
-			
-			client := auth.NewMarketplaceClient(marketplaceURL, apiKey)
-			
-			fmt.Printf("Attempting to purchase %d token(s)...\n", count)
-			resp, err := client.InitiatePurchase(count)
+			out := map[string]interface{}{"archive": args[1], "source": args[0], "format_version": core.FormatVersion}
+			return printer.Print(out, func(w io.Writer) error {
+				_, err := fmt.Fprintf(w, "Archive written to %s in format version %d\n", args[1], core.FormatVersion)
+				return err
+			})
+		},
+	}
+}
+
+// createRecompressCmd defines the 'recompress' command.
+func createRecompressCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "recompress <archive.nsm>",
+		Short: "Recompress an archive's data with another algorithm or level.",
+		Long: `Decompress and recompress the data of an archive in place with new settings,
+for example to move an old gzip archive to zstd without extracting and recreating
+it. The archive's files and metadata are unchanged, and no token is used.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
 			if err != nil {
-				return fmt.Errorf("could not initiate purchase: %w", err)
+				return err
+			}
+			algo, _ := cmd.Flags().GetString("algo")
+			level, err := compressionLevelFlag(cmd)
+			if err != nil {
+				return err
+			}
+			windowLog, _ := cmd.Flags().GetInt("window-log")
+			long, _ := cmd.Flags().GetBool("long")
+			indexKey, err := readIndexKey(cmd)
+			if err != nil {
+				return err
+			}
+			passphrase, err := archivePassphrase(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			engine, err := core.NewEngine(&core.Config{
+				IndexKey:     indexKey,
+				Passphrase:   passphrase,
+				KeyFile:      keyFilePath(cmd),
+				WindowLog:    windowLog,
+				LongDistance: long,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to initialize core engine: %w", err)
 			}
 
-			fmt.Println("\n--- Please complete your payment ---")
-			fmt.Printf("Open this URL in your browser:\n%s\n\n", resp.PaymentURL)
-			fmt.Println("After payment, your new tokens will be synced automatically.")
-			return nil
+			if err := engine.Recompress(args[0], core.CompressionType(strings.ToLower(algo)), level); err != nil {
+				return fmt.Errorf("archive recompression failed: %w", err)
+			}
+			out := map[string]interface{}{"archive": args[0], "algorithm": strings.ToLower(algo), "level": level}
+			return printer.Print(out, func(w io.Writer) error {
+				_, err := fmt.Fprintln(w, "Archive recompressed:", args[0])
+				return err
+			})
 		},
 	}
+	cmd.Flags().String("algo", string(core.ZSTD), "Compression algorithm: zstd, gzip, lz4 or store")
+	cmd.Flags().String("level", "", "Compression level on the algorithm's own scale (zstd 1-22, gzip -2-9), or a zstd preset: fastest, default, better, best")
+	cmd.Flags().Int("window-log", 0, fmt.Sprintf("Use a 2^N byte zstd window (%d-%d)", core.MinWindowLog, core.MaxWindowLog))
+	cmd.Flags().Bool("long", false, "Enable long-distance matching (128 MiB window unless --window-log is set)")
+	return cmd
 }
 
-// createServerCmd defines the 'server' command.
-func createServerCmd() *cobra.Command {
+// createRemoveCmd defines the 'remove' command.
+func createRemoveCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "server",
-		Short: "Run the web server for the marketplace and API.",
+		Use:   "remove <archive.nsm> <file>...",
+		Short: "Remove files from an archive.",
+		Long: `Remove files, given by their paths in the archive, and rewrite the archive in
+place without their data. The other files are copied without being recompressed,
+and no token is used.`,
+		Args: cobra.MinimumNArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			port, _ := cmd.Flags().GetInt("port")
-			
-			logrus.WithField("port", port).Info("Starting NSM API server...")
-			
-			// Initialize the server
-			server, err := api.NewServer()
+			printer, err := newPrinter(cmd)
 			if err != nil {
-				return fmt.Errorf("failed to initialize server: %w", err)
+				return err
 			}
-			
-			// Start listening
-			return server.Run(fmt.Sprintf(":%d", port))
+			indexKey, err := readIndexKey(cmd)
+			if err != nil {
+				return err
+			}
+			passphrase, err := archivePassphrase(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			engine, err := core.NewEngine(&core.Config{
+				IndexKey:   indexKey,
+				Passphrase: passphrase,
+				KeyFile:    keyFilePath(cmd),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to initialize core engine: %w", err)
+			}
+
+			if err := engine.Remove(args[0], args[1:]); err != nil {
+				return fmt.Errorf("removing files failed: %w", err)
+			}
+			out := map[string]interface{}{"archive": args[0], "removed": args[1:]}
+			return printer.Print(out, func(w io.Writer) error {
+				_, err := fmt.Fprintf(w, "Removed %d file(s) from %s\n", len(args)-1, args[0])
+				return err
+			})
 		},
 	}
-	cmd.Flags().IntP("port", "p", 8080, "Port to run the server on")
+	return cmd
+}
+
+// createRewrapIndexCmd defines the 'rewrap-index' command.
+func createRewrapIndexCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rewrap-index <archive.nsm>",
+		Short: "Re-encrypt an archive's index with a new key.",
+		Long: `Re-encrypt the index of an archive, which holds its file names and other
+metadata, without touching the compressed data. This is fast whatever the archive
+size. Without --old-key-file the index is read unencrypted, or with the passphrase
+of an archive created with --encrypt; without --new-key-file it is stored
+unencrypted.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			var oldKey, newKey []byte
+			if path, _ := cmd.Flags().GetString("old-key-file"); path != "" {
+				if oldKey, err = readKeyFile(path); err != nil {
+					return err
+				}
+			}
+			if path, _ := cmd.Flags().GetString("new-key-file"); path != "" {
+				if newKey, err = readKeyFile(path); err != nil {
+					return err
+				}
+			}
+
+			var passphrase []byte
+			if oldKey == nil {
+				if passphrase, err = archivePassphrase(cmd, args[0]); err != nil {
+					return err
+				}
+			}
+
+			engine, err := core.NewEngine(&core.Config{Passphrase: passphrase})
+			if err != nil {
+				return fmt.Errorf("failed to initialize core engine: %w", err)
+			}
+			if err := engine.RewrapIndex(args[0], oldKey, newKey); err != nil {
+				return fmt.Errorf("failed to rewrap index: %w", err)
+			}
+			out := map[string]interface{}{"archive": args[0], "index_encrypted": newKey != nil}
+			return printer.Print(out, func(w io.Writer) error {
+				_, err := fmt.Fprintln(w, "Archive index rewrapped:", args[0])
+				return err
+			})
+		},
+	}
+	cmd.Flags().String("old-key-file", "", "File holding the current index key")
+	cmd.Flags().String("new-key-file", "", "File holding the new index key")
+	return cmd
+}
+
+// createVerifyCmd defines the 'verify' command.
+func createVerifyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify <archive.nsm|->",
+		Short: "Verify the integrity of a .nsm archive.",
+		Long: `Verify the data checksum of an archive and decompress every file to check it.
+With --output json the outcome is printed as a JSON object for use by backup tooling.
+
+With - the archive is read from standard input in a single pass, for example
+'curl ... | nsm verify -'. Files are not decompressed in that mode, because their
+boundaries are only known once the index at the end of the stream has been read.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			indexKey, err := readIndexKey(cmd)
+			if err != nil {
+				return err
+			}
+			passphrase, err := archivePassphrase(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			engine, err := core.NewEngine(&core.Config{IndexKey: indexKey, Passphrase: passphrase, KeyFile: keyFilePath(cmd)})
+			if err != nil {
+				return fmt.Errorf("failed to initialize core engine: %w", err)
+			}
+
+			if args[0] == "-" {
+				err := engine.VerifyStream(bufio.NewReader(os.Stdin))
+				out := map[string]interface{}{"ok": err == nil}
+				if err != nil {
+					out["error"] = err.Error()
+				}
+				printErr := printer.Print(out, func(w io.Writer) error {
+					if err == nil {
+						fmt.Fprintln(w, "Archive stream OK (files not decompressed)")
+					}
+					return nil
+				})
+				if err != nil {
+					return fmt.Errorf("verification failed: %w", err)
+				}
+				return printErr
+			}
+
+			result, err := engine.VerifyDetailed(args[0])
+			if err != nil {
+				return fmt.Errorf("verification failed: %w", err)
+			}
+			if err := printer.Print(result, func(w io.Writer) error {
+				printVerifyResult(w, result)
+				return nil
+			}); err != nil {
+				return err
+			}
+			if !result.OK {
+				return fmt.Errorf("archive verification failed")
+			}
+			return nil
+		},
+	}
+	cmd.Flags().Bool("json", false, "Print the verification result as JSON, like --output json")
+	return cmd
+}
+
+// printVerifyResult prints a human-readable verification report to w.
+func printVerifyResult(w io.Writer, result *core.VerifyResult) {
+	if result.ChecksumOK {
+		fmt.Fprintln(w, "Data checksum OK")
+	} else {
+		fmt.Fprintln(w, "Data checksum MISMATCH")
+	}
+	for _, f := range result.Files {
+		if f.OK {
+			fmt.Fprintf(w, "OK      %s (%d bytes)\n", f.Path, f.Size)
+		} else {
+			fmt.Fprintf(w, "FAILED  %s: %s\n", f.Path, f.Error)
+		}
+	}
+	status := "all OK"
+	if !result.OK {
+		status = "verification FAILED"
+	}
+	fmt.Fprintf(w, "\n%d file(s), %d bytes verified in %s, %s\n", len(result.Files), result.BytesVerified, result.Duration.Round(time.Millisecond), status)
+}
+
+func createCompareCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "compare <archive.nsm> <dir>",
+		Short: "Check a directory against the files of an archive.",
+		Long: `Compare the files below a directory with an archive, for example to confirm a
+restore or to see what changed since a backup. Files are compared by size and
+checksum; only the archive's index is read. Files missing from the directory,
+extra files and differing files are reported, and the command fails if there
+are any. With --output json the result is printed as a JSON object.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			excludeVCS, _ := cmd.Flags().GetBool("exclude-vcs")
+			noDefaultIgnores, _ := cmd.Flags().GetBool("no-default-ignores")
+			indexKey, err := readIndexKey(cmd)
+			if err != nil {
+				return err
+			}
+			passphrase, err := archivePassphrase(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			engine, err := core.NewEngine(&core.Config{
+				IndexKey:         indexKey,
+				Passphrase:       passphrase,
+				KeyFile:          keyFilePath(cmd),
+				ExcludeVCS:       excludeVCS,
+				NoDefaultIgnores: noDefaultIgnores,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to initialize core engine: %w", err)
+			}
+
+			result, err := engine.Compare(args[0], args[1])
+			if err != nil {
+				return fmt.Errorf("comparison failed: %w", err)
+			}
+			if err := printer.Print(result, func(w io.Writer) error {
+				printCompareResult(w, result)
+				return nil
+			}); err != nil {
+				return err
+			}
+			if !result.Equal() {
+				return fmt.Errorf("directory differs from archive")
+			}
+			return nil
+		},
+	}
+	cmd.Flags().Bool("json", false, "Print the comparison result as JSON, like --output json")
+	cmd.Flags().Bool("exclude-vcs", false, "Don't report version-control directories as extra")
+	cmd.Flags().Bool("no-default-ignores", false, "Also report OS artifacts such as .DS_Store as extra")
+	return cmd
+}
+
+// createWatchCmd defines the 'watch' command.
+func createWatchCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch <output.nsm> <input_files...>",
+		Short: "Keep an archive up to date with its inputs.",
+		Long: `Check the inputs every --interval and rebuild the archive when the content of a
+file changed, like 'nsm create' does, until interrupted. Each rebuild costs
+tokens. Files that were only touched are hashed and compared with the previous
+build, kept in <output.nsm>` + core.WatchCacheExtension + `, and don't trigger a rebuild.`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			interval, _ := cmd.Flags().GetDuration("interval")
+			if interval <= 0 {
+				return fmt.Errorf("--interval must be positive")
+			}
+			excludeVCS, _ := cmd.Flags().GetBool("exclude-vcs")
+			exclude, err := excludePatterns(cmd)
+			if err != nil {
+				return err
+			}
+			cfg, err := loadConfig(cmd)
+			if err != nil {
+				return err
+			}
+			homeDir, err := os.UserHomeDir()
+			if err != nil {
+				return fmt.Errorf("failed to get user home directory: %w", err)
+			}
+			tokens, err := auth.NewTokenManager(homeDir, cfg.LicenseKey)
+			if err != nil {
+				return fmt.Errorf("failed to initialize token manager: %w", err)
+			}
+			engine, err := core.NewEngine(&core.Config{
+				LicenseKey:  cfg.LicenseKey,
+				Tokens:      tokens,
+				DefaultAlgo: cfg.Create.Algorithm,
+				Creator:     cfg.Create.Creator,
+				ExcludeVCS:  excludeVCS || cfg.Create.ExcludeVCS,
+				Exclude:     exclude,
+				TempDir:     cfg.TempDir,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to initialize core engine: %w", err)
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer stop()
+			out := map[string]interface{}{"archive": args[0], "inputs": args[1:], "interval": interval.String()}
+			if err := printer.Print(out, func(w io.Writer) error {
+				_, err := fmt.Fprintf(w, "Watching %d input(s) for %s; press Ctrl+C to stop\n", len(args)-1, args[0])
+				return err
+			}); err != nil {
+				return err
+			}
+			return engine.Watch(ctx, args[0], args[1:], interval)
+		},
+	}
+	cmd.Flags().Duration("interval", 2*time.Second, "How often to check the inputs for changes")
+	cmd.Flags().Bool("exclude-vcs", false, "Skip version-control directories (.git, .svn, .hg, ...)")
+	addExcludeFlags(cmd)
+	return cmd
+}
+
+// printCompareResult prints every difference found by compare and a summary to w.
+func printCompareResult(w io.Writer, result *core.CompareResult) {
+	for _, p := range result.Missing {
+		fmt.Fprintf(w, "MISSING  %s\n", p)
+	}
+	for _, p := range result.Extra {
+		fmt.Fprintf(w, "EXTRA    %s\n", p)
+	}
+	for _, d := range result.Differing {
+		fmt.Fprintf(w, "DIFFERS  %s (%s)\n", d.Path, d.Reason)
+	}
+	fmt.Fprintf(w, "%d matching, %d missing, %d extra, %d differing\n",
+		result.Matching, len(result.Missing), len(result.Extra), len(result.Differing))
+}
+
+// checkedFile is the JSON form of a file checked by 'extract --check'.
+type checkedFile struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+}
+
+// runExtractCheck prints the per-file results of a deep integrity check and a summary.
+func runExtractCheck(printer *Printer, engine *core.Engine, archiveFile string) error {
+	results, err := engine.CheckArchive(archiveFile)
+	if results == nil && err != nil {
+		return fmt.Errorf("archive check failed: %w", err)
+	}
+
+	files := make([]checkedFile, len(results))
+	for i, res := range results {
+		files[i] = checkedFile{Path: res.Path, Size: res.Size}
+		if res.Err != nil {
+			files[i].Error = res.Err.Error()
+		}
+	}
+	out := map[string]interface{}{"ok": err == nil, "files": files}
+	if printErr := printer.Print(out, func(w io.Writer) error {
+		for _, res := range results {
+			if res.Err != nil {
+				fmt.Fprintf(w, "FAILED  %s: %v\n", res.Path, res.Err)
+			} else {
+				fmt.Fprintf(w, "OK      %s (%d bytes)\n", res.Path, res.Size)
+			}
+		}
+		fmt.Fprintf(w, "\n%d file(s) checked", len(results))
+		if err != nil {
+			fmt.Fprintln(w, ", verification FAILED")
+		} else {
+			fmt.Fprintln(w, ", all OK")
+		}
+		return nil
+	}); printErr != nil {
+		return printErr
+	}
+	return err
+}
+
+// createSearchCmd defines the 'search' command.
+func createSearchCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "search <archive.nsm> <query>",
+		Short: "Perform a full-text search within a .nsm archive.",
+		Long: `Search the files of an archive for all the words of a query and print the
+matching lines. --format selects the output:
+
+  text   matching files, each followed by its matching lines (default)
+  grep   one path:line:text line per match, for editors and scripts
+  jsonl  one JSON object per match, with the byte ranges of the matched words
+
+In the text format, matched words are highlighted when --color is enabled. With
+--output json the matches are printed as a single JSON array instead.
+
+Archives created without a search index are searched by decompressing every file,
+which can be slow. --require-index fails on them instead, and --verbose reports on
+standard error whether the index was used and how many files were decompressed.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			format, _ := cmd.Flags().GetString("format")
+			colorMode, _ := cmd.Flags().GetString("color")
+			if format != "text" && format != "grep" && format != "jsonl" {
+				return fmt.Errorf("unknown --format %q (want text, grep or jsonl)", format)
+			}
+			if printer.JSON() && cmd.Flags().Changed("format") {
+				return fmt.Errorf("--format cannot be combined with --output %s", OutputJSON)
+			}
+			var color bool
+			switch colorMode {
+			case "always":
+				color = true
+			case "auto":
+				color = os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+			case "never":
+			default:
+				return fmt.Errorf("unknown --color %q (want auto, always or never)", colorMode)
+			}
+
+			indexKey, err := readIndexKey(cmd)
+			if err != nil {
+				return err
+			}
+			passphrase, err := archivePassphrase(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			requireIndex, _ := cmd.Flags().GetBool("require-index")
+			engine, err := core.NewEngine(&core.Config{IndexKey: indexKey, Passphrase: passphrase, KeyFile: keyFilePath(cmd), RequireSearchIndex: requireIndex})
+			if err != nil {
+				return fmt.Errorf("failed to initialize core engine: %w", err)
+			}
+
+			matches, skipped, stats, err := engine.SearchLinesWithStats(args[0], args[1])
+			if err != nil {
+				return fmt.Errorf("search failed: %w", err)
+			}
+			if matches == nil {
+				matches = []core.LineMatch{}
+			}
+			if err := printer.Print(matches, func(w io.Writer) error {
+				return writeSearchMatches(w, matches, format, color)
+			}); err != nil {
+				return err
+			}
+			if verbose, _ := cmd.Flags().GetBool("verbose"); verbose {
+				if err := writeSearchStats(os.Stderr, stats, format); err != nil {
+					return err
+				}
+			}
+			if len(skipped) > 0 {
+				fmt.Fprintf(os.Stderr, "Warning: %d file(s) could not be searched:\n", len(skipped))
+				for _, f := range skipped {
+					fmt.Fprintf(os.Stderr, "  %s: %v\n", f.Path, f.Err)
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().String("format", "text", "Output format: text, grep (path:line:text) or jsonl (one JSON object per match)")
+	cmd.Flags().String("color", "auto", "Highlight matches in the text format: auto (on a terminal, unless $NO_COLOR is set), always or never")
+	cmd.Flags().Bool("require-index", false, "Fail on archives without a search index instead of decompressing every file")
+	cmd.Flags().BoolP("verbose", "v", false, "Report on standard error whether the search index was used and how many files were decompressed (as JSON with --format jsonl)")
+	return cmd
+}
+
+// createExtractMatchingCmd defines the 'extract-matching' command.
+func createExtractMatchingCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "extract-matching <archive.nsm> <destination_path> <query>",
+		Short: "Extract only the files of an archive that match a search query.",
+		Long: `Search an archive as 'nsm search' does and extract only the files containing
+all the words of the query, for example to pull the relevant logs out of a large
+archive. Only those files are read and decompressed.`,
+		Args: cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			indexKey, err := readIndexKey(cmd)
+			if err != nil {
+				return err
+			}
+			passphrase, err := archivePassphrase(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			engine, err := core.NewEngine(&core.Config{IndexKey: indexKey, Passphrase: passphrase, KeyFile: keyFilePath(cmd)})
+			if err != nil {
+				return fmt.Errorf("failed to initialize core engine: %w", err)
+			}
+
+			extracted, skipped, err := engine.ExtractMatching(args[0], args[1], args[2])
+			if err != nil {
+				return fmt.Errorf("extraction failed: %w", err)
+			}
+			if len(skipped) > 0 {
+				fmt.Fprintf(os.Stderr, "Warning: %d file(s) could not be searched:\n", len(skipped))
+				for _, f := range skipped {
+					fmt.Fprintf(os.Stderr, "  %s: %v\n", f.Path, f.Err)
+				}
+			}
+			if extracted == nil {
+				extracted = []string{}
+			}
+			out := map[string]interface{}{"archive": args[0], "destination": args[1], "extracted": extracted}
+			return printer.Print(out, func(w io.Writer) error {
+				if len(extracted) == 0 {
+					fmt.Fprintln(w, "No matches found.")
+					return nil
+				}
+				for _, p := range extracted {
+					fmt.Fprintln(w, p)
+				}
+				fmt.Fprintf(w, "%d matching file(s) extracted to %s\n", len(extracted), args[1])
+				return nil
+			})
+		},
+	}
+}
+
+// ANSI escapes highlighting matched words.
+const (
+	highlightStart = "\x1b[1;31m"
+	highlightEnd   = "\x1b[0m"
+)
+
+// writeSearchMatches prints search matches to w in the given format.
+func writeSearchMatches(w io.Writer, matches []core.LineMatch, format string, color bool) error {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case "jsonl":
+		enc := json.NewEncoder(bw)
+		for _, m := range matches {
+			if err := enc.Encode(m); err != nil {
+				return fmt.Errorf("failed to write JSON output: %w", err)
+			}
+		}
+	case "grep":
+		for _, m := range matches {
+			fmt.Fprintf(bw, "%s:%d:%s\n", m.Path, m.Line, m.Text)
+		}
+	default:
+		if len(matches) == 0 {
+			fmt.Fprintln(bw, "No matches found.")
+		}
+		for i, m := range matches {
+			if i == 0 || matches[i-1].Path != m.Path {
+				fmt.Fprintln(bw, m.Path)
+			}
+			text := m.Text
+			if color {
+				text = highlight(m.Text, m.Spans)
+			}
+			fmt.Fprintf(bw, "%6d: %s\n", m.Line, text)
+		}
+	}
+	return bw.Flush()
+}
+
+// writeSearchStats reports how a search was carried out to w, as a JSON object for the
+// jsonl format and as a sentence otherwise.
+func writeSearchStats(w io.Writer, stats core.SearchStats, format string) error {
+	if format == "jsonl" {
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			return fmt.Errorf("failed to write JSON output: %w", err)
+		}
+		return nil
+	}
+	how := "the search index"
+	if stats.Method == core.SearchMethodScan {
+		how = "a full scan (the archive has no search index)"
+	}
+	_, err := fmt.Fprintf(w, "Searched with %s; %d file(s) decompressed\n", how, stats.FilesDecompressed)
+	return err
+}
+
+// highlight wraps the spans of text in highlighting escapes.
+func highlight(text string, spans []core.Span) string {
+	var b strings.Builder
+	last := 0
+	for _, sp := range spans {
+		b.WriteString(text[last:sp.Start])
+		b.WriteString(highlightStart)
+		b.WriteString(text[sp.Start:sp.End])
+		b.WriteString(highlightEnd)
+		last = sp.End
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// createBuyTokensCmd defines the 'buy-tokens' command.
+func createBuyTokensCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "buy-tokens <count>",
+		Short: "Purchase more compression tokens from the marketplace.",
+		Long: `Purchase more compression tokens from the marketplace.
+
+The order is remembered until it is paid or cancelled, so an interrupted purchase is
+never orphaned: while it is pending, run with --resume to wait for its payment or with
+--cancel to cancel it before buying again.`,
+		Args: cobra.RangeArgs(0, 1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			resume, _ := cmd.Flags().GetBool("resume")
+			cancel, _ := cmd.Flags().GetBool("cancel")
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			if resume && cancel {
+				return fmt.Errorf("--resume and --cancel are mutually exclusive")
+			}
+
+			cfg, err := loadConfig(cmd)
+			if err != nil {
+				return err
+			}
+			apiKey, _ := cmd.Flags().GetString("license-key")
+			if apiKey == "" {
+				apiKey = cfg.LicenseKey
+			}
+			if apiKey == "" {
+				return fmt.Errorf("a license key is required to buy tokens. Use --license-key")
+			}
+			homeDir, err := os.UserHomeDir()
+			if err != nil {
+				return fmt.Errorf("failed to get user home directory: %w", err)
+			}
+			tokens, err := auth.NewTokenManager(homeDir, apiKey)
+			if err != nil {
+				return fmt.Errorf("failed to initialize token manager: %w", err)
+			}
+			client, err := newMarketplaceClient(cfg, marketplaceURL(cfg), apiKey, tokens)
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case cancel:
+				pending := tokens.PendingOrder()
+				if pending == nil {
+					return printNoPendingOrder(printer)
+				}
+				if err := client.CancelPendingOrder(tokens); err != nil {
+					return fmt.Errorf("could not cancel order %s: %w", pending.OrderID, err)
+				}
+				out := auth.OrderStatus{OrderID: pending.OrderID, Status: auth.OrderCancelled, TokenCount: pending.TokenCount}
+				return printer.Print(out, func(w io.Writer) error {
+					_, err := fmt.Fprintln(w, "Cancelled order", pending.OrderID)
+					return err
+				})
+			case resume:
+				return waitForOrder(printer, client, tokens, timeout)
+			}
+
+			if len(args) != 1 {
+				return fmt.Errorf("a token count is required")
+			}
+			count, err := strconv.Atoi(args[0])
+			if err != nil || count <= 0 {
+				return fmt.Errorf("invalid token count: must be a positive number")
+			}
+
+			printer.Textf("Attempting to purchase %d token(s)...", count)
+			order, err := client.StartPurchase(tokens, count)
+			if errors.Is(err, auth.ErrPendingOrder) {
+				return fmt.Errorf("%w\nRun 'nsm buy-tokens --resume' to wait for its payment or 'nsm buy-tokens --cancel' to cancel it", err)
+			}
+			if err != nil {
+				return fmt.Errorf("could not initiate purchase: %w", err)
+			}
+
+			return printer.Print(tokens.PendingOrder(), func(w io.Writer) error {
+				fmt.Fprintln(w, "\n--- Please complete your payment ---")
+				fmt.Fprintf(w, "Open this URL in your browser:\n%s\n\n", order.PaymentURL)
+				fmt.Fprintln(w, "After payment, run 'nsm buy-tokens --resume' to sync your new tokens.")
+				return nil
+			})
+		},
+	}
+	cmd.Flags().Bool("resume", false, "Wait for the pending order to be paid and sync the new tokens")
+	cmd.Flags().Bool("cancel", false, "Cancel the pending order")
+	cmd.Flags().Duration("timeout", 5*time.Minute, "How long --resume waits for the payment")
+	cmd.Flags().String("license-key", "", "License key to buy tokens for (default from the config file)")
+	return cmd
+}
+
+// createTokensCmd defines the 'tokens' command and its subcommands.
+func createTokensCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tokens",
+		Short: "Inspect and sync the local compression tokens.",
+	}
+	cmd.AddCommand(createTokensStatusCmd())
+	cmd.AddCommand(createTokensSyncCmd())
+	cmd.AddCommand(createTokensHistoryCmd())
+	return cmd
+}
+
+// createTokensStatusCmd defines the 'tokens status' command.
+func createTokensStatusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Show the token balance.",
+		Long: `Show the local token balance and when it was last synced with the marketplace.
+It only reads the local token file, so it works offline; run 'nsm tokens sync' to
+refresh it.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			homeDir, err := os.UserHomeDir()
+			if err != nil {
+				return fmt.Errorf("failed to get user home directory: %w", err)
+			}
+			tokens, err := auth.NewTokenManager(homeDir, "")
+			if err != nil {
+				return fmt.Errorf("failed to initialize token manager: %w", err)
+			}
+			return printTokenStatus(printer, tokens)
+		},
+	}
+}
+
+// tokenStatus is the JSON form of the balance printed by 'tokens status'.
+type tokenStatus struct {
+	Available    int                `json:"available"`
+	LastSync     *time.Time         `json:"last_sync"` // null if never synced.
+	PendingOrder *auth.PendingOrder `json:"pending_order,omitempty"`
+}
+
+// printTokenStatus prints the balance of tokens and when it was last synced.
+func printTokenStatus(printer *Printer, tokens *auth.TokenManager) error {
+	status := tokenStatus{Available: tokens.AvailableTokens(), PendingOrder: tokens.PendingOrder()}
+	if lastSync := tokens.LastSync(); !lastSync.IsZero() {
+		status.LastSync = &lastSync
+	}
+	return printer.Print(status, func(w io.Writer) error {
+		fmt.Fprintf(w, "Available tokens: %d\n", status.Available)
+		if status.LastSync == nil {
+			fmt.Fprintln(w, "Last sync:        never")
+		} else {
+			fmt.Fprintf(w, "Last sync:        %s\n", status.LastSync.Local().Format("2006-01-02 15:04:05"))
+		}
+		if pending := status.PendingOrder; pending != nil {
+			fmt.Fprintf(w, "Pending order:    %s for %d token(s)\n", pending.OrderID, pending.TokenCount)
+		}
+		return nil
+	})
+}
+
+// createTokensSyncCmd defines the 'tokens sync' command.
+func createTokensSyncCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Sync the token balance with the marketplace.",
+		Long: `Validate the license key with the marketplace and replace the local token balance
+with the one it reports. The license key comes from --license-key or the config file.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			cfg, err := loadConfig(cmd)
+			if err != nil {
+				return err
+			}
+			apiKey, _ := cmd.Flags().GetString("license-key")
+			if apiKey == "" {
+				apiKey = cfg.LicenseKey
+			}
+			if apiKey == "" {
+				return fmt.Errorf("a license key is required to sync tokens. Use --license-key")
+			}
+
+			homeDir, err := os.UserHomeDir()
+			if err != nil {
+				return fmt.Errorf("failed to get user home directory: %w", err)
+			}
+			tokens, err := auth.NewTokenManager(homeDir, apiKey)
+			if err != nil {
+				return fmt.Errorf("failed to initialize token manager: %w", err)
+			}
+			client, err := newMarketplaceClient(cfg, marketplaceURL(cfg), apiKey, tokens)
+			if err != nil {
+				return err
+			}
+			if _, err := client.SyncTokens(tokens); err != nil {
+				return fmt.Errorf("failed to sync tokens: %w", err)
+			}
+			return printTokenStatus(printer, tokens)
+		},
+	}
+	cmd.Flags().String("license-key", "", "License key to sync (default from the config file)")
+	return cmd
+}
+
+// createTokensHistoryCmd defines the 'tokens history' command.
+func createTokensHistoryCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "Show what compression tokens were spent on.",
+		Long: `Show the token usage log, oldest first: when each archive was created, and the
+tokens left afterwards. With --output json the history is printed as a JSON array.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			homeDir, err := os.UserHomeDir()
+			if err != nil {
+				return fmt.Errorf("failed to get user home directory: %w", err)
+			}
+			tokens, err := auth.NewTokenManager(homeDir, "")
+			if err != nil {
+				return fmt.Errorf("failed to initialize token manager: %w", err)
+			}
+			records, err := tokens.UsageHistory()
+			if err != nil {
+				return fmt.Errorf("failed to read token usage: %w", err)
+			}
+			if records == nil {
+				records = []auth.UsageRecord{}
+			}
+			return printer.Print(records, func(w io.Writer) error {
+				return printUsageHistory(w, records)
+			})
+		},
+	}
+	cmd.Flags().Bool("json", false, "Print the history as JSON, like --output json")
+	return cmd
+}
+
+// printUsageHistory prints token usage records as a table.
+func printUsageHistory(w io.Writer, records []auth.UsageRecord) error {
+	if len(records) == 0 {
+		_, err := fmt.Fprintln(w, "No tokens spent yet.")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tOPERATION\tREMAINING\tARCHIVE")
+	for _, r := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", r.Timestamp.Local().Format("2006-01-02 15:04:05"), r.Operation, r.TokensRemaining, r.Archive)
+	}
+	return tw.Flush()
+}
+
+// printCreateResult prints the sizes and duration of a create, such as
+// "Compressed 1.2 GiB → 310.4 MiB (3.9x) in 42s", what deduplication saved, and what
+// each algorithm compressed when there were several.
+func printCreateResult(w io.Writer, r *core.CreateResult) {
+	elapsed := r.Elapsed.Round(time.Millisecond)
+	if elapsed >= time.Second {
+		elapsed = elapsed.Round(time.Second)
+	}
+	factor := ""
+	if r.ArchiveSize > 0 && r.InputSize > 0 {
+		factor = fmt.Sprintf(" (%.1fx)", float64(r.InputSize)/float64(r.ArchiveSize))
+	}
+	fmt.Fprintf(w, "Compressed %s → %s%s in %s\n", formatSize(r.InputSize), formatSize(r.ArchiveSize), factor, elapsed)
+	if r.Duplicates > 0 {
+		fmt.Fprintf(w, "  %d duplicate file(s), %s stored once\n", r.Duplicates, formatSize(r.DedupSaved))
+	}
+	if r.Excluded > 0 {
+		fmt.Fprintf(w, "  %d path(s) excluded\n", r.Excluded)
+	}
+	if len(r.Algorithms) < 2 {
+		return
+	}
+	algos := make([]string, 0, len(r.Algorithms))
+	for algo := range r.Algorithms {
+		algos = append(algos, string(algo))
+	}
+	sort.Strings(algos)
+	for _, algo := range algos {
+		stats := r.Algorithms[core.CompressionType(algo)]
+		fmt.Fprintf(w, "  %-6s %d file(s), %s → %s\n", algo, stats.Files, formatSize(stats.UncompressedSize), formatSize(stats.CompressedSize))
+	}
+}
+
+// dryRun is the JSON form of what 'create --dry-run' prints.
+type dryRun struct {
+	Files     []dryRunFile   `json:"files"`
+	EmptyDirs []string       `json:"empty_dirs,omitempty"`
+	Skipped   []checkedFile  `json:"skipped,omitempty"` // Unreadable files, with Error set.
+	Excluded  int            `json:"excluded"`
+	Unchanged int            `json:"unchanged"`
+	Estimate  *core.Estimate `json:"estimate"`
+}
+
+// dryRunFile is a file create would archive.
+type dryRunFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+func newDryRun(inputs *core.InputSet, est *core.Estimate) dryRun {
+	out := dryRun{
+		Files:     make([]dryRunFile, len(inputs.Files)),
+		EmptyDirs: inputs.EmptyDirs,
+		Excluded:  inputs.Excluded,
+		Unchanged: inputs.Unchanged,
+		Estimate:  est,
+	}
+	for i, file := range inputs.Files {
+		out.Files[i] = dryRunFile{Path: file.Name, Size: file.Info.Size()}
+	}
+	for _, skipped := range inputs.Skipped {
+		out.Skipped = append(out.Skipped, checkedFile{Path: skipped.Path, Error: skipped.Err.Error()})
+	}
+	return out
+}
+
+// printDryRun prints the files create would archive and the estimate of the archive.
+func printDryRun(w io.Writer, inputs *core.InputSet, est *core.Estimate) {
+	for _, file := range inputs.Files {
+		fmt.Fprintf(w, "%10s  %s\n", formatSize(file.Info.Size()), file.Name)
+	}
+	for _, dir := range inputs.EmptyDirs {
+		fmt.Fprintf(w, "%10s  %s/\n", "", dir)
+	}
+	for _, skipped := range inputs.Skipped {
+		fmt.Fprintf(w, "Skipping unreadable %s: %v\n", skipped.Path, skipped.Err)
+	}
+	fmt.Fprintf(w, "Would archive %d file(s), %s → about %s (estimated from a sample), costing %d token(s)\n",
+		est.Files, formatSize(est.UncompressedSize), formatSize(est.EstimatedSize), est.Tokens)
+	if inputs.Excluded > 0 {
+		fmt.Fprintf(w, "  %d path(s) excluded\n", inputs.Excluded)
+	}
+	if inputs.Unchanged > 0 {
+		fmt.Fprintf(w, "  %d unchanged file(s) left out\n", inputs.Unchanged)
+	}
+	fmt.Fprintln(w, "Dry run: nothing was written and no token was spent.")
+}
+
+// orderPollInterval is how often waitForOrder checks the pending order.
+const orderPollInterval = 5 * time.Second
+
+// printNoPendingOrder reports that there is no pending order, which is null in JSON.
+func printNoPendingOrder(printer *Printer) error {
+	return printer.Print(nil, func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, "No pending order.")
+		return err
+	})
+}
+
+// waitForOrder polls the pending order until it is completed or cancelled, or until
+// timeout expires, in which case the order stays pending. The last status of the order
+// is what is reported in JSON.
+func waitForOrder(printer *Printer, client *auth.MarketplaceClient, tokens *auth.TokenManager, timeout time.Duration) error {
+	pending := tokens.PendingOrder()
+	if pending == nil {
+		return printNoPendingOrder(printer)
+	}
+	printer.Textf("Waiting for payment of order %s (%d token(s))...", pending.OrderID, pending.TokenCount)
+	printer.Textf("Payment URL: %s", pending.PaymentURL)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := client.CheckPendingOrder(tokens)
+		if err != nil {
+			return fmt.Errorf("could not check order %s: %w", pending.OrderID, err)
+		}
+		switch status.Status {
+		case auth.OrderCompleted:
+			return printer.Print(status, func(w io.Writer) error {
+				if status.TransactionID != "" {
+					fmt.Fprintln(w, "Payment captured, transaction", status.TransactionID)
+				}
+				_, err := fmt.Fprintf(w, "Payment received. You now have %d token(s).\n", tokens.AvailableTokens())
+				return err
+			})
+		case auth.OrderCancelled:
+			return printer.Print(status, func(w io.Writer) error {
+				_, err := fmt.Fprintln(w, "Order", pending.OrderID, "was cancelled.")
+				return err
+			})
+		}
+		if time.Now().Add(orderPollInterval).After(deadline) {
+			return printer.Print(status, func(w io.Writer) error {
+				_, err := fmt.Fprintln(w, "Still awaiting payment; run 'nsm buy-tokens --resume' again later.")
+				return err
+			})
+		}
+		time.Sleep(orderPollInterval)
+	}
+}
+
+// createServerCmd defines the 'server' command.
+func createServerCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "server",
+		Short: "Run the web server for the marketplace and API.",
+		Long: `Run the web server for the marketplace and API.
+
+The server is configured through environment variables. NSM_PAYPAL_CLIENT_ID and
+NSM_PAYPAL_SECRET are required; see api.ServerConfig for the optional settings.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			port, _ := cmd.Flags().GetInt("port")
+
+			cfg, err := api.LoadServerConfig()
+			if err != nil {
+				return err
+			}
+			if cmd.Flags().Changed("archive-dir") {
+				cfg.ArchiveDir, _ = cmd.Flags().GetString("archive-dir")
+			}
+			if cmd.Flags().Changed("shutdown-timeout") {
+				cfg.ShutdownTimeout, _ = cmd.Flags().GetDuration("shutdown-timeout")
+			}
+			if cmd.Flags().Changed("metrics-addr") {
+				cfg.MetricsAddr, _ = cmd.Flags().GetString("metrics-addr")
+			}
+			
+			logrus.WithField("port", port).Info("Starting NSM API server...")
+			
+			// Initialize the server
+			server, err := api.NewServer(cfg)
+			if err != nil {
+				return fmt.Errorf("failed to initialize server: %w", err)
+			}
+			
+			// Start listening
+			return server.Run(fmt.Sprintf(":%d", port))
+		},
+	}
+	cmd.Flags().IntP("port", "p", 8080, "Port to run the server on")
+	cmd.Flags().String("archive-dir", "", "Directory where stored archives are kept (overrides "+api.EnvArchiveDir+")")
+	cmd.Flags().Duration("shutdown-timeout", 30*time.Second, "How long shutdown waits for running archive operations before cancelling them (overrides "+api.EnvShutdownTimeout+")")
+	cmd.Flags().String("metrics-addr", "", "Serve the Prometheus metrics on this address, such as 127.0.0.1:9090, instead of on /metrics (overrides "+api.EnvMetricsAddr+")")
+	return cmd
+}
+
+// createConfigCmd defines the 'config' command.
+func createConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage the configuration file.",
+	}
+	cmd.AddCommand(createConfigInitCmd())
+	return cmd
+}
+
+// createConfigInitCmd defines the 'config init' command.
+func createConfigInitCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "init [path]",
+		Short: "Write a config file with every setting documented.",
+		Long: `Write a config file listing every setting with its default value, all commented
+out, to edit as needed. It is written to ~/` + config.UserConfigName + ` unless a path is given, and
+an existing file is only replaced with --force.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			printer, err := newPrinter(cmd)
+			if err != nil {
+				return err
+			}
+			var path string
+			if len(args) == 1 {
+				path = args[0]
+			} else {
+				homeDir, err := os.UserHomeDir()
+				if err != nil {
+					return fmt.Errorf("failed to get user home directory: %w", err)
+				}
+				path = filepath.Join(homeDir, config.UserConfigName)
+			}
+			force, _ := cmd.Flags().GetBool("force")
+			if err := config.Init(path, force); err != nil {
+				return err
+			}
+			return printer.Print(map[string]interface{}{"path": path}, func(w io.Writer) error {
+				_, err := fmt.Fprintln(w, "Wrote", path)
+				return err
+			})
+		},
+	}
+	cmd.Flags().Bool("force", false, "Replace an existing config file")
 	return cmd
 }
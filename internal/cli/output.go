@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// Output formats selected with --output.
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// Printer writes what a command reports on standard output: text for people, or a
+// single JSON value for scripts. Commands hand it the value they report and how to
+// write it as text, so none of them has to decide on the format itself. Logs, progress
+// bars and warnings go to standard error either way.
+type Printer struct {
+	w    io.Writer
+	json bool
+}
+
+// NewPrinter returns a Printer writing to w in format, OutputText or OutputJSON.
+func NewPrinter(w io.Writer, format string) (*Printer, error) {
+	switch format {
+	case OutputText:
+		return &Printer{w: w}, nil
+	case OutputJSON:
+		return &Printer{w: w, json: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown --output %q (want %s or %s)", format, OutputText, OutputJSON)
+	}
+}
+
+// newPrinter returns the Printer of cmd, writing to standard output in the format given
+// by --output. The --json flag of the commands that had one before --output existed
+// still selects JSON.
+func newPrinter(cmd *cobra.Command) (*Printer, error) {
+	format, _ := cmd.Flags().GetString("output")
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		format = OutputJSON
+	}
+	return NewPrinter(os.Stdout, format)
+}
+
+// JSON reports whether p writes JSON.
+func (p *Printer) JSON() bool {
+	return p.json
+}
+
+// Print reports v, as indented JSON or by passing p's writer to text.
+func (p *Printer) Print(v interface{}, text func(w io.Writer) error) error {
+	if !p.json {
+		return text(p.w)
+	}
+	enc := json.NewEncoder(p.w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return fmt.Errorf("failed to write JSON output: %w", err)
+	}
+	return nil
+}
+
+// Textf writes a line of text for people, such as a note on what the command is
+// doing. It writes nothing in JSON, where only the value given to Print is output.
+func (p *Printer) Textf(format string, args ...interface{}) {
+	if !p.json {
+		fmt.Fprintf(p.w, format+"\n", args...)
+	}
+}
@@ -0,0 +1,131 @@
+// Package cli centralizes all cobra command definitions and their execution logic.
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/nexus/nsm/internal/core"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// PasswordEnv is the environment variable holding the archive passphrase for
+// non-interactive use, when --password-file isn't given.
+const PasswordEnv = "NSM_PASSWORD"
+
+// readPassphrase returns the passphrase given by --password, --password-file or
+// $NSM_PASSWORD, or prompts for it on the terminal, twice if confirm is set.
+func readPassphrase(cmd *cobra.Command, confirm bool) ([]byte, error) {
+	if cmd.Flags().Changed("password") {
+		password, _ := cmd.Flags().GetString("password")
+		if password == "" {
+			return nil, errors.New("the passphrase cannot be empty")
+		}
+		return []byte(password), nil
+	}
+	if path, _ := cmd.Flags().GetString("password-file"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password file: %w", err)
+		}
+		// Only the line ending is dropped: other whitespace is part of the passphrase.
+		data = bytes.TrimRight(data, "\r\n")
+		if len(data) == 0 {
+			return nil, fmt.Errorf("password file %s is empty", path)
+		}
+		return data, nil
+	}
+	if env := os.Getenv(PasswordEnv); env != "" {
+		return []byte(env), nil
+	}
+
+	passphrase, err := promptPassword("Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("the passphrase cannot be empty")
+	}
+	if confirm {
+		again, err := promptPassword("Confirm passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("the passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// archivePassphrase returns the passphrase protecting archiveFile, or nil if the archive
+// isn't protected by one. Errors opening the archive are left for the engine to report.
+func archivePassphrase(cmd *cobra.Command, archiveFile string) ([]byte, error) {
+	f, err := os.Open(archiveFile)
+	if err != nil {
+		return nil, nil
+	}
+	header, err := core.ReadHeader(f)
+	f.Close()
+	// The index may have been rewrapped with a key while the data still needs the
+	// passphrase.
+	if err != nil || header.Flags&core.FlagIndexPassphrase == 0 && header.DataKDF == (core.KDFParams{}) {
+		return nil, nil
+	}
+	return readPassphrase(cmd, false)
+}
+
+// readKDFParams returns the Argon2id parameters given by --kdf-time, --kdf-memory and
+// --kdf-threads.
+func readKDFParams(cmd *cobra.Command) (core.KDFParams, error) {
+	var p core.KDFParams
+	p.Time, _ = cmd.Flags().GetUint8("kdf-time")
+	p.Memory, _ = cmd.Flags().GetUint16("kdf-memory")
+	p.Threads, _ = cmd.Flags().GetUint8("kdf-threads")
+	switch {
+	case p.Time == 0:
+		return p, fmt.Errorf("--kdf-time must be positive")
+	case p.Threads == 0:
+		return p, fmt.Errorf("--kdf-threads must be positive")
+	case p.Memory == 0 || p.Memory > core.MaxKDFMemory:
+		return p, fmt.Errorf("--kdf-memory must be between 1 and %d MiB", core.MaxKDFMemory)
+	}
+	return p, nil
+}
+
+// promptPassword prints prompt to standard error and reads a line from the terminal
+// without echoing it.
+func promptPassword(prompt string) ([]byte, error) {
+	tty, err := openTTY()
+	if err != nil {
+		return nil, fmt.Errorf("no terminal to prompt for the passphrase; use --password-file or $%s", PasswordEnv)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return line, nil
+}
+
+// openTTY opens the terminal, which stays available for prompts when standard input
+// is redirected: the console input on Windows, the controlling terminal elsewhere.
+func openTTY() (*os.File, error) {
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CONIN$"
+	}
+	return os.OpenFile(name, os.O_RDWR, 0)
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/nexus/nsm/internal/core"
+)
+
+// progressBarWidth is the number of cells of a progress bar.
+const progressBarWidth = 30
+
+// newProgressBar returns a progress callback drawing a bar labelled label on standard
+// error, or nil if standard error isn't a terminal, so logs and pipes stay clean.
+func newProgressBar(label string) core.ProgressFunc {
+	if !isTerminal(os.Stderr) {
+		return nil
+	}
+	return progressBar(os.Stderr, label)
+}
+
+// progressBar returns a progress callback redrawing a bar on a single line of w, and
+// ending the line once everything is processed.
+func progressBar(w io.Writer, label string) core.ProgressFunc {
+	return func(done, total int64) {
+		fraction := 1.0
+		if total > 0 && done < total {
+			fraction = float64(done) / float64(total)
+		}
+		filled := int(fraction * progressBarWidth)
+		fmt.Fprintf(w, "\r%s [%s%s] %3.0f%% %s / %s", label,
+			strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled),
+			fraction*100, formatSize(done), formatSize(total))
+		if done >= total {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// formatSize formats a byte count with a binary unit, such as "12.3 MiB".
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,250 @@
+// Package config loads the CLI configuration from YAML files.
+//
+// Several files can be combined, for example a shared team configuration followed by
+// a personal override. Files are merged in order, so later files take precedence:
+//
+//   - mappings are merged key by key, recursively, so an override only needs the keys
+//     it changes;
+//   - scalars and lists are replaced as a whole: a list in a later file replaces the
+//     list of an earlier file instead of being appended to it;
+//   - an explicit null in a later file resets the key to its default.
+//
+// Command-line flags take precedence over the files, and the files over the
+// environment variables listed below, which only fill in settings no file sets.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SystemConfigPath is the machine-wide configuration file, read first.
+const SystemConfigPath = "/etc/nsm/config.yaml"
+
+// UserConfigName is the name of the per-user configuration file in the home directory.
+const UserConfigName = ".nsm.yaml"
+
+// Environment variables read by Load for the settings no config file sets.
+const (
+	EnvLicenseKey     = "NSM_LICENSE_KEY"
+	EnvMarketplaceURL = "NSM_MARKETPLACE_URL"
+	EnvAlgorithm      = "NSM_ALGORITHM"
+	EnvLevel          = "NSM_LEVEL"
+	EnvCipher         = "NSM_CIPHER"
+	EnvEncrypt        = "NSM_ENCRYPT" // A boolean, such as true, false, 1 or 0.
+)
+
+// Config is the merged configuration. Zero values mean "not configured", letting
+// command-line flags and built-in defaults apply.
+type Config struct {
+	// LicenseKey authenticates with the marketplace.
+	LicenseKey string `yaml:"license_key"`
+	// TempDir is where intermediate data is buffered.
+	TempDir string `yaml:"temp_dir"`
+
+	Create      CreateConfig      `yaml:"create"`
+	Marketplace MarketplaceConfig `yaml:"marketplace"`
+}
+
+// MarketplaceConfig controls how the CLI identifies itself to the marketplace.
+type MarketplaceConfig struct {
+	// URL is the base URL of the marketplace API.
+	URL string `yaml:"url"`
+	// UserAgent replaces the default User-Agent, which names the tool and its version.
+	UserAgent string `yaml:"user_agent"`
+	// DisableClientID stops sending the anonymous installation id.
+	DisableClientID bool `yaml:"disable_client_id"`
+}
+
+// CreateConfig holds the defaults of the create command.
+type CreateConfig struct {
+	Algorithm        string   `yaml:"algorithm"`
+	Level            string   `yaml:"level"`   // A number or preset name, as for --level.
+	Encrypt          bool     `yaml:"encrypt"` // Encrypt with a passphrase, as with --encrypt.
+	Cipher           string   `yaml:"cipher"`
+	Creator          string   `yaml:"creator"`
+	ExcludeVCS       bool     `yaml:"exclude_vcs"`
+	SearchIndex      string   `yaml:"search_index"`
+	IndexCompression string   `yaml:"index_compression"`
+	GroupSmallFiles  bool     `yaml:"group_small_files"`
+	StoreExtensions  []string `yaml:"store_extensions"`
+}
+
+// DefaultPaths returns the configuration files read by default, in merge order:
+// SystemConfigPath, then UserConfigName in the home directory. Only files that exist
+// are returned.
+func DefaultPaths() []string {
+	candidates := []string{SystemConfigPath}
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, UserConfigName))
+	}
+
+	var paths []string
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Load reads and merges the given files in order, later files overriding earlier ones.
+// Every file must exist; use DefaultPaths to pick up only the default files present.
+func Load(paths ...string) (*Config, error) {
+	merged := map[string]interface{}{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		var doc map[string]interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		mergeMaps(merged, doc)
+	}
+
+	// Round-tripping the merged document decodes it with the struct's yaml tags.
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge config files: %w", err)
+	}
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := cfg.applyEnv(merged); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv fills in the settings left unset by the config files, whose merged document
+// is merged, from the environment.
+func (c *Config) applyEnv(merged map[string]interface{}) error {
+	for _, setting := range []struct {
+		value *string
+		env   string
+	}{
+		{&c.LicenseKey, EnvLicenseKey},
+		{&c.Marketplace.URL, EnvMarketplaceURL},
+		{&c.Create.Algorithm, EnvAlgorithm},
+		{&c.Create.Level, EnvLevel},
+		{&c.Create.Cipher, EnvCipher},
+	} {
+		if *setting.value == "" {
+			*setting.value = os.Getenv(setting.env)
+		}
+	}
+
+	// A boolean can't tell an unset key from false, so the document is checked.
+	create, _ := merged["create"].(map[string]interface{})
+	if _, set := create["encrypt"]; !set {
+		if value := os.Getenv(EnvEncrypt); value != "" {
+			encrypt, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: want true or false", EnvEncrypt, value)
+			}
+			c.Create.Encrypt = encrypt
+		}
+	}
+	return nil
+}
+
+// Template is the config file written by Init. Every setting is commented out, so it
+// changes nothing until edited, even over another file.
+const Template = `# NSM configuration.
+#
+# Settings here are defaults: command-line flags override them, and they override the
+# environment variables named below. Uncomment a setting, and the section it is in,
+# to change it.
+
+# Key authenticating with the marketplace ($` + EnvLicenseKey + `).
+# license_key: ""
+
+# Directory for temporary buffers (default $NSM_TMPDIR or the system temp directory).
+# temp_dir: ""
+
+# create:
+#   # Compression algorithm: zstd, gzip, lz4 or store ($` + EnvAlgorithm + `).
+#   algorithm: zstd
+#   # Compression level on the algorithm's own scale (zstd 1-22, gzip -2-9), or a
+#   # zstd preset: fastest, default, better, best ($` + EnvLevel + `).
+#   level: default
+#   # Encrypt archives with a passphrase, as with --encrypt ($` + EnvEncrypt + `).
+#   encrypt: false
+#   # Cipher of encrypted data: aes-256-gcm or chacha20-poly1305 ($` + EnvCipher + `).
+#   cipher: aes-256-gcm
+#   # Creator recorded in the archive metadata.
+#   creator: ""
+#   # Skip version control directories such as .git.
+#   exclude_vcs: false
+#   # Where the search index is kept: embedded, sidecar or none.
+#   search_index: embedded
+#   # Compress the archive index: auto (large indexes only), always or never.
+#   index_compression: auto
+#   # Pack small files into shared frames.
+#   group_small_files: false
+#   # Extensions of already compressed files, stored as they are. Replaces the
+#   # built-in list.
+#   store_extensions: [".jpg", ".png", ".zip"]
+
+# marketplace:
+#   # Base URL of the marketplace API ($` + EnvMarketplaceURL + `).
+#   url: http://localhost:8080
+#   # User-Agent sent to the marketplace instead of the tool name and version.
+#   user_agent: ""
+#   # Stop sending the anonymous installation id.
+#   disable_client_id: false
+`
+
+// Init writes Template to path, creating its directory. An existing file is only
+// replaced if overwrite is set. The file is only readable by its owner, as it may come
+// to hold the license key.
+func Init(path string, overwrite bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("config file %s already exists", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create config file: %w", err)
+	}
+	_, err = f.WriteString(Template)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// mergeMaps merges src into dst. Nested mappings are merged recursively; any other
+// value in src, including lists, replaces the value in dst.
+func mergeMaps(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, srcIsMap := value.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			mergeMaps(dstMap, srcMap)
+			continue
+		}
+		if value == nil {
+			delete(dst, key)
+			continue
+		}
+		dst[key] = value
+	}
+}
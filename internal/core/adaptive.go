@@ -0,0 +1,160 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+)
+
+// Adaptive compression splits a stream into chunks of adaptiveChunkSize bytes, each
+// compressed as its own zstd frame, so the level can change between chunks without
+// the reader noticing: concatenated frames decompress as one stream.
+const (
+	adaptiveChunkSize = 1 << 20
+	// adaptiveWindow is the number of recent chunks the throughput is measured over.
+	adaptiveWindow = 4
+	// adaptiveHeadroom is how far above the target the throughput must be before the
+	// level is raised, so it doesn't flip back and forth around the target.
+	adaptiveHeadroom = 1.5
+)
+
+// zstdLevelSteps are the lowest zstd levels of each encoder preset, from fastest to
+// strongest. Levels between two steps compress the same, so adaptation moves between
+// steps.
+var zstdLevelSteps = []int{1, 3, 6, 10}
+
+// CompressAdaptive compresses src with zstd like CompressWith, but lowers the level
+// whenever the throughput over the last few chunks, including the time spent writing
+// to dst, falls below targetRate bytes per second, and raises it again, up to
+// opts.Level, when there is headroom. It keeps the throughput of streaming sources
+// stable at the cost of a varying ratio. It returns the compressed size and the levels
+// used, in ascending order.
+func (c *Compressor) CompressAdaptive(dst io.Writer, src io.Reader, opts CompressOptions, targetRate float64) (int64, []int, error) {
+	if targetRate <= 0 {
+		return 0, nil, NewCoreError(ErrInvalidInput, fmt.Sprintf("invalid target rate %g (want a positive number of bytes per second)", targetRate))
+	}
+	ceiling := opts.Level
+	if ceiling == DefaultLevel {
+		ceiling = zstdLevelSteps[1]
+	}
+	if ceiling < 1 || ceiling > 22 {
+		return 0, nil, NewCoreError(ErrInvalidInput, fmt.Sprintf("invalid zstd level %d (want 1-22)", ceiling))
+	}
+
+	rate := &rateWindow{}
+	used := make(map[int]bool)
+	level := ceiling
+	chunk := make([]byte, adaptiveChunkSize)
+	var total int64
+	for {
+		n, err := io.ReadFull(src, chunk)
+		if n > 0 {
+			start := time.Now()
+			written, cerr := c.CompressWith(dst, bytes.NewReader(chunk[:n]), ZSTD, CompressOptions{Level: level, WindowLog: opts.WindowLog, Dictionary: opts.Dictionary})
+			if cerr != nil {
+				return 0, nil, cerr
+			}
+			total += written
+			used[level] = true
+			rate.add(int64(n), time.Since(start))
+
+			next := level
+			if current := rate.rate(); current < targetRate {
+				next = lowerLevel(level)
+			} else if rate.full() && current > targetRate*adaptiveHeadroom {
+				next = higherLevel(level, ceiling)
+			}
+			if next != level {
+				c.log.WithFields(logrus.Fields{"from": level, "to": next, "rate": int64(rate.rate())}).Debug("Adapting compression level")
+				level = next
+				rate.reset()
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, NewCoreError(ErrCompression, "failed during data streaming").Wrap(err)
+		}
+	}
+	if total == 0 {
+		// An empty input still gets a frame, as with CompressWith.
+		written, err := c.CompressWith(dst, bytes.NewReader(nil), ZSTD, CompressOptions{Level: level, WindowLog: opts.WindowLog, Dictionary: opts.Dictionary})
+		if err != nil {
+			return 0, nil, err
+		}
+		total, used[level] = written, true
+	}
+
+	levels := make([]int, 0, len(used))
+	for l := range used {
+		levels = append(levels, l)
+	}
+	sort.Ints(levels)
+	return total, levels, nil
+}
+
+// lowerLevel returns the level of the next faster encoder preset, or level if it is
+// already the fastest.
+func lowerLevel(level int) int {
+	current := zstd.EncoderLevelFromZstd(level)
+	for i := len(zstdLevelSteps) - 1; i >= 0; i-- {
+		if zstd.EncoderLevelFromZstd(zstdLevelSteps[i]) < current {
+			return zstdLevelSteps[i]
+		}
+	}
+	return level
+}
+
+// higherLevel returns the level of the next stronger encoder preset, capped at ceiling.
+func higherLevel(level, ceiling int) int {
+	current := zstd.EncoderLevelFromZstd(level)
+	for _, step := range zstdLevelSteps {
+		if zstd.EncoderLevelFromZstd(step) > current {
+			if step > ceiling || zstd.EncoderLevelFromZstd(step) == zstd.EncoderLevelFromZstd(ceiling) {
+				return ceiling
+			}
+			return step
+		}
+	}
+	return level
+}
+
+// rateWindow measures throughput over the last adaptiveWindow chunks.
+type rateWindow struct {
+	bytes [adaptiveWindow]int64
+	times [adaptiveWindow]time.Duration
+	count int
+}
+
+func (w *rateWindow) add(n int64, d time.Duration) {
+	i := w.count % adaptiveWindow
+	w.bytes[i], w.times[i] = n, d
+	w.count++
+}
+
+// full reports whether the window holds adaptiveWindow chunks.
+func (w *rateWindow) full() bool { return w.count >= adaptiveWindow }
+
+// rate returns the throughput in bytes per second.
+func (w *rateWindow) rate() float64 {
+	var n int64
+	var d time.Duration
+	for i := 0; i < adaptiveWindow && i < w.count; i++ {
+		n += w.bytes[i]
+		d += w.times[i]
+	}
+	if d <= 0 {
+		return math.Inf(1)
+	}
+	return float64(n) / d.Seconds()
+}
+
+func (w *rateWindow) reset() { *w = rateWindow{} }
@@ -0,0 +1,112 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// EstimateCompressionMemory returns a rough upper bound of the memory a compression
+// stream with the given algorithm and options needs. A zstd encoder keeps its window
+// as history, plus a block in flight, and match tables that grow with the level, so
+// high levels and large windows dominate. It is used to admit concurrent compressions
+// within Config.CompressionMemoryBudget.
+func EstimateCompressionMemory(algo CompressionType, opts CompressOptions) int64 {
+	switch algo {
+	case ZSTD:
+		level := zstd.SpeedDefault
+		if opts.Level != DefaultLevel {
+			level = zstd.EncoderLevelFromZstd(opts.Level)
+		}
+		// Default windows and approximate table sizes of each encoder level.
+		var window, tables int64
+		switch level {
+		case zstd.SpeedFastest:
+			window, tables = 4<<20, 256<<10
+		case zstd.SpeedDefault:
+			window, tables = 8<<20, 2<<20
+		case zstd.SpeedBetterCompression:
+			window, tables = 16<<20, 8<<20
+		default:
+			window, tables = 32<<20, 40<<20
+		}
+		if opts.WindowLog != 0 {
+			window = 1 << opts.WindowLog
+		}
+		return 2*window + tables
+	case GZIP:
+		// Deflate's window and hash chains are fixed-size.
+		return 1 << 20
+	default:
+		return 64 << 10
+	}
+}
+
+// memoryAdmission admits jobs while the sum of their memory estimates fits within a
+// budget and queues the rest. Waiting jobs are admitted in arrival order, so a large
+// job isn't starved by a stream of small ones; a job larger than the whole budget runs
+// alone once everything before it has finished.
+type memoryAdmission struct {
+	budget   int64
+	mu       sync.Mutex
+	reserved int64
+	queue    []*admissionTicket
+}
+
+// admissionTicket is a job waiting for memory.
+type admissionTicket struct {
+	size  int64
+	ready chan struct{}
+}
+
+func newMemoryAdmission(budget int64) *memoryAdmission {
+	return &memoryAdmission{budget: budget}
+}
+
+// acquire blocks until size bytes can be reserved and returns a function releasing them.
+func (m *memoryAdmission) acquire(size int64) func() {
+	m.mu.Lock()
+	if len(m.queue) == 0 && m.fits(size) {
+		m.reserved += size
+		m.mu.Unlock()
+	} else {
+		t := &admissionTicket{size: size, ready: make(chan struct{})}
+		m.queue = append(m.queue, t)
+		m.mu.Unlock()
+		<-t.ready
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.reserved -= size
+			m.admitWaiting()
+		})
+	}
+}
+
+// fits reports whether size bytes can be reserved now. m.mu must be held.
+func (m *memoryAdmission) fits(size int64) bool {
+	return m.reserved == 0 || m.reserved+size <= m.budget
+}
+
+// admitWaiting admits queued jobs, in order, while they fit. m.mu must be held.
+func (m *memoryAdmission) admitWaiting() {
+	for len(m.queue) > 0 && m.fits(m.queue[0].size) {
+		t := m.queue[0]
+		m.queue[0] = nil
+		m.queue = m.queue[1:]
+		m.reserved += t.size
+		close(t.ready)
+	}
+}
+
+// usage returns the memory reserved by running jobs and the number of queued jobs.
+func (m *memoryAdmission) usage() (int64, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reserved, len(m.queue)
+}
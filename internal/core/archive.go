@@ -0,0 +1,206 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// archiveReader gives random access to the parts of an opened archive.
+type archiveReader struct {
+	r      io.ReaderAt
+	size   int64
+	closer io.Closer
+	header *Header
+	index  *Index
+	algo   CompressionType
+	dict   *Dictionary // Dictionary of the data, see FlagDictionary; nil if none.
+
+	// The most recently decompressed file group, see decompressGroupMember.
+	groupMu     sync.Mutex
+	groupID     uint32
+	groupOffset int64
+	groupData   []byte
+
+	// extracted counts the bytes decompressed so far, see Config.MaxExtractSize.
+	extracted atomic.Int64
+
+	// The key decrypting the data, see archiveDataKey.
+	dataKeyOnce sync.Once
+	dataKey     []byte
+	dataKeyErr  error
+}
+
+// openArchive opens an archive file and decodes its header and index.
+func (e *Engine) openArchive(archiveFile string) (*archiveReader, error) {
+	f, err := os.Open(archiveFile)
+	if err != nil {
+		return nil, NewCoreError(ErrArchiveRead, "failed to open archive "+archiveFile).Wrap(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, NewCoreError(ErrArchiveRead, "failed to stat archive "+archiveFile).Wrap(err)
+	}
+
+	a, err := e.readArchive(f, info.Size(), archiveFile)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a.closer = f
+	return a, nil
+}
+
+// readArchive decodes the header and index of an archive of the given size.
+func (e *Engine) readArchive(r io.ReaderAt, size int64, name string) (*archiveReader, error) {
+	header, err := ReadHeader(io.NewSectionReader(r, 0, HeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	if header.IndexOffset < HeaderSize || header.IndexLength < 0 || header.IndexOffset+header.IndexLength > size {
+		return nil, NewCoreError(ErrInvalidFormat, "archive index lies outside the file")
+	}
+	algo, err := compressionFromCode(header.CompressionType)
+	if err != nil {
+		return nil, err
+	}
+
+	dict, err := readDictionary(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := e.decodeIndex(io.NewSectionReader(r, header.IndexOffset, header.IndexLength), header, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &archiveReader{r: r, size: size, header: header, index: index, algo: algo, dict: dict}, nil
+}
+
+// Close releases the underlying file, if any, and wipes the data key.
+func (a *archiveReader) Close() error {
+	wipe(a.dataKey)
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// dataSize returns the length of the compressed data block.
+func (a *archiveReader) dataSize() int64 {
+	return a.header.dataEnd() - HeaderSize
+}
+
+// entries returns the index entries sorted by their position in the data block,
+// which is the order they were written in. Members of a file group are adjacent.
+func (a *archiveReader) entries() []FileMetadata {
+	entries := make([]FileMetadata, 0, len(a.index.Files))
+	for _, entry := range a.index.Files {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Offset != entries[j].Offset {
+			return entries[i].Offset < entries[j].Offset
+		}
+		if entries[i].GroupOffset != entries[j].GroupOffset {
+			return entries[i].GroupOffset < entries[j].GroupOffset
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
+
+// grouped reports whether the archive has files packed into shared frames, see
+// Config.GroupSmallFiles.
+func (a *archiveReader) grouped() bool {
+	for _, entry := range a.index.Files {
+		if entry.Group != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// entryAlgo returns the algorithm a file was compressed with, which is the archive's
+// unless the file records its own.
+func (a *archiveReader) entryAlgo(entry FileMetadata) (CompressionType, error) {
+	if entry.Compression == 0 {
+		return a.algo, nil
+	}
+	return compressionFromCode(entry.Compression)
+}
+
+// decompressEntry writes the decompressed content of a single file to w.
+// Each file is stored as its own compressed frame, so only its byte range is read.
+func (e *Engine) decompressEntry(a *archiveReader, entry FileMetadata, w io.Writer) error {
+	if entry.Offset < 0 || entry.CompressedSize < 0 || entry.Offset+entry.CompressedSize > a.dataSize() {
+		return NewCoreError(ErrInvalidFormat, "data of "+entry.Path+" lies outside the data block")
+	}
+	if entry.Group != 0 {
+		return e.decompressGroupMember(a, entry, w)
+	}
+	if len(entry.Chunks) > 0 {
+		return e.decompressChunks(a, entry, w)
+	}
+
+	algo, err := a.entryAlgo(entry)
+	if err != nil {
+		return err
+	}
+	limited, err := e.limitOutput(a, w, entry.Path, entry.CompressedSize, entry.UncompressedSize)
+	if err != nil {
+		return err
+	}
+	if limited != nil {
+		w = limited
+	}
+	section, dec, err := e.frameReader(a, entry)
+	if err != nil {
+		return err
+	}
+	n, err := e.compressor.DecompressWith(w, section, algo, a.dict)
+	if err != nil {
+		if err := limited.exceeded(); err != nil {
+			return err
+		}
+		if err := dec.authErr(); err != nil {
+			return err
+		}
+		return NewCoreError(ErrDecompression, "failed to decompress "+entry.Path).Wrap(err)
+	}
+	if n != entry.UncompressedSize {
+		return NewCoreError(ErrInvalidFormat, fmt.Sprintf("%s: expected %d bytes, got %d", entry.Path, entry.UncompressedSize, n))
+	}
+	return nil
+}
+
+// safeJoin resolves an archive path below the destination directory.
+// Absolute paths and paths escaping the destination via ".." are rejected.
+func safeJoin(destination, name string) (string, error) {
+	cleaned := path.Clean(filepath.ToSlash(name))
+	if name == "" || path.IsAbs(cleaned) || filepath.IsAbs(name) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", NewCoreError(ErrInvalidFormat, "archive entry escapes the destination directory: "+name)
+	}
+	return filepath.Join(destination, filepath.FromSlash(cleaned)), nil
+}
+
+// readCounter counts the bytes read through an io.Reader.
+type readCounter struct {
+	reader io.Reader
+	total  int64
+}
+
+func (rc *readCounter) Read(p []byte) (int, error) {
+	n, err := rc.reader.Read(p)
+	rc.total += int64(n)
+	return n, err
+}
@@ -0,0 +1,164 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// Content-defined chunking cuts a file where its content says so rather than at fixed
+// offsets, so an insertion or deletion only changes the chunks around it: the chunks
+// after it are found again in the same place relative to their content.
+const (
+	// minChunkSize and maxChunkSize bound the size of a chunk; only the last chunk of
+	// a file may be smaller.
+	minChunkSize = 16 << 10
+	maxChunkSize = 256 << 10
+	// chunkBits sets the average chunk size past minChunkSize: a cut is made where the
+	// top chunkBits bits of the rolling hash are zero, once in 2^chunkBits bytes.
+	chunkBits = 16
+	// gearWindow is how many bytes the rolling hash depends on: each byte is shifted
+	// out of the 64-bit hash after that many more.
+	gearWindow = 64
+)
+
+// gearTable maps each byte to a random value added to the rolling hash. It is fixed,
+// so the same content is always cut in the same places.
+var gearTable = func() (t [256]uint64) {
+	// splitmix64, seeded with a constant.
+	x := uint64(0x6e736d2d63686e6b)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// chunker splits the content of a reader into chunks cut with a gear rolling hash,
+// a variant of Buzhash used by FastCDC.
+type chunker struct {
+	r          io.Reader
+	buf        []byte
+	start, end int // Unread part of buf.
+	eof        bool
+	err        error
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, maxChunkSize)}
+}
+
+// Next returns the next chunk, which is valid until the following call, or io.EOF once
+// the content is exhausted.
+func (c *chunker) Next() ([]byte, error) {
+	if c.end-c.start < maxChunkSize && !c.eof {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			c.eof = true
+		default:
+			c.eof, c.err = true, err
+		}
+	}
+	if c.start == c.end {
+		if c.err != nil {
+			return nil, c.err
+		}
+		return nil, io.EOF
+	}
+	data := c.buf[c.start:c.end]
+	n := cutPoint(data)
+	c.start += n
+	return data[:n], nil
+}
+
+// cutPoint returns the size of the chunk at the beginning of data.
+func cutPoint(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+	limit := len(data)
+	if limit > maxChunkSize {
+		limit = maxChunkSize
+	}
+	const mask = (1<<chunkBits - 1) << (64 - chunkBits)
+	var h uint64
+	// The hash starts a window early, so whether a position is a cut depends on the
+	// bytes before it only, not on where the chunk started.
+	for i := minChunkSize - gearWindow; i < limit; i++ {
+		h = h<<1 + gearTable[data[i]]
+		if i >= minChunkSize && h&mask == 0 {
+			return i + 1
+		}
+	}
+	return limit
+}
+
+// chunkKey identifies a chunk stored by writeChunks: chunks are only shared between
+// files compressed with the same algorithm.
+type chunkKey struct {
+	sum  [32]byte
+	algo CompressionType
+}
+
+// writeChunks splits r into content-defined chunks and writes the ones not in store yet
+// to frames as their own frames compressed with algo, starting at offset bytes into
+// the data block, adding them to store. It returns the chunks of the content and the
+// size written. Empty content is one empty chunk.
+func (e *Engine) writeChunks(frames *frameWriter, r io.Reader, algo CompressionType, opts CompressOptions, store map[chunkKey]ChunkRef, offset int64) ([]ChunkRef, int64, error) {
+	c := newChunker(r)
+	var refs []ChunkRef
+	var written int64
+	for {
+		data, err := c.Next()
+		if err == io.EOF && refs == nil {
+			data, err = nil, nil // Recorded, so the file still counts as chunked.
+		}
+		if err == io.EOF {
+			return refs, written, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		key := chunkKey{sha256.Sum256(data), algo}
+		ref, ok := store[key]
+		if !ok {
+			n, err := frames.write(func(w io.Writer) (int64, error) {
+				return e.compressor.CompressWith(w, bytes.NewReader(data), algo, opts)
+			})
+			if err != nil {
+				return nil, 0, err
+			}
+			ref = ChunkRef{Offset: offset + written, CompressedSize: n, Size: int64(len(data))}
+			store[key] = ref
+			written += n
+		}
+		refs = append(refs, ref)
+	}
+}
+
+// decompressChunks writes the content of a chunked file to w, one chunk after the other.
+func (e *Engine) decompressChunks(a *archiveReader, entry FileMetadata, w io.Writer) error {
+	var total int64
+	for _, c := range entry.Chunks {
+		total += c.Size
+	}
+	if total != entry.UncompressedSize {
+		return NewCoreError(ErrInvalidFormat, fmt.Sprintf("%s: chunks hold %d bytes, expected %d", entry.Path, total, entry.UncompressedSize))
+	}
+	for _, c := range entry.Chunks {
+		if err := e.decompressEntry(a, entry.chunkEntry(c), w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
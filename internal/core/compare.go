@@ -0,0 +1,151 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reasons for a FileDifference.
+const (
+	DiffSize     = "size"
+	DiffContent  = "content"
+	DiffNotAFile = "not_a_file"
+)
+
+// FileDifference is a file whose content in the directory differs from the archive.
+type FileDifference struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"` // One of the Diff* constants.
+}
+
+// CompareResult reports how a directory differs from an archive. Paths are the
+// archive's, relative to the compared directory.
+type CompareResult struct {
+	Missing   []string         `json:"missing"`   // In the archive but not in the directory.
+	Extra     []string         `json:"extra"`     // In the directory but not in the archive.
+	Differing []FileDifference `json:"differing"` // In both, with different content.
+	Matching  int              `json:"matching"`  // In both, with the same content.
+}
+
+// Equal reports whether the directory matches the archive exactly.
+func (r *CompareResult) Equal() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Differing) == 0
+}
+
+// Compare checks whether the files below dir match the archive, for example to
+// confirm a restore or detect drift since a backup. Files are compared by size, then
+// by SHA-256 against the checksums recorded in the index, so the archive's data is
+// only read for archives written before checksums were recorded. Files the configured
+// filters would leave out of an archive are not reported as extra.
+func (e *Engine) Compare(archiveFile, dir string) (*CompareResult, error) {
+	a, err := e.openArchive(archiveFile)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+
+	result := &CompareResult{Missing: []string{}, Extra: []string{}, Differing: []FileDifference{}}
+	for _, entry := range a.entries() {
+		target, err := safeJoin(dir, entry.Path)
+		if err != nil {
+			return nil, err
+		}
+		reason, err := e.compareFile(a, entry, target)
+		switch {
+		case os.IsNotExist(err):
+			result.Missing = append(result.Missing, entry.Path)
+		case err != nil:
+			return nil, err
+		case reason != "":
+			result.Differing = append(result.Differing, FileDifference{Path: entry.Path, Reason: reason})
+		default:
+			result.Matching++
+		}
+	}
+
+	filter := NewPathFilter(e.config)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if filter.Excluded(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		if _, ok := a.index.Files[name]; !ok && !d.IsDir() {
+			result.Extra = append(result.Extra, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, NewCoreError(ErrArchiveRead, "failed to walk directory "+dir).Wrap(err)
+	}
+
+	sort.Strings(result.Missing)
+	sort.Strings(result.Extra)
+	sort.Slice(result.Differing, func(i, j int) bool { return result.Differing[i].Path < result.Differing[j].Path })
+	e.log.WithFields(logrus.Fields{
+		"archive":   archiveFile,
+		"missing":   len(result.Missing),
+		"extra":     len(result.Extra),
+		"differing": len(result.Differing),
+	}).Info("Comparison finished")
+	return result, nil
+}
+
+// compareFile compares an archived file with the file at target and returns why they
+// differ, or "" if they match. It returns an os.IsNotExist error if target is missing.
+func (e *Engine) compareFile(a *archiveReader, entry FileMetadata, target string) (string, error) {
+	info, err := os.Stat(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", err
+		}
+		return "", NewCoreError(ErrArchiveRead, "failed to stat "+target).Wrap(err)
+	}
+	if !info.Mode().IsRegular() {
+		return DiffNotAFile, nil
+	}
+	if info.Size() != entry.UncompressedSize {
+		return DiffSize, nil
+	}
+
+	want := entry.Checksum
+	if want == ([32]byte{}) {
+		// Older archives have no checksums: hash the archived content instead.
+		h := sha256.New()
+		if err := e.decompressEntry(a, entry, h); err != nil {
+			return "", err
+		}
+		copy(want[:], h.Sum(nil))
+	}
+	f, err := os.Open(target)
+	if err != nil {
+		return "", NewCoreError(ErrArchiveRead, "failed to open "+target).Wrap(err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", NewCoreError(ErrArchiveRead, "failed to read "+target).Wrap(err)
+	}
+	var got [32]byte
+	copy(got[:], h.Sum(nil))
+	if got != want {
+		return DiffContent, nil
+	}
+	return "", nil
+}
@@ -3,9 +3,14 @@ package core
 
 import (
 	"compress/gzip"
+	"fmt"
 	"io"
+	"math"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/sirupsen/logrus"
@@ -19,15 +24,185 @@ const (
 	ZSTD CompressionType = "zstd"
 	// GZIP is widely available and a good fallback.
 	GZIP CompressionType = "gzip"
+	// STORE copies data verbatim, for inputs that don't compress.
+	STORE CompressionType = "store"
+	// LZ4 trades ratio for the fastest compression and decompression, which suits
+	// inputs that barely compress such as media.
+	LZ4 CompressionType = "lz4"
 )
 
+// DefaultLevel selects the algorithm's default compression level.
+const DefaultLevel = 0
+
+// compressionLevelNames maps the names accepted by ParseCompressionLevel to a zstd level
+// of each encoder preset.
+var compressionLevelNames = map[string]int{
+	"fastest": 1,
+	"default": 3,
+	"better":  7,
+	"best":    11,
+}
+
+// ParseCompressionLevel parses a compression level given either as a number on the
+// algorithm's own scale or as the name of a zstd preset: fastest, default, better or
+// best. An empty string is DefaultLevel.
+func ParseCompressionLevel(s string) (int, error) {
+	if s == "" {
+		return DefaultLevel, nil
+	}
+	if level, ok := compressionLevelNames[strings.ToLower(s)]; ok {
+		return level, nil
+	}
+	level, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, NewCoreError(ErrInvalidInput, fmt.Sprintf("invalid compression level %q (want a number or fastest, default, better, best)", s))
+	}
+	return level, nil
+}
+
+// Limits of CompressOptions.WindowLog, from the zstd format.
+const (
+	MinWindowLog = 10 // 1 KiB
+	MaxWindowLog = 29 // 512 MiB, also the largest window the decoder accepts.
+
+	// LongWindowLog is the window of long-distance matching, as zstd --long: 128 MiB,
+	// so repetitions up to that far apart are found.
+	LongWindowLog = 27
+)
+
+// CompressOptions tunes a compression stream. The zero value selects the
+// algorithm's defaults.
+type CompressOptions struct {
+	// Level uses the algorithm's native scale, see CompressLevel.
+	Level int
+	// WindowLog sets the zstd window to 1<<WindowLog bytes, between MinWindowLog and
+	// MaxWindowLog. A larger window finds repetitions further apart, improving the
+	// ratio on large redundant inputs, but compressing and decompressing need that much
+	// memory. Zero keeps the level's default (8 MiB at the default level). Other
+	// algorithms ignore it.
+	WindowLog int
+	// Dictionary, if not nil, primes zstd with a dictionary, see TrainDictionary.
+	// Frames compressed with it can only be decompressed with it. Other algorithms
+	// ignore it.
+	Dictionary *Dictionary
+}
+
+// DefaultStoreExtensions lists file extensions whose content is already compressed.
+// Files with these extensions are stored without compression, which saves the CPU time
+// of trying to compress them. See Config.StoreExtensions.
+var DefaultStoreExtensions = []string{
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic",
+	".mp3", ".aac", ".ogg", ".flac",
+	".mp4", ".mkv", ".mov", ".avi", ".webm",
+	".zip", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar",
+	".nsm",
+}
+
+// Thresholds of ChooseAlgo, in bits of entropy per byte of the sample.
+const (
+	// storeEntropy is the entropy above which content is taken to be compressed or
+	// encrypted already, which no algorithm shrinks.
+	storeEntropy = 7.5
+	// lz4Entropy is the entropy above which content, typically binary, compresses too
+	// little for zstd to be worth its time.
+	lz4Entropy = 6.0
+)
+
+// storeRatio is the compression ratio of a sample with LZ4 above which ChooseAlgo stores
+// its content rather than spend time compressing it for next to nothing.
+const storeRatio = 0.97
+
+// AlgoSampleSize is how much of a file's beginning is sampled to choose its algorithm,
+// see ChooseAlgo.
+const AlgoSampleSize = 64 << 10
+
+// minAlgoSample is the smallest sample ChooseAlgo estimates the entropy of.
+const minAlgoSample = 256
+
+// AdaptiveTextLevel is the zstd level of files ChooseAlgo picks zstd for, unless a level
+// is configured: text compresses well, so a higher level pays off.
+const AdaptiveTextLevel = 7
+
+// ChooseAlgo picks an algorithm for content beginning with sample, from its Shannon
+// entropy: content that is already compressed or encrypted is stored, content that
+// barely compresses, such as binaries, gets LZ4, and anything else, typically text,
+// gets zstd. Samples too small to tell get zstd. As the entropy of single bytes misses
+// content whose bytes are unevenly spread but never repeat in sequence, the sample of
+// an LZ4 candidate is compressed with it, and its content stored if LZ4 doesn't
+// shrink it by more than a few percent.
+func (c *Compressor) ChooseAlgo(sample []byte) CompressionType {
+	if len(sample) < minAlgoSample {
+		return ZSTD
+	}
+	var counts [256]int
+	for _, b := range sample {
+		counts[b]++
+	}
+	var entropy float64
+	n := float64(len(sample))
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / n
+			entropy -= p * math.Log2(p)
+		}
+	}
+	switch {
+	case entropy > storeEntropy:
+		return STORE
+	case entropy > lz4Entropy:
+		if len(sample) > lz4BlockSize {
+			sample = sample[:lz4BlockSize]
+		}
+		var table [1 << lz4HashLog]int32
+		limit := int(float64(len(sample)) * storeRatio)
+		if n := lz4CompressBlock(make([]byte, limit), sample, &table); n == 0 {
+			return STORE
+		}
+		return LZ4
+	default:
+		return ZSTD
+	}
+}
+
+// extensionSet builds a case-insensitive lookup of file extensions. A missing leading
+// dot is added, so "jpg" and ".JPG" are the same extension.
+func extensionSet(lists ...[]string) map[string]bool {
+	set := make(map[string]bool)
+	for _, list := range lists {
+		for _, ext := range list {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext == "" {
+				continue
+			}
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			set[ext] = true
+		}
+	}
+	return set
+}
+
 // Compressor handles the streaming compression and decompression logic.
 // It is designed to be thread-safe and memory-efficient.
 type Compressor struct {
 	log         *logrus.Entry
-	workerPool  chan struct{} // Limits the number of concurrent compression jobs.
-	zstdEncoder *sync.Pool    // Pool of ZSTD encoders to reduce allocations.
-	zstdDecoder *sync.Pool    // Pool of ZSTD decoders.
+	workerPool  chan struct{}    // Limits the number of concurrent compression jobs.
+	memory      *memoryAdmission // Limits their total memory; nil if unbounded.
+	zstdDecoder *sync.Pool       // Pool of ZSTD decoders.
+
+	encoderMu   sync.Mutex
+	zstdEncoder map[zstdEncoderKey]*sync.Pool // Pools of ZSTD encoders per setting to reduce allocations.
+
+	compressCounters   operationCounters // See Stats.
+	decompressCounters operationCounters
+}
+
+// zstdEncoderKey identifies the settings of a pooled zstd encoder, which are fixed
+// when it is created.
+type zstdEncoderKey struct {
+	level     zstd.EncoderLevel
+	windowLog int
 }
 
 // NewCompressor initializes a new compressor with optimized defaults.
@@ -40,29 +215,100 @@ func NewCompressor() *Compressor {
 	}
 
 	return &Compressor{
-		log:        logrus.WithField("component", "compressor"),
-		workerPool: make(chan struct{}, numWorkers),
-		zstdEncoder: &sync.Pool{
-			New: func() interface{} {
-				// Encoder can be configured for different levels of compression.
-				encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
-				return encoder
-			},
-		},
+		log:         logrus.WithField("component", "compressor"),
+		workerPool:  make(chan struct{}, numWorkers),
+		zstdEncoder: make(map[zstdEncoderKey]*sync.Pool),
 		zstdDecoder: &sync.Pool{
 			New: func() interface{} {
-				decoder, _ := zstd.NewReader(nil)
+				decoder, _ := zstd.NewReader(nil, zstd.WithDecoderMaxWindow(1<<MaxWindowLog))
 				return decoder
 			},
 		},
 	}
 }
 
+// SetMemoryBudget bounds the total estimated memory of concurrent compressions (see
+// EstimateCompressionMemory) to budget bytes, queuing the compressions that don't fit
+// until enough memory is released. Zero or less removes the bound. It must be called
+// before the compressor is used.
+func (c *Compressor) SetMemoryBudget(budget int64) {
+	c.memory = nil
+	if budget > 0 {
+		c.memory = newMemoryAdmission(budget)
+	}
+}
+
+// MemoryUsage returns the estimated memory reserved by running compressions and the
+// number of compressions queued for memory. Both are zero without a memory budget.
+func (c *Compressor) MemoryUsage() (reserved int64, queued int) {
+	if c.memory == nil {
+		return 0, 0
+	}
+	return c.memory.usage()
+}
+
+// workers returns the size of the worker pool, the most compression or decompression
+// jobs running at the same time.
+func (c *Compressor) workers() int {
+	return cap(c.workerPool)
+}
+
 // Compress streams data from a reader, compresses it, and writes it to a writer.
 // It automatically selects the compression algorithm.
 func (c *Compressor) Compress(dst io.Writer, src io.Reader, compType CompressionType) (int64, error) {
-	c.log.WithField("algorithm", compType).Info("Starting compression stream")
+	return c.CompressLevel(dst, src, compType, DefaultLevel)
+}
+
+// CompressLevel is like Compress with an explicit compression level. Levels use each
+// algorithm's native scale: 1-22 for zstd (mapped onto its speed presets) and -2-9
+// for gzip. DefaultLevel selects the algorithm's default; STORE and LZ4 ignore the level.
+func (c *Compressor) CompressLevel(dst io.Writer, src io.Reader, compType CompressionType, level int) (int64, error) {
+	return c.CompressWith(dst, src, compType, CompressOptions{Level: level})
+}
+
+// encoderPool returns the pool of zstd encoders with the given settings, creating it
+// on first use.
+func (c *Compressor) encoderPool(key zstdEncoderKey) *sync.Pool {
+	c.encoderMu.Lock()
+	defer c.encoderMu.Unlock()
+	pool, ok := c.zstdEncoder[key]
+	if !ok {
+		pool = newEncoderPool(key)
+		c.zstdEncoder[key] = pool
+	}
+	return pool
+}
 
+// newEncoderPool returns a pool of zstd encoders with the given settings and extra
+// options.
+func newEncoderPool(key zstdEncoderKey, extra ...zstd.EOption) *sync.Pool {
+	opts := []zstd.EOption{zstd.WithEncoderLevel(key.level)}
+	if key.windowLog != 0 {
+		opts = append(opts, zstd.WithWindowSize(1<<key.windowLog))
+	}
+	opts = append(opts, extra...)
+	return &sync.Pool{
+		New: func() interface{} {
+			encoder, _ := zstd.NewWriter(nil, opts...)
+			return encoder
+		},
+	}
+}
+
+// CompressWith is like Compress with explicit options.
+func (c *Compressor) CompressWith(dst io.Writer, src io.Reader, compType CompressionType, opts CompressOptions) (_ int64, err error) {
+	level := opts.Level
+	c.log.WithFields(logrus.Fields{"algorithm": compType, "level": level, "window_log": opts.WindowLog}).Info("Starting compression stream")
+	if opts.WindowLog != 0 && (opts.WindowLog < MinWindowLog || opts.WindowLog > MaxWindowLog) {
+		return 0, NewCoreError(ErrInvalidInput, fmt.Sprintf("invalid zstd window log %d (want %d-%d)", opts.WindowLog, MinWindowLog, MaxWindowLog))
+	}
+	queued := time.Now()
+
+	// Wait for memory before taking a worker, so a queued job doesn't hold one idle.
+	if c.memory != nil {
+		release := c.memory.acquire(EstimateCompressionMemory(compType, opts))
+		defer release()
+	}
 	// Acquire a worker from the pool to limit concurrency.
 	c.workerPool <- struct{}{}
 	defer func() { <-c.workerPool }() // Release the worker when done.
@@ -72,30 +318,56 @@ func (c *Compressor) Compress(dst io.Writer, src io.Reader, compType Compression
 
 	// The Counter is used to track the number of bytes written to the underlying writer.
 	counter := &writeCounter{writer: dst}
+	in := &readCounter{reader: src}
+	start := time.Now()
+	defer func() { c.compressCounters.record(queued, start, in.total, counter.total, err) }()
 
 	switch compType {
 	case ZSTD:
+		encoderLevel := zstd.SpeedDefault
+		if level != DefaultLevel {
+			if level < 1 || level > 22 {
+				return 0, NewCoreError(ErrInvalidInput, fmt.Sprintf("invalid zstd level %d (want 1-22)", level))
+			}
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
 		// Get an encoder from the pool and reset it to write to our destination.
-		zstdWriter := c.zstdEncoder.Get().(*zstd.Encoder)
+		key := zstdEncoderKey{level: encoderLevel, windowLog: opts.WindowLog}
+		pool := c.encoderPool(key)
+		if opts.Dictionary != nil {
+			pool = opts.Dictionary.encoderPool(key)
+		}
+		zstdWriter := pool.Get().(*zstd.Encoder)
 		zstdWriter.Reset(counter)
-		defer func() {
-			zstdWriter.Close()
-			c.zstdEncoder.Put(zstdWriter) // Return encoder to the pool.
-		}()
+		// Closing twice would emit stray bytes at some levels, so the deferred cleanup
+		// only returns the encoder to the pool; Reset discards any unfinished frame.
+		defer pool.Put(zstdWriter)
 		compWriter = zstdWriter
 
 	case GZIP:
+		if level == DefaultLevel {
+			level = gzip.DefaultCompression
+		}
 		// Gzip writer doesn't have a poolable equivalent as easily, so we create a new one.
-		gzipWriter := gzip.NewWriter(counter)
+		gzipWriter, err := gzip.NewWriterLevel(counter, level)
+		if err != nil {
+			return 0, NewCoreError(ErrInvalidInput, fmt.Sprintf("invalid gzip level %d (want -2-9)", level)).Wrap(err)
+		}
 		defer gzipWriter.Close()
 		compWriter = gzipWriter
 
+	case LZ4:
+		compWriter = newLZ4Writer(counter)
+
+	case STORE:
+		compWriter = nopWriteCloser{counter}
+
 	default:
 		return 0, NewCoreError(ErrUnsupportedAlgorithm, "unsupported compression type: "+string(compType))
 	}
 
 	// io.Copy does the heavy lifting, streaming data in chunks, keeping memory usage low.
-	_, err := io.Copy(compWriter, src)
+	_, err = io.Copy(compWriter, in)
 	if err != nil {
 		return 0, NewCoreError(ErrCompression, "failed during data streaming").Wrap(err)
 	}
@@ -112,26 +384,43 @@ func (c *Compressor) Compress(dst io.Writer, src io.Reader, compType Compression
 
 // Decompress streams data from a reader, decompresses it, and writes it to a writer.
 func (c *Compressor) Decompress(dst io.Writer, src io.Reader, compType CompressionType) (int64, error) {
+	return c.DecompressWith(dst, src, compType, nil)
+}
+
+// DecompressWith is like Decompress for data that may have been compressed with dict,
+// see CompressOptions.Dictionary. zstd frames compressed without a dictionary are still
+// decompressed when dict is set.
+func (c *Compressor) DecompressWith(dst io.Writer, src io.Reader, compType CompressionType, dict *Dictionary) (_ int64, err error) {
 	c.log.WithField("algorithm", compType).Info("Starting decompression stream")
+	queued := time.Now()
 
 	// Acquire a worker from the pool.
 	c.workerPool <- struct{}{}
 	defer func() { <-c.workerPool }()
 
-	var compReader io.ReadCloser
+	in := &readCounter{reader: src}
+	out := &writeCounter{writer: dst}
+	src, dst = in, out
+	start := time.Now()
+	defer func() { c.decompressCounters.record(queued, start, in.total, out.total, err) }()
+
+	var compReader io.Reader
 
 	switch compType {
 	case ZSTD:
 		// Get a decoder from the pool and reset it to read from our source.
-		zstdReader := c.zstdDecoder.Get().(*zstd.Decoder)
+		pool := c.zstdDecoder
+		if dict != nil {
+			pool = dict.decoders
+		}
+		zstdReader := pool.Get().(*zstd.Decoder)
 		if err := zstdReader.Reset(src); err != nil {
-			c.zstdDecoder.Put(zstdReader)
+			pool.Put(zstdReader)
 			return 0, NewCoreError(ErrDecompression, "failed to reset zstd decoder").Wrap(err)
 		}
-		defer func() {
-			zstdReader.Close()
-			c.zstdDecoder.Put(zstdReader) // Return decoder to the pool.
-		}()
+		// The decoder is not closed here: a closed decoder cannot be reset,
+		// so it is simply returned to the pool for reuse.
+		defer pool.Put(zstdReader)
 		compReader = zstdReader
 
 	case GZIP:
@@ -142,6 +431,12 @@ func (c *Compressor) Decompress(dst io.Writer, src io.Reader, compType Compressi
 		defer gzipReader.Close()
 		compReader = gzipReader
 
+	case LZ4:
+		compReader = newLZ4Reader(src)
+
+	case STORE:
+		compReader = src
+
 	default:
 		return 0, NewCoreError(ErrUnsupportedAlgorithm, "unsupported compression type: "+string(compType))
 	}
@@ -156,6 +451,13 @@ func (c *Compressor) Decompress(dst io.Writer, src io.Reader, compType Compressi
 	return writtenBytes, nil
 }
 
+// nopWriteCloser adds a no-op Close to an io.Writer, for the STORE algorithm.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
 // writeCounter is a helper struct to count bytes written to an io.Writer.
 type writeCounter struct {
 	writer io.Writer
@@ -0,0 +1,87 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// CompressorStats are the totals of the calls a Compressor served since it was
+// created, see Compressor.Stats.
+type CompressorStats struct {
+	Compress   OperationStats `json:"compress"`
+	Decompress OperationStats `json:"decompress"`
+}
+
+// OperationStats are the totals of one kind of Compressor call. A large Wait means the
+// worker pool or the memory budget holds calls back.
+type OperationStats struct {
+	Calls    int64         `json:"calls"`
+	Errors   int64         `json:"errors"`
+	BytesIn  int64         `json:"bytes_in"`  // Read from the source.
+	BytesOut int64         `json:"bytes_out"` // Written to the destination.
+	Duration time.Duration `json:"duration"`  // Time spent streaming, once a worker was available.
+	Wait     time.Duration `json:"wait"`      // Time spent queued for a worker or memory.
+}
+
+// CompressThroughput returns the uncompressed bytes compressed per second of
+// streaming, 0 before any compression. Well below the speed of the algorithm, it means
+// the archive is I/O bound rather than CPU bound.
+func (s CompressorStats) CompressThroughput() float64 {
+	return throughput(s.Compress.BytesIn, s.Compress.Duration)
+}
+
+// DecompressThroughput is like CompressThroughput for decompression.
+func (s CompressorStats) DecompressThroughput() float64 {
+	return throughput(s.Decompress.BytesOut, s.Decompress.Duration)
+}
+
+func throughput(bytes int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) / d.Seconds()
+}
+
+// operationCounters accumulates OperationStats from concurrent calls.
+type operationCounters struct {
+	calls, errors, in, out, duration, wait atomic.Int64
+}
+
+// record adds a call that was queued at queued, started streaming at start, read in
+// bytes and wrote out bytes.
+func (c *operationCounters) record(queued, start time.Time, in, out int64, err error) {
+	c.calls.Add(1)
+	if err != nil {
+		c.errors.Add(1)
+	}
+	c.in.Add(in)
+	c.out.Add(out)
+	c.duration.Add(int64(time.Since(start)))
+	c.wait.Add(int64(start.Sub(queued)))
+}
+
+func (c *operationCounters) stats() OperationStats {
+	return OperationStats{
+		Calls:    c.calls.Load(),
+		Errors:   c.errors.Load(),
+		BytesIn:  c.in.Load(),
+		BytesOut: c.out.Load(),
+		Duration: time.Duration(c.duration.Load()),
+		Wait:     time.Duration(c.wait.Load()),
+	}
+}
+
+// Stats returns the totals of the compressions and decompressions c has served. They
+// are read without stopping calls in progress, so they may be slightly apart.
+func (c *Compressor) Stats() CompressorStats {
+	return CompressorStats{
+		Compress:   c.compressCounters.stats(),
+		Decompress: c.decompressCounters.stats(),
+	}
+}
+
+// CompressorStats returns the statistics of the compressor of e, see Compressor.Stats.
+func (e *Engine) CompressorStats() CompressorStats {
+	return e.compressor.Stats()
+}
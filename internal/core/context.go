@@ -0,0 +1,52 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader is a reader failing with the context's error once it is done, so a
+// cancelled operation stops in the middle of a file instead of at the next one.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// contextWriter is the writer counterpart of contextReader.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c *contextWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
+// withContextReader returns r reading until ctx is done, or r itself if ctx can't be
+// cancelled.
+func withContextReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		return r
+	}
+	return &contextReader{ctx: ctx, r: r}
+}
+
+// withContextWriter returns w writing until ctx is done, or w itself if ctx can't be
+// cancelled.
+func withContextWriter(ctx context.Context, w io.Writer) io.Writer {
+	if ctx.Done() == nil {
+		return w
+	}
+	return &contextWriter{ctx: ctx, w: w}
+}
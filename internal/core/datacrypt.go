@@ -0,0 +1,351 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Data encryption algorithms, stored in Header.EncryptionType. Codes are part of the
+// on-disk format and must never be reused.
+const (
+	EncryptionNone             uint8 = 0
+	EncryptionAES256GCM        uint8 = 1
+	EncryptionChaCha20Poly1305 uint8 = 2
+)
+
+// Names of the data encryption algorithms, see Config.EncryptionAlgo.
+const (
+	CipherAES256GCM        = "aes-256-gcm"
+	CipherChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+// EncryptionKeySize is the size in bytes of Config.EncryptionKey, which both ciphers use.
+const EncryptionKeySize = 32
+
+// With Config.EncryptionKey or Config.Passphrase, every compressed frame of the data
+// block is encrypted on its own, so files can still be extracted individually. Both
+// ciphers are AEADs with 12-byte nonces, so a frame is cut into chunks of up to
+// encryptionChunkSize bytes, each sealed separately:
+//
+//	length uint32 (big-endian) | nonce (12 random bytes) | ciphertext and tag (length bytes)
+//
+// The index of the chunk in the frame and whether it is the last one are
+// authenticated along with it, so chunks can't be reordered, dropped or truncated
+// without failing decryption. A frame always ends with a last chunk, possibly empty.
+const encryptionChunkSize = 64 << 10
+
+// dataAEAD returns the cipher of Header.EncryptionType encType for a data encryption key.
+func dataAEAD(encType uint8, key []byte) (cipher.AEAD, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, NewCoreError(ErrInvalidInput, fmt.Sprintf("encryption key must be %d bytes, got %d", EncryptionKeySize, len(key)))
+	}
+	switch encType {
+	case EncryptionAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, NewCoreError(ErrInvalidInput, "invalid encryption key").Wrap(err)
+		}
+		return cipher.NewGCM(block)
+	case EncryptionChaCha20Poly1305:
+		aead, err := chacha20poly1305.New(key)
+		if err != nil {
+			return nil, NewCoreError(ErrInvalidInput, "invalid encryption key").Wrap(err)
+		}
+		return aead, nil
+	default:
+		return nil, NewCoreError(ErrUnsupportedAlgorithm, fmt.Sprintf("unknown encryption type %d", encType))
+	}
+}
+
+// encryptionType returns the Header.EncryptionType of the cipher named algo, see
+// Config.EncryptionAlgo.
+func encryptionType(algo string) (uint8, error) {
+	switch algo {
+	case "", CipherAES256GCM:
+		return EncryptionAES256GCM, nil
+	case CipherChaCha20Poly1305:
+		return EncryptionChaCha20Poly1305, nil
+	default:
+		return 0, NewCoreError(ErrInvalidInput, fmt.Sprintf("unknown cipher %q (want %s or %s)", algo, CipherAES256GCM, CipherChaCha20Poly1305))
+	}
+}
+
+// chunkAD returns the additional data authenticated with chunk i of a frame.
+func chunkAD(i uint64, last bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, i)
+	if last {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// chunkWriter encrypts a frame written to it into sealed chunks. Close seals the last
+// chunk; it doesn't close the underlying writer.
+type chunkWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	out   []byte
+	index uint64
+	err   error
+}
+
+func newChunkWriter(w io.Writer, aead cipher.AEAD) *chunkWriter {
+	return &chunkWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, encryptionChunkSize),
+		out:  make([]byte, 4+aead.NonceSize()+encryptionChunkSize+aead.Overhead()),
+	}
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 && c.err == nil {
+		// A full chunk is only sealed once more data arrives, since the last chunk
+		// is sealed differently.
+		if len(c.buf) == cap(c.buf) {
+			c.err = c.seal(false)
+			continue
+		}
+		k := copy(c.buf[len(c.buf):cap(c.buf)], p)
+		c.buf = c.buf[:len(c.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, c.err
+}
+
+func (c *chunkWriter) Close() error {
+	if c.err == nil {
+		c.err = c.seal(true)
+	}
+	return c.err
+}
+
+// seal encrypts and writes the buffered chunk.
+func (c *chunkWriter) seal(last bool) error {
+	nonce := c.out[4 : 4+c.aead.NonceSize()]
+	if _, err := rand.Read(nonce); err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to generate encryption nonce").Wrap(err)
+	}
+	sealed := c.aead.Seal(c.out[4+len(nonce):4+len(nonce)], nonce, c.buf, chunkAD(c.index, last))
+	binary.BigEndian.PutUint32(c.out, uint32(len(sealed)))
+	if _, err := c.w.Write(c.out[:4+len(nonce)+len(sealed)]); err != nil {
+		return err
+	}
+	c.index++
+	c.buf = c.buf[:0]
+	return nil
+}
+
+// chunkReader decrypts a frame written by chunkWriter. A chunk that fails to
+// authenticate stops the frame before any of its content is returned.
+type chunkReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	path   string // File the frame holds, for errors.
+	index  uint64
+	length [4]byte // Length of the next chunk, read ahead to tell the last chunk.
+	buf    []byte
+	out    []byte // Unread plaintext of the current chunk.
+	last   bool
+	err    error
+	failed error // Authentication failure, see authErr.
+}
+
+func newChunkReader(r io.Reader, aead cipher.AEAD, path string) *chunkReader {
+	c := &chunkReader{
+		r:    r,
+		aead: aead,
+		path: path,
+		buf:  make([]byte, aead.NonceSize()+encryptionChunkSize+aead.Overhead()),
+	}
+	if _, err := io.ReadFull(r, c.length[:]); err != nil {
+		c.err = c.truncated(err)
+	}
+	return c
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.last {
+			return 0, io.EOF
+		}
+		c.err = c.open()
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (c *chunkReader) open() error {
+	nonceSize := c.aead.NonceSize()
+	size := int(binary.BigEndian.Uint32(c.length[:]))
+	if size < c.aead.Overhead() || size > encryptionChunkSize+c.aead.Overhead() {
+		return NewCoreError(ErrInvalidFormat, "invalid encrypted chunk in "+c.path)
+	}
+	chunk := c.buf[:nonceSize+size]
+	if _, err := io.ReadFull(c.r, chunk); err != nil {
+		return c.truncated(err)
+	}
+	_, err := io.ReadFull(c.r, c.length[:])
+	switch err {
+	case nil:
+	case io.EOF:
+		c.last = true
+	default:
+		return c.truncated(err)
+	}
+	plain, err := c.aead.Open(chunk[nonceSize:nonceSize], chunk[:nonceSize], chunk[nonceSize:], chunkAD(c.index, c.last))
+	if err != nil {
+		c.failed = NewCoreError(ErrDecryption, fmt.Sprintf("failed to authenticate the data of %s (wrong key or corrupted archive)", c.path)).Wrap(err)
+		return c.failed
+	}
+	c.index++
+	c.out = plain
+	return nil
+}
+
+// truncated reports a frame that ends early.
+func (c *chunkReader) truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return NewCoreError(ErrInvalidFormat, "encrypted data of "+c.path+" is truncated")
+	}
+	return NewCoreError(ErrArchiveRead, "failed to read the data of "+c.path).Wrap(err)
+}
+
+// authErr returns the error of a chunk that failed to authenticate, if any. It does
+// nothing on a nil reader.
+func (c *chunkReader) authErr() error {
+	if c == nil {
+		return nil
+	}
+	return c.failed
+}
+
+// frameReader returns a reader of the frame holding entry, decrypting it if the
+// archive is encrypted. The returned chunkReader is nil for unencrypted archives.
+func (e *Engine) frameReader(a *archiveReader, entry FileMetadata) (io.Reader, *chunkReader, error) {
+	section := io.NewSectionReader(a.r, HeaderSize+entry.Offset, entry.CompressedSize)
+	switch a.header.EncryptionType {
+	case EncryptionNone:
+		return section, nil, nil
+	case EncryptionAES256GCM, EncryptionChaCha20Poly1305:
+	default:
+		return nil, nil, NewCoreError(ErrUnsupportedAlgorithm, fmt.Sprintf("unknown encryption type %d", a.header.EncryptionType))
+	}
+	key, err := e.archiveDataKey(a)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := dataAEAD(a.header.EncryptionType, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := newChunkReader(section, aead, entry.Path)
+	return dec, dec, nil
+}
+
+// archiveDataKey returns the key decrypting the data of a: the key derived from
+// Config.Passphrase, mixed with the key file if the header says so, if the archive's
+// data key comes from a passphrase, or else Config.EncryptionKey or Config.KeyFile. It
+// is derived once per opened archive.
+func (e *Engine) archiveDataKey(a *archiveReader) ([]byte, error) {
+	a.dataKeyOnce.Do(func() {
+		switch {
+		case a.header.DataKDF != (KDFParams{}) && (e.config.Passphrase != nil || e.config.EncryptionKey == nil):
+			a.dataKey, a.dataKeyErr = e.passphraseDataKey(a.header)
+			if a.dataKeyErr == nil && a.header.Flags&FlagDataKeyFile != 0 {
+				a.dataKey, a.dataKeyErr = e.withKeyFile(a.dataKey, a.header)
+			}
+		case e.config.EncryptionKey != nil:
+			a.dataKey = append([]byte(nil), e.config.EncryptionKey...)
+		case e.keyFile != nil:
+			a.dataKey = append([]byte(nil), e.keyFile...)
+		default:
+			a.dataKeyErr = NewCoreError(ErrDecryption, "archive data is encrypted; an encryption key is required")
+		}
+	})
+	return a.dataKey, a.dataKeyErr
+}
+
+// newDataKey returns the key encrypting the data of a new archive, or nil if it isn't
+// encrypted: Config.EncryptionKey, or else a key derived from Config.Passphrase with a
+// new salt recorded in h, mixed with Config.KeyFile if set, or else Config.KeyFile.
+// The caller wipes it when done.
+func (e *Engine) newDataKey(h *Header) ([]byte, error) {
+	if e.config.EncryptionKey != nil {
+		return append([]byte(nil), e.config.EncryptionKey...), nil
+	}
+	if e.config.Passphrase == nil {
+		if e.keyFile != nil {
+			return append([]byte(nil), e.keyFile...), nil
+		}
+		return nil, nil
+	}
+	key, err := e.newPassphraseDataKey(h)
+	if err != nil || e.keyFile == nil {
+		return key, err
+	}
+	h.Flags |= FlagDataKeyFile
+	return e.withKeyFile(key, h)
+}
+
+// frameWriter writes the frames of a new data block to w, encrypting each one if it
+// has a key.
+type frameWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	encType uint8 // Header.EncryptionType of aead.
+}
+
+// newFrameWriter returns a frameWriter encrypting with key and the cipher of
+// Header.EncryptionType encType, or not at all if key is nil.
+func newFrameWriter(w io.Writer, encType uint8, key []byte) (*frameWriter, error) {
+	f := &frameWriter{w: w}
+	if key != nil {
+		aead, err := dataAEAD(encType, key)
+		if err != nil {
+			return nil, err
+		}
+		f.aead, f.encType = aead, encType
+	}
+	return f, nil
+}
+
+// encryptionType returns the Header.EncryptionType of the frames written.
+func (f *frameWriter) encryptionType() uint8 {
+	if f.aead == nil {
+		return EncryptionNone
+	}
+	return f.encType
+}
+
+// write writes one frame, produced by compress, and returns its size in the data block.
+func (f *frameWriter) write(compress func(w io.Writer) (int64, error)) (int64, error) {
+	if f.aead == nil {
+		return compress(f.w)
+	}
+	counter := &writeCounter{writer: f.w}
+	enc := newChunkWriter(counter, f.aead)
+	if _, err := compress(enc); err != nil {
+		return 0, err
+	}
+	if err := enc.Close(); err != nil {
+		return 0, err
+	}
+	return counter.total, nil
+}
@@ -0,0 +1,66 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"crypto/sha256"
+	"io"
+)
+
+// frameLocation is where a frame lies in the data block. Files with the same content
+// share a frame, so rewriting an archive copies each frame once.
+type frameLocation struct {
+	offset, size int64
+}
+
+// findDuplicates finds the files with the same content as an earlier one, for
+// Config.Dedup. Only files sharing their size with another are hashed, which takes an
+// extra read of each. It returns, for every file, the position of the earlier file it
+// duplicates, or -1, and the checksums of the files hashed.
+func (e *Engine) findDuplicates(files []InputFile, job *createJob) ([]int, map[int][32]byte, error) {
+	dups := make([]int, len(files))
+	bySize := make(map[int64][]int)
+	for i, file := range files {
+		dups[i] = -1
+		// Empty files have no data to share.
+		if size := file.Info.Size(); size > 0 {
+			bySize[size] = append(bySize[size], i)
+		}
+	}
+
+	sums := make(map[int][32]byte)
+	for _, same := range bySize {
+		if len(same) < 2 {
+			continue
+		}
+		first := make(map[[32]byte]int) // Earliest file with each checksum.
+		for _, i := range same {
+			sum, err := e.hashInput(files[i], job)
+			if err != nil {
+				return nil, nil, err
+			}
+			sums[i] = sum
+			if j, ok := first[sum]; ok {
+				dups[i] = j
+			} else {
+				first[sum] = i
+			}
+		}
+	}
+	return dups, sums, nil
+}
+
+// hashInput returns the SHA-256 checksum of the content of file.
+func (e *Engine) hashInput(file InputFile, job *createJob) ([32]byte, error) {
+	var sum [32]byte
+	f, err := file.openContent()
+	if err != nil {
+		return sum, NewCoreError(ErrArchiveWrite, "failed to open input "+file.Path).Wrap(err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, job.reader(f)); err != nil {
+		return sum, NewCoreError(ErrArchiveWrite, "failed to read input "+file.Path).Wrap(err)
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
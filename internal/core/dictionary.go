@@ -0,0 +1,238 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// DefaultDictionarySize is the size of the dictionaries TrainDictionary builds, as
+	// zstd's own trainer: large enough for the common parts of typical small files.
+	DefaultDictionarySize = 110 << 10
+	// maxDictionarySize caps dictionaries read from archives.
+	maxDictionarySize = 8 << 20
+
+	// dictSampleSize is how much of each input TrainDictionary samples, and
+	// dictSampleTotal how much it samples in all.
+	dictSampleSize  = 128 << 10
+	dictSampleTotal = 16 << 20
+	// minDictSamples is the least input TrainDictionary trains on, below which a
+	// dictionary can't be expected to help.
+	minDictSamples = 4 << 10
+)
+
+// Dictionary is a zstd dictionary compressing and decompressing data, see
+// CompressOptions.Dictionary. The encoders and decoders using it are pooled with it,
+// so they are released along with it.
+type Dictionary struct {
+	data []byte
+	id   uint32
+
+	encoderMu sync.Mutex
+	encoders  map[zstdEncoderKey]*sync.Pool
+	decoders  *sync.Pool
+}
+
+// NewDictionary parses a zstd dictionary, such as one built by TrainDictionary.
+func NewDictionary(data []byte) (*Dictionary, error) {
+	info, err := zstd.InspectDictionary(data)
+	if err != nil {
+		return nil, NewCoreError(ErrInvalidInput, "invalid zstd dictionary").Wrap(err)
+	}
+	d := &Dictionary{
+		data:     append([]byte(nil), data...),
+		id:       info.ID(),
+		encoders: make(map[zstdEncoderKey]*sync.Pool),
+	}
+	d.decoders = &sync.Pool{
+		New: func() interface{} {
+			decoder, _ := zstd.NewReader(nil, zstd.WithDecoderMaxWindow(1<<MaxWindowLog), zstd.WithDecoderDicts(d.data))
+			return decoder
+		},
+	}
+	return d, nil
+}
+
+// Bytes returns the encoded dictionary.
+func (d *Dictionary) Bytes() []byte {
+	return d.data
+}
+
+// ID returns the dictionary id recorded in the frames compressed with it.
+func (d *Dictionary) ID() uint32 {
+	return d.id
+}
+
+// encoderPool returns the pool of zstd encoders using d with the given settings,
+// creating it on first use.
+func (d *Dictionary) encoderPool(key zstdEncoderKey) *sync.Pool {
+	d.encoderMu.Lock()
+	defer d.encoderMu.Unlock()
+	pool, ok := d.encoders[key]
+	if !ok {
+		pool = newEncoderPool(key, zstd.WithEncoderDict(d.data))
+		d.encoders[key] = pool
+	}
+	return pool
+}
+
+// TrainDictionary builds a zstd dictionary from samples of the files of inputFiles,
+// collected like Create does, to be set as Config.Dictionary. It pays off for archives
+// of many small, similar files such as JSON documents or logs, where each file is too
+// small for zstd to learn its structure: the dictionary holds their common content
+// once. The beginning of every file is sampled, up to 16 MiB in all, spread evenly
+// over the files. Inputs with too little content fail with ErrInvalidInput.
+// No token is consumed.
+func (e *Engine) TrainDictionary(inputFiles []string) ([]byte, error) {
+	if err := e.validateInputs(inputFiles); err != nil {
+		return nil, err
+	}
+	inputs, err := e.CollectInputs(inputFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	files := inputs.Files
+	perFile := int64(dictSampleSize)
+	if len(files) > 0 && int64(len(files))*perFile > dictSampleTotal {
+		perFile = dictSampleTotal / int64(len(files))
+	}
+	var samples [][]byte
+	var total int
+	for _, file := range files {
+		sample, err := readSample(file, perFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(sample) > 0 {
+			samples = append(samples, sample)
+			total += len(sample)
+		}
+	}
+	if total < minDictSamples || len(samples) < 2 {
+		return nil, NewCoreError(ErrInvalidInput, fmt.Sprintf("not enough content to train a dictionary (%d bytes in %d files)", total, len(samples)))
+	}
+
+	history := dictionaryHistory(samples, DefaultDictionarySize)
+	level := zstd.SpeedDefault
+	if e.config.CompressionLevel != DefaultLevel {
+		level = zstd.EncoderLevelFromZstd(e.config.CompressionLevel)
+	}
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       dictionaryID(history),
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    level,
+	})
+	if err != nil {
+		return nil, NewCoreError(ErrCompression, "failed to build dictionary").Wrap(err)
+	}
+	e.log.WithField("size", len(dict)).WithField("samples", len(samples)).Info("Dictionary trained")
+	return dict, nil
+}
+
+// readSample returns up to n bytes from the beginning of file.
+func readSample(file InputFile, n int64) ([]byte, error) {
+	f, err := file.openContent()
+	if err != nil {
+		return nil, NewCoreError(ErrInvalidInput, "failed to open input "+file.Path).Wrap(err)
+	}
+	defer f.Close()
+	sample, err := io.ReadAll(io.LimitReader(f, n))
+	if err != nil {
+		return nil, NewCoreError(ErrInvalidInput, "failed to read input "+file.Path).Wrap(err)
+	}
+	return sample, nil
+}
+
+// dictionaryHistory returns the content of a dictionary of up to size bytes for
+// samples: an equal share of the beginning of each, which is where similar files tend
+// to agree, in order. zstd finds matches nearer the end of the content more cheaply,
+// which favors the last samples slightly.
+func dictionaryHistory(samples [][]byte, size int) []byte {
+	share := size / len(samples)
+	if share < 256 {
+		share = 256
+	}
+	history := make([]byte, 0, size)
+	for _, sample := range samples {
+		if len(sample) > share {
+			sample = sample[:share]
+		}
+		if len(history)+len(sample) > size {
+			sample = sample[:size-len(history)]
+		}
+		history = append(history, sample...)
+		if len(history) == size {
+			break
+		}
+	}
+	return history
+}
+
+// dictionaryID derives the id of a dictionary from its content, so the same samples
+// make the same dictionary. Ids below 32768 are reserved by zstd, and ids of 2^31 and
+// above are best avoided.
+func dictionaryID(history []byte) uint32 {
+	return 1<<15 + crc32.ChecksumIEEE(history)%(1<<31-1<<15)
+}
+
+// archiveDictionary returns the dictionary new archives compressed with algo use,
+// from Config.Dictionary; nil if none is configured.
+func (e *Engine) archiveDictionary(algo CompressionType) (*Dictionary, error) {
+	if e.config.Dictionary == nil {
+		return nil, nil
+	}
+	if algo != ZSTD {
+		return nil, NewCoreError(ErrInvalidInput, "a dictionary only applies to zstd, not "+string(algo))
+	}
+	if e.config.EncryptionKey != nil || e.config.Passphrase != nil {
+		// The dictionary is stored in the clear, and it holds samples of the content.
+		return nil, NewCoreError(ErrInvalidInput, "a dictionary can't be combined with encryption")
+	}
+	return NewDictionary(e.config.Dictionary)
+}
+
+// writeDictionary writes the dictionary block of dict, if not nil, to out at offset
+// bytes into the data region, that is right after the data block, and records it in
+// header. It returns the size written.
+func writeDictionary(out io.Writer, header *Header, offset int64, dict *Dictionary) (int64, error) {
+	header.Flags &^= FlagDictionary
+	header.DictOffset, header.DictLength = 0, 0
+	if dict == nil {
+		return 0, nil
+	}
+	if _, err := out.Write(dict.data); err != nil {
+		return 0, NewCoreError(ErrArchiveWrite, "failed to write dictionary").Wrap(err)
+	}
+	header.Flags |= FlagDictionary
+	header.DictOffset = HeaderSize + offset
+	header.DictLength = uint32(len(dict.data))
+	return int64(len(dict.data)), nil
+}
+
+// readDictionary reads the dictionary block described by header; nil if there is none.
+// It lies between the data block and the index.
+func readDictionary(r io.ReaderAt, header *Header) (*Dictionary, error) {
+	if header.Flags&FlagDictionary == 0 {
+		return nil, nil
+	}
+	if header.DictOffset < HeaderSize || header.DictLength > maxDictionarySize || header.DictOffset+int64(header.DictLength) > header.IndexOffset {
+		return nil, NewCoreError(ErrInvalidFormat, "archive dictionary lies outside the file")
+	}
+	data := make([]byte, header.DictLength)
+	if _, err := r.ReadAt(data, header.DictOffset); err != nil {
+		return nil, NewCoreError(ErrArchiveRead, "failed to read archive dictionary").Wrap(err)
+	}
+	dict, err := NewDictionary(data)
+	if err != nil {
+		return nil, NewCoreError(ErrInvalidFormat, "archive dictionary is corrupt").Wrap(err)
+	}
+	return dict, nil
+}
@@ -4,12 +4,20 @@
 package core
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/klauspost/compress/zstd"
 	"github.com/sirupsen/logrus"
 )
 
@@ -38,15 +46,189 @@ type FileIndexEntry struct {
 // This would be loaded from a file (e.g., YAML) or environment variables.
 type Config struct {
 	LicenseKey    string
-	TokenCount    int    // Number of available tokens
-	DefaultAlgo   string // Default compression algorithm
-	EncryptionKey []byte // 256-bit key for AES
+	Tokens        TokenSource // Charged by Create; required for creating archives
+	CostPolicy    CostPolicy  // Token cost of a create; defaults to DefaultCostPolicy
+	DefaultAlgo   string      // Default compression algorithm
+	EncryptionKey []byte      // 256-bit key encrypting the data of new archives with EncryptionAlgo
+	Creator       string      // Optional label recorded in the archive metadata
+	Reproducible  bool        // Strip host and user details from the archive metadata
+
+	ExcludeVCS       bool // Skip version-control directories such as .git
+	NoDefaultIgnores bool // Archive OS artifacts such as .DS_Store instead of skipping them
+	KeepGoing        bool // Skip and report unreadable files instead of failing
+	FollowSymlinks   bool // Archive the targets of symbolic links found in input directories instead of skipping them
+
+	// Exclude lists glob patterns (see filepath.Match) of paths left out of archives,
+	// on top of the default ignores. A pattern without a slash, such as "*.tmp" or
+	// "node_modules", matches any component of a path; one with a slash matches the
+	// whole path relative to the input directory, where "**" stands for any number of
+	// directories, as in "build/**/*.o". Excluding a directory excludes all it holds.
+	Exclude []string
+
+	// OnlyNewer, when non-zero, restricts create to files modified after this time,
+	// producing a lightweight incremental archive.
+	OnlyNewer time.Time
+
+	// SearchIndex selects where the full-text search index is stored.
+	// Defaults to SearchIndexEmbedded.
+	SearchIndex SearchIndexMode
+
+	// StoreExtensions lists the extensions of files that are stored without compression,
+	// such as ".jpg". Nil selects DefaultStoreExtensions; an empty non-nil list compresses
+	// every file. ExtraStoreExtensions are added to the list either way.
+	StoreExtensions      []string
+	ExtraStoreExtensions []string
+
+	// AdaptiveAlgo chooses the algorithm of each file from a sample of its beginning
+	// (see Compressor.ChooseAlgo) instead of using DefaultAlgo for all of them. Each file
+	// records its algorithm, and files given zstd use AdaptiveTextLevel unless
+	// CompressionLevel is set. Grouped files and files with StoreExtensions are left
+	// alone.
+	AdaptiveAlgo bool
+
+	// GroupSmallFiles packs files smaller than GroupThreshold (DefaultGroupThreshold
+	// if zero) into shared compression frames, which saves the per-frame overhead of
+	// archives with many tiny files. Larger files keep their own frames.
+	GroupSmallFiles bool
+	GroupThreshold  int64
+
+	// Dedup stores the data of files with identical content once: later copies point at
+	// the frame of the first, which suits backups holding the same file many times.
+	// Files sharing their size with another are read an extra time to be hashed, and
+	// imported tar files, which can only be read once, are not deduplicated.
+	Dedup bool
+
+	// Chunking splits files larger than 16 KiB into content-defined chunks of 64 KiB on
+	// average, each compressed as its own frame, and stores chunks found in several
+	// files once. Files that differ by a few edits, such as versions of a large file,
+	// then share most of their data. Chunked files are neither grouped nor compressed
+	// with TargetRate or AdaptiveAlgo.
+	Chunking bool
+
+	// IndexKey, if set, is a 256-bit key encrypting the archive index, and is needed to
+	// read archives whose index is encrypted. It is independent of the data encryption,
+	// so access to an archive's metadata can be changed with RewrapIndex.
+	IndexKey []byte
+
+	// IndexKeySource, if set, supplies the index key of each archive read instead of
+	// IndexKey, for example by deriving it from a passphrase or unwrapping it with a key
+	// service. It is asked once per opened archive. New archives still use IndexKey.
+	IndexKeySource KeySource
+
+	// Passphrase, if set, protects the index of new archives with a key derived from it
+	// with Argon2id (see DeriveKey) instead of IndexKey, and is needed to read such
+	// archives. Unless EncryptionKey is set, it encrypts their data as well, with a key
+	// derived from it with a salt of its own. KDF sets the Argon2id parameters of new
+	// archives; its zero fields take those of DefaultKDFParams.
+	Passphrase []byte
+	KDF        KDFParams
+
+	// KeyFile is the path of a file holding exactly EncryptionKeySize raw bytes, such as
+	// a key kept on a hardware token, used like EncryptionKey. Combined with Passphrase,
+	// the data key is mixed from both with HKDF (see FlagDataKeyFile), so the data of
+	// the archive needs the key file and the passphrase while its index only needs the
+	// passphrase. It can't be combined with EncryptionKey. The key is read once by
+	// NewEngine and never logged.
+	KeyFile string
+
+	// EncryptionAlgo is the cipher encrypting the data of new archives with
+	// EncryptionKey or Passphrase: CipherAES256GCM, the default, or
+	// CipherChaCha20Poly1305, which is faster on CPUs without AES instructions. It is
+	// recorded in the header, so reading needs no setting. The index is always
+	// encrypted with AES-256-GCM.
+	EncryptionAlgo string
+
+	// IndexCompression selects whether the archive index is compressed.
+	// Defaults to IndexCompressionAuto.
+	IndexCompression IndexCompressionMode
+
+	// TempDir is where intermediate data is buffered, such as streamed input whose
+	// size isn't known up front. Defaults to the system temp directory.
+	TempDir string
+
+	// WindowLog sets the zstd window of new archives to 1<<WindowLog bytes (see
+	// CompressOptions). It is recorded in the header, and extracting needs as much
+	// memory as the window. Zero keeps the default.
+	WindowLog int
+
+	// Dictionary, if set, is a zstd dictionary new archives are compressed with, as
+	// built by TrainDictionary. It is stored in the archive, which extraction reads it
+	// from. It needs zstd and can't be combined with encryption.
+	Dictionary []byte
+
+	// LongDistance enables long-distance matching for inputs whose redundancy is spread
+	// far apart, such as concatenated logs or VM images. It uses a LongWindowLog window
+	// unless WindowLog is set, so compressing and extracting need about 128 MiB more.
+	LongDistance bool
+
+	// CompressionLevel is the compression level of new archives on the algorithm's own
+	// scale (see CompressLevel and ParseCompressionLevel); DefaultLevel selects the
+	// algorithm's default. It is recorded in the header.
+	CompressionLevel int
+
+	// TargetRate, if positive, makes zstd compression adaptive for real-time
+	// pipelines: each file starts at CompressionLevel and is compressed at lower levels while the
+	// throughput stays below TargetRate bytes per second, then at higher ones again up
+	// to CompressionLevel when there is headroom (see Compressor.CompressAdaptive). The levels used
+	// are recorded in the archive metadata. Since they depend on timing, it can't be
+	// combined with Reproducible.
+	TargetRate float64
+
+	// CompressionMemoryBudget, if positive, bounds the estimated memory of concurrent
+	// compressions in bytes (see Compressor.SetMemoryBudget), so a process shared by
+	// many requests doesn't run out of memory on high levels or large windows.
+	CompressionMemoryBudget int64
+
+	// CompressionWorkers is how many files Create works on at the same time. Files of up
+	// to 1 MiB are compressed ahead of their turn into memory and written in order, so
+	// the archive is the same either way. Zero uses the size of the compressor's worker
+	// pool (half the CPUs), which also bounds how many compressions run at once whatever
+	// the setting; 1 compresses one file at a time.
+	CompressionWorkers int
+
+	// ExtractWorkers is how many files Extract writes at the same time, each read
+	// through its own view of the archive. Files are stored in frames of their own, so
+	// neither encryption nor a dictionary ties them together. Zero uses the size of the
+	// compressor's worker pool, which also bounds how many decompressions run at once;
+	// 1 extracts one file at a time. Archives with grouped files (see GroupSmallFiles)
+	// are always extracted one file at a time, as a group is decompressed once for all
+	// its members.
+	ExtractWorkers int
+
+	// MaxExtractSize and MaxExtractRatio, if positive, guard against decompression
+	// bombs: reading an archive fails with ErrLimitExceeded once more than
+	// MaxExtractSize bytes have been decompressed from it, or once a file expands to
+	// more than MaxExtractRatio times its compressed size (files may always expand to
+	// 1 MiB). Decompression stops as soon as a limit is crossed.
+	MaxExtractSize  int64
+	MaxExtractRatio float64
+
+	// RequireSearchIndex makes searches of archives without a search index fail with
+	// ErrNoSearchIndex instead of decompressing every file to scan it, which can be
+	// slow on large archives.
+	RequireSearchIndex bool
+
+	// Progress, if set, is called as Create and Extract read and write file content,
+	// at most every 100ms and once more at the end, with the bytes processed so far
+	// and the total size of the files. It is called from the goroutine running the
+	// operation.
+	Progress ProgressFunc
 }
 
+// largeWindowLog is the window log above which creating an archive warns about the
+// memory needed to extract it.
+const largeWindowLog = 27
+
 // Engine is the central struct that orchestrates all core operations.
+// It is safe for concurrent use: the configuration is only read after construction and
+// the compressor pools its encoders, so a single engine can be shared by every request
+// of a long-running process. Token accounting can be injected per call with
+// CreateWithTokens, keeping account state out of the shared engine.
 type Engine struct {
-	config *Config
-	log    *logrus.Entry
+	config     *Config
+	log        *logrus.Entry
+	compressor *Compressor
+	keyFile    []byte // Content of Config.KeyFile; nil if none.
 }
 
 // NewEngine creates and initializes a new Engine with the given configuration.
@@ -58,119 +240,912 @@ func NewEngine(cfg *Config) (*Engine, error) {
 		logrus.Warn("No license key provided. Operations requiring tokens may fail.")
 	}
 
-	// In a real app, you would validate the license key against a remote API
-	// to fetch the initial token count.
-	// For now, we simulate a free token.
-	if cfg.TokenCount == 0 {
-		cfg.TokenCount = 1 // Grant one free token by default.
+	if err := checkExcludePatterns(cfg.Exclude); err != nil {
+		return nil, err
+	}
+
+	var keyFile []byte
+	if cfg.KeyFile != "" {
+		if cfg.EncryptionKey != nil {
+			return nil, NewCoreError(ErrInvalidInput, "a key file can't be combined with an encryption key")
+		}
+		var err error
+		if keyFile, err = ReadKeyFile(cfg.KeyFile); err != nil {
+			return nil, err
+		}
 	}
 
+	compressor := NewCompressor()
+	compressor.SetMemoryBudget(cfg.CompressionMemoryBudget)
 	return &Engine{
-		config: cfg,
-		log:    logrus.WithField("component", "engine"),
+		config:     cfg,
+		log:        logrus.WithField("component", "engine"),
+		compressor: compressor,
+		keyFile:    keyFile,
 	}, nil
 }
 
 // Create compresses input files into a single .nsm archive.
 // It handles token validation, streaming compression, and encryption.
-func (e *Engine) Create(outputFile string, inputFiles []string) error {
-	e.log.Info("Validating token for 'create' operation...")
-	if err := e.useToken(); err != nil {
-		return err
+// The token is charged to Config.Tokens.
+func (e *Engine) Create(outputFile string, inputFiles []string) (*CreateResult, error) {
+	return e.CreateContext(context.Background(), outputFile, inputFiles)
+}
+
+// CreateContext is like Create, and stops once ctx is done, between files or in the
+// middle of one. The partial archive is then removed, the tokens are refunded, and
+// ctx.Err() is returned.
+func (e *Engine) CreateContext(ctx context.Context, outputFile string, inputFiles []string) (*CreateResult, error) {
+	return e.createWithTokens(ctx, outputFile, inputFiles, e.config.Tokens)
+}
+
+// CreateWithTokens is like Create but charges the operation to tokens instead of
+// Config.Tokens, letting callers that share one engine keep tokens per account.
+// The cost is computed by the cost policy once the inputs have been validated, consumed
+// in one go, and refunded if the archive could not be written.
+func (e *Engine) CreateWithTokens(outputFile string, inputFiles []string, tokens TokenSource) (*CreateResult, error) {
+	return e.createWithTokens(context.Background(), outputFile, inputFiles, tokens)
+}
+
+// createWithTokens implements CreateWithTokens and CreateContext.
+func (e *Engine) createWithTokens(ctx context.Context, outputFile string, inputFiles []string, tokens TokenSource) (*CreateResult, error) {
+	if tokens == nil {
+		return nil, NewCoreError(ErrInvalidInput, "no token source configured for 'create' operation")
+	}
+
+	// Inputs are checked before the token is consumed, so a mistyped path
+	// doesn't cost the user a token.
+	if err := e.validateInputs(inputFiles); err != nil {
+		return nil, err
+	}
+
+	inputs, err := e.CollectInputs(inputFiles)
+	if err != nil {
+		return nil, err
+	}
+	for _, skipped := range inputs.Skipped {
+		e.log.WithField("path", skipped.Path).WithError(skipped.Err).Warn("Skipping unreadable file")
+	}
+	return e.createFromInputs(outputFile, inputs, tokens, &createJob{ctx: ctx})
+}
+
+// CreateFromList is like Create for the paths of a file list (see ReadFileList), such
+// as the output of find, which may be longer than a command line allows. Files are
+// stored under the paths they are listed with (see CollectListedInputs), and the
+// configured filters apply. Listed paths that don't exist are all reported, before the
+// token is consumed.
+func (e *Engine) CreateFromList(outputFile string, paths []string) (*CreateResult, error) {
+	tokens := e.config.Tokens
+	if tokens == nil {
+		return nil, NewCoreError(ErrInvalidInput, "no token source configured for 'create' operation")
+	}
+	if len(paths) == 0 {
+		return nil, NewCoreError(ErrInvalidInput, "the file list is empty")
+	}
+	if err := e.validateInputs(paths); err != nil {
+		return nil, err
+	}
+
+	inputs, err := e.CollectListedInputs(paths)
+	if err != nil {
+		return nil, err
+	}
+	for _, skipped := range inputs.Skipped {
+		e.log.WithField("path", skipped.Path).WithError(skipped.Err).Warn("Skipping unreadable file")
+	}
+	return e.createFromInputs(outputFile, inputs, tokens, nil)
+}
+
+// createFromInputs charges tokens for inputs and archives them to outputFile. job, if
+// not nil, is told about every file archived and can cancel the archive.
+func (e *Engine) createFromInputs(outputFile string, inputs *InputSet, tokens TokenSource, job *createJob) (*CreateResult, error) {
+	start := time.Now()
+	if job == nil {
+		job = &createJob{ctx: context.Background()}
+	}
+	algo := CompressionType(e.config.DefaultAlgo)
+	if algo == "" {
+		algo = ZSTD
+	}
+	algoCode, err := compressionCode(algo)
+	if err != nil {
+		return nil, err
+	}
+	switch e.config.SearchIndex {
+	case "", SearchIndexEmbedded, SearchIndexSidecar, SearchIndexNone:
+	default:
+		return nil, NewCoreError(ErrInvalidInput, "unknown search index mode: "+string(e.config.SearchIndex))
+	}
+	switch e.config.IndexCompression {
+	case "", IndexCompressionAuto, IndexCompressionAlways, IndexCompressionNever:
+	default:
+		return nil, NewCoreError(ErrInvalidInput, "unknown index compression mode: "+string(e.config.IndexCompression))
+	}
+	if err := e.checkWindowLog(algo); err != nil {
+		return nil, err
+	}
+	if err := e.checkTargetRate(algo); err != nil {
+		return nil, err
+	}
+	if _, err := e.archiveDictionary(algo); err != nil {
+		return nil, err
+	}
+	encType, err := encryptionType(e.config.EncryptionAlgo)
+	if err != nil {
+		return nil, err
+	}
+	if e.config.EncryptionKey != nil {
+		if _, err := dataAEAD(encType, e.config.EncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+	if e.config.Passphrase != nil && len(e.config.Passphrase) == 0 {
+		return nil, NewCoreError(ErrInvalidInput, "the passphrase cannot be empty")
+	}
+	if job.output != nil && e.config.SearchIndex == SearchIndexSidecar {
+		return nil, NewCoreError(ErrInvalidInput, "an archive written to a stream can't have a sidecar index")
+	}
+	if e.config.SearchIndex == SearchIndexSidecar && e.encrypts() {
+		return nil, NewCoreError(ErrInvalidInput, "an encrypted archive can't have a sidecar index, which would hold its keywords unencrypted")
+	}
+
+	cost := e.cost(len(inputs.Files), inputs.TotalSize())
+	e.log.WithField("tokens", cost).Info("Validating tokens for 'create' operation...")
+	if err := tokens.ConsumeN(cost); err != nil {
+		return nil, fmt.Errorf("archive costs %d token(s): %w", cost, err)
 	}
 
 	e.log.WithFields(logrus.Fields{
-		"output": outputFile,
-		"algo":   "zstd", // Example of adaptive choice
+		"output":    outputFile,
+		"files":     len(inputs.Files),
+		"unchanged": inputs.Unchanged,
+		"excluded":  inputs.Excluded,
+		"algo":      algo,
 	}).Info("Starting compression")
 
-	// --- High-level plan for archive creation ---
-	// 1. Create the output file.
-	// 2. Write a placeholder for the NSMHeader.
-	// 3. Create a compression writer (e.g., zstd.NewWriter).
-	// 4. If encryption is enabled, wrap the writer with a cipher stream (e.g., cipher.NewGCM).
-	// 5. Loop through each input file:
-	//    a. Open the input file for reading.
-	//    b. Create a FileIndexEntry for the file.
-	//    c. Copy the file's content to the compression writer (io.Copy). This will stream the data.
-	//    d. Record the compressed size and update the index entry.
-	//    e. Add the entry to an in-memory index list.
-	// 6. Close the compression and encryption writers.
-	// 7. Record the current file offset; this is where the index will start.
-	// 8. Serialize the index (e.g., using JSON or Gob) and write it to the output file.
-	// 9. Go back to the beginning of the file (Seek).
-	// 10. Populate the final NSMHeader with correct offsets and lengths.
-	// 11. Write the final header.
-
-	return errors.New("Create function not fully implemented")
-}
-
-// Extract decompress a .nsm archive.
+	archiveSize, err := e.createArchive(outputFile, inputs, algo, algoCode, job)
+	if err != nil {
+		// The user didn't get an archive, so they shouldn't pay for it.
+		if refundErr := tokens.RefundN(cost); refundErr != nil {
+			e.log.WithError(refundErr).WithField("tokens", cost).Error("Failed to refund tokens after a failed create")
+		}
+		return nil, err
+	}
+	if logger, ok := tokens.(UsageLogger); ok {
+		// The archive exists either way; a missing record is only worth a warning.
+		if err := logger.LogUsage("create", outputFile); err != nil {
+			e.log.WithError(err).Warn("Failed to record token usage")
+		}
+	}
+
+	result := job.result(time.Since(start))
+	result.ArchiveSize = archiveSize
+	result.Excluded = inputs.Excluded
+	if result.InputSize > 0 {
+		result.Ratio = float64(result.ArchiveSize) / float64(result.InputSize)
+	}
+	e.log.WithField("output", outputFile).Info("Archive created")
+	return result, nil
+}
+
+// windowLog returns the zstd window log new archives are compressed with, 0 for the
+// default.
+func (e *Engine) windowLog() int {
+	if e.config.WindowLog == 0 && e.config.LongDistance {
+		return LongWindowLog
+	}
+	return e.config.WindowLog
+}
+
+// checkWindowLog validates the configured window for compressing with algo, and warns
+// when it needs a lot of memory.
+func (e *Engine) checkWindowLog(algo CompressionType) error {
+	w := e.windowLog()
+	if w == 0 {
+		return nil
+	}
+	if w < MinWindowLog || w > MaxWindowLog {
+		return NewCoreError(ErrInvalidInput, fmt.Sprintf("invalid window log %d (want %d-%d)", w, MinWindowLog, MaxWindowLog))
+	}
+	if algo != ZSTD {
+		return NewCoreError(ErrInvalidInput, "a window log only applies to zstd, not "+string(algo))
+	}
+	if w > largeWindowLog {
+		e.log.WithField("window_mib", 1<<(w-20)).Warn("Large compression window: compressing and extracting need about this much memory")
+	}
+	return nil
+}
+
+// checkTargetRate validates Config.TargetRate for compressing with algo.
+func (e *Engine) checkTargetRate(algo CompressionType) error {
+	switch rate := e.config.TargetRate; {
+	case rate < 0:
+		return NewCoreError(ErrInvalidInput, fmt.Sprintf("invalid target rate %g (want a positive number of bytes per second)", rate))
+	case rate == 0:
+		return nil
+	case algo != ZSTD:
+		return NewCoreError(ErrInvalidInput, "a target rate only applies to zstd, not "+string(algo))
+	case e.config.Reproducible:
+		return NewCoreError(ErrInvalidInput, "a target rate varies the compression with timing, so it can't be combined with reproducible archives")
+	}
+	return nil
+}
+
+// cost returns the token cost of archiving files totalling totalSize bytes.
+func (e *Engine) cost(files int, totalSize int64) int {
+	policy := e.config.CostPolicy
+	if policy == nil {
+		policy = DefaultCostPolicy
+	}
+	if cost := policy.Cost(files, totalSize); cost > 1 {
+		return cost
+	}
+	return 1
+}
+
+// createArchive writes the archive for inputs to outputFile, plus its sidecar index
+// when one is configured, or to the output of job if it has one. A partially written
+// archive is removed on failure. It returns the size of the archive.
+func (e *Engine) createArchive(outputFile string, inputs *InputSet, algo CompressionType, algoCode uint8, job *createJob) (int64, error) {
+	if job.output != nil {
+		return e.streamArchive(job.output, inputs, algo, algoCode, job)
+	}
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return 0, NewCoreError(ErrArchiveWrite, "failed to create archive "+outputFile).Wrap(err)
+	}
+	header, searchData, err := e.writeArchive(out, inputs, algo, algoCode, job)
+	if err != nil {
+		// A cancelled job may fail in the middle of a file; report the cancellation.
+		if jobErr := job.err(); jobErr != nil {
+			err = jobErr
+		}
+		out.Close()
+		os.Remove(outputFile) // Don't leave a half-written archive behind.
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(outputFile)
+		return 0, NewCoreError(ErrArchiveWrite, "failed to close archive "+outputFile).Wrap(err)
+	}
+	if header.Flags&FlagSearchSidecar != 0 {
+		if err := writeSidecarIndex(outputFile, header, searchData); err != nil {
+			os.Remove(outputFile)
+			return 0, err
+		}
+	}
+	return header.IndexOffset + header.IndexLength, nil
+}
+
+// writeArchive writes a complete archive to out. The layout is:
+// a fixed-size header, one compressed frame per file (the data block), then the index.
+// The header is written last, once the index offset and the data checksum are known.
+// It returns the final header and the search index that was built.
+func (e *Engine) writeArchive(out io.WriteSeeker, inputs *InputSet, algo CompressionType, algoCode uint8, job *createJob) (*Header, map[string][]string, error) {
+	files := inputs.Files
+	searchMode := e.config.SearchIndex
+	if searchMode == "" {
+		searchMode = SearchIndexEmbedded
+	}
+
+	// Reserve space for the header; it is rewritten at the end.
+	if err := WriteHeader(out, &Header{}); err != nil {
+		return nil, nil, err
+	}
+
+	// Every compressed byte of the data block goes through the checksum writer.
+	dataWriter, hasher := NewChecksumWriter(out)
+	var totalSize int64
+	for _, file := range files {
+		totalSize += file.Info.Size()
+	}
+	prog := newProgress(e.config.Progress, totalSize)
+	// The data key, if any, is derived before any data is written; the KDF parameters
+	// of a passphrase-derived key go in the header.
+	header := &Header{}
+	dataKey, err := e.newDataKey(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(dataKey)
+	encType, err := encryptionType(e.config.EncryptionAlgo)
+	if err != nil {
+		return nil, nil, err
+	}
+	frames, err := newFrameWriter(dataWriter, encType, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	idx := &Index{
+		Files:     make(map[string]FileMetadata, len(files)),
+		Metadata:  NewArchiveMetadata(e.config.Creator, e.config.Reproducible),
+		EmptyDirs: inputs.EmptyDirs,
+	}
+
+	storeExts := e.config.StoreExtensions
+	if storeExts == nil {
+		storeExts = DefaultStoreExtensions
+	}
+	stored := extensionSet(storeExts, e.config.ExtraStoreExtensions)
+
+	groupThreshold := e.config.GroupThreshold
+	if groupThreshold <= 0 {
+		groupThreshold = DefaultGroupThreshold
+	}
+	group := &fileGroup{id: 1}
+	dict, err := e.archiveDictionary(algo)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := CompressOptions{Level: e.config.CompressionLevel, WindowLog: e.windowLog(), Dictionary: dict}
+	levels := make(map[int]bool)
+	if opts.Level != DefaultLevel && algo == ZSTD {
+		levels[opts.Level] = true
+	}
+
+	searchData := make(map[string][]string)
+	var offset int64
+
+	// flushGroup compresses the pending group as one frame and points its members at it.
+	flushGroup := func() error {
+		if len(group.members) == 0 {
+			return nil
+		}
+		compressed, err := frames.write(func(w io.Writer) (int64, error) {
+			return e.compressor.CompressWith(w, &group.buf, algo, opts)
+		})
+		if err != nil {
+			return NewCoreError(ErrCompression, "failed to compress file group").Wrap(err)
+		}
+		var groupSize int64
+		for _, name := range group.members {
+			groupSize += idx.Files[name].UncompressedSize
+		}
+		for _, name := range group.members {
+			meta := idx.Files[name]
+			meta.Offset = offset
+			meta.CompressedSize = compressed
+			idx.Files[name] = meta
+			job.groupedFile(meta, algo, groupSize)
+		}
+		offset += compressed
+		group.reset()
+		return nil
+	}
+
+	// Small files are compressed ahead of their turn by up to workers goroutines, into
+	// buffers written in archive order, so the output doesn't depend on timing.
+	// Files with the same content as an earlier one share its frame, see Config.Dedup.
+	var dups []int
+	var sums map[int][32]byte
+	if e.config.Dedup && !inputs.sequential {
+		if dups, sums, err = e.findDuplicates(files, job); err != nil {
+			return nil, nil, err
+		}
+	}
+	shared := make(map[int]*inputDigest) // Digests of the files duplicated, once read.
+	for _, d := range dups {
+		if d >= 0 {
+			shared[d] = nil
+		}
+	}
+	var duplicates []string          // Names of the files sharing a frame, in order.
+	dupOf := make(map[string]string) // Name of the file each duplicates.
+	chunks := make(map[chunkKey]ChunkRef)
+
+	workers := e.compressionWorkers()
+	plans := make([]filePlan, len(files))
+	for i, file := range files {
+		plan := filePlan{algo: algo, dupOf: -1}
+		// Already-compressed formats are stored as is; the entry records the switch.
+		if algo != STORE && stored[strings.ToLower(path.Ext(file.Name))] {
+			plan.algo, plan.code = STORE, compressionCodes[STORE]
+		}
+		plan.grouped = e.config.GroupSmallFiles && plan.code == 0 && file.Info.Size() < groupThreshold
+		plan.choose = e.config.AdaptiveAlgo && plan.code == 0 && !plan.grouped
+		plan.adaptive = e.config.TargetRate > 0 && plan.algo == ZSTD
+		plan.ahead = workers > 1 && !inputs.sequential && !plan.grouped && !plan.adaptive && file.Info.Size() <= parallelFileSize
+		if e.config.Chunking && !plan.grouped && file.Info.Size() > minChunkSize {
+			plan.chunked, plan.choose, plan.adaptive, plan.ahead = true, false, false, false
+		}
+		if dups != nil && dups[i] >= 0 {
+			plan.dupOf, plan.grouped, plan.ahead = dups[i], false, false
+		}
+		plans[i] = plan
+	}
+	wantKeywords := searchMode != SearchIndexNone
+	pending := make(map[int]*pendingFrame)
+	next := 0 // Next file that may be compressed ahead.
+
+	for i, file := range files {
+		if err := job.err(); err != nil {
+			return nil, nil, err
+		}
+		plan := plans[i]
+		for ; next < len(files) && next < i+workers; next++ {
+			if plans[next].ahead {
+				pending[next] = e.compressAhead(frames, files[next], plans[next], opts, wantKeywords, job)
+			}
+		}
+
+		// Empty files get an entry too, so they are recreated on extraction.
+		meta := FileMetadata{
+			Path:        file.Name,
+			ModTime:     file.Info.ModTime(),
+			Mode:        uint32(file.Info.Mode().Perm()),
+			Compression: plan.code,
+		}
+		var digest *inputDigest
+		var err error
+		used, usedLevel := plan.algo, opts.Level // Set by the chosen algorithm, see plan.choose.
+		duplicate := false
+		switch {
+		case plan.dupOf >= 0 && shared[plan.dupOf] != nil && shared[plan.dupOf].checksum == sums[i]:
+			// The frame is shared once the original's is known, after the loop. An
+			// original that changed since it was hashed isn't shared.
+			orig := shared[plan.dupOf]
+			digest = &inputDigest{size: orig.size, checksum: orig.checksum, keywords: orig.keywords}
+			duplicate = true
+			duplicates = append(duplicates, file.Name)
+			dupOf[file.Name] = files[plan.dupOf].Name
+			prog.add(digest.size)
+		case plan.grouped:
+			// The frame location is filled in when the group is flushed.
+			meta.Group = group.id
+			meta.GroupOffset = int64(group.buf.Len())
+			digest, err = e.readInput(file, wantKeywords, prog, job, func(r io.Reader) error {
+				_, err := io.Copy(&group.buf, r)
+				return err
+			})
+			group.members = append(group.members, file.Name)
+		case plan.chunked:
+			meta.Offset = offset
+			digest, err = e.readInput(file, wantKeywords, prog, job, func(r io.Reader) error {
+				var err error
+				meta.Chunks, meta.CompressedSize, err = e.writeChunks(frames, r, plan.algo, opts, chunks, offset)
+				return err
+			})
+		case plan.ahead:
+			p := pending[i]
+			delete(pending, i)
+			<-p.done
+			if digest, err = p.digest, p.err; err == nil {
+				used, usedLevel = p.algo, p.level
+				meta.Offset, meta.CompressedSize = offset, p.compressedSize
+				if _, err = p.frame.WriteTo(frames.w); err != nil {
+					err = NewCoreError(ErrArchiveWrite, "failed to write "+file.Path).Wrap(err)
+				}
+				prog.add(digest.size)
+			}
+		default:
+			meta.Offset = offset
+			digest, err = e.readInput(file, wantKeywords, prog, job, func(r io.Reader) error {
+				fileOpts := opts
+				if plan.choose {
+					r, used, fileOpts = e.chooseAlgo(r, plan.algo, opts)
+					usedLevel = fileOpts.Level
+				}
+				var err error
+				meta.CompressedSize, err = frames.write(func(w io.Writer) (int64, error) {
+					if plan.adaptive && used == ZSTD {
+						n, adapted, err := e.compressor.CompressAdaptive(w, r, fileOpts, e.config.TargetRate)
+						for _, l := range adapted {
+							levels[l] = true
+						}
+						return n, err
+					}
+					return e.compressor.CompressWith(w, r, used, fileOpts)
+				})
+				return err
+			})
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if plan.choose {
+			if used != algo {
+				meta.Compression = compressionCodes[used]
+			}
+			if used == ZSTD && usedLevel != DefaultLevel && !plan.adaptive {
+				levels[usedLevel] = true
+			}
+		}
+		if !plan.grouped {
+			offset += meta.CompressedSize
+		}
+		for _, kw := range digest.keywords {
+			searchData[kw] = append(searchData[kw], file.Name)
+		}
+		meta.UncompressedSize = digest.size
+		meta.Checksum = digest.checksum
+		idx.Files[file.Name] = meta
+		if _, ok := shared[i]; ok {
+			shared[i] = digest
+		}
+		if !plan.grouped && !duplicate {
+			job.file(meta, used)
+		}
+
+		if group.buf.Len() >= maxGroupSize {
+			if err := flushGroup(); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err := flushGroup(); err != nil {
+		return nil, nil, err
+	}
+	for _, name := range duplicates {
+		meta, orig := idx.Files[name], idx.Files[dupOf[name]]
+		meta.Offset, meta.CompressedSize, meta.Compression = orig.Offset, orig.CompressedSize, orig.Compression
+		meta.Group, meta.GroupOffset, meta.Chunks = orig.Group, orig.GroupOffset, orig.Chunks
+		idx.Files[name] = meta
+		dupAlgo := algo
+		if meta.Compression != 0 {
+			dupAlgo, _ = compressionFromCode(meta.Compression)
+		}
+		job.duplicate(meta, dupAlgo)
+	}
+	prog.finish()
+
+	for l := range levels {
+		idx.Metadata.Levels = append(idx.Metadata.Levels, l)
+	}
+	sort.Ints(idx.Metadata.Levels)
+
+	var flags uint32
+	switch searchMode {
+	case SearchIndexEmbedded:
+		idx.SearchData = searchData
+		flags |= FlagSearchEmbedded
+	case SearchIndexSidecar:
+		flags |= FlagSearchSidecar
+	}
+	if e.config.LongDistance {
+		flags |= FlagLongDistance
+	}
+
+	header.Magic = MagicNumber
+	header.Version = FormatVersion
+	header.CompressionType = algoCode
+	header.EncryptionType = frames.encryptionType()
+	header.Timestamp = time.Now().UnixNano()
+	copy(header.DataChecksum[:], hasher.Sum(nil))
+	dictLength, err := writeDictionary(out, header, offset, dict)
+	if err != nil {
+		return nil, nil, err
+	}
+	flags |= header.Flags & (FlagDictionary | FlagDataKeyFile)
+	header.IndexOffset = HeaderSize + offset + dictLength
+	header.WindowLog = uint8(opts.WindowLog)
+	header.Level = int8(opts.Level)
+	indexLength, indexFlags, err := e.writeIndex(out, idx, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	header.IndexLength = indexLength
+	header.Flags = flags | indexFlags
+
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, NewCoreError(ErrArchiveWrite, "failed to seek to archive header").Wrap(err)
+	}
+	if err := WriteHeader(out, header); err != nil {
+		return nil, nil, err
+	}
+	return header, searchData, nil
+}
+
+// Extract decompresses a .nsm archive into destinationPath, recreating
+// intermediate directories. Entries whose path would escape the destination
+// are rejected with ErrInvalidFormat before anything is written.
 func (e *Engine) Extract(archiveFile, destinationPath string) error {
-	e.log.WithField("archive", archiveFile).Info("Starting extraction")
+	return e.ExtractContext(context.Background(), archiveFile, destinationPath)
+}
 
-	// --- High-level plan for extraction ---
-	// 1. Open the archive file.
-	// 2. Read and decode the NSMHeader.
-	// 3. Seek to the IndexOffset specified in the header.
-	// 4. Read and decode the file index.
-	// 5. Seek back to the start of the compressed data (just after the header).
-	// 6. Create a compression reader (e.g., zstd.NewReader).
-	// 7. If encrypted, wrap the reader with a cipher stream.
-	// 8. Loop through each FileIndexEntry in the index:
-	//    a. Create the destination file and directories.
-	//    b. Use io.CopyN to read exactly `CompressedSize` bytes from the main reader
-	//       and write them to the destination file. This ensures streaming decompression.
-	// 9. Close all files and readers.
+// ExtractContext is like Extract, and stops once ctx is done, between files or in the
+// middle of one, returning ctx.Err(). Files already extracted are kept; the one being
+// written is removed.
+func (e *Engine) ExtractContext(ctx context.Context, archiveFile, destinationPath string) error {
+	s, err := e.OpenSession(archiveFile)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.ExtractFilesContext(ctx, destinationPath)
+}
 
-	return errors.New("Extract function not fully implemented")
+// ExtractResume is like Extract for a destination an earlier extraction of the archive
+// was interrupted in. Files already there with the size and checksum recorded in the
+// archive are kept, only getting their mode and mod time restored; any other file,
+// such as one cut short, is extracted again from scratch. Archives written before
+// checksums were recorded have every file extracted again.
+func (e *Engine) ExtractResume(archiveFile, destinationPath string) error {
+	s, err := e.OpenSession(archiveFile)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.extractFiles(context.Background(), destinationPath, true, nil)
 }
 
-// Search performs a full-text search on the content of an archive without full extraction.
-func (e *Engine) Search(archiveFile, query string) ([]string, error) {
-	e.log.WithFields(logrus.Fields{
-		"archive": archiveFile,
-		"query":   query,
-	}).Info("Performing search")
+// extractedBefore reports whether target already holds the content of entry, as left
+// by an earlier extraction, in which case its mode and mod time are restored.
+func extractedBefore(entry FileMetadata, target string) (bool, error) {
+	info, err := os.Lstat(target)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != entry.UncompressedSize || entry.Checksum == ([32]byte{}) {
+		return false, nil
+	}
+	f, err := os.Open(target)
+	if err != nil {
+		return false, nil // Extracted again, which reports a real problem.
+	}
+	sum := sha256.New()
+	_, err = io.Copy(sum, f)
+	f.Close()
+	if err != nil || !bytes.Equal(sum.Sum(nil), entry.Checksum[:]) {
+		return false, nil
+	}
+	return true, restoreAttributes(entry, target)
+}
 
-	// --- High-level plan for search ---
-	// This is complex. A simple approach would be:
-	// 1. Read the header and index, similar to Extract.
-	// 2. For each file in the index:
-	//    a. Decompress its content into memory or a temporary buffer.
-	//    b. Run a search algorithm (e.g., strings.Contains) on the decompressed data.
-	//    c. If a match is found, add the file's path to a result list.
-	// A more advanced, efficient implementation would require a pre-built full-text index
-	// stored alongside the file index within the .nsm file itself.
-
-	return nil, errors.New("Search function not fully implemented")
-}
-
-// useToken checks for and decrements an available token.
-func (e *Engine) useToken() error {
-	if e.config.TokenCount <= 0 {
-		e.log.Error("No compression tokens available.")
-		return errors.New("no tokens available. Please buy more tokens using 'nsm buy-tokens'")
-	}
-	e.config.TokenCount--
-	e.log.WithField("remaining_tokens", e.config.TokenCount).Info("Token consumed successfully")
-	// In a real app, this state change would need to be persisted back to the config file
-	// or synchronized with the remote API.
+// ExtractFile writes the single archived file innerPath to the file dst, seeking
+// directly to its data, so reading one file of a large archive is cheap. A path that
+// isn't in the archive fails with ErrFileNotFound.
+func (e *Engine) ExtractFile(archiveFile, innerPath, dst string) error {
+	s, err := e.OpenSession(archiveFile)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.ExtractFile(innerPath, dst)
+}
+
+// extractEntry writes a single archived file to target and restores its mode and mod
+// time. Its content is checked against the checksum recorded in the index, if any, so
+// corruption the compression format doesn't detect, such as in a stored file, fails
+// with ErrChecksumMismatch. prog, if not nil, counts the bytes written. Once ctx is
+// done, the file is removed and ctx.Err() returned.
+func (e *Engine) extractEntry(ctx context.Context, a *archiveReader, entry FileMetadata, target string, prog *progress) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to create directory for "+entry.Path).Wrap(err)
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(entry.Mode)|0200)
+	if err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to create "+target).Wrap(err)
+	}
+	var w io.Writer = out
+	if prog != nil {
+		w = io.MultiWriter(out, prog)
+	}
+	// Archives written before checksums were recorded have none to check.
+	var sum hash.Hash
+	if entry.Checksum != ([32]byte{}) {
+		sum = sha256.New()
+		w = io.MultiWriter(w, sum)
+	}
+	err = e.decompressEntry(a, entry, withContextWriter(ctx, w))
+	if err == nil && sum != nil && !bytes.Equal(sum.Sum(nil), entry.Checksum[:]) {
+		err = NewCoreError(ErrChecksumMismatch, "checksum mismatch for "+entry.Path)
+	}
+	if err != nil {
+		// Don't leave a partial file behind, which for a decompression bomb may be huge.
+		out.Close()
+		os.Remove(target)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to write "+target).Wrap(err)
+	}
+	return restoreAttributes(entry, target)
+}
+
+// restoreAttributes gives the extracted file target the original permissions and
+// modification time of entry.
+func restoreAttributes(entry FileMetadata, target string) error {
+	if err := os.Chmod(target, os.FileMode(entry.Mode)); err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to set mode of "+target).Wrap(err)
+	}
+	if err := os.Chtimes(target, entry.ModTime, entry.ModTime); err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to set times of "+target).Wrap(err)
+	}
 	return nil
 }
 
-// getEncryptionStream is a helper for setting up AES-256 encryption.
-func (e *Engine) getEncryptionStream(w io.Writer) (io.Writer, error) {
-	block, err := aes.NewCipher(e.config.EncryptionKey)
+// List returns the metadata of every file in the archive, sorted by path.
+// Only the header and index are read, whatever index format the archive uses.
+func (e *Engine) List(archiveFile string) ([]FileMetadata, error) {
+	s, err := e.OpenSession(archiveFile)
 	if err != nil {
 		return nil, err
 	}
-	// GCM is a recommended mode for authenticated encryption.
-	gcm, err := cipher.NewGCM(block)
+	defer s.Close()
+	return s.List(), nil
+}
+
+// FileCheckResult reports the outcome of checking a single file in an archive.
+type FileCheckResult struct {
+	Path string
+	Size int64 // Uncompressed size recorded in the index.
+	Err  error // nil if the file decompressed correctly.
+}
+
+// CheckArchive decompresses every file in the archive and verifies it without writing
+// anything to disk. Corruption is detected by the compression format's own checksums
+// and by comparing the decompressed size with the index. Unlike a data-block checksum,
+// this exercises the full decompression path. The returned error is non-nil if any
+// file failed; the results always cover every file that could be checked.
+func (e *Engine) CheckArchive(archiveFile string) ([]FileCheckResult, error) {
+	e.log.WithField("archive", archiveFile).Info("Checking archive")
+
+	a, err := e.openArchive(archiveFile)
 	if err != nil {
 		return nil, err
 	}
-	// The stream writer would need to handle nonces correctly.
-	// This is a simplified placeholder.
-	return &cipher.StreamWriter{S: gcm, W: w}, nil
+	defer a.Close()
+
+	var results []FileCheckResult
+	failed := 0
+	for _, entry := range a.entries() {
+		err := e.decompressEntry(a, entry, io.Discard)
+		if err != nil {
+			failed++
+		}
+		results = append(results, FileCheckResult{Path: entry.Path, Size: entry.UncompressedSize, Err: err})
+	}
+
+	if failed > 0 {
+		return results, NewCoreError(ErrChecksumMismatch, fmt.Sprintf("%d of %d files failed verification", failed, len(results)))
+	}
+	return results, nil
+}
+
+// SearchResult is a file matching a search query.
+type SearchResult struct {
+	Path string
+	Size int64 // Uncompressed size of the file.
+}
+
+// How a search found its matches, see SearchStats.
+const (
+	SearchMethodIndex = "index" // Looked up in the search index.
+	SearchMethodScan  = "scan"  // Found by decompressing every file.
+)
+
+// SearchStats reports what a search cost, since archives without a search index are
+// scanned in full.
+type SearchStats struct {
+	Method            string `json:"method"` // SearchMethodIndex or SearchMethodScan.
+	FilesDecompressed int    `json:"files_decompressed"`
+}
+
+// Search performs a full-text search on the content of an archive without full extraction.
+// It looks the query's keywords up in the search index, embedded or sidecar, and returns
+// the files containing all of them, sorted by path. No match yields an empty slice.
+//
+// Archives created without a search index are scanned instead, decompressing one file
+// at a time. A file that fails to decompress is skipped and reported in the returned
+// FileErrors, and the matches from the other files are still returned. With
+// Config.RequireSearchIndex, such archives are rejected instead.
+func (e *Engine) Search(archiveFile, query string) ([]SearchResult, []FileError, error) {
+	return e.SearchContext(context.Background(), archiveFile, query)
+}
+
+// SearchContext is like Search, and stops once ctx is done, returning ctx.Err(). Only
+// archives without a search index, which are scanned, take long enough to cancel.
+func (e *Engine) SearchContext(ctx context.Context, archiveFile, query string) ([]SearchResult, []FileError, error) {
+	results, skipped, _, err := e.searchWithStats(ctx, archiveFile, query)
+	return results, skipped, err
+}
+
+// SearchWithStats is like Search, and also reports whether the search index was used
+// and how many files were decompressed.
+func (e *Engine) SearchWithStats(archiveFile, query string) ([]SearchResult, []FileError, SearchStats, error) {
+	return e.searchWithStats(context.Background(), archiveFile, query)
+}
+
+// searchWithStats implements SearchWithStats and SearchContext.
+func (e *Engine) searchWithStats(ctx context.Context, archiveFile, query string) ([]SearchResult, []FileError, SearchStats, error) {
+	e.log.WithFields(logrus.Fields{
+		"archive": archiveFile,
+		"query":   query,
+	}).Info("Performing search")
+
+	a, err := e.openArchive(archiveFile)
+	if err != nil {
+		return nil, nil, SearchStats{}, err
+	}
+	defer a.Close()
+	return e.searchFiles(ctx, a, archiveFile, queryKeywords(query))
+}
+
+// searchFiles returns the files of a containing all keywords, using its search index if
+// it has one and scanning it, until ctx is done, otherwise. A sidecar index is looked
+// for next to archiveFile, unless it is "" for an archive without a path.
+func (e *Engine) searchFiles(ctx context.Context, a *archiveReader, archiveFile string, keywords []string) ([]SearchResult, []FileError, SearchStats, error) {
+	var searchData map[string][]string
+	switch {
+	case a.header.Flags&FlagSearchEmbedded != 0:
+		searchData = a.index.SearchData
+	case a.header.Flags&FlagSearchSidecar != 0 && archiveFile != "":
+		var err error
+		if searchData, err = readSidecarIndex(archiveFile, a.header); err != nil {
+			return nil, nil, SearchStats{}, err
+		}
+	case e.config.RequireSearchIndex:
+		return nil, nil, SearchStats{}, NewCoreError(ErrNoSearchIndex, "archive "+archiveFile+" has no search index, and scanning it was not allowed")
+	default:
+		e.log.WithField("files", len(a.index.Files)).Warn("Archive has no search index; decompressing every file to search it")
+		results, skipped, err := e.scanArchive(ctx, a, keywords)
+		if err != nil {
+			return nil, nil, SearchStats{}, err
+		}
+		return results, skipped, SearchStats{Method: SearchMethodScan, FilesDecompressed: len(a.index.Files)}, nil
+	}
+
+	paths := matchKeywords(searchData, keywords)
+	results := make([]SearchResult, 0, len(paths))
+	for _, p := range paths {
+		results = append(results, SearchResult{Path: p, Size: a.index.Files[p].UncompressedSize})
+	}
+	return results, nil, SearchStats{Method: SearchMethodIndex}, nil
+}
+
+// scanArchive searches an archive without a search index by decompressing every file
+// through a keyword collector. Files that can't be decompressed are skipped and reported.
+// Once ctx is done, the scan stops with ctx.Err().
+func (e *Engine) scanArchive(ctx context.Context, a *archiveReader, keywords []string) ([]SearchResult, []FileError, error) {
+	results := []SearchResult{}
+	var skipped []FileError
+	for _, entry := range a.entries() {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		collector := newKeywordCollector()
+		if err := e.decompressEntry(a, entry, withContextWriter(ctx, collector)); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, nil, ctxErr
+			}
+			e.log.WithField("path", entry.Path).WithError(err).Warn("Skipping file that could not be scanned")
+			skipped = append(skipped, FileError{Path: entry.Path, Err: err})
+			continue
+		}
+		found := make(map[string][]string)
+		for _, kw := range collector.Keywords() {
+			found[kw] = []string{entry.Path}
+		}
+		if len(matchKeywords(found, keywords)) > 0 {
+			results = append(results, SearchResult{Path: entry.Path, Size: entry.UncompressedSize})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+	return results, skipped, nil
+}
+
+// validateInputs checks that every input file exists and can be opened for reading.
+// All problems are collected so the user can fix them in a single pass.
+// With KeepGoing, unreadable inputs are left for CollectInputs to skip and report;
+// missing inputs are always an error.
+func (e *Engine) validateInputs(inputFiles []string) error {
+	var problems []string
+	for _, path := range inputFiles {
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				problems = append(problems, path+" (not found)")
+			} else {
+				problems = append(problems, path+" ("+err.Error()+")")
+			}
+			continue
+		}
+		if err := checkReadable(path); err != nil && !e.config.KeepGoing {
+			problems = append(problems, path+" (not readable)")
+		}
+	}
+
+	if len(problems) > 0 {
+		return NewCoreError(ErrInvalidInput, "invalid input files: "+strings.Join(problems, ", "))
+	}
+	return nil
 }
@@ -0,0 +1,76 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+// ErrorCode classifies the failures raised by the core package. A code is also an
+// error, so callers can test for one with errors.Is, which matches any CoreError
+// carrying it:
+//
+//	if errors.Is(err, core.ErrFileNotFound) { ... }
+type ErrorCode string
+
+// Error returns the code itself.
+func (c ErrorCode) Error() string {
+	return string(c)
+}
+
+// Error codes used to classify failures raised by the core package.
+const (
+	ErrArchiveRead          ErrorCode = "archive_read"
+	ErrArchiveWrite         ErrorCode = "archive_write"
+	ErrInvalidFormat        ErrorCode = "invalid_format"
+	ErrInvalidInput         ErrorCode = "invalid_input"
+	ErrUnsupportedAlgorithm ErrorCode = "unsupported_algorithm"
+	ErrCompression          ErrorCode = "compression"
+	ErrDecompression        ErrorCode = "decompression"
+	ErrChecksumMismatch     ErrorCode = "checksum_mismatch"
+	ErrDecryption           ErrorCode = "decryption"
+	ErrLimitExceeded        ErrorCode = "limit_exceeded"
+	ErrNoSearchIndex        ErrorCode = "no_search_index"
+	ErrFileNotFound         ErrorCode = "file_not_found"
+)
+
+// CoreError is the error type returned by the core package.
+// It carries a machine-readable code alongside a human-readable message.
+type CoreError struct {
+	Code    ErrorCode
+	Message string
+	cause   error
+}
+
+// NewCoreError creates a new CoreError with the given code and message.
+func NewCoreError(code ErrorCode, message string) *CoreError {
+	return &CoreError{Code: code, Message: message}
+}
+
+// Wrap attaches an underlying cause to the error and returns it. The cause stays
+// reachable through errors.Unwrap, errors.Is and errors.As.
+func (e *CoreError) Wrap(err error) *CoreError {
+	e.cause = err
+	return e
+}
+
+// Error implements the error interface.
+func (e *CoreError) Error() string {
+	if e.cause != nil {
+		return e.Message + ": " + e.cause.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the cause given to Wrap, or nil.
+func (e *CoreError) Unwrap() error {
+	return e.cause
+}
+
+// Is reports whether target is e's code, or a CoreError with the same code, so that
+// errors.Is(err, ErrInvalidFormat) holds for any CoreError with that code. Other
+// targets are looked for in the cause by errors.Is itself.
+func (e *CoreError) Is(target error) bool {
+	switch t := target.(type) {
+	case ErrorCode:
+		return e.Code == t
+	case *CoreError:
+		return e.Code == t.Code
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"bytes"
+	"io"
+)
+
+const (
+	// MaxEstimateSampleSize caps how much of a sample is compressed to estimate the ratio.
+	MaxEstimateSampleSize = 1 << 20
+	// estimatedEntryOverhead approximates the per-file cost of a compressed frame
+	// header plus its index entry.
+	estimatedEntryOverhead = 96
+	// minFileSample is the least EstimateInputs samples of a file, however many there
+	// are, so the sample isn't made of frame-sized scraps.
+	minFileSample = 4 << 10
+)
+
+// Estimate is the predicted outcome of creating an archive, computed without writing it.
+type Estimate struct {
+	Files            int     `json:"files"`
+	UncompressedSize int64   `json:"uncompressed_size"`
+	EstimatedSize    int64   `json:"estimated_size"` // Predicted archive size in bytes, header and index included.
+	Ratio            float64 `json:"ratio"`          // Compressed size / uncompressed size of the sample.
+	Tokens           int     `json:"tokens"`         // Tokens the create would cost under the engine's cost policy.
+}
+
+// EstimateCreate predicts the size and token cost of archiving files totalling totalSize
+// bytes, using the compression ratio of sample under the engine's algorithm. At most
+// MaxEstimateSampleSize bytes of the sample are read. Without a sample the data is
+// assumed incompressible, giving an upper bound. Nothing is written and no token is charged.
+func (e *Engine) EstimateCreate(files int, totalSize int64, sample io.Reader) (*Estimate, error) {
+	if files < 0 || totalSize < 0 {
+		return nil, NewCoreError(ErrInvalidInput, "file count and size must not be negative")
+	}
+
+	ratio := 1.0
+	if sample != nil {
+		algo := CompressionType(e.config.DefaultAlgo)
+		if algo == "" {
+			algo = ZSTD
+		}
+		src := &readCounter{reader: io.LimitReader(sample, MaxEstimateSampleSize)}
+		compressed, err := e.compressor.Compress(io.Discard, src, algo)
+		if err != nil {
+			return nil, NewCoreError(ErrCompression, "failed to compress estimate sample").Wrap(err)
+		}
+		if src.total > 0 {
+			ratio = float64(compressed) / float64(src.total)
+			if ratio > 1 {
+				// Tiny or incompressible samples are dominated by the frame
+				// header, which is already covered by the per-entry overhead.
+				ratio = 1
+			}
+		}
+	}
+
+	return &Estimate{
+		Files:            files,
+		UncompressedSize: totalSize,
+		EstimatedSize:    HeaderSize + int64(ratio*float64(totalSize)) + int64(files)*estimatedEntryOverhead,
+		Ratio:            ratio,
+		Tokens:           e.cost(files, totalSize),
+	}, nil
+}
+
+// EstimateInputs is like EstimateCreate for the files of inputs, as collected by
+// CollectInputs: the sample is the beginning of each file, in equal shares of
+// MaxEstimateSampleSize, for as many files as it fits. It is what 'nsm create
+// --dry-run' reports, before anything is written or charged.
+func (e *Engine) EstimateInputs(inputs *InputSet) (*Estimate, error) {
+	share := int64(MaxEstimateSampleSize)
+	if n := int64(len(inputs.Files)); n > 0 {
+		share /= n
+	}
+	if share < minFileSample {
+		share = minFileSample
+	}
+	var sample bytes.Buffer
+	for _, file := range inputs.Files {
+		if sample.Len() >= MaxEstimateSampleSize {
+			break
+		}
+		f, err := file.openContent()
+		if err != nil {
+			return nil, NewCoreError(ErrInvalidInput, "failed to open input "+file.Path).Wrap(err)
+		}
+		_, err = io.Copy(&sample, io.LimitReader(f, share))
+		f.Close()
+		if err != nil {
+			return nil, NewCoreError(ErrInvalidInput, "failed to read input "+file.Path).Wrap(err)
+		}
+	}
+	var r io.Reader
+	if sample.Len() > 0 {
+		r = &sample
+	}
+	return e.EstimateCreate(len(inputs.Files), inputs.TotalSize(), r)
+}
@@ -0,0 +1,443 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VCSIgnorePatterns are the version-control and metadata entries skipped when
+// Config.ExcludeVCS is set.
+var VCSIgnorePatterns = []string{".git", ".svn", ".hg", ".bzr", "CVS", ".DS_Store", "Thumbs.db"}
+
+// DefaultIgnorePatterns are operating-system artifacts that are never worth archiving.
+// They are skipped unless Config.NoDefaultIgnores is set.
+var DefaultIgnorePatterns = []string{".DS_Store", "Thumbs.db", "desktop.ini"}
+
+// PathFilter decides which paths are left out of an archive.
+// A path is excluded when any of its components matches one of the patterns,
+// so excluding ".git" also excludes everything underneath it. Patterns of
+// Config.Exclude holding a slash match the whole path instead, see Config.Exclude.
+type PathFilter struct {
+	patterns     []string
+	pathPatterns [][]string // Patterns with a slash, split into components.
+}
+
+// NewPathFilter builds the filter described by the configuration.
+func NewPathFilter(cfg *Config) *PathFilter {
+	var patterns []string
+	if !cfg.NoDefaultIgnores {
+		patterns = append(patterns, DefaultIgnorePatterns...)
+	}
+	if cfg.ExcludeVCS {
+		patterns = append(patterns, VCSIgnorePatterns...)
+	}
+	f := &PathFilter{patterns: patterns}
+	for _, pattern := range cfg.Exclude {
+		pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+		if strings.Contains(pattern, "/") {
+			f.pathPatterns = append(f.pathPatterns, strings.Split(pattern, "/"))
+		} else if pattern != "" {
+			f.patterns = append(f.patterns, pattern)
+		}
+	}
+	return f
+}
+
+// Excluded reports whether the given path should be left out of the archive.
+func (f *PathFilter) Excluded(path string) bool {
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(path)), "/")
+	for _, part := range parts {
+		for _, pattern := range f.patterns {
+			if ok, _ := filepath.Match(pattern, part); ok {
+				return true
+			}
+		}
+	}
+	for _, pattern := range f.pathPatterns {
+		if matchComponents(pattern, parts) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchComponents reports whether the components of a path match those of a pattern,
+// where a "**" component matches any number of components, none included.
+func matchComponents(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchComponents(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// checkExcludePatterns validates the patterns of Config.Exclude.
+func checkExcludePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(filepath.ToSlash(pattern), ""); err != nil {
+			return NewCoreError(ErrInvalidInput, "invalid exclude pattern "+strconv.Quote(pattern)).Wrap(err)
+		}
+	}
+	return nil
+}
+
+// ReadExcludeFile reads exclude patterns from a file with one per line, like a
+// .gitignore: blank lines and lines starting with "#" are skipped, and surrounding
+// spaces are trimmed. Negated patterns ("!pattern") are not supported.
+func ReadExcludeFile(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, NewCoreError(ErrInvalidInput, "failed to read exclude file").Wrap(err)
+	}
+	var patterns []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "!"):
+			return nil, NewCoreError(ErrInvalidInput, fmt.Sprintf("%s:%d: negated patterns are not supported", file, i+1))
+		}
+		patterns = append(patterns, line)
+	}
+	if err := checkExcludePatterns(patterns); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// FileError records a problem with a single file that did not abort the whole operation.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+// InputFile is a single file selected for archiving.
+type InputFile struct {
+	Path string      // Location on disk.
+	Name string      // Slash-separated path recorded in the archive.
+	Info fs.FileInfo // File information captured while collecting inputs.
+
+	open func() (io.ReadCloser, error) // Opens the content, if not the file at Path.
+}
+
+// openContent opens the content of the file.
+func (f InputFile) openContent() (io.ReadCloser, error) {
+	if f.open != nil {
+		return f.open()
+	}
+	return os.Open(f.Path)
+}
+
+// InputSet is the resolved list of files for a create operation.
+type InputSet struct {
+	Files     []InputFile // Regular files to archive, including empty ones.
+	EmptyDirs []string    // Archive names of walked directories with no files below them, sorted.
+	Skipped   []FileError // Unreadable files left out because KeepGoing is set.
+	Unchanged int         // Files left out because they are not newer than Config.OnlyNewer.
+	Excluded  int         // Paths left out by the filter; an excluded directory counts once.
+
+	sequential bool // The files can only be opened once each, in order.
+}
+
+// TotalSize returns the combined uncompressed size of the files to archive.
+func (s *InputSet) TotalSize() int64 {
+	var total int64
+	for _, f := range s.Files {
+		total += f.Info.Size()
+	}
+	return total
+}
+
+// CollectInputs resolves the inputs of a create operation to the set of regular
+// files that would be archived. Directories are walked recursively and every path
+// is checked against the configured filter; empty ones are recorded so extraction
+// recreates them. Symbolic links found while walking are skipped with a warning unless
+// Config.FollowSymlinks is set. Files that cannot be read fail the operation, or are
+// recorded in InputSet.Skipped when KeepGoing is set.
+func (e *Engine) CollectInputs(inputs []string) (*InputSet, error) {
+	return e.collectInputs(inputs, false)
+}
+
+// CollectListedInputs is like CollectInputs for the paths of a file list (see
+// ReadFileList): every file is stored under the path it is listed with, rather than
+// under its base name, so files with the same name in different directories don't
+// collide. Absolute paths lose their leading separator, like tar does; paths that
+// climb out of the current directory with ".." are rejected.
+func (e *Engine) CollectListedInputs(paths []string) (*InputSet, error) {
+	return e.collectInputs(paths, true)
+}
+
+// collectInputs implements CollectInputs and CollectListedInputs.
+func (e *Engine) collectInputs(inputs []string, listed bool) (*InputSet, error) {
+	filter := NewPathFilter(e.config)
+	set := &InputSet{}
+	sources := map[string]string{} // Archive name -> path on disk, to detect collisions.
+	var dirs []string
+	nonEmpty := map[string]bool{} // Directories with something below them.
+	markParents := func(name string) {
+		for p := path.Dir(name); p != "." && p != "/" && !nonEmpty[p]; p = path.Dir(p) {
+			nonEmpty[p] = true
+		}
+	}
+
+	addFile := func(path, name string, info fs.FileInfo) error {
+		markParents(name)
+		if !e.config.OnlyNewer.IsZero() && !info.ModTime().After(e.config.OnlyNewer) {
+			set.Unchanged++
+			return nil
+		}
+		if err := checkReadable(path); err != nil {
+			if !e.config.KeepGoing {
+				return NewCoreError(ErrInvalidInput, "cannot read input file "+path).Wrap(err)
+			}
+			set.Skipped = append(set.Skipped, FileError{Path: path, Err: err})
+			return nil
+		}
+		if other, ok := sources[name]; ok {
+			return NewCoreError(ErrInvalidInput, "both "+other+" and "+path+" would be stored as "+name)
+		}
+		sources[name] = path
+		set.Files = append(set.Files, InputFile{Path: path, Name: name, Info: info})
+		return nil
+	}
+
+	for _, input := range inputs {
+		if filter.Excluded(input) {
+			e.log.WithField("path", input).Debug("Skipping excluded input")
+			set.Excluded++
+			continue
+		}
+		info, err := os.Stat(input)
+		if err != nil {
+			return nil, NewCoreError(ErrInvalidInput, "failed to stat input "+input).Wrap(err)
+		}
+		prefix := ""
+		if listed {
+			if prefix, err = listedName(input); err != nil {
+				return nil, err
+			}
+		}
+		if !info.IsDir() {
+			name := filepath.Base(input)
+			if listed {
+				name = prefix
+			}
+			if err := addFile(input, name, info); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// following holds the directories being walked through symbolic links, and the
+		// input itself, so a link to one of them doesn't loop forever.
+		following := map[string]bool{}
+		if real, err := filepath.EvalSymlinks(input); err == nil {
+			following[real] = true
+		}
+		// walk walks dir, which is at relDir below the input.
+		var walk func(dir, relDir string) error
+		walk = func(dir, relDir string) error {
+			return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					// An unreadable subdirectory is skipped like an unreadable file.
+					if e.config.KeepGoing && path != input && os.IsPermission(err) {
+						set.Skipped = append(set.Skipped, FileError{Path: path, Err: err})
+						return filepath.SkipDir
+					}
+					return err
+				}
+				rel, err := filepath.Rel(dir, path)
+				if err != nil {
+					return err
+				}
+				rel = filepath.Join(relDir, rel)
+				if rel != "." && filter.Excluded(rel) {
+					e.log.WithField("path", path).Debug("Skipping excluded path")
+					set.Excluded++
+					if d.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				name := archiveName(input, rel)
+				if listed {
+					name = filepath.ToSlash(filepath.Join(filepath.FromSlash(prefix), rel))
+				}
+				switch {
+				case d.IsDir():
+					if name != "." {
+						markParents(name)
+						dirs = append(dirs, name)
+					}
+				case d.Type().IsRegular():
+					info, err := d.Info()
+					if err != nil {
+						return err
+					}
+					return addFile(path, name, info)
+				case d.Type()&fs.ModeSymlink != 0:
+					if !e.config.FollowSymlinks {
+						e.log.WithField("path", path).Warn("Skipping symbolic link")
+						return nil
+					}
+					info, err := os.Stat(path)
+					if err != nil {
+						return err
+					}
+					if info.Mode().IsRegular() {
+						return addFile(path, name, info)
+					}
+					if !info.IsDir() {
+						return nil
+					}
+					real, err := filepath.EvalSymlinks(path)
+					if err != nil {
+						return err
+					}
+					if following[real] {
+						e.log.WithField("path", path).Warn("Skipping symbolic link to a directory being archived")
+						return nil
+					}
+					following[real] = true
+					defer delete(following, real)
+					// The trailing separator makes WalkDir descend into the link's target.
+					return walk(path+string(filepath.Separator), rel)
+				}
+				return nil
+			})
+		}
+		err = walk(input, "")
+		if err != nil {
+			if _, ok := err.(*CoreError); ok {
+				return nil, err
+			}
+			return nil, NewCoreError(ErrInvalidInput, "failed to walk input directory "+input).Wrap(err)
+		}
+	}
+	for _, dir := range dirs {
+		if !nonEmpty[dir] {
+			set.EmptyDirs = append(set.EmptyDirs, dir)
+		}
+	}
+	sort.Strings(set.EmptyDirs)
+	return set, nil
+}
+
+// archiveName returns the name under which a file found while walking the input
+// directory root is stored. The directory's own name is kept as a prefix, like tar
+// does, unless the input is "." or a filesystem root.
+func archiveName(root, rel string) string {
+	base := filepath.Base(filepath.Clean(root))
+	if base == "." || base == string(filepath.Separator) {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(filepath.Join(base, rel))
+}
+
+// listedName returns the archive name of a path from a file list: the cleaned,
+// slash-separated path, relative to the current directory.
+func listedName(input string) (string, error) {
+	name := filepath.ToSlash(filepath.Clean(input))
+	name = strings.TrimLeft(strings.TrimPrefix(name, filepath.VolumeName(input)), "/")
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", NewCoreError(ErrInvalidInput, "listed path escapes the current directory: "+input)
+	}
+	if name == "" {
+		name = "."
+	}
+	return name, nil
+}
+
+// ReadFileList reads the paths of a file list such as the output of find: one path
+// per line, or NUL-separated if nul is set (find -print0), which allows any character
+// in file names. Empty entries are ignored, and so are carriage returns ending lines.
+func ReadFileList(r io.Reader, nul bool) ([]string, error) {
+	sep := byte('\n')
+	if nul {
+		sep = 0
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, sep); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	var paths []string
+	for scanner.Scan() {
+		entry := scanner.Text()
+		if !nul {
+			entry = strings.TrimSuffix(entry, "\r")
+		}
+		if entry != "" {
+			paths = append(paths, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, NewCoreError(ErrInvalidInput, "failed to read file list").Wrap(err)
+	}
+	return paths, nil
+}
+
+// checkReadable verifies that the file at path can be opened for reading.
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// ParseReferenceTime resolves the argument of --only-newer. It accepts an RFC 3339
+// timestamp, a plain date (YYYY-MM-DD), or the path of an existing archive, in which
+// case the archive's creation time is used.
+func ParseReferenceTime(ref string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, ref); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", ref, time.Local); err == nil {
+		return t, nil
+	}
+
+	f, err := os.Open(ref)
+	if err != nil {
+		return time.Time{}, NewCoreError(ErrInvalidInput, "reference must be a timestamp or an existing archive: "+ref).Wrap(err)
+	}
+	defer f.Close()
+
+	header, err := ReadHeader(f)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, header.Timestamp), nil
+}
@@ -2,21 +2,59 @@
 package core
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"hash"
 	"io"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
 	// MagicNumber identifies the file as a valid .nsm archive. (NSM v1)
 	MagicNumber uint32 = 0x4E534D01
 	// HeaderSize is the fixed size of the archive header in bytes.
-	HeaderSize = 64
+	HeaderSize = 128
+	// FormatVersionGob is the original format, whose index is gob-encoded.
+	FormatVersionGob uint16 = 1
+	// FormatVersionProto stores the index as protobuf (see index.proto).
+	FormatVersionProto uint16 = 2
+	// FormatVersion is the archive format version written by this build.
+	FormatVersion = FormatVersionProto
 )
 
+// compressionCodes maps each compression algorithm to the byte stored in Header.CompressionType.
+// Codes are part of the on-disk format and must never be reused.
+var compressionCodes = map[CompressionType]uint8{
+	ZSTD:  1,
+	GZIP:  2,
+	STORE: 3,
+	LZ4:   4,
+}
+
+// compressionCode returns the header byte for the given algorithm.
+func compressionCode(algo CompressionType) (uint8, error) {
+	code, ok := compressionCodes[algo]
+	if !ok {
+		return 0, NewCoreError(ErrUnsupportedAlgorithm, "unsupported compression type: "+string(algo))
+	}
+	return code, nil
+}
+
+// compressionFromCode returns the algorithm recorded in a header byte.
+func compressionFromCode(code uint8) (CompressionType, error) {
+	for algo, c := range compressionCodes {
+		if c == code {
+			return algo, nil
+		}
+	}
+	return "", NewCoreError(ErrUnsupportedAlgorithm, fmt.Sprintf("unknown compression type code %d", code))
+}
+
 // Header is the fixed-size block at the beginning of every .nsm file.
 // Its structure must remain backward-compatible.
 type Header struct {
@@ -28,13 +66,70 @@ type Header struct {
 	IndexOffset      int64     // 8 bytes: Byte offset to the start of the Index block.
 	IndexLength      int64     // 8 bytes: Length of the Index block in bytes.
 	DataChecksum     [32]byte // 32 bytes: SHA-256 checksum of the compressed data block.
+	Flags            uint32    // 4 bytes: Bit set of Flag* values.
+	WindowLog        uint8     // 1 byte: zstd window log the data was compressed with; 0 for the default.
+	KDF              KDFParams // 4 bytes: Argon2id parameters deriving the index key from a passphrase; zero if none.
+	KDFSalt          [16]byte  // 16 bytes: Argon2id salt of the passphrase, see FlagIndexPassphrase.
+	Level            int8      // 1 byte: Compression level the data was written with; 0 for the default.
+	DataKDF          KDFParams // 4 bytes: Argon2id parameters deriving the data key from a passphrase; zero if none.
+	DataKDFSalt      [16]byte  // 16 bytes: Argon2id salt of the data key, kept when the index is rewritten.
+	DictOffset       int64     // 8 bytes: Byte offset to the zstd dictionary block, see FlagDictionary; 0 if none.
+	DictLength       uint32    // 4 bytes: Length of the dictionary block in bytes.
+	Reserved         [6]byte   // 6 bytes: Zero, reserved for future fields.
+}
+
+func init() {
+	// The header is encoded field by field, without alignment padding, so its size is
+	// the sum of its fields: a new field must take its bytes from Reserved, or every
+	// offset computed from HeaderSize would be wrong.
+	if n := binary.Size(Header{}); n != HeaderSize {
+		panic(fmt.Sprintf("core: Header encodes to %d bytes instead of HeaderSize (%d)", n, HeaderSize))
+	}
+}
+
+// Header flags. New flags must only ever be added, never renumbered.
+const (
+	// FlagSearchEmbedded means the full-text search index is stored in the archive's index.
+	FlagSearchEmbedded uint32 = 1 << iota
+	// FlagSearchSidecar means the full-text search index is stored in a separate
+	// "<archive>.idx" file next to the archive.
+	FlagSearchSidecar
+	// FlagIndexCompressed means the encoded index is stored as a zstd frame.
+	FlagIndexCompressed
+	// FlagIndexEncrypted means the index block is encrypted with an index key
+	// (see RewrapIndex), on top of any compression.
+	FlagIndexEncrypted
+	// FlagLongDistance means the data was compressed with long-distance matching;
+	// WindowLog holds the window it used.
+	FlagLongDistance
+	// FlagIndexPassphrase means the index key is derived from a passphrase with the
+	// KDF parameters and KDFSalt of the header. FlagIndexEncrypted is set as well.
+	FlagIndexPassphrase
+	// FlagDictionary means the data was compressed with the zstd dictionary stored in
+	// the block DictOffset and DictLength describe, between the data block and the index.
+	FlagDictionary
+	// FlagDataKeyFile means the data key mixes the key derived from the passphrase
+	// (see DataKDF) with the key of a key file, see Config.KeyFile.
+	FlagDataKeyFile
+)
+
+// dataEnd returns the offset where the data block ends: at the dictionary block if
+// there is one, or else at the index.
+func (h *Header) dataEnd() int64 {
+	if h.Flags&FlagDictionary != 0 {
+		return h.DictOffset
+	}
+	return h.IndexOffset
 }
 
 // Index contains all metadata for the files stored in the archive.
-// It is serialized using gob for efficient Go-specific encoding.
+// Its encoding depends on the format version: gob up to FormatVersionGob,
+// protobuf from FormatVersionProto on.
 type Index struct {
 	Files      map[string]FileMetadata // Map of original file path to its metadata.
 	SearchData map[string][]string     // A simple full-text index (e.g., keyword -> file path).
+	Metadata   *ArchiveMetadata        // Provenance of the archive; nil for archives written before it existed.
+	EmptyDirs  []string                // Sorted paths of empty directories, recreated by Extract.
 }
 
 // FileMetadata stores information about a single file in the archive.
@@ -45,6 +140,41 @@ type FileMetadata struct {
 	Offset           int64 // Offset within the compressed data block where this file begins.
 	ModTime          time.Time
 	Mode             uint32 // File permissions
+	Compression      uint8  // Compression code of this file; 0 means the archive's (Header.CompressionType).
+
+	// Group is non-zero for a file packed with others into a shared frame, which
+	// Offset and CompressedSize then describe. GroupOffset locates the file within the
+	// decompressed group.
+	Group       uint32
+	GroupOffset int64
+
+	// Checksum is the SHA-256 of the file's uncompressed content. It is zero for
+	// archives written before it was recorded.
+	Checksum [32]byte
+
+	// Chunks is non-empty for a file split into content-defined chunks (see
+	// Config.Chunking), each its own frame compressed like the file, which may be
+	// shared with other files. Offset and CompressedSize then describe the frames
+	// first stored for this file, possibly none.
+	Chunks []ChunkRef
+}
+
+// ChunkRef locates a chunk of a file in the data block.
+type ChunkRef struct {
+	Offset         int64 // Offset of the chunk's frame within the data block.
+	CompressedSize int64
+	Size           int64 // Size of the chunk's content.
+}
+
+// chunkEntry returns an entry describing chunk c of f alone, to be read like a file.
+func (f FileMetadata) chunkEntry(c ChunkRef) FileMetadata {
+	return FileMetadata{
+		Path:             f.Path,
+		Offset:           c.Offset,
+		CompressedSize:   c.CompressedSize,
+		UncompressedSize: c.Size,
+		Compression:      f.Compression,
+	}
 }
 
 // WriteHeader writes the binary Header to the given writer.
@@ -71,28 +201,149 @@ func ReadHeader(r io.Reader) (*Header, error) {
 	if h.Magic != MagicNumber {
 		return nil, NewCoreError(ErrInvalidFormat, "not a valid .nsm file (magic number mismatch)")
 	}
+	if h.Version == 0 || h.Version > FormatVersion {
+		return nil, NewCoreError(ErrInvalidFormat, fmt.Sprintf("archive version %d not supported by this build (it reads versions %d to %d)", h.Version, FormatVersionGob, FormatVersion))
+	}
+	if h.WindowLog > MaxWindowLog {
+		return nil, NewCoreError(ErrInvalidFormat, fmt.Sprintf("archive needs a 2^%d byte compression window (this build decodes up to 2^%d)", h.WindowLog, MaxWindowLog))
+	}
 	return h, nil
 }
 
-// WriteIndex serializes the Index struct using gob and writes it to the writer.
+// WriteIndex serializes the Index in the current format and writes it to the writer.
 // It returns the length of the written data.
 func WriteIndex(w io.Writer, idx *Index) (int64, error) {
+	return WriteIndexVersion(w, idx, FormatVersion)
+}
+
+// WriteIndexVersion serializes the Index in the encoding of the given format version.
+// Writing older versions is only useful for tests and compatibility tooling.
+func WriteIndexVersion(w io.Writer, idx *Index, version uint16) (int64, error) {
 	counter := &writeCounter{writer: w}
-	encoder := gob.NewEncoder(counter)
-	if err := encoder.Encode(idx); err != nil {
-		return 0, NewCoreError(ErrArchiveWrite, "failed to write archive index").Wrap(err)
+	switch version {
+	case FormatVersionGob:
+		if err := gob.NewEncoder(counter).Encode(idx); err != nil {
+			return 0, NewCoreError(ErrArchiveWrite, "failed to write archive index").Wrap(err)
+		}
+	case FormatVersionProto:
+		if _, err := counter.Write(marshalIndexProto(idx)); err != nil {
+			return 0, NewCoreError(ErrArchiveWrite, "failed to write archive index").Wrap(err)
+		}
+	default:
+		return 0, NewCoreError(ErrInvalidInput, fmt.Sprintf("cannot write index for format version %d", version))
 	}
 	return counter.total, nil
 }
 
-// ReadIndex reads from the reader and deserializes the Index struct.
-func ReadIndex(r io.Reader) (*Index, error) {
-	decoder := gob.NewDecoder(r)
-	idx := &Index{}
-	if err := decoder.Decode(idx); err != nil {
-		return nil, NewCoreError(ErrArchiveRead, "failed to read archive index").Wrap(err)
+// ReadIndex reads the Index block described by an archive header. The index is
+// decompressed first if FlagIndexCompressed is set, then decoded with the decoder
+// matching the header's format version. An encrypted index must be decrypted first.
+func ReadIndex(r io.Reader, h *Header) (*Index, error) {
+	if h.Flags&FlagIndexCompressed != 0 {
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, NewCoreError(ErrDecompression, "failed to decompress archive index").Wrap(err)
+		}
+		defer decoder.Close()
+		r = decoder
+	}
+
+	switch h.Version {
+	case FormatVersionGob:
+		idx := &Index{}
+		if err := gob.NewDecoder(r).Decode(idx); err != nil {
+			return nil, NewCoreError(ErrArchiveRead, "failed to read archive index").Wrap(err)
+		}
+		return idx, nil
+	case FormatVersionProto:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, NewCoreError(ErrArchiveRead, "failed to read archive index").Wrap(err)
+		}
+		idx, err := unmarshalIndexProto(data)
+		if err != nil {
+			return nil, NewCoreError(ErrArchiveRead, "failed to read archive index").Wrap(err)
+		}
+		return idx, nil
+	default:
+		return nil, NewCoreError(ErrInvalidFormat, fmt.Sprintf("unsupported archive format version %d", h.Version))
+	}
+}
+
+// IndexCompressionMode selects whether the archive index is compressed.
+type IndexCompressionMode string
+
+const (
+	// IndexCompressionAuto compresses indexes larger than IndexCompressionThreshold.
+	// It is the default.
+	IndexCompressionAuto IndexCompressionMode = "auto"
+	// IndexCompressionAlways compresses every index.
+	IndexCompressionAlways IndexCompressionMode = "always"
+	// IndexCompressionNever stores the index as is, readable by builds that predate
+	// index compression.
+	IndexCompressionNever IndexCompressionMode = "never"
+)
+
+// IndexCompressionThreshold is the encoded index size above which IndexCompressionAuto
+// compresses the index. Smaller indexes gain too little to be worth it.
+const IndexCompressionThreshold = 64 << 10
+
+// writeIndex writes idx in the current format, compressed according to
+// Config.IndexCompression and encrypted with Config.Passphrase or Config.IndexKey if
+// one is set. h is the header of the archive, whose data checksum is authenticated
+// along with the index; its KDF fields are set to match the encryption.
+// It returns the stored length and the header flags to set.
+func (e *Engine) writeIndex(w io.Writer, idx *Index, h *Header) (int64, uint32, error) {
+	var raw bytes.Buffer
+	if _, err := WriteIndex(&raw, idx); err != nil {
+		return 0, 0, err
+	}
+
+	compress := false
+	switch e.config.IndexCompression {
+	case "", IndexCompressionAuto:
+		compress = raw.Len() > IndexCompressionThreshold
+	case IndexCompressionAlways:
+		compress = true
+	case IndexCompressionNever:
+	default:
+		return 0, 0, NewCoreError(ErrInvalidInput, "unknown index compression mode: "+string(e.config.IndexCompression))
+	}
+
+	var flags uint32
+	block := &raw
+	if compress {
+		var compressed bytes.Buffer
+		if _, err := e.compressor.Compress(&compressed, &raw, ZSTD); err != nil {
+			return 0, 0, NewCoreError(ErrArchiveWrite, "failed to compress archive index").Wrap(err)
+		}
+		block = &compressed
+		flags |= FlagIndexCompressed
+	}
+	h.KDF, h.KDFSalt = KDFParams{}, [16]byte{}
+	key := e.config.IndexKey
+	if e.config.Passphrase != nil {
+		var err error
+		if key, err = e.newPassphraseKey(h); err != nil {
+			return 0, 0, err
+		}
+		defer wipe(key)
+		flags |= FlagIndexPassphrase
+	}
+	if key != nil {
+		sealed, err := sealIndex(key, block.Bytes(), h.DataChecksum)
+		if err != nil {
+			return 0, 0, err
+		}
+		block = bytes.NewBuffer(sealed)
+		flags |= FlagIndexEncrypted
+	}
+
+	n, err := block.WriteTo(w)
+	if err != nil {
+		return 0, 0, NewCoreError(ErrArchiveWrite, "failed to write archive index").Wrap(err)
 	}
-	return idx, nil
+	return n, flags, nil
 }
 
 // NewChecksumWriter returns an io.Writer that calculates a SHA-256 checksum
@@ -0,0 +1,74 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// DefaultGroupThreshold is the size below which files are grouped when
+// Config.GroupSmallFiles is set.
+const DefaultGroupThreshold = 32 << 10
+
+// maxGroupSize bounds the uncompressed size of a file group. Groups are built and
+// extracted in memory, so this also bounds the memory they use.
+const maxGroupSize = 4 << 20
+
+// fileGroup collects small files that are compressed together as one frame.
+type fileGroup struct {
+	id      uint32
+	buf     bytes.Buffer
+	members []string // Paths of the files in buf, in order.
+}
+
+// reset empties the group and moves on to the next group id.
+func (g *fileGroup) reset() {
+	g.buf.Reset()
+	g.members = g.members[:0]
+	g.id++
+}
+
+// decompressGroupMember writes a grouped file to w. The decompressed group is cached,
+// so extracting its members one after another decompresses it only once.
+func (e *Engine) decompressGroupMember(a *archiveReader, entry FileMetadata, w io.Writer) error {
+	a.groupMu.Lock()
+	defer a.groupMu.Unlock()
+
+	if a.groupID != entry.Group || a.groupOffset != entry.Offset || a.groupData == nil {
+		var buf bytes.Buffer
+		var out io.Writer = &buf
+		// The whole group is buffered, so the limits apply to it rather than to entry.
+		limited, err := e.limitOutput(a, out, entry.Path, entry.CompressedSize, 0)
+		if err != nil {
+			return err
+		}
+		if limited != nil {
+			out = limited
+		}
+		section, dec, err := e.frameReader(a, entry)
+		if err != nil {
+			return err
+		}
+		if _, err := e.compressor.DecompressWith(out, section, a.algo, a.dict); err != nil {
+			a.groupData = nil
+			if err := limited.exceeded(); err != nil {
+				return err
+			}
+			if err := dec.authErr(); err != nil {
+				return err
+			}
+			return NewCoreError(ErrDecompression, "failed to decompress the group of "+entry.Path).Wrap(err)
+		}
+		a.groupID, a.groupOffset, a.groupData = entry.Group, entry.Offset, buf.Bytes()
+	}
+
+	end := entry.GroupOffset + entry.UncompressedSize
+	if entry.GroupOffset < 0 || entry.UncompressedSize < 0 || end > int64(len(a.groupData)) {
+		return NewCoreError(ErrInvalidFormat, fmt.Sprintf("%s lies outside its file group", entry.Path))
+	}
+	if _, err := w.Write(a.groupData[entry.GroupOffset:end]); err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to write "+entry.Path).Wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sourceFormat is the format of an archive imported by CreateFromArchive.
+type sourceFormat int
+
+const (
+	sourceTar sourceFormat = iota
+	sourceTarGzip
+	sourceZip
+)
+
+// CreateFromArchive is like Create for the entries of a .tar, .tar.gz or .zip archive,
+// which are re-packed into outputFile without being extracted to disk. Entries keep
+// their paths, sizes, modification times and permissions; directories with no files
+// below them are recorded like Create does, and entries that are neither files nor
+// directories, such as symbolic links, are skipped with a warning. An entry appearing
+// twice in a tar file is taken from its last copy, as tar extracts it. The source
+// format is detected from its magic bytes, or from its extension for old tar files
+// without one. The configured filters apply, and paths climbing out of the archive
+// with ".." are rejected before the token is consumed.
+func (e *Engine) CreateFromArchive(outputFile, sourceArchive string) (*CreateResult, error) {
+	tokens := e.config.Tokens
+	if tokens == nil {
+		return nil, NewCoreError(ErrInvalidInput, "no token source configured for 'create' operation")
+	}
+	format, err := detectSourceFormat(sourceArchive)
+	if err != nil {
+		return nil, err
+	}
+	if out, err := os.Stat(outputFile); err == nil {
+		if src, err := os.Stat(sourceArchive); err == nil && os.SameFile(out, src) {
+			return nil, NewCoreError(ErrInvalidInput, "the archive to import cannot be the output archive")
+		}
+	}
+
+	var entries []importEntry
+	var source io.Closer
+	switch format {
+	case sourceZip:
+		zr, err := zip.OpenReader(sourceArchive)
+		if err != nil {
+			return nil, NewCoreError(ErrInvalidInput, "failed to read zip archive "+sourceArchive).Wrap(err)
+		}
+		source = zr
+		for _, f := range zr.File {
+			entries = append(entries, importEntry{name: f.Name, info: f.FileInfo(), open: f.Open})
+		}
+	default:
+		ts, err := openTarSource(sourceArchive, format == sourceTarGzip)
+		if err != nil {
+			return nil, err
+		}
+		source = ts
+		if entries, err = ts.list(); err != nil {
+			ts.Close()
+			return nil, err
+		}
+		// Listing read through the whole stream; the content is read again from the
+		// start as the files are archived, in order.
+		if err := ts.rewind(); err != nil {
+			ts.Close()
+			return nil, err
+		}
+	}
+	defer source.Close()
+
+	inputs, err := e.importInputs(sourceArchive, entries)
+	if err != nil {
+		return nil, err
+	}
+	inputs.sequential = format != sourceZip
+	e.log.WithFields(logrus.Fields{
+		"source": sourceArchive,
+		"files":  len(inputs.Files),
+	}).Info("Importing archive")
+	return e.createFromInputs(outputFile, inputs, tokens, nil)
+}
+
+// detectSourceFormat returns the format of an archive to import.
+func detectSourceFormat(file string) (sourceFormat, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, NewCoreError(ErrInvalidInput, "failed to open archive "+file).Wrap(err)
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, NewCoreError(ErrInvalidInput, "failed to read archive "+file).Wrap(err)
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return sourceZip, nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return sourceTarGzip, nil
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return sourceTar, nil
+	}
+	// Tar files from before POSIX have no magic, and zip files may start with other
+	// data, such as a self-extractor.
+	switch lower := strings.ToLower(file); {
+	case strings.HasSuffix(lower, ".tar"):
+		return sourceTar, nil
+	case strings.HasSuffix(lower, ".zip"):
+		return sourceZip, nil
+	}
+	return 0, NewCoreError(ErrInvalidInput, "unsupported archive format of "+file+" (want .tar, .tar.gz or .zip)")
+}
+
+// importEntry is an entry of an archive being imported.
+type importEntry struct {
+	name string
+	info fs.FileInfo
+	open func() (io.ReadCloser, error)
+}
+
+// importInputs returns the input set archiving the files of entries, which come from
+// sourceArchive.
+func (e *Engine) importInputs(sourceArchive string, entries []importEntry) (*InputSet, error) {
+	filter := NewPathFilter(e.config)
+	set := &InputSet{}
+	var files []InputFile
+	last := map[string]int{} // Position in files of the last entry of each name.
+	var dirs []string
+	for _, entry := range entries {
+		name := strings.TrimLeft(path.Clean(entry.name), "/")
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return nil, NewCoreError(ErrInvalidInput, "entry of "+sourceArchive+" escapes the archive: "+entry.name)
+		}
+		if name == "" || name == "." {
+			continue
+		}
+		if filter.Excluded(name) {
+			e.log.WithField("path", name).Debug("Skipping excluded entry")
+			set.Excluded++
+			continue
+		}
+		mode := entry.info.Mode()
+		switch {
+		case mode.IsDir():
+			dirs = append(dirs, name)
+		case mode.IsRegular():
+			last[name] = len(files)
+			files = append(files, InputFile{
+				Path: sourceArchive + ":" + name,
+				Name: name,
+				Info: entry.info,
+				open: entry.open,
+			})
+		default:
+			e.log.WithFields(logrus.Fields{
+				"path": name,
+				"type": fmt.Sprint(mode.Type()),
+			}).Warn("Skipping entry that is not a regular file or directory")
+		}
+	}
+
+	nonEmpty := map[string]bool{} // Directories with something below them.
+	for i, file := range files {
+		if last[file.Name] != i {
+			continue
+		}
+		for p := path.Dir(file.Name); p != "." && p != "/" && !nonEmpty[p]; p = path.Dir(p) {
+			nonEmpty[p] = true
+		}
+		if !e.config.OnlyNewer.IsZero() && !file.Info.ModTime().After(e.config.OnlyNewer) {
+			set.Unchanged++
+			continue
+		}
+		set.Files = append(set.Files, file)
+	}
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		for p := path.Dir(dir); p != "." && !nonEmpty[p]; p = path.Dir(p) {
+			nonEmpty[p] = true
+		}
+	}
+	for _, dir := range dirs {
+		if !nonEmpty[dir] && !seen[dir] {
+			seen[dir] = true
+			set.EmptyDirs = append(set.EmptyDirs, dir)
+		}
+	}
+	sort.Strings(set.EmptyDirs)
+	return set, nil
+}
+
+// tarSource reads a tar file, compressed with gzip or not, for CreateFromArchive. Its
+// entries are read in order, each at most once.
+type tarSource struct {
+	path string
+	file *os.File
+	gz   *gzip.Reader // nil for an uncompressed tar file.
+	tr   *tar.Reader
+	next int // Number of the next header tr returns.
+}
+
+// openTarSource opens the tar file at path, decompressing it with gzip if gz is set.
+func openTarSource(path string, gz bool) (*tarSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, NewCoreError(ErrInvalidInput, "failed to open archive "+path).Wrap(err)
+	}
+	s := &tarSource{path: path, file: f}
+	if gz {
+		if s.gz, err = gzip.NewReader(f); err != nil {
+			f.Close()
+			return nil, NewCoreError(ErrInvalidInput, "failed to read gzip stream of "+path).Wrap(err)
+		}
+		s.tr = tar.NewReader(s.gz)
+	} else {
+		s.tr = tar.NewReader(f)
+	}
+	return s, nil
+}
+
+// list reads every header of the tar file and returns its entries, opening their
+// content with entry.
+func (s *tarSource) list() ([]importEntry, error) {
+	var entries []importEntry
+	for {
+		hdr, err := s.tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, NewCoreError(ErrInvalidInput, "failed to read tar archive "+s.path).Wrap(err)
+		}
+		n := s.next
+		s.next++
+		entries = append(entries, importEntry{
+			name: hdr.Name,
+			info: hdr.FileInfo(),
+			open: func() (io.ReadCloser, error) { return s.entry(n) },
+		})
+	}
+}
+
+// rewind starts reading the tar file again from its first entry.
+func (s *tarSource) rewind() error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return NewCoreError(ErrInvalidInput, "failed to rewind archive "+s.path).Wrap(err)
+	}
+	if s.gz != nil {
+		if err := s.gz.Reset(s.file); err != nil {
+			return NewCoreError(ErrInvalidInput, "failed to read gzip stream of "+s.path).Wrap(err)
+		}
+		s.tr = tar.NewReader(s.gz)
+	} else {
+		s.tr = tar.NewReader(s.file)
+	}
+	s.next = 0
+	return nil
+}
+
+// entry skips to the n-th entry of the tar file and returns its content.
+func (s *tarSource) entry(n int) (io.ReadCloser, error) {
+	if n < s.next {
+		return nil, fmt.Errorf("entry %d of %s was already read", n, s.path)
+	}
+	for s.next <= n {
+		if _, err := s.tr.Next(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		s.next++
+	}
+	return io.NopCloser(s.tr), nil
+}
+
+// Close closes the tar file.
+func (s *tarSource) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,196 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// IndexKeySize is the size in bytes of an index key (AES-256).
+const IndexKeySize = 32
+
+// The index is encrypted separately from the data block (envelope style), so who can
+// read an archive's metadata can be changed by rewrapping only the index. A sealed index
+// is a random nonce followed by the AES-256-GCM ciphertext of the encoded (and possibly
+// compressed) index. The data block checksum is authenticated along with it, tying the
+// index to the data it describes.
+
+// indexAEAD returns the AES-256-GCM cipher for an index key.
+func indexAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != IndexKeySize {
+		return nil, NewCoreError(ErrInvalidInput, fmt.Sprintf("index key must be %d bytes, got %d", IndexKeySize, len(key)))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, NewCoreError(ErrInvalidInput, "invalid index key").Wrap(err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealIndex encrypts an encoded index with key.
+func sealIndex(key, index []byte, dataChecksum [32]byte) ([]byte, error) {
+	aead, err := indexAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(index)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, NewCoreError(ErrArchiveWrite, "failed to generate index nonce").Wrap(err)
+	}
+	return aead.Seal(nonce, nonce, index, dataChecksum[:]), nil
+}
+
+// openIndex decrypts an index sealed by sealIndex. It fails if the key is wrong or the
+// index or data checksum was altered.
+func openIndex(key, sealed []byte, dataChecksum [32]byte) ([]byte, error) {
+	if key == nil {
+		return nil, NewCoreError(ErrDecryption, "archive index is encrypted; an index key is required")
+	}
+	aead, err := indexAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, NewCoreError(ErrInvalidFormat, "encrypted archive index is truncated")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	index, err := aead.Open(nil, nonce, ciphertext, dataChecksum[:])
+	if err != nil {
+		return nil, NewCoreError(ErrDecryption, "failed to decrypt archive index (wrong key?)").Wrap(err)
+	}
+	return index, nil
+}
+
+// encrypts reports whether the engine encrypts the index or the data of the archives
+// it creates.
+func (e *Engine) encrypts() bool {
+	return e.config.IndexKey != nil || e.config.Passphrase != nil || e.config.EncryptionKey != nil || e.keyFile != nil
+}
+
+// hasIndexKey reports whether the engine is configured to decrypt the index of h.
+func (e *Engine) hasIndexKey(h *Header) bool {
+	if h.Flags&FlagIndexPassphrase != 0 {
+		return e.config.Passphrase != nil
+	}
+	return e.config.IndexKey != nil || e.config.IndexKeySource != nil
+}
+
+// decodeIndex reads the index block described by h of the archive name ("" for a
+// stream), decrypting it with the engine's index key, or the key derived from its
+// passphrase, if it is encrypted.
+func (e *Engine) decodeIndex(r io.Reader, h *Header, name string) (*Index, error) {
+	if h.Flags&FlagIndexEncrypted == 0 {
+		return ReadIndex(r, h)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, NewCoreError(ErrArchiveRead, "failed to read archive index").Wrap(err)
+	}
+	var key []byte
+	release := func() { wipe(key) }
+	if h.Flags&FlagIndexPassphrase != 0 {
+		key, err = e.passphraseKey(h)
+	} else {
+		key, release, err = e.indexKey(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	index, err := openIndex(key, sealed, h.DataChecksum)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	return ReadIndex(bytes.NewReader(index), h)
+}
+
+// RewrapIndex re-encrypts the index of an archive from oldKey to newKey.
+// The data block is copied unchanged into a new archive written next to the original,
+// which is renamed over it once synced, so an interrupted rewrap leaves the original
+// archive intact. A nil oldKey reads an unencrypted index and
+// a nil newKey stores the index unencrypted. The index of a passphrase-protected
+// archive is read with Config.Passphrase if oldKey is nil; the rewrapped index is
+// protected by newKey instead. It does not consume a token.
+func (e *Engine) RewrapIndex(archiveFile string, oldKey, newKey []byte) error {
+	f, err := os.Open(archiveFile)
+	if err != nil {
+		return NewCoreError(ErrArchiveRead, "failed to open archive "+archiveFile).Wrap(err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return NewCoreError(ErrArchiveRead, "failed to stat archive "+archiveFile).Wrap(err)
+	}
+	header, err := ReadHeader(io.NewSectionReader(f, 0, HeaderSize))
+	if err != nil {
+		return err
+	}
+	if header.IndexOffset < HeaderSize || header.IndexLength < 0 || header.IndexOffset+header.IndexLength > info.Size() {
+		return NewCoreError(ErrInvalidFormat, "archive index lies outside the file")
+	}
+
+	index := make([]byte, header.IndexLength)
+	if _, err := f.ReadAt(index, header.IndexOffset); err != nil {
+		return NewCoreError(ErrArchiveRead, "failed to read archive index").Wrap(err)
+	}
+	if header.Flags&FlagIndexPassphrase != 0 && oldKey == nil {
+		if oldKey, err = e.passphraseKey(header); err != nil {
+			return err
+		}
+		defer wipe(oldKey)
+	}
+	if header.Flags&FlagIndexEncrypted != 0 {
+		if index, err = openIndex(oldKey, index, header.DataChecksum); err != nil {
+			return err
+		}
+	}
+	// Make sure the index is intact before committing to it.
+	plain := *header
+	plain.Flags &^= FlagIndexEncrypted | FlagIndexPassphrase
+	plain.KDF, plain.KDFSalt = KDFParams{}, [16]byte{}
+	if _, err := ReadIndex(bytes.NewReader(index), &plain); err != nil {
+		return err
+	}
+
+	if newKey != nil {
+		if index, err = sealIndex(newKey, index, header.DataChecksum); err != nil {
+			return err
+		}
+		plain.Flags |= FlagIndexEncrypted
+	}
+	header = &plain
+	header.IndexLength = int64(len(index))
+
+	if err := replaceArchive(archiveFile, ".rewrap-*", func(out *os.File) error {
+		if err := WriteHeader(out, header); err != nil {
+			return err
+		}
+		// Everything between the header and the index, the dictionary included, is kept.
+		if _, err := io.Copy(out, io.NewSectionReader(f, HeaderSize, header.IndexOffset-HeaderSize)); err != nil {
+			return NewCoreError(ErrArchiveWrite, "failed to copy archive data").Wrap(err)
+		}
+		if _, err := out.Write(index); err != nil {
+			return NewCoreError(ErrArchiveWrite, "failed to write archive index").Wrap(err)
+		}
+		if err := out.Sync(); err != nil {
+			return NewCoreError(ErrArchiveWrite, "failed to sync archive").Wrap(err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	e.log.WithFields(logrus.Fields{
+		"archive":   archiveFile,
+		"encrypted": newKey != nil,
+	}).Info("Archive index rewrapped")
+	return nil
+}
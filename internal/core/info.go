@@ -0,0 +1,71 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// ArchiveInfo summarizes an archive from its header and index. It is meant to be
+// serialized, for example by 'nsm info --json'.
+type ArchiveInfo struct {
+	FormatVersion    uint16           `json:"format_version"`
+	Compression      CompressionType  `json:"compression"`
+	Level            int              `json:"level"`      // Compression level; 0 for the algorithm's default.
+	Encryption       string           `json:"encryption"` // "none" or the data encryption algorithm.
+	IndexEncrypted   bool             `json:"index_encrypted"`
+	Files            int              `json:"files"`
+	UncompressedSize int64            `json:"uncompressed_size"`         // Total size of the files.
+	CompressedSize   int64            `json:"compressed_size"`           // Size of the data block.
+	Ratio            float64          `json:"ratio"`                     // CompressedSize / UncompressedSize; 0 for no data.
+	DictionarySize   int64            `json:"dictionary_size,omitempty"` // Size of the zstd dictionary, see Config.Dictionary; 0 if none.
+	Created          time.Time        `json:"created"`
+	Metadata         *ArchiveMetadata `json:"metadata,omitempty"`
+}
+
+// Info describes an archive without decompressing anything: only its header and index
+// are read, so it is cheap whatever the archive size. An encrypted index needs its key
+// or passphrase; the data key isn't needed.
+func (e *Engine) Info(archiveFile string) (*ArchiveInfo, error) {
+	a, err := e.openArchive(archiveFile)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+
+	info := &ArchiveInfo{
+		FormatVersion:  a.header.Version,
+		Compression:    a.algo,
+		Level:          int(a.header.Level),
+		Encryption:     encryptionName(a.header.EncryptionType),
+		IndexEncrypted: a.header.Flags&FlagIndexEncrypted != 0,
+		Files:          len(a.index.Files),
+		CompressedSize: a.dataSize(),
+		Created:        time.Unix(0, a.header.Timestamp),
+		Metadata:       a.index.Metadata,
+	}
+	if a.dict != nil {
+		info.DictionarySize = int64(len(a.dict.Bytes()))
+	}
+	for _, entry := range a.index.Files {
+		info.UncompressedSize += entry.UncompressedSize
+	}
+	if info.UncompressedSize > 0 {
+		info.Ratio = float64(info.CompressedSize) / float64(info.UncompressedSize)
+	}
+	return info, nil
+}
+
+// encryptionName returns the name of a Header.EncryptionType.
+func encryptionName(t uint8) string {
+	switch t {
+	case EncryptionNone:
+		return "none"
+	case EncryptionAES256GCM:
+		return CipherAES256GCM
+	case EncryptionChaCha20Poly1305:
+		return CipherChaCha20Poly1305
+	default:
+		return fmt.Sprintf("unknown (%d)", t)
+	}
+}
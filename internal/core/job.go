@@ -0,0 +1,216 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// CreateSpec describes an archive built by CreateJob.
+type CreateSpec struct {
+	OutputFile string
+	Inputs     []string    // Files and directories, as for Create.
+	Tokens     TokenSource // Charged for the archive; nil means Config.Tokens.
+}
+
+// FileResult reports a file archived by CreateJob.
+type FileResult struct {
+	Path             string          // Name recorded in the archive, or the input path if Err is set.
+	UncompressedSize int64           // Size of the file.
+	CompressedSize   int64           // Size of its frame; for grouped files, their share of the group's frame.
+	Ratio            float64         // CompressedSize / UncompressedSize; 0 for empty files.
+	Algorithm        CompressionType // Algorithm the file was compressed with.
+	Grouped          bool            // Whether the file shares a frame, see Config.GroupSmallFiles.
+	Duplicate        bool            // Whether the file shares the frame of an identical one, see Config.Dedup.
+	Err              error           // Why the file was left out, with Config.KeepGoing.
+}
+
+// CreateResult sums up an archive written by Create and its variants.
+type CreateResult struct {
+	Files       int                           `json:"files"`        // Number of files archived.
+	InputSize   int64                         `json:"input_size"`   // Total size of the files.
+	Duplicates  int                           `json:"duplicates"`   // Files whose data is shared with an identical one, see Config.Dedup.
+	Excluded    int                           `json:"excluded"`     // Paths left out by Config.Exclude and the ignore lists; a directory counts once.
+	DedupSaved  int64                         `json:"dedup_saved"`  // Total size of the duplicates, which isn't stored again.
+	ArchiveSize int64                         `json:"archive_size"` // Size of the archive file, header and index included.
+	Ratio       float64                       `json:"ratio"`        // ArchiveSize / InputSize; 0 for no input.
+	Elapsed     time.Duration                 `json:"elapsed"`      // Time spent writing the archive.
+	Algorithms  map[CompressionType]AlgoStats `json:"algorithms"`   // What each algorithm compressed.
+}
+
+// AlgoStats sums up the files of an archive compressed with one algorithm.
+type AlgoStats struct {
+	Files            int   `json:"files"`
+	UncompressedSize int64 `json:"uncompressed_size"`
+	CompressedSize   int64 `json:"compressed_size"` // Grouped files count their share of the group's frame.
+}
+
+// CreateJob builds an archive like Create, and streams a FileResult for every file as
+// soon as it is archived, for example to render a live table. Files are reported in
+// archive order, except grouped ones, which are reported when their group is written,
+// and duplicates, which are reported last.
+// Files left out with Config.KeepGoing are reported first, with Err set.
+//
+// The results channel is closed when the job ends, and the error channel then receives
+// a single value: nil if the archive was written and its tokens charged, or why it
+// wasn't, in which case no tokens are charged. The results must be drained for the job
+// to progress. Cancelling ctx stops the job before the next file and removes the
+// partial archive.
+func (e *Engine) CreateJob(ctx context.Context, spec CreateSpec) (<-chan FileResult, <-chan error) {
+	results := make(chan FileResult)
+	done := make(chan error, 1)
+	go func() {
+		job := &createJob{ctx: ctx, results: results}
+		err := e.runCreateJob(spec, job)
+		close(results)
+		done <- err
+		close(done)
+	}()
+	return results, done
+}
+
+// runCreateJob implements CreateJob.
+func (e *Engine) runCreateJob(spec CreateSpec, job *createJob) error {
+	tokens := spec.Tokens
+	if tokens == nil {
+		tokens = e.config.Tokens
+	}
+	if tokens == nil {
+		return NewCoreError(ErrInvalidInput, "no token source configured for 'create' operation")
+	}
+	if err := e.validateInputs(spec.Inputs); err != nil {
+		return err
+	}
+	inputs, err := e.CollectInputs(spec.Inputs)
+	if err != nil {
+		return err
+	}
+	for _, skipped := range inputs.Skipped {
+		e.log.WithField("path", skipped.Path).WithError(skipped.Err).Warn("Skipping unreadable file")
+		if err := job.send(FileResult{Path: skipped.Path, Err: skipped.Err}); err != nil {
+			return err
+		}
+	}
+	if err := job.err(); err != nil {
+		return err
+	}
+	_, err = e.createFromInputs(spec.OutputFile, inputs, tokens, job)
+	return err
+}
+
+// createJob carries the context of a create to writeArchive, tallies the files it
+// archives, and connects it to the consumer of a CreateJob if results is set. Its
+// methods do nothing on a nil job.
+type createJob struct {
+	ctx     context.Context
+	results chan<- FileResult
+	output  io.Writer // Where the archive goes instead of a file, see CreateFromReaders.
+	algos   map[CompressionType]AlgoStats
+
+	duplicates int // Files sharing the frame of an identical one, and their total size.
+	dupSize    int64
+}
+
+// err returns why the job should stop, or nil.
+func (j *createJob) err() error {
+	if j == nil {
+		return nil
+	}
+	return j.ctx.Err()
+}
+
+// reader returns r, failing once the job is cancelled.
+func (j *createJob) reader(r io.Reader) io.Reader {
+	if j == nil {
+		return r
+	}
+	return withContextReader(j.ctx, r)
+}
+
+// file reports a file compressed in its own frame.
+func (j *createJob) file(meta FileMetadata, algo CompressionType) {
+	j.report(meta, algo, meta.CompressedSize, false)
+}
+
+// groupedFile reports a file of a group of groupSize bytes, whose frame was just written.
+func (j *createJob) groupedFile(meta FileMetadata, algo CompressionType, groupSize int64) {
+	var share int64
+	if groupSize > 0 {
+		share = meta.CompressedSize * meta.UncompressedSize / groupSize
+	}
+	j.report(meta, algo, share, true)
+}
+
+// duplicate reports a file sharing the frame of an identical one, which takes no space.
+func (j *createJob) duplicate(meta FileMetadata, algo CompressionType) {
+	if j == nil {
+		return
+	}
+	j.duplicates++
+	j.dupSize += meta.UncompressedSize
+	j.send(FileResult{
+		Path:             meta.Path,
+		UncompressedSize: meta.UncompressedSize,
+		Algorithm:        algo,
+		Grouped:          meta.Group != 0,
+		Duplicate:        true,
+	})
+}
+
+func (j *createJob) report(meta FileMetadata, algo CompressionType, compressed int64, grouped bool) {
+	if j == nil {
+		return
+	}
+	result := FileResult{
+		Path:             meta.Path,
+		UncompressedSize: meta.UncompressedSize,
+		CompressedSize:   compressed,
+		Algorithm:        algo,
+		Grouped:          grouped,
+	}
+	if meta.UncompressedSize > 0 {
+		result.Ratio = float64(compressed) / float64(meta.UncompressedSize)
+	}
+	if j.algos == nil {
+		j.algos = make(map[CompressionType]AlgoStats)
+	}
+	stats := j.algos[algo]
+	stats.Files++
+	stats.UncompressedSize += meta.UncompressedSize
+	stats.CompressedSize += compressed
+	j.algos[algo] = stats
+	// A cancelled job stops at the next file; the result is dropped.
+	j.send(result)
+}
+
+// result returns the totals of the files reported, for a create that took elapsed.
+// The archive size and ratio are left to the caller.
+func (j *createJob) result(elapsed time.Duration) *CreateResult {
+	r := &CreateResult{Elapsed: elapsed, Algorithms: make(map[CompressionType]AlgoStats)}
+	if j == nil {
+		return r
+	}
+	for algo, stats := range j.algos {
+		r.Algorithms[algo] = stats
+		r.Files += stats.Files
+		r.InputSize += stats.UncompressedSize
+	}
+	r.Duplicates, r.DedupSaved = j.duplicates, j.dupSize
+	r.Files += j.duplicates
+	r.InputSize += j.dupSize
+	return r
+}
+
+// send delivers a result unless the job is cancelled first.
+func (j *createJob) send(r FileResult) error {
+	if j.results == nil {
+		return nil
+	}
+	select {
+	case j.results <- r:
+		return nil
+	case <-j.ctx.Done():
+		return j.ctx.Err()
+	}
+}
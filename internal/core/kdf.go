@@ -0,0 +1,166 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Passphrase-protected archives derive their keys with Argon2id from the passphrase
+// and a random salt. The salt and the Argon2id parameters are stored in the header, so
+// the key can be derived again from the passphrase alone.
+const (
+	// KDFSaltSize is the size in bytes of the salt stored in Header.KDFSalt.
+	KDFSaltSize = 16
+	// MaxKDFMemory bounds the Argon2id memory, in MiB, of each key of an archive, so a
+	// crafted archive can't make opening it exhaust memory. The index and data keys are
+	// derived one after the other, so each needs at most this much in turn.
+	MaxKDFMemory = 256
+)
+
+// KDFParams are the Argon2id parameters deriving a key from a passphrase. They are
+// stored in the header as 4 bytes.
+type KDFParams struct {
+	Time    uint8  // Passes over the memory.
+	Threads uint8  // Lanes computed in parallel.
+	Memory  uint16 // Memory in MiB.
+}
+
+// DefaultKDFParams are the parameters of new archives, unless Config.KDF sets them:
+// 64 MiB and 3 passes, as RFC 9106 recommends when memory is constrained.
+var DefaultKDFParams = KDFParams{Time: 3, Threads: 4, Memory: 64}
+
+// check returns an error with code if p can't derive a key.
+func (p KDFParams) check(code ErrorCode) error {
+	if p.Time == 0 || p.Threads == 0 || p.Memory == 0 || p.Memory > MaxKDFMemory {
+		return NewCoreError(code, fmt.Sprintf("invalid key derivation parameters: time %d, threads %d, memory %d MiB", p.Time, p.Threads, p.Memory))
+	}
+	return nil
+}
+
+// deriveKey derives a key of IndexKeySize bytes from passphrase and salt with p.
+func (p KDFParams) deriveKey(passphrase, salt []byte) []byte {
+	return argon2.IDKey(passphrase, salt, uint32(p.Time), uint32(p.Memory)*1024, p.Threads, IndexKeySize)
+}
+
+// DeriveKey derives a 256-bit key from password and salt with Argon2id and the
+// parameters of new archives, see Config.KDF.
+func (e *Engine) DeriveKey(password string, salt []byte) []byte {
+	return e.kdfParams().deriveKey([]byte(password), salt)
+}
+
+// passphraseKey derives the index key of an archive from Config.Passphrase and the
+// KDF parameters of its header.
+func (e *Engine) passphraseKey(h *Header) ([]byte, error) {
+	return e.deriveFromPassphrase(h.KDFSalt[:], h.KDF)
+}
+
+// passphraseDataKey derives the data key of an archive from Config.Passphrase and the
+// data KDF parameters of its header.
+func (e *Engine) passphraseDataKey(h *Header) ([]byte, error) {
+	return e.deriveFromPassphrase(h.DataKDFSalt[:], h.DataKDF)
+}
+
+// deriveFromPassphrase derives a key from Config.Passphrase with parameters read from
+// a header.
+func (e *Engine) deriveFromPassphrase(salt []byte, params KDFParams) ([]byte, error) {
+	if e.config.Passphrase == nil {
+		return nil, NewCoreError(ErrDecryption, "archive is protected by a passphrase; a passphrase is required")
+	}
+	if len(e.config.Passphrase) == 0 {
+		return nil, NewCoreError(ErrInvalidInput, "the passphrase cannot be empty")
+	}
+	if err := params.check(ErrInvalidFormat); err != nil {
+		return nil, err
+	}
+	return params.deriveKey(e.config.Passphrase, salt), nil
+}
+
+// kdfParams returns the KDF parameters of the keys of new archives: Config.KDF, with
+// those of DefaultKDFParams where it has none.
+func (e *Engine) kdfParams() KDFParams {
+	p := e.config.KDF
+	if p.Time == 0 {
+		p.Time = DefaultKDFParams.Time
+	}
+	if p.Threads == 0 {
+		p.Threads = DefaultKDFParams.Threads
+	}
+	if p.Memory == 0 {
+		p.Memory = DefaultKDFParams.Memory
+	}
+	return p
+}
+
+// newPassphraseKey picks a new salt for h, using the KDF parameters of Config.KDF, and
+// derives the index key from Config.Passphrase.
+func (e *Engine) newPassphraseKey(h *Header) ([]byte, error) {
+	if _, err := rand.Read(h.KDFSalt[:]); err != nil {
+		return nil, NewCoreError(ErrArchiveWrite, "failed to generate key derivation salt").Wrap(err)
+	}
+	h.KDF = e.kdfParams()
+	if err := h.KDF.check(ErrInvalidInput); err != nil {
+		return nil, err
+	}
+	return e.passphraseKey(h)
+}
+
+// newPassphraseDataKey is like newPassphraseKey for the data key, which has a salt of
+// its own so that rewriting the index leaves it unchanged.
+func (e *Engine) newPassphraseDataKey(h *Header) ([]byte, error) {
+	if _, err := rand.Read(h.DataKDFSalt[:]); err != nil {
+		return nil, NewCoreError(ErrArchiveWrite, "failed to generate key derivation salt").Wrap(err)
+	}
+	h.DataKDF = e.kdfParams()
+	if err := h.DataKDF.check(ErrInvalidInput); err != nil {
+		return nil, err
+	}
+	return e.passphraseDataKey(h)
+}
+
+// keyFileInfo is the HKDF info of data keys mixed from a passphrase and a key file.
+const keyFileInfo = "nsm data key: passphrase and key file"
+
+// ReadKeyFile reads a key file, see Config.KeyFile: it must hold exactly
+// EncryptionKeySize bytes.
+func ReadKeyFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, NewCoreError(ErrInvalidInput, "failed to open key file").Wrap(err)
+	}
+	defer f.Close()
+	// One byte more tells a longer file apart.
+	key := make([]byte, EncryptionKeySize+1)
+	n, err := io.ReadFull(f, key)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		wipe(key)
+		return nil, NewCoreError(ErrInvalidInput, "failed to read key file").Wrap(err)
+	}
+	if n != EncryptionKeySize {
+		wipe(key)
+		return nil, NewCoreError(ErrInvalidInput, fmt.Sprintf("key file %s must hold exactly %d bytes", path, EncryptionKeySize))
+	}
+	return key[:EncryptionKeySize], nil
+}
+
+// withKeyFile mixes passphraseKey, the data key derived from the passphrase of h, with
+// the key of Config.KeyFile, and wipes it. Neither key alone reveals the result.
+func (e *Engine) withKeyFile(passphraseKey []byte, h *Header) ([]byte, error) {
+	defer wipe(passphraseKey)
+	if e.keyFile == nil {
+		return nil, NewCoreError(ErrDecryption, "archive data is also protected by a key file; a key file is required")
+	}
+	ikm := append(append(make([]byte, 0, len(passphraseKey)+len(e.keyFile)), passphraseKey...), e.keyFile...)
+	defer wipe(ikm)
+	key := make([]byte, EncryptionKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, h.DataKDFSalt[:], []byte(keyFileInfo)), key); err != nil {
+		return nil, NewCoreError(ErrDecryption, "failed to derive data key").Wrap(err)
+	}
+	return key, nil
+}
@@ -0,0 +1,84 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"fmt"
+	"io"
+)
+
+// minRatioAllowance is the output every entry may produce whatever
+// Config.MaxExtractRatio, so small but very compressible files such as empty
+// templates aren't mistaken for decompression bombs.
+const minRatioAllowance = 1 << 20
+
+// outputLimit returns how many bytes an entry of the given compressed size may
+// decompress to under Config.MaxExtractSize and Config.MaxExtractRatio, or -1 if
+// there is no limit.
+func (e *Engine) outputLimit(a *archiveReader, compressed int64) int64 {
+	limit := int64(-1)
+	if max := e.config.MaxExtractSize; max > 0 {
+		limit = max - a.extracted.Load()
+		if limit < 0 {
+			limit = 0
+		}
+	}
+	if ratio := e.config.MaxExtractRatio; ratio > 0 {
+		byRatio := int64(ratio * float64(compressed))
+		if byRatio < minRatioAllowance {
+			byRatio = minRatioAllowance
+		}
+		if limit < 0 || byRatio < limit {
+			limit = byRatio
+		}
+	}
+	return limit
+}
+
+// limitOutput wraps w to enforce the extraction limits on an entry of the given
+// compressed size, which the index says decompresses to declared bytes. It fails right
+// away if the declared size is over the limit, and returns nil if there is no limit.
+func (e *Engine) limitOutput(a *archiveReader, w io.Writer, path string, compressed, declared int64) (*limitedWriter, error) {
+	limit := e.outputLimit(a, compressed)
+	if limit < 0 {
+		return nil, nil
+	}
+	if declared > limit {
+		return nil, limitError(path, limit)
+	}
+	return &limitedWriter{w: w, a: a, path: path, limit: limit}, nil
+}
+
+// limitedWriter passes at most limit bytes to w, adding them to the archive's extracted
+// total, and fails as soon as more are written, which stops the decompression.
+type limitedWriter struct {
+	w       io.Writer
+	a       *archiveReader
+	path    string
+	limit   int64
+	written int64
+	err     *CoreError // Set once the limit is exceeded.
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.written+int64(len(p)) > l.limit {
+		l.err = limitError(l.path, l.limit)
+		return 0, l.err
+	}
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	l.a.extracted.Add(int64(n))
+	return n, err
+}
+
+// exceeded returns the limit error if l stopped a decompression, and nil otherwise,
+// including for a nil l.
+func (l *limitedWriter) exceeded() error {
+	if l == nil || l.err == nil {
+		return nil
+	}
+	return l.err
+}
+
+func limitError(path string, limit int64) *CoreError {
+	return NewCoreError(ErrLimitExceeded, fmt.Sprintf("%s expands beyond the extraction limit of %d bytes; the archive may be a decompression bomb", path, limit))
+}
@@ -0,0 +1,471 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// LZ4 streams use the LZ4 frame format, so the lz4 tool can read them too. They are
+// written as independent blocks of up to lz4BlockSize bytes, without checksums, since
+// archives checksum their data already. Frames written by other tools are read as
+// well, including linked blocks; their checksums are skipped.
+const (
+	lz4Magic         = 0x184D2204
+	lz4SkippableMin  = 0x184D2A50 // Skippable frames use magics 0x184D2A50-0x184D2A5F.
+	lz4SkippableMask = 0xFFFFFFF0
+	lz4BlockSize     = 64 << 10
+	lz4Uncompressed  = 1 << 31 // Block size flag of blocks stored verbatim.
+
+	// Frame descriptor bits.
+	lz4Version         = 1 << 6
+	lz4FlagIndependent = 1 << 5
+	lz4FlagBlockSum    = 1 << 4
+	lz4FlagContentSize = 1 << 3
+	lz4FlagContentSum  = 1 << 2
+	lz4FlagDictID      = 1 << 0
+
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5  // The last bytes of a block are always literals.
+	lz4MatchLimit   = 12 // No match starts this close to the end of a block.
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 14
+)
+
+var errLZ4Corrupt = errors.New("corrupt lz4 block")
+
+// lz4BlockSizes maps the block size code of a frame descriptor to the largest block.
+var lz4BlockSizes = map[byte]int{4: 64 << 10, 5: 256 << 10, 6: 1 << 20, 7: 4 << 20}
+
+// lz4Writer compresses a stream into a single LZ4 frame.
+type lz4Writer struct {
+	w           io.Writer
+	buf         []byte // Input of the next block.
+	out         []byte // Compressed block.
+	table       [1 << lz4HashLog]int32
+	wroteHeader bool
+	err         error
+}
+
+func newLZ4Writer(w io.Writer) *lz4Writer {
+	return &lz4Writer{
+		w:   w,
+		buf: make([]byte, 0, lz4BlockSize),
+		out: make([]byte, lz4BlockSize),
+	}
+}
+
+func (z *lz4Writer) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 && z.err == nil {
+		k := copy(z.buf[len(z.buf):cap(z.buf)], p)
+		z.buf = z.buf[:len(z.buf)+k]
+		p = p[k:]
+		n += k
+		if len(z.buf) == cap(z.buf) {
+			z.err = z.writeBlock()
+		}
+	}
+	return n, z.err
+}
+
+// Close writes the last block and ends the frame. It doesn't close the underlying writer.
+func (z *lz4Writer) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+	if len(z.buf) > 0 {
+		if z.err = z.writeBlock(); z.err != nil {
+			return z.err
+		}
+	}
+	if z.err = z.writeHeader(); z.err != nil {
+		return z.err
+	}
+	var endMark [4]byte
+	_, z.err = z.w.Write(endMark[:])
+	return z.err
+}
+
+// writeHeader writes the frame header before the first block.
+func (z *lz4Writer) writeHeader() error {
+	if z.wroteHeader {
+		return nil
+	}
+	z.wroteHeader = true
+	var header [7]byte
+	binary.LittleEndian.PutUint32(header[:], lz4Magic)
+	header[4] = lz4Version | lz4FlagIndependent
+	header[5] = 4 << 4 // 64 KiB blocks.
+	header[6] = byte(xxh32(header[4:6]) >> 8)
+	_, err := z.w.Write(header[:])
+	return err
+}
+
+// writeBlock compresses and writes the buffered input, or stores it if it doesn't shrink.
+func (z *lz4Writer) writeBlock() error {
+	if err := z.writeHeader(); err != nil {
+		return err
+	}
+	block := z.buf
+	var size [4]byte
+	if n := lz4CompressBlock(z.out, z.buf, &z.table); n > 0 && n < len(z.buf) {
+		block = z.out[:n]
+		binary.LittleEndian.PutUint32(size[:], uint32(n))
+	} else {
+		binary.LittleEndian.PutUint32(size[:], uint32(len(block))|lz4Uncompressed)
+	}
+	if _, err := z.w.Write(size[:]); err != nil {
+		return err
+	}
+	if _, err := z.w.Write(block); err != nil {
+		return err
+	}
+	z.buf = z.buf[:0]
+	return nil
+}
+
+// lz4CompressBlock compresses src into dst with a greedy hash matcher and returns the
+// compressed size, or 0 if it doesn't fit in dst.
+func lz4CompressBlock(dst, src []byte, table *[1 << lz4HashLog]int32) int {
+	if len(src) <= lz4MatchLimit {
+		return lz4AppendSequence(dst, 0, src, 0, 0)
+	}
+	for i := range table {
+		table[i] = -1
+	}
+	di, anchor := 0, 0
+	limit := len(src) - lz4MatchLimit
+	end := len(src) - lz4LastLiterals
+	for si := 0; si < limit; {
+		seq := binary.LittleEndian.Uint32(src[si:])
+		h := (seq * 2654435761) >> (32 - lz4HashLog)
+		ref := int(table[h])
+		table[h] = int32(si)
+		if ref < 0 || si-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			// Step faster through data that doesn't match.
+			si += 1 + (si-anchor)>>6
+			continue
+		}
+		for si > anchor && ref > 0 && src[si-1] == src[ref-1] {
+			si--
+			ref--
+		}
+		length := lz4MinMatch
+		for si+length < end && src[si+length] == src[ref+length] {
+			length++
+		}
+		if di = lz4AppendSequence(dst, di, src[anchor:si], si-ref, length); di == 0 {
+			return 0
+		}
+		si += length
+		anchor = si
+	}
+	return lz4AppendSequence(dst, di, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence writes literals followed by a match at dst[di:] and returns the new
+// end, or 0 if it doesn't fit. A zero length writes the final, literal-only sequence.
+func lz4AppendSequence(dst []byte, di int, literals []byte, offset, length int) int {
+	if di+len(literals)+len(literals)/255+length/255+5 > len(dst) {
+		return 0
+	}
+	tokenAt := di
+	di++
+	var token byte
+	if n := len(literals); n >= 15 {
+		token = 15 << 4
+		di = lz4AppendLength(dst, di, n-15)
+	} else {
+		token = byte(n) << 4
+	}
+	di += copy(dst[di:], literals)
+	if length > 0 {
+		binary.LittleEndian.PutUint16(dst[di:], uint16(offset))
+		di += 2
+		if n := length - lz4MinMatch; n >= 15 {
+			token |= 15
+			di = lz4AppendLength(dst, di, n-15)
+		} else {
+			token |= byte(n)
+		}
+	}
+	dst[tokenAt] = token
+	return di
+}
+
+// lz4AppendLength writes the continuation bytes of a length.
+func lz4AppendLength(dst []byte, di, n int) int {
+	for ; n >= 255; n -= 255 {
+		dst[di] = 255
+		di++
+	}
+	dst[di] = byte(n)
+	return di + 1
+}
+
+// lz4DecompressBlock decompresses src to dst[di:], where dst[:di] is the history
+// matches may refer to, and returns the end of the output.
+func lz4DecompressBlock(dst []byte, di int, src []byte) (int, error) {
+	si := 0
+	for {
+		if si >= len(src) {
+			return 0, errLZ4Corrupt
+		}
+		token := src[si]
+		si++
+		n := int(token >> 4)
+		if n == 15 {
+			var err error
+			if n, si, err = lz4ReadLength(src, si, n); err != nil {
+				return 0, err
+			}
+		}
+		if n > len(src)-si || n > len(dst)-di {
+			return 0, errLZ4Corrupt
+		}
+		di += copy(dst[di:], src[si:si+n])
+		si += n
+		if si == len(src) {
+			return di, nil
+		}
+
+		if len(src)-si < 2 {
+			return 0, errLZ4Corrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[si:]))
+		si += 2
+		n = int(token & 15)
+		if n == 15 {
+			var err error
+			if n, si, err = lz4ReadLength(src, si, n); err != nil {
+				return 0, err
+			}
+		}
+		n += lz4MinMatch
+		if offset == 0 || offset > di || n > len(dst)-di {
+			return 0, errLZ4Corrupt
+		}
+		if offset >= n {
+			di += copy(dst[di:di+n], dst[di-offset:])
+			continue
+		}
+		// Overlapping matches repeat the bytes just written.
+		for i := 0; i < n; i++ {
+			dst[di+i] = dst[di-offset+i]
+		}
+		di += n
+	}
+}
+
+// lz4ReadLength adds the continuation bytes of a length to n.
+func lz4ReadLength(src []byte, si, n int) (int, int, error) {
+	for {
+		if si >= len(src) {
+			return 0, 0, errLZ4Corrupt
+		}
+		b := src[si]
+		si++
+		n += int(b)
+		if b != 255 {
+			return n, si, nil
+		}
+	}
+}
+
+// lz4Reader decompresses a stream of LZ4 frames.
+type lz4Reader struct {
+	r        io.Reader
+	frames   int
+	inFrame  bool
+	flags    byte
+	maxBlock int
+	block    []byte // Compressed block.
+	window   []byte // Decompressed output, after the history of linked blocks.
+	out      []byte // Unread part of the last block.
+	err      error
+}
+
+func newLZ4Reader(r io.Reader) *lz4Reader {
+	return &lz4Reader{r: r}
+}
+
+func (z *lz4Reader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.nextBlock()
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// nextBlock decompresses the next block into out, starting a new frame if needed.
+func (z *lz4Reader) nextBlock() error {
+	if !z.inFrame {
+		return z.readHeader()
+	}
+	var word [4]byte
+	if _, err := io.ReadFull(z.r, word[:]); err != nil {
+		return noEOF(err)
+	}
+	size := binary.LittleEndian.Uint32(word[:])
+	if size == 0 {
+		z.inFrame = false
+		if z.flags&lz4FlagContentSum != 0 {
+			return z.skip(4)
+		}
+		return nil
+	}
+	stored := size&lz4Uncompressed != 0
+	size &^= lz4Uncompressed
+	if int(size) > z.maxBlock {
+		return errLZ4Corrupt
+	}
+	block := z.block[:size]
+	if _, err := io.ReadFull(z.r, block); err != nil {
+		return noEOF(err)
+	}
+	if z.flags&lz4FlagBlockSum != 0 {
+		if err := z.skip(4); err != nil {
+			return err
+		}
+	}
+
+	// Linked blocks may refer to the 64 KiB of output before them.
+	history := 0
+	if z.flags&lz4FlagIndependent == 0 {
+		history = len(z.window)
+		if history > lz4MaxOffset {
+			history = lz4MaxOffset
+		}
+		copy(z.window[:cap(z.window)], z.window[len(z.window)-history:])
+	}
+	dst := z.window[:history+z.maxBlock]
+	end := history + int(size)
+	if stored {
+		copy(dst[history:], block)
+	} else {
+		var err error
+		if end, err = lz4DecompressBlock(dst, history, block); err != nil {
+			return err
+		}
+	}
+	z.window = dst[:end]
+	z.out = dst[history:end]
+	return nil
+}
+
+// readHeader reads a frame header, skipping skippable frames. It returns io.EOF at the
+// end of the stream.
+func (z *lz4Reader) readHeader() error {
+	var word [4]byte
+	for {
+		if _, err := io.ReadFull(z.r, word[:]); err != nil {
+			if err == io.EOF && z.frames > 0 {
+				return io.EOF
+			}
+			return noEOF(err)
+		}
+		magic := binary.LittleEndian.Uint32(word[:])
+		if magic == lz4Magic {
+			break
+		}
+		if magic&lz4SkippableMask != lz4SkippableMin {
+			return fmt.Errorf("not an lz4 frame (magic %#x)", magic)
+		}
+		if _, err := io.ReadFull(z.r, word[:]); err != nil {
+			return noEOF(err)
+		}
+		if err := z.skip(int64(binary.LittleEndian.Uint32(word[:]))); err != nil {
+			return err
+		}
+	}
+
+	descriptor := make([]byte, 2, 15)
+	if _, err := io.ReadFull(z.r, descriptor); err != nil {
+		return noEOF(err)
+	}
+	flags := descriptor[0]
+	if flags>>6 != 1 {
+		return fmt.Errorf("unsupported lz4 frame version %d", flags>>6)
+	}
+	if flags&lz4FlagDictID != 0 {
+		return errors.New("lz4 frames with a dictionary are not supported")
+	}
+	maxBlock, ok := lz4BlockSizes[(descriptor[1]>>4)&7]
+	if !ok {
+		return fmt.Errorf("invalid lz4 block size code %d", (descriptor[1]>>4)&7)
+	}
+	extra := 1 // Header checksum.
+	if flags&lz4FlagContentSize != 0 {
+		extra += 8
+	}
+	descriptor = descriptor[:2+extra]
+	if _, err := io.ReadFull(z.r, descriptor[2:]); err != nil {
+		return noEOF(err)
+	}
+	last := len(descriptor) - 1
+	if byte(xxh32(descriptor[:last])>>8) != descriptor[last] {
+		return errors.New("lz4 frame header checksum mismatch")
+	}
+
+	z.inFrame, z.flags, z.maxBlock = true, flags, maxBlock
+	if cap(z.block) < maxBlock {
+		z.block = make([]byte, maxBlock)
+	}
+	if cap(z.window) < lz4MaxOffset+maxBlock {
+		z.window = make([]byte, 0, lz4MaxOffset+maxBlock)
+	}
+	z.window = z.window[:0]
+	z.frames++
+	return nil
+}
+
+// skip discards n bytes of input.
+func (z *lz4Reader) skip(n int64) error {
+	if _, err := io.CopyN(io.Discard, z.r, n); err != nil {
+		return noEOF(err)
+	}
+	return nil
+}
+
+// noEOF reports a stream that ends inside a frame as truncated.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// xxh32 returns the XXH32 hash of a short input (under 16 bytes) with seed 0, as used
+// by LZ4 frame header checksums.
+func xxh32(b []byte) uint32 {
+	const (
+		prime1 = 2654435761
+		prime2 = 2246822519
+		prime3 = 3266489917
+		prime4 = 668265263
+		prime5 = 374761393
+	)
+	h := uint32(prime5) + uint32(len(b))
+	for ; len(b) >= 4; b = b[4:] {
+		h += binary.LittleEndian.Uint32(b) * prime3
+		h = bits.RotateLeft32(h, 17) * prime4
+	}
+	for _, c := range b {
+		h += uint32(c) * prime5
+		h = bits.RotateLeft32(h, 11) * prime1
+	}
+	h ^= h >> 15
+	h *= prime2
+	h ^= h >> 13
+	h *= prime3
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,53 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"os"
+	"os/user"
+	"runtime"
+
+	"github.com/nexus/nsm/internal/version"
+)
+
+// ArchiveMetadata records provenance information about how an archive was built.
+// It is stored in the index rather than the fixed-size header, so it can grow
+// without breaking the 64-byte header layout.
+type ArchiveMetadata struct {
+	ToolVersion string // Version of the nsm build that created the archive.
+	ToolCommit  string // Commit hash of that build.
+	OS          string // GOOS of the creating machine.
+	Arch        string // GOARCH of the creating machine.
+	Creator     string // Optional, user-supplied label.
+	Hostname    string // Omitted in reproducible mode.
+	User        string // Omitted in reproducible mode.
+
+	// Levels lists the zstd levels the data was compressed with, in ascending order,
+	// when they were chosen explicitly or varied (see Config.TargetRate). It is empty
+	// for the algorithm's default level.
+	Levels []int
+}
+
+// NewArchiveMetadata collects metadata about the current build and environment.
+// When reproducible is true, host and user information is left out so that the
+// same inputs produce the same archive on any machine.
+func NewArchiveMetadata(creator string, reproducible bool) *ArchiveMetadata {
+	meta := &ArchiveMetadata{
+		ToolVersion: version.Version,
+		ToolCommit:  version.Commit,
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Creator:     creator,
+	}
+	if reproducible {
+		return meta
+	}
+
+	// Host and user lookups are best-effort; failures simply leave the fields empty.
+	if host, err := os.Hostname(); err == nil {
+		meta.Hostname = host
+	}
+	if u, err := user.Current(); err == nil {
+		meta.User = u.Username
+	}
+	return meta
+}
@@ -0,0 +1,128 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"io"
+)
+
+// parallelFileSize is the size up to which files are compressed ahead of their turn
+// into memory buffers (see Config.CompressionWorkers). Larger files are streamed to the
+// archive one at a time, so buffering never holds more than a few of these.
+const parallelFileSize = 1 << 20
+
+// filePlan is how writeArchive stores a file.
+type filePlan struct {
+	algo     CompressionType
+	code     uint8 // FileMetadata.Compression.
+	grouped  bool  // Packed into a shared frame, see Config.GroupSmallFiles.
+	adaptive bool  // Compressed with CompressAdaptive, see Config.TargetRate.
+	choose   bool  // algo is replaced by the one chosen for the content, see Config.AdaptiveAlgo.
+	dupOf    int   // Position of the earlier file with the same content, or -1; see Config.Dedup.
+	chunked  bool  // Split into chunks stored once, see Config.Chunking.
+	ahead    bool  // Compressed ahead of its turn by compressAhead.
+}
+
+// inputDigest is what is learned about an input file while it streams through.
+type inputDigest struct {
+	size     int64
+	checksum [32]byte
+	keywords []string // nil unless requested.
+}
+
+// readInput opens file and passes its content to consume, computing its checksum and,
+// if keywords is set, its keywords along the way. prog, if not nil, counts the bytes
+// read; reading fails once job is cancelled.
+func (e *Engine) readInput(file InputFile, keywords bool, prog *progress, job *createJob, consume func(r io.Reader) error) (*inputDigest, error) {
+	f, err := file.openContent()
+	if err != nil {
+		return nil, NewCoreError(ErrArchiveWrite, "failed to open input "+file.Path).Wrap(err)
+	}
+	defer f.Close()
+
+	src := &readCounter{reader: job.reader(f)}
+	sum := sha256.New()
+	var collector *keywordCollector
+	var reader io.Reader = io.TeeReader(src, sum)
+	if keywords {
+		collector = newKeywordCollector()
+		reader = io.TeeReader(reader, collector)
+	}
+	if prog != nil {
+		reader = io.TeeReader(reader, prog)
+	}
+	if err := consume(reader); err != nil {
+		return nil, NewCoreError(ErrCompression, "failed to compress "+file.Path).Wrap(err)
+	}
+
+	digest := &inputDigest{size: src.total}
+	copy(digest.checksum[:], sum.Sum(nil))
+	if collector != nil {
+		digest.keywords = collector.Keywords()
+	}
+	return digest, nil
+}
+
+// pendingFrame is a file being compressed ahead of its turn. Its fields are set once
+// done is closed.
+type pendingFrame struct {
+	done           chan struct{}
+	frame          bytes.Buffer // The frame, encrypted like the ones frames writes.
+	compressedSize int64
+	algo           CompressionType // The algorithm and level the frame was compressed with.
+	level          int
+	digest         *inputDigest
+	err            error
+}
+
+// compressAhead starts compressing file into a frame buffered in memory, to be written
+// by frames once its turn comes. The compressor's worker pool bounds how many run at
+// the same time.
+func (e *Engine) compressAhead(frames *frameWriter, file InputFile, plan filePlan, opts CompressOptions, keywords bool, job *createJob) *pendingFrame {
+	p := &pendingFrame{done: make(chan struct{}), algo: plan.algo, level: opts.Level}
+	buffered := &frameWriter{w: &p.frame, aead: frames.aead}
+	go func() {
+		defer close(p.done)
+		p.digest, p.err = e.readInput(file, keywords, nil, job, func(r io.Reader) error {
+			fileOpts := opts
+			if plan.choose {
+				r, p.algo, fileOpts = e.chooseAlgo(r, plan.algo, opts)
+				p.level = fileOpts.Level
+			}
+			var err error
+			p.compressedSize, err = buffered.write(func(w io.Writer) (int64, error) {
+				return e.compressor.CompressWith(w, r, p.algo, fileOpts)
+			})
+			return err
+		})
+	}()
+	return p
+}
+
+// chooseAlgo picks the algorithm of a file with filePlan.choose from the beginning of
+// its content r, for an archive compressed with archiveAlgo and opts. It returns a
+// reader of the whole content, the algorithm, and the options to compress with it.
+func (e *Engine) chooseAlgo(r io.Reader, archiveAlgo CompressionType, opts CompressOptions) (io.Reader, CompressionType, CompressOptions) {
+	br := bufio.NewReaderSize(r, AlgoSampleSize)
+	sample, _ := br.Peek(AlgoSampleSize) // A read error comes back when br is read.
+	algo := e.compressor.ChooseAlgo(sample)
+	if algo != archiveAlgo {
+		// The level, window and dictionary are the archive algorithm's.
+		opts = CompressOptions{}
+	}
+	if algo == ZSTD && opts.Level == DefaultLevel {
+		opts.Level = AdaptiveTextLevel
+	}
+	return br, algo, opts
+}
+
+// compressionWorkers returns how many files Create works on at the same time, see
+// Config.CompressionWorkers.
+func (e *Engine) compressionWorkers() int {
+	if e.config.CompressionWorkers > 0 {
+		return e.config.CompressionWorkers
+	}
+	return e.compressor.workers()
+}
@@ -0,0 +1,70 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// ProgressFunc is told how an operation is progressing: how many bytes of file content
+// it has processed out of the total it expects. See Config.Progress.
+type ProgressFunc func(bytesProcessed, totalBytes int64)
+
+// progressInterval is the shortest time between two progress reports, so a callback
+// drawing a progress bar isn't called for every write.
+const progressInterval = 100 * time.Millisecond
+
+// progress counts the bytes written to it and reports them to a ProgressFunc. Its
+// methods do nothing on a nil progress, so operations without a callback pay nothing.
+// They may be called concurrently, by files extracted in parallel.
+type progress struct {
+	mu       sync.Mutex
+	fn       ProgressFunc
+	total    int64
+	done     int64
+	reported int64
+	last     time.Time
+}
+
+// newProgress returns a progress reporting to fn out of total bytes, or nil if fn is nil.
+func newProgress(fn ProgressFunc, total int64) *progress {
+	if fn == nil {
+		return nil
+	}
+	return &progress{fn: fn, total: total, reported: -1}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.add(int64(len(b)))
+	return len(b), nil
+}
+
+// add counts n more bytes processed.
+func (p *progress) add(n int64) {
+	if p != nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.done += n
+		if now := time.Now(); now.Sub(p.last) >= progressInterval {
+			p.last = now
+			p.report()
+		}
+	}
+}
+
+// finish reports the final count, which the callback sees last.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.reported != p.done {
+		p.report()
+	}
+}
+
+func (p *progress) report() {
+	p.reported = p.done
+	p.fn(p.done, p.total)
+}
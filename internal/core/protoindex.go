@@ -0,0 +1,329 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The protobuf index is encoded by hand with protowire, following index.proto.
+// Unknown fields are skipped on decode, so newer writers can add fields that
+// older readers ignore.
+
+// Field numbers from index.proto.
+const (
+	pbIndexFiles      protowire.Number = 1
+	pbIndexSearchData protowire.Number = 2
+	pbIndexMetadata   protowire.Number = 3
+	pbIndexEmptyDirs  protowire.Number = 4
+
+	pbFilePath             protowire.Number = 1
+	pbFileUncompressedSize protowire.Number = 2
+	pbFileCompressedSize   protowire.Number = 3
+	pbFileOffset           protowire.Number = 4
+	pbFileModTime          protowire.Number = 5
+	pbFileMode             protowire.Number = 6
+	pbFileCompression      protowire.Number = 7
+	pbFileGroup            protowire.Number = 8
+	pbFileGroupOffset      protowire.Number = 9
+	pbFileChecksum         protowire.Number = 10
+	pbFileChunks           protowire.Number = 11
+
+	pbChunkOffset         protowire.Number = 1
+	pbChunkCompressedSize protowire.Number = 2
+	pbChunkSize           protowire.Number = 3
+
+	pbKeywordKeyword protowire.Number = 1
+	pbKeywordPaths   protowire.Number = 2
+
+	pbMetaToolVersion protowire.Number = 1
+	pbMetaToolCommit  protowire.Number = 2
+	pbMetaOS          protowire.Number = 3
+	pbMetaArch        protowire.Number = 4
+	pbMetaCreator     protowire.Number = 5
+	pbMetaHostname    protowire.Number = 6
+	pbMetaUser        protowire.Number = 7
+	pbMetaLevels      protowire.Number = 8
+)
+
+// errMalformedIndex is returned for an index that isn't valid protobuf.
+var errMalformedIndex = errors.New("malformed protobuf index")
+
+// marshalIndexProto encodes the index. Files and keywords are sorted so the
+// encoding is deterministic.
+func marshalIndexProto(idx *Index) []byte {
+	var b []byte
+
+	paths := make([]string, 0, len(idx.Files))
+	for p := range idx.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		b = protowire.AppendTag(b, pbIndexFiles, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalFileProto(idx.Files[p]))
+	}
+
+	keywords := make([]string, 0, len(idx.SearchData))
+	for kw := range idx.SearchData {
+		keywords = append(keywords, kw)
+	}
+	sort.Strings(keywords)
+	for _, kw := range keywords {
+		var m []byte
+		m = appendString(m, pbKeywordKeyword, kw)
+		for _, p := range idx.SearchData[kw] {
+			m = protowire.AppendTag(m, pbKeywordPaths, protowire.BytesType)
+			m = protowire.AppendString(m, p)
+		}
+		b = protowire.AppendTag(b, pbIndexSearchData, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+
+	if meta := idx.Metadata; meta != nil {
+		var m []byte
+		m = appendString(m, pbMetaToolVersion, meta.ToolVersion)
+		m = appendString(m, pbMetaToolCommit, meta.ToolCommit)
+		m = appendString(m, pbMetaOS, meta.OS)
+		m = appendString(m, pbMetaArch, meta.Arch)
+		m = appendString(m, pbMetaCreator, meta.Creator)
+		m = appendString(m, pbMetaHostname, meta.Hostname)
+		m = appendString(m, pbMetaUser, meta.User)
+		if len(meta.Levels) > 0 {
+			var packed []byte
+			for _, l := range meta.Levels {
+				packed = protowire.AppendVarint(packed, uint64(l))
+			}
+			m = protowire.AppendTag(m, pbMetaLevels, protowire.BytesType)
+			m = protowire.AppendBytes(m, packed)
+		}
+		b = protowire.AppendTag(b, pbIndexMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+
+	for _, dir := range idx.EmptyDirs {
+		b = protowire.AppendTag(b, pbIndexEmptyDirs, protowire.BytesType)
+		b = protowire.AppendString(b, dir)
+	}
+	return b
+}
+
+func marshalFileProto(f FileMetadata) []byte {
+	var b []byte
+	b = appendString(b, pbFilePath, f.Path)
+	b = appendVarint(b, pbFileUncompressedSize, uint64(f.UncompressedSize))
+	b = appendVarint(b, pbFileCompressedSize, uint64(f.CompressedSize))
+	b = appendVarint(b, pbFileOffset, uint64(f.Offset))
+	if !f.ModTime.IsZero() {
+		b = appendVarint(b, pbFileModTime, uint64(f.ModTime.UnixNano()))
+	}
+	b = appendVarint(b, pbFileMode, uint64(f.Mode))
+	b = appendVarint(b, pbFileCompression, uint64(f.Compression))
+	b = appendVarint(b, pbFileGroup, uint64(f.Group))
+	b = appendVarint(b, pbFileGroupOffset, uint64(f.GroupOffset))
+	if f.Checksum != ([32]byte{}) {
+		b = protowire.AppendTag(b, pbFileChecksum, protowire.BytesType)
+		b = protowire.AppendBytes(b, f.Checksum[:])
+	}
+	for _, c := range f.Chunks {
+		var m []byte
+		m = appendVarint(m, pbChunkOffset, uint64(c.Offset))
+		m = appendVarint(m, pbChunkCompressedSize, uint64(c.CompressedSize))
+		m = appendVarint(m, pbChunkSize, uint64(c.Size))
+		b = protowire.AppendTag(b, pbFileChunks, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	return b
+}
+
+// appendString appends a string field, omitting it when empty as proto3 does.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendVarint appends a varint field, omitting it when zero as proto3 does.
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// unmarshalIndexProto decodes an index encoded by marshalIndexProto.
+func unmarshalIndexProto(b []byte) (*Index, error) {
+	idx := &Index{Files: make(map[string]FileMetadata)}
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case pbIndexFiles:
+			f, err := unmarshalFileProto(v)
+			if err != nil {
+				return err
+			}
+			idx.Files[f.Path] = f
+		case pbIndexSearchData:
+			var kw string
+			var paths []string
+			err := walkFields(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+				switch {
+				case num == pbKeywordKeyword && typ == protowire.BytesType:
+					kw = string(v)
+				case num == pbKeywordPaths && typ == protowire.BytesType:
+					paths = append(paths, string(v))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if idx.SearchData == nil {
+				idx.SearchData = make(map[string][]string)
+			}
+			idx.SearchData[kw] = append(idx.SearchData[kw], paths...)
+		case pbIndexMetadata:
+			meta := &ArchiveMetadata{}
+			fields := map[protowire.Number]*string{
+				pbMetaToolVersion: &meta.ToolVersion,
+				pbMetaToolCommit:  &meta.ToolCommit,
+				pbMetaOS:          &meta.OS,
+				pbMetaArch:        &meta.Arch,
+				pbMetaCreator:     &meta.Creator,
+				pbMetaHostname:    &meta.Hostname,
+				pbMetaUser:        &meta.User,
+			}
+			err := walkFields(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+				if dst, ok := fields[num]; ok && typ == protowire.BytesType {
+					*dst = string(v)
+				}
+				if num == pbMetaLevels && typ == protowire.BytesType {
+					for len(v) > 0 {
+						l, n := protowire.ConsumeVarint(v)
+						if n < 0 {
+							return errMalformedIndex
+						}
+						meta.Levels = append(meta.Levels, int(l))
+						v = v[n:]
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			idx.Metadata = meta
+		case pbIndexEmptyDirs:
+			idx.EmptyDirs = append(idx.EmptyDirs, string(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func unmarshalFileProto(b []byte) (FileMetadata, error) {
+	var f FileMetadata
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		if num == pbFilePath && typ == protowire.BytesType {
+			f.Path = string(v)
+			return nil
+		}
+		if num == pbFileChecksum && typ == protowire.BytesType {
+			if len(v) != len(f.Checksum) {
+				return errMalformedIndex
+			}
+			copy(f.Checksum[:], v)
+			return nil
+		}
+		if num == pbFileChunks && typ == protowire.BytesType {
+			var c ChunkRef
+			err := walkFields(v, func(num protowire.Number, typ protowire.Type, _ []byte, n uint64) error {
+				if typ != protowire.VarintType {
+					return nil
+				}
+				switch num {
+				case pbChunkOffset:
+					c.Offset = int64(n)
+				case pbChunkCompressedSize:
+					c.CompressedSize = int64(n)
+				case pbChunkSize:
+					c.Size = int64(n)
+				}
+				return nil
+			})
+			f.Chunks = append(f.Chunks, c)
+			return err
+		}
+		if typ != protowire.VarintType {
+			return nil
+		}
+		switch num {
+		case pbFileUncompressedSize:
+			f.UncompressedSize = int64(n)
+		case pbFileCompressedSize:
+			f.CompressedSize = int64(n)
+		case pbFileOffset:
+			f.Offset = int64(n)
+		case pbFileModTime:
+			f.ModTime = time.Unix(0, int64(n))
+		case pbFileMode:
+			f.Mode = uint32(n)
+		case pbFileCompression:
+			f.Compression = uint8(n)
+		case pbFileGroup:
+			f.Group = uint32(n)
+		case pbFileGroupOffset:
+			f.GroupOffset = int64(n)
+		}
+		return nil
+	})
+	return f, err
+}
+
+// walkFields calls fn for every field of an encoded message. For bytes fields v holds
+// the payload; for varint fields n holds the value. Other wire types are skipped.
+func walkFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, tagLen := protowire.ConsumeTag(b)
+		if tagLen < 0 {
+			return errMalformedIndex
+		}
+		b = b[tagLen:]
+
+		var (
+			v   []byte
+			n   uint64
+			val int
+		)
+		switch typ {
+		case protowire.BytesType:
+			v, val = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			n, val = protowire.ConsumeVarint(b)
+		default:
+			val = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if val < 0 {
+			return errMalformedIndex
+		}
+		b = b[val:]
+
+		if typ == protowire.BytesType || typ == protowire.VarintType {
+			if err := fn(num, typ, v, n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
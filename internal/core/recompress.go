@@ -0,0 +1,231 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Recompress rewrites the data block of an archive with another algorithm and level,
+// for example to move an old gzip archive to zstd without extracting it. The window
+// comes from Config.WindowLog and Config.LongDistance. Files stored with their own
+// algorithm, such as already-compressed formats, are copied as they are, and grouped
+// files stay grouped. The header, index sizes and data checksum are updated; an
+// encrypted index is encrypted again with Config.Passphrase or Config.IndexKey, one of
+// which must then be set. The zstd dictionary of an archive, if any, is kept when
+// recompressing to zstd and dropped otherwise.
+// Like Upgrade, it replaces the archive atomically and does not consume a token.
+func (e *Engine) Recompress(archiveFile string, algo CompressionType, level int) error {
+	algoCode, err := compressionCode(algo)
+	if err != nil {
+		return err
+	}
+	if err := e.checkWindowLog(algo); err != nil {
+		return err
+	}
+
+	a, err := e.openArchive(archiveFile)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	if a.header.Flags&FlagIndexEncrypted != 0 && e.config.IndexKey == nil && e.config.Passphrase == nil {
+		return NewCoreError(ErrInvalidInput, "the archive index is encrypted; an index key or passphrase is needed to keep it encrypted")
+	}
+	from := a.algo
+
+	opts := CompressOptions{Level: level, WindowLog: e.windowLog()}
+	if algo == ZSTD {
+		opts.Dictionary = a.dict
+	}
+	if err := replaceArchive(archiveFile, ".recompress-*", func(out *os.File) error {
+		return e.writeRecompressed(out, a, algo, algoCode, opts)
+	}); err != nil {
+		return err
+	}
+
+	e.log.WithFields(logrus.Fields{
+		"archive": archiveFile,
+		"from":    from,
+		"to":      algo,
+		"level":   level,
+	}).Info("Archive recompressed")
+	return nil
+}
+
+// writeRecompressed writes a to out with its frames recompressed, followed by the
+// updated index and header.
+func (e *Engine) writeRecompressed(out *os.File, a *archiveReader, algo CompressionType, algoCode uint8, opts CompressOptions) error {
+	// Reserve space for the header; it is rewritten at the end.
+	if err := WriteHeader(out, &Header{}); err != nil {
+		return err
+	}
+	dataWriter, hasher := NewChecksumWriter(out)
+	// Encrypted archives stay encrypted, with the key they were read with.
+	var key []byte
+	if a.header.EncryptionType != EncryptionNone {
+		var err error
+		if key, err = e.archiveDataKey(a); err != nil {
+			return err
+		}
+	}
+	frames, err := newFrameWriter(dataWriter, a.header.EncryptionType, key)
+	if err != nil {
+		return err
+	}
+
+	// Each frame is decompressed to a temporary file before being compressed again,
+	// which keeps memory use flat whatever the file sizes.
+	buf, err := e.createTemp("nsm-recompress-*")
+	if err != nil {
+		return err
+	}
+	defer e.removeTemp(buf)
+
+	files := make(map[string]FileMetadata, len(a.index.Files))
+	groups := make(map[uint32]FileMetadata)           // Rewritten frame of each group, by group id.
+	rewritten := make(map[frameLocation]FileMetadata) // Rewritten frames shared by files, see Config.Dedup.
+	var offset int64
+	for _, entry := range a.entries() {
+		if len(entry.Chunks) > 0 {
+			// Chunk frames are rewritten once, with the first file using them.
+			start := offset
+			chunks := make([]ChunkRef, len(entry.Chunks))
+			for i, c := range entry.Chunks {
+				loc := frameLocation{c.Offset, c.CompressedSize}
+				frame, ok := rewritten[loc]
+				if !ok {
+					size, err := e.recompressFrame(frames, buf, a, entry.chunkEntry(c), algo, opts)
+					if err != nil {
+						return err
+					}
+					frame = FileMetadata{Offset: offset, CompressedSize: size}
+					offset += size
+					if c.CompressedSize > 0 {
+						rewritten[loc] = frame
+					}
+				}
+				c.Offset, c.CompressedSize = frame.Offset, frame.CompressedSize
+				chunks[i] = c
+			}
+			entry.Chunks = chunks
+			entry.Offset, entry.CompressedSize = start, offset-start
+			files[entry.Path] = entry
+			continue
+		}
+		old := frameLocation{entry.Offset, entry.CompressedSize}
+		if frame, ok := rewritten[old]; ok && entry.Group == 0 {
+			entry.Offset, entry.CompressedSize = frame.Offset, frame.CompressedSize
+			files[entry.Path] = entry
+			continue
+		}
+		if entry.Group != 0 {
+			if frame, ok := groups[entry.Group]; ok {
+				entry.Offset, entry.CompressedSize = frame.Offset, frame.CompressedSize
+				files[entry.Path] = entry
+				continue
+			}
+		}
+		size, err := e.recompressFrame(frames, buf, a, entry, algo, opts)
+		if err != nil {
+			return err
+		}
+		entry.Offset, entry.CompressedSize = offset, size
+		offset += size
+		if entry.Group != 0 {
+			groups[entry.Group] = entry
+		} else if old.size > 0 {
+			rewritten[old] = entry
+		}
+		files[entry.Path] = entry
+	}
+
+	header := *a.header
+	copy(header.DataChecksum[:], hasher.Sum(nil))
+	dictLength, err := writeDictionary(out, &header, offset, opts.Dictionary)
+	if err != nil {
+		return err
+	}
+	idx := *a.index
+	idx.Files = files
+	if idx.Metadata != nil {
+		// The recorded levels describe the old data.
+		meta := *idx.Metadata
+		meta.Levels = nil
+		if algo == ZSTD && opts.Level != DefaultLevel {
+			meta.Levels = []int{opts.Level}
+		}
+		idx.Metadata = &meta
+	}
+	indexLength, indexFlags, err := e.writeIndex(out, &idx, &header)
+	if err != nil {
+		return err
+	}
+
+	header.Version = FormatVersion
+	header.CompressionType = algoCode
+	header.WindowLog = uint8(opts.WindowLog)
+	header.Level = int8(opts.Level)
+	header.Flags = header.Flags&^(FlagIndexCompressed|FlagIndexEncrypted|FlagIndexPassphrase|FlagLongDistance) | indexFlags
+	if e.config.LongDistance {
+		header.Flags |= FlagLongDistance
+	}
+	header.IndexOffset = HeaderSize + offset + dictLength
+	header.IndexLength = indexLength
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to seek to archive header").Wrap(err)
+	}
+	if err := WriteHeader(out, &header); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to sync archive").Wrap(err)
+	}
+	return nil
+}
+
+// recompressFrame writes the frame holding entry to frames compressed with algo, using
+// buf as scratch space, and returns the size written. Frames of stored files are
+// copied as they are, encrypted or not.
+func (e *Engine) recompressFrame(frames *frameWriter, buf *os.File, a *archiveReader, entry FileMetadata, algo CompressionType, opts CompressOptions) (int64, error) {
+	if entry.Offset < 0 || entry.CompressedSize < 0 || entry.Offset+entry.CompressedSize > a.dataSize() {
+		return 0, NewCoreError(ErrInvalidFormat, "data of "+entry.Path+" lies outside the data block")
+	}
+	if entry.Compression != 0 {
+		section := io.NewSectionReader(a.r, HeaderSize+entry.Offset, entry.CompressedSize)
+		n, err := io.Copy(frames.w, section)
+		if err != nil {
+			return 0, NewCoreError(ErrArchiveWrite, "failed to copy "+entry.Path).Wrap(err)
+		}
+		return n, nil
+	}
+
+	if _, err := buf.Seek(0, io.SeekStart); err != nil {
+		return 0, NewCoreError(ErrArchiveWrite, "failed to rewind temporary file").Wrap(err)
+	}
+	if err := buf.Truncate(0); err != nil {
+		return 0, NewCoreError(ErrArchiveWrite, "failed to reset temporary file").Wrap(err)
+	}
+	section, dec, err := e.frameReader(a, entry)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := e.compressor.DecompressWith(buf, section, a.algo, a.dict); err != nil {
+		if err := dec.authErr(); err != nil {
+			return 0, err
+		}
+		return 0, NewCoreError(ErrDecompression, "failed to decompress "+entry.Path).Wrap(err)
+	}
+	if _, err := buf.Seek(0, io.SeekStart); err != nil {
+		return 0, NewCoreError(ErrArchiveWrite, "failed to rewind temporary file").Wrap(err)
+	}
+	n, err := frames.write(func(w io.Writer) (int64, error) {
+		return e.compressor.CompressWith(w, buf, algo, opts)
+	})
+	if err != nil {
+		return 0, NewCoreError(ErrCompression, "failed to compress "+entry.Path).Wrap(err)
+	}
+	return n, nil
+}
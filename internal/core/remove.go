@@ -0,0 +1,261 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Remove deletes the files innerPaths from an archive. The surviving frames are copied
+// as they are into a new archive with a compacted data block, which then replaces the
+// original atomically, so nothing of the removed files is left behind. A file group
+// that loses some of its members is recompressed with the others. The search index,
+// embedded or sidecar, drops the removed files and the keywords only they contained.
+// A path that isn't in the archive fails with ErrFileNotFound before anything is
+// written. Like Recompress, an encrypted index is encrypted again with
+// Config.Passphrase or Config.IndexKey, and no token is consumed.
+func (e *Engine) Remove(archiveFile string, innerPaths []string) error {
+	if len(innerPaths) == 0 {
+		return NewCoreError(ErrInvalidInput, "no files to remove")
+	}
+	a, err := e.openArchive(archiveFile)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	removed := make(map[string]bool, len(innerPaths))
+	for _, p := range innerPaths {
+		if _, ok := a.index.Files[p]; !ok {
+			return NewCoreError(ErrFileNotFound, "no file "+p+" in archive "+archiveFile)
+		}
+		removed[p] = true
+	}
+	if a.header.Flags&FlagIndexEncrypted != 0 && e.config.IndexKey == nil && e.config.Passphrase == nil {
+		return NewCoreError(ErrInvalidInput, "the archive index is encrypted; an index key or passphrase is needed to keep it encrypted")
+	}
+	var sidecar map[string][]string
+	if a.header.Flags&FlagSearchSidecar != 0 {
+		if sidecar, err = readSidecarIndex(archiveFile, a.header); err != nil {
+			return err
+		}
+	}
+
+	var header *Header
+	if err := replaceArchive(archiveFile, ".remove-*", func(out *os.File) error {
+		header, err = e.writeRemoved(out, a, removed)
+		return err
+	}); err != nil {
+		return err
+	}
+	if sidecar != nil {
+		if err := writeSidecarIndex(archiveFile, header, withoutPaths(sidecar, removed)); err != nil {
+			return err
+		}
+	}
+
+	e.log.WithFields(logrus.Fields{
+		"archive": archiveFile,
+		"removed": len(removed),
+	}).Info("Files removed from archive")
+	return nil
+}
+
+// writeRemoved writes a to out without the removed files, followed by the updated
+// index and header, and returns the header.
+func (e *Engine) writeRemoved(out *os.File, a *archiveReader, removed map[string]bool) (*Header, error) {
+	// Reserve space for the header; it is rewritten at the end.
+	if err := WriteHeader(out, &Header{}); err != nil {
+		return nil, err
+	}
+	dataWriter, hasher := NewChecksumWriter(out)
+
+	// Groups that lose some of their members are rebuilt, which needs the data key of
+	// an encrypted archive; other frames are copied without decrypting them.
+	partial := make(map[uint32]bool)
+	for p := range removed {
+		if group := a.index.Files[p].Group; group != 0 {
+			partial[group] = true
+		}
+	}
+	var key []byte
+	if len(partial) > 0 && a.header.EncryptionType != EncryptionNone {
+		var err error
+		if key, err = e.archiveDataKey(a); err != nil {
+			return nil, err
+		}
+	}
+	frames, err := newFrameWriter(dataWriter, a.header.EncryptionType, key)
+	if err != nil {
+		return nil, err
+	}
+	opts := CompressOptions{Level: int(a.header.Level), WindowLog: int(a.header.WindowLog), Dictionary: a.dict}
+
+	entries := a.entries()
+	files := make(map[string]FileMetadata, len(entries))
+	groups := make(map[uint32]FileMetadata) // Rewritten frame of each group, by group id.
+	copied := make(map[frameLocation]int64) // New offset of each frame copied, see Config.Dedup.
+	var offset int64
+	for _, entry := range entries {
+		if removed[entry.Path] {
+			continue
+		}
+		if len(entry.Chunks) > 0 {
+			// Chunk frames are copied once, with the first file still using them.
+			start := offset
+			chunks := make([]ChunkRef, len(entry.Chunks))
+			for i, c := range entry.Chunks {
+				loc := frameLocation{c.Offset, c.CompressedSize}
+				newOffset, ok := copied[loc]
+				if !ok {
+					n, err := copyFrame(dataWriter, a, entry.chunkEntry(c))
+					if err != nil {
+						return nil, err
+					}
+					newOffset = offset
+					offset += n
+					if c.CompressedSize > 0 {
+						copied[loc] = newOffset
+					}
+				}
+				c.Offset = newOffset
+				chunks[i] = c
+			}
+			entry.Chunks = chunks
+			entry.Offset, entry.CompressedSize = start, offset-start
+			files[entry.Path] = entry
+			continue
+		}
+		old := frameLocation{entry.Offset, entry.CompressedSize}
+		if newOffset, ok := copied[old]; ok && entry.Group == 0 {
+			entry.Offset = newOffset
+			files[entry.Path] = entry
+			continue
+		}
+		if entry.Group != 0 {
+			if frame, ok := groups[entry.Group]; ok {
+				if !partial[entry.Group] {
+					entry.Offset, entry.CompressedSize = frame.Offset, frame.CompressedSize
+					files[entry.Path] = entry
+				}
+				continue
+			}
+		}
+		if entry.Group != 0 && partial[entry.Group] {
+			members, size, err := e.rebuildGroup(frames, a, entries, entry.Group, removed, opts)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range members {
+				m.Offset, m.CompressedSize = offset, size
+				files[m.Path] = m
+			}
+			groups[entry.Group] = entry
+			offset += size
+			continue
+		}
+
+		n, err := copyFrame(dataWriter, a, entry)
+		if err != nil {
+			return nil, err
+		}
+		entry.Offset = offset
+		offset += n
+		if entry.Group != 0 {
+			groups[entry.Group] = entry
+		} else if entry.CompressedSize > 0 {
+			copied[old] = entry.Offset
+		}
+		files[entry.Path] = entry
+	}
+
+	header := *a.header
+	copy(header.DataChecksum[:], hasher.Sum(nil))
+	// The copied frames still need the dictionary.
+	dictLength, err := writeDictionary(out, &header, offset, a.dict)
+	if err != nil {
+		return nil, err
+	}
+	idx := *a.index
+	idx.Files = files
+	if idx.SearchData != nil {
+		idx.SearchData = withoutPaths(idx.SearchData, removed)
+	}
+	indexLength, indexFlags, err := e.writeIndex(out, &idx, &header)
+	if err != nil {
+		return nil, err
+	}
+
+	header.Version = FormatVersion
+	header.Flags = header.Flags&^(FlagIndexCompressed|FlagIndexEncrypted|FlagIndexPassphrase) | indexFlags
+	header.IndexOffset = HeaderSize + offset + dictLength
+	header.IndexLength = indexLength
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return nil, NewCoreError(ErrArchiveWrite, "failed to seek to archive header").Wrap(err)
+	}
+	if err := WriteHeader(out, &header); err != nil {
+		return nil, err
+	}
+	if err := out.Sync(); err != nil {
+		return nil, NewCoreError(ErrArchiveWrite, "failed to sync archive").Wrap(err)
+	}
+	return &header, nil
+}
+
+// copyFrame copies the frame of entry from a to w as it is, and returns its size.
+func copyFrame(w io.Writer, a *archiveReader, entry FileMetadata) (int64, error) {
+	if entry.Offset < 0 || entry.CompressedSize < 0 || entry.Offset+entry.CompressedSize > a.dataSize() {
+		return 0, NewCoreError(ErrInvalidFormat, "data of "+entry.Path+" lies outside the data block")
+	}
+	n, err := io.Copy(w, io.NewSectionReader(a.r, HeaderSize+entry.Offset, entry.CompressedSize))
+	if err != nil {
+		return 0, NewCoreError(ErrArchiveWrite, "failed to copy "+entry.Path).Wrap(err)
+	}
+	return n, nil
+}
+
+// rebuildGroup writes the members of group that aren't removed to frames as a new
+// group frame, and returns them with their new group offsets and the frame's size.
+func (e *Engine) rebuildGroup(frames *frameWriter, a *archiveReader, entries []FileMetadata, group uint32, removed map[string]bool, opts CompressOptions) ([]FileMetadata, int64, error) {
+	var buf bytes.Buffer
+	var members []FileMetadata
+	for _, entry := range entries {
+		if entry.Group != group || removed[entry.Path] {
+			continue
+		}
+		member := entry
+		member.GroupOffset = int64(buf.Len())
+		if err := e.decompressGroupMember(a, entry, &buf); err != nil {
+			return nil, 0, err
+		}
+		members = append(members, member)
+	}
+	size, err := frames.write(func(w io.Writer) (int64, error) {
+		return e.compressor.CompressWith(w, &buf, a.algo, opts)
+	})
+	if err != nil {
+		return nil, 0, NewCoreError(ErrCompression, "failed to compress file group").Wrap(err)
+	}
+	return members, size, nil
+}
+
+// withoutPaths returns a copy of searchData without the removed paths, dropping the
+// keywords that only they contained.
+func withoutPaths(searchData map[string][]string, removed map[string]bool) map[string][]string {
+	kept := make(map[string][]string, len(searchData))
+	for kw, paths := range searchData {
+		var left []string
+		for _, p := range paths {
+			if !removed[p] {
+				left = append(left, p)
+			}
+		}
+		if len(left) > 0 {
+			kept[kw] = left
+		}
+	}
+	return kept
+}
@@ -0,0 +1,362 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"os"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SearchIndexMode controls where the full-text search index of an archive is stored.
+type SearchIndexMode string
+
+const (
+	// SearchIndexEmbedded stores the search index inside the archive (the default).
+	SearchIndexEmbedded SearchIndexMode = "embedded"
+	// SearchIndexSidecar stores the search index in a separate "<archive>.idx" file,
+	// keeping the archive itself lean. The sidecar is not encrypted, so encrypted
+	// archives can't use it.
+	SearchIndexSidecar SearchIndexMode = "sidecar"
+	// SearchIndexNone builds no search index at all.
+	SearchIndexNone SearchIndexMode = "none"
+)
+
+const (
+	// SidecarExtension is appended to the archive path to name the sidecar index file.
+	SidecarExtension = ".idx"
+
+	minKeywordLength = 2
+	maxKeywordLength = 64
+)
+
+// sidecarIndex is the content of a sidecar search index file.
+type sidecarIndex struct {
+	// DataChecksum ties the sidecar to the archive it was built for.
+	DataChecksum [32]byte
+	SearchData   map[string][]string
+}
+
+// keywordCollector is an io.Writer that extracts lower-cased keywords from UTF-8 text.
+// Content that is not valid UTF-8, or contains NUL bytes, is treated as binary and
+// yields no keywords at all.
+type keywordCollector struct {
+	words   map[string]struct{}
+	current []byte // Keyword being accumulated across writes.
+	pending []byte // Incomplete UTF-8 sequence left over from the previous write.
+	binary  bool
+}
+
+func newKeywordCollector() *keywordCollector {
+	return &keywordCollector{words: make(map[string]struct{})}
+}
+
+func (k *keywordCollector) Write(p []byte) (int, error) {
+	if k.binary {
+		return len(p), nil
+	}
+
+	data := p
+	if len(k.pending) > 0 {
+		data = append(k.pending, p...)
+		k.pending = nil
+	}
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size <= 1 {
+			if !utf8.FullRune(data) {
+				// The rune continues in the next write.
+				k.pending = append([]byte(nil), data...)
+				break
+			}
+			k.markBinary()
+			return len(p), nil
+		}
+		if r == 0 {
+			k.markBinary()
+			return len(p), nil
+		}
+
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			k.current = utf8.AppendRune(k.current, unicode.ToLower(r))
+		} else {
+			k.flush()
+		}
+		data = data[size:]
+	}
+	return len(p), nil
+}
+
+// flush records the keyword accumulated so far, if it has a useful length.
+func (k *keywordCollector) flush() {
+	if n := utf8.RuneCount(k.current); n >= minKeywordLength && n <= maxKeywordLength {
+		k.words[string(k.current)] = struct{}{}
+	}
+	k.current = k.current[:0]
+}
+
+func (k *keywordCollector) markBinary() {
+	k.binary = true
+	k.words = nil
+	k.current = nil
+	k.pending = nil
+}
+
+// Keywords finishes collection and returns the keywords found, or nil for binary content.
+func (k *keywordCollector) Keywords() []string {
+	if len(k.pending) > 0 {
+		k.markBinary() // Truncated UTF-8 sequence at the end of the content.
+	}
+	if k.binary {
+		return nil
+	}
+	k.flush()
+	words := make([]string, 0, len(k.words))
+	for w := range k.words {
+		words = append(words, w)
+	}
+	return words
+}
+
+// queryKeywords splits a search query into keywords using the same rules as indexing.
+func queryKeywords(query string) []string {
+	k := newKeywordCollector()
+	k.Write([]byte(query))
+	return k.Keywords()
+}
+
+// writeSidecarIndex writes the search index to the sidecar file of an archive.
+func writeSidecarIndex(archiveFile string, header *Header, searchData map[string][]string) error {
+	f, err := os.Create(archiveFile + SidecarExtension)
+	if err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to create search index sidecar").Wrap(err)
+	}
+	sidecar := sidecarIndex{DataChecksum: header.DataChecksum, SearchData: searchData}
+	if err := gob.NewEncoder(f).Encode(&sidecar); err != nil {
+		f.Close()
+		return NewCoreError(ErrArchiveWrite, "failed to write search index sidecar").Wrap(err)
+	}
+	if err := f.Close(); err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to write search index sidecar").Wrap(err)
+	}
+	return nil
+}
+
+// readSidecarIndex loads the sidecar search index of an archive and checks that it
+// was built for this archive.
+func readSidecarIndex(archiveFile string, header *Header) (map[string][]string, error) {
+	f, err := os.Open(archiveFile + SidecarExtension)
+	if err != nil {
+		return nil, NewCoreError(ErrArchiveRead, "search index sidecar not found: "+archiveFile+SidecarExtension).Wrap(err)
+	}
+	defer f.Close()
+
+	var sidecar sidecarIndex
+	if err := gob.NewDecoder(f).Decode(&sidecar); err != nil {
+		return nil, NewCoreError(ErrArchiveRead, "failed to read search index sidecar").Wrap(err)
+	}
+	if sidecar.DataChecksum != header.DataChecksum {
+		return nil, NewCoreError(ErrInvalidFormat, "search index sidecar does not belong to this archive")
+	}
+	return sidecar.SearchData, nil
+}
+
+// matchKeywords returns the sorted paths that contain every keyword.
+func matchKeywords(searchData map[string][]string, keywords []string) []string {
+	counts := make(map[string]int)
+	for _, kw := range keywords {
+		for _, path := range searchData[kw] {
+			counts[path]++
+		}
+	}
+
+	matches := []string{}
+	for path, n := range counts {
+		if n == len(keywords) {
+			matches = append(matches, path)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// MaxMatchLineLength is the number of bytes of each line that SearchLines searches and
+// reports; the rest of a longer line, such as minified code, is ignored.
+const MaxMatchLineLength = 4096
+
+// LineMatch is a line of an archived file containing some of the query's keywords.
+type LineMatch struct {
+	Path  string `json:"path"`
+	Line  int    `json:"line"`  // 1-based line number.
+	Text  string `json:"text"`  // The line without its ending.
+	Spans []Span `json:"spans"` // Byte ranges of the keywords in Text, in order.
+}
+
+// Span is the byte range [Start, End) of a keyword within a line.
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// SearchLines is like Search, but returns the lines of the matching files that contain
+// any of the query's keywords, with their positions, for output such as grep's. As in
+// Search, keywords match whole words case-insensitively. The matching files are
+// decompressed one at a time; those that fail are skipped and reported.
+func (e *Engine) SearchLines(archiveFile, query string) ([]LineMatch, []FileError, error) {
+	matches, skipped, _, err := e.SearchLinesWithStats(archiveFile, query)
+	return matches, skipped, err
+}
+
+// SearchLinesWithStats is like SearchLines, and also reports whether the search index
+// was used and how many files were decompressed, including the matching files read
+// for their lines.
+func (e *Engine) SearchLinesWithStats(archiveFile, query string) ([]LineMatch, []FileError, SearchStats, error) {
+	a, err := e.openArchive(archiveFile)
+	if err != nil {
+		return nil, nil, SearchStats{}, err
+	}
+	defer a.Close()
+
+	keywords := queryKeywords(query)
+	files, skipped, stats, err := e.searchFiles(context.Background(), a, archiveFile, keywords)
+	if err != nil {
+		return nil, nil, stats, err
+	}
+	want := make(map[string]bool, len(keywords))
+	for _, kw := range keywords {
+		want[kw] = true
+	}
+
+	matches := []LineMatch{}
+	for _, f := range files {
+		m := &lineMatcher{path: f.Path, keywords: want}
+		if err := e.decompressEntry(a, a.index.Files[f.Path], m); err != nil {
+			skipped = append(skipped, FileError{Path: f.Path, Err: err})
+			continue
+		}
+		m.finish()
+		matches = append(matches, m.matches...)
+	}
+	stats.FilesDecompressed += len(files)
+	return matches, skipped, stats, nil
+}
+
+// lineMatcher is an io.Writer that splits content into lines and records those
+// containing keywords.
+type lineMatcher struct {
+	path     string
+	keywords map[string]bool
+	number   int    // Number of the current line, minus one.
+	line     []byte // Current line, up to MaxMatchLineLength bytes.
+	partial  bool   // Whether the current line has any content.
+	cut      bool   // Whether the current line was longer than MaxMatchLineLength.
+	matches  []LineMatch
+}
+
+func (m *lineMatcher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		end := bytes.IndexByte(p, '\n')
+		chunk := p
+		if end >= 0 {
+			chunk = p[:end]
+		}
+		if room := MaxMatchLineLength - len(m.line); len(chunk) > room {
+			chunk = chunk[:room]
+			m.cut = true
+		}
+		m.line = append(m.line, chunk...)
+		m.partial = true
+		if end < 0 {
+			break
+		}
+		m.endLine()
+		p = p[end+1:]
+	}
+	return n, nil
+}
+
+// endLine records the current line if it contains keywords and starts the next one.
+func (m *lineMatcher) endLine() {
+	m.number++
+	text := bytes.TrimSuffix(m.line, []byte("\r"))
+	if m.cut {
+		// Don't report half a character where the line was cut.
+		for i := len(text) - 1; i >= 0 && i >= len(text)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(text[i]) {
+				if !utf8.FullRune(text[i:]) {
+					text = text[:i]
+				}
+				break
+			}
+		}
+	}
+	if spans := keywordSpans(text, m.keywords); len(spans) > 0 {
+		m.matches = append(m.matches, LineMatch{Path: m.path, Line: m.number, Text: string(text), Spans: spans})
+	}
+	m.line, m.partial, m.cut = m.line[:0], false, false
+}
+
+// finish records the last line if the content doesn't end with a newline.
+func (m *lineMatcher) finish() {
+	if m.partial {
+		m.endLine()
+	}
+}
+
+// keywordSpans returns the positions of the words of line that are keywords, splitting
+// words as keywordCollector does.
+func keywordSpans(line []byte, keywords map[string]bool) []Span {
+	var spans []Span
+	var word []byte
+	start := 0
+	for i := 0; i <= len(line); {
+		r, size := utf8.RuneError, 1
+		if i < len(line) {
+			r, size = utf8.DecodeRune(line[i:])
+		}
+		if i < len(line) && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if len(word) == 0 {
+				start = i
+			}
+			word = utf8.AppendRune(word, unicode.ToLower(r))
+		} else if len(word) > 0 {
+			if keywords[string(word)] {
+				spans = append(spans, Span{Start: start, End: i})
+			}
+			word = word[:0]
+		}
+		i += size
+	}
+	return spans
+}
+
+// ExtractMatching extracts below destinationPath only the files of an archive that
+// match query, as Search finds them, and returns their paths. Nothing is extracted if no
+// file matches. Files that couldn't be searched are skipped and reported.
+func (e *Engine) ExtractMatching(archiveFile, destinationPath, query string) ([]string, []FileError, error) {
+	s, err := e.OpenSession(archiveFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.Close()
+
+	results, skipped, _, err := e.searchFiles(context.Background(), s.a, archiveFile, queryKeywords(query))
+	if err != nil {
+		return nil, nil, err
+	}
+	paths := make([]string, len(results))
+	for i, r := range results {
+		paths[i] = r.Path
+	}
+	if len(paths) == 0 {
+		return paths, skipped, nil
+	}
+	if err := s.ExtractFiles(destinationPath, paths...); err != nil {
+		return nil, skipped, err
+	}
+	return paths, skipped, nil
+}
@@ -0,0 +1,345 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// KeySource supplies the index keys of archives, see Config.IndexKeySource.
+type KeySource interface {
+	// IndexKey returns the index key of the named archive ("" for an archive read from
+	// a stream). The engine takes ownership of the returned buffer and wipes it as soon
+	// as the index is decrypted, so it must not be shared or reused.
+	IndexKey(archiveFile string) ([]byte, error)
+}
+
+// indexKey returns the index key for the named archive and a function to call once the
+// key is no longer needed. Keys from Config.IndexKeySource are wiped by that function;
+// Config.IndexKey belongs to the caller and is left alone.
+func (e *Engine) indexKey(name string) ([]byte, func(), error) {
+	if e.config.IndexKeySource == nil {
+		return e.config.IndexKey, func() {}, nil
+	}
+	key, err := e.config.IndexKeySource.IndexKey(name)
+	if err != nil {
+		wipe(key)
+		return nil, nil, NewCoreError(ErrDecryption, "failed to get the index key of "+name).Wrap(err)
+	}
+	return key, func() { wipe(key) }, nil
+}
+
+// wipe overwrites key material with zeros.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	// Keep the writes from being optimized away as dead stores.
+	runtime.KeepAlive(b)
+}
+
+// ArchiveSession is an archive opened for several operations. Its header and index are
+// read, and decrypted, only once, so extracting many files in a few calls doesn't fetch
+// the index key again for each. The key itself is wiped right after the index is
+// decrypted: the session keeps the decoded index, never the key.
+type ArchiveSession struct {
+	e    *Engine
+	a    *archiveReader
+	name string
+}
+
+// OpenSession opens an archive for several operations. The session must be closed.
+func (e *Engine) OpenSession(archiveFile string) (*ArchiveSession, error) {
+	a, err := e.openArchive(archiveFile)
+	if err != nil {
+		return nil, err
+	}
+	return &ArchiveSession{e: e, a: a, name: archiveFile}, nil
+}
+
+// OpenReader opens an archive of the given size held in r, such as an archive in
+// memory or in object storage read with HTTP range requests, for several operations.
+// Files are read with random access through r: opening reads the header and index, and
+// each file read afterwards only fetches its own frame.
+func (e *Engine) OpenReader(r io.ReaderAt, size int64) (*ArchiveSession, error) {
+	a, err := e.readArchive(r, size, "")
+	if err != nil {
+		return nil, err
+	}
+	return &ArchiveSession{e: e, a: a}, nil
+}
+
+// OpenBytes opens an archive held in data, for example one embedded in the binary
+// with go:embed.
+func (e *Engine) OpenBytes(data []byte) (*ArchiveSession, error) {
+	return e.OpenReader(bytes.NewReader(data), int64(len(data)))
+}
+
+// OpenFS opens the archive name in fsys, such as an embed.FS. Files that don't support
+// random access through io.ReaderAt are read into memory first.
+func (e *Engine) OpenFS(fsys fs.FS, name string) (*ArchiveSession, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, NewCoreError(ErrArchiveRead, "failed to open archive "+name).Wrap(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, NewCoreError(ErrArchiveRead, "failed to stat archive "+name).Wrap(err)
+	}
+
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, NewCoreError(ErrArchiveRead, "failed to read archive "+name).Wrap(err)
+		}
+		s, err := e.OpenBytes(data)
+		if err != nil {
+			return nil, err
+		}
+		s.name = name
+		return s, nil
+	}
+
+	a, err := e.readArchive(r, info.Size(), name)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a.closer = f
+	return &ArchiveSession{e: e, a: a, name: name}, nil
+}
+
+// List returns the metadata of every file in the archive, sorted by path.
+func (s *ArchiveSession) List() []FileMetadata {
+	entries := s.a.entries()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+// Cat writes the content of the archived file path to w.
+func (s *ArchiveSession) Cat(path string, w io.Writer) error {
+	entry, err := s.entry(path)
+	if err != nil {
+		return err
+	}
+	return s.e.decompressEntry(s.a, entry, w)
+}
+
+// ExtractFile writes the archived file path to dst, restoring its mode and mod time.
+// Only that file's data is read and decompressed.
+func (s *ArchiveSession) ExtractFile(path, dst string) error {
+	entry, err := s.entry(path)
+	if err != nil {
+		return err
+	}
+	prog := newProgress(s.e.config.Progress, entry.UncompressedSize)
+	if err := s.e.extractEntry(context.Background(), s.a, entry, dst, prog); err != nil {
+		return err
+	}
+	prog.finish()
+	return nil
+}
+
+// entry returns the metadata of the archived file path, or an ErrFileNotFound error.
+func (s *ArchiveSession) entry(path string) (FileMetadata, error) {
+	entry, ok := s.a.index.Files[path]
+	if !ok {
+		return FileMetadata{}, NewCoreError(ErrFileNotFound, "no file "+path+" in archive "+s.name)
+	}
+	return entry, nil
+}
+
+// ExtractFiles extracts the named files, or every file if none are named, below
+// destinationPath, restoring their modes and mod times.
+func (s *ArchiveSession) ExtractFiles(destinationPath string, paths ...string) error {
+	return s.ExtractFilesContext(context.Background(), destinationPath, paths...)
+}
+
+// ExtractFilesContext is like ExtractFiles, and stops once ctx is done, between files
+// or in the middle of one, returning ctx.Err().
+func (s *ArchiveSession) ExtractFilesContext(ctx context.Context, destinationPath string, paths ...string) error {
+	return s.extractFiles(ctx, destinationPath, false, paths)
+}
+
+// extractFiles implements ExtractFilesContext and, with resume set, Engine.ExtractResume.
+func (s *ArchiveSession) extractFiles(ctx context.Context, destinationPath string, resume bool, paths []string) error {
+	s.e.log.WithFields(logrus.Fields{"archive": s.name, "resume": resume}).Info("Starting extraction")
+
+	entries := s.a.entries()
+	if len(paths) > 0 {
+		wanted := make(map[string]bool, len(paths))
+		for _, p := range paths {
+			if _, err := s.entry(p); err != nil {
+				return err
+			}
+			wanted[p] = true
+		}
+		selected := entries[:0]
+		for _, entry := range entries {
+			if wanted[entry.Path] {
+				selected = append(selected, entry)
+			}
+		}
+		entries = selected
+	}
+
+	targets := make([]string, len(entries))
+	for i, entry := range entries {
+		var err error
+		if targets[i], err = safeJoin(destinationPath, entry.Path); err != nil {
+			return err
+		}
+	}
+	// Empty directories are only recreated when extracting everything.
+	var dirs []string
+	if len(paths) == 0 {
+		for _, dir := range s.a.index.EmptyDirs {
+			target, err := safeJoin(destinationPath, dir)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, target)
+		}
+	}
+
+	var totalSize int64
+	for _, entry := range entries {
+		totalSize += entry.UncompressedSize
+	}
+	prog := newProgress(s.e.config.Progress, totalSize)
+	present, err := s.extractEntries(ctx, entries, targets, resume, prog)
+	if err != nil {
+		return err
+	}
+	prog.finish()
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return NewCoreError(ErrArchiveWrite, "failed to create directory "+dir).Wrap(err)
+		}
+	}
+
+	s.e.log.WithFields(logrus.Fields{
+		"archive": s.name,
+		"files":   len(entries),
+		"present": present,
+	}).Info("Extraction finished")
+	return nil
+}
+
+// extractEntries extracts each entry to its target, up to extractWorkers files at a
+// time: each reads its own section of the archive, which io.ReaderAt lets them do in
+// parallel. With resume, the files found already extracted are kept and counted in the
+// returned number. The first error stops the other files.
+func (s *ArchiveSession) extractEntries(ctx context.Context, entries []FileMetadata, targets []string, resume bool, prog *progress) (int, error) {
+	workers := s.extractWorkers()
+	if workers > len(entries) {
+		workers = len(entries)
+	}
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		present  int
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	next := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				kept, err := s.extractOne(jobCtx, entries[i], targets[i], resume, prog)
+				mu.Lock()
+				if kept {
+					present++
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for i := range entries {
+		select {
+		case next <- i:
+		case <-jobCtx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	if firstErr != nil {
+		return present, firstErr
+	}
+	return present, ctx.Err()
+}
+
+// extractOne extracts entry to target, unless resume is set and it is already there,
+// which it reports.
+func (s *ArchiveSession) extractOne(ctx context.Context, entry FileMetadata, target string, resume bool, prog *progress) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if resume {
+		done, err := extractedBefore(entry, target)
+		if err != nil {
+			return false, err
+		}
+		if done {
+			prog.add(entry.UncompressedSize)
+			return true, nil
+		}
+	}
+	return false, s.e.extractEntry(ctx, s.a, entry, target, prog)
+}
+
+// extractWorkers returns how many files extractEntries works on at the same time, see
+// Config.ExtractWorkers.
+func (s *ArchiveSession) extractWorkers() int {
+	workers := s.e.config.ExtractWorkers
+	if workers <= 0 {
+		workers = s.e.compressor.workers()
+	}
+	if workers > 1 && s.a.grouped() {
+		s.e.log.WithFields(logrus.Fields{
+			"archive": s.name,
+			"reason":  "grouped files are decompressed together",
+		}).Info("Extracting one file at a time")
+		return 1
+	}
+	return workers
+}
+
+// Search is like Engine.Search for the session's archive. An archive read through
+// OpenReader has no path to find a sidecar index next to, so it is scanned instead.
+func (s *ArchiveSession) Search(query string) ([]SearchResult, []FileError, error) {
+	return s.SearchContext(context.Background(), query)
+}
+
+// SearchContext is like Search, and stops once ctx is done, returning ctx.Err().
+func (s *ArchiveSession) SearchContext(ctx context.Context, query string) ([]SearchResult, []FileError, error) {
+	results, skipped, _, err := s.e.searchFiles(ctx, s.a, s.name, queryKeywords(query))
+	return results, skipped, err
+}
+
+// Close releases the archive.
+func (s *ArchiveSession) Close() error {
+	return s.a.Close()
+}
@@ -0,0 +1,209 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// EnvTempDir names the environment variable front ends read to set Config.TempDir,
+// for systems where the default temp directory is too small for large inputs.
+const EnvTempDir = "NSM_TMPDIR"
+
+// createTemp creates a temporary file in Config.TempDir, or in the system temp
+// directory when none is configured. The caller must release it with removeTemp.
+func (e *Engine) createTemp(pattern string) (*os.File, error) {
+	f, err := os.CreateTemp(e.config.TempDir, pattern)
+	if err != nil {
+		return nil, NewCoreError(ErrArchiveWrite, "failed to create temporary file").Wrap(err)
+	}
+	return f, nil
+}
+
+// removeTemp closes and deletes a file created by createTemp.
+func (e *Engine) removeTemp(f *os.File) {
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+		e.log.WithError(err).WithField("path", f.Name()).Warn("Failed to remove temporary file")
+	}
+}
+
+// CreateFromReader archives the content of r, such as standard input, as a single
+// file recorded under name. Since the size of a stream isn't known up front, it is
+// first buffered to a temporary file in Config.TempDir, which is removed afterwards
+// whether or not the archive could be created. The token is charged to Config.Tokens.
+func (e *Engine) CreateFromReader(outputFile, name string, r io.Reader) (*CreateResult, error) {
+	tokens := e.config.Tokens
+	if tokens == nil {
+		return nil, NewCoreError(ErrInvalidInput, "no token source configured for 'create' operation")
+	}
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		return nil, NewCoreError(ErrInvalidInput, "a file name is required for streamed input")
+	}
+
+	tmp, err := e.createTemp("nsm-stream-*")
+	if err != nil {
+		return nil, err
+	}
+	defer e.removeTemp(tmp)
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return nil, NewCoreError(ErrArchiveWrite, "failed to buffer input stream").Wrap(err)
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return nil, NewCoreError(ErrArchiveWrite, "failed to buffer input stream").Wrap(err)
+	}
+
+	inputs := &InputSet{Files: []InputFile{{Path: tmp.Name(), Name: name, Info: info}}}
+	return e.createFromInputs(outputFile, inputs, tokens, nil)
+}
+
+// CreateFromReaders archives the content of entries, by archive name, and writes the
+// archive to out, so archives can be built without touching the disk, for example in a
+// server. Each entry is read into memory, since the token cost depends on the sizes,
+// and the archive is assembled in memory before it is written to out, since its header
+// is only complete at the end. Entries are archived in name order, with the current
+// time as their modification time. Tokens are charged to Config.Tokens like Create
+// does; a sidecar search index isn't possible without a file next to the archive.
+func (e *Engine) CreateFromReaders(out io.Writer, entries map[string]io.Reader) (*CreateResult, error) {
+	tokens := e.config.Tokens
+	if tokens == nil {
+		return nil, NewCoreError(ErrInvalidInput, "no token source configured for 'create' operation")
+	}
+	if len(entries) == 0 {
+		return nil, NewCoreError(ErrInvalidInput, "no entries to archive")
+	}
+
+	names := make(map[string]string, len(entries)) // Archive name of each entry.
+	for name := range entries {
+		clean := path.Clean("/" + name)[1:]
+		if clean == "" {
+			return nil, NewCoreError(ErrInvalidInput, "invalid entry name "+name)
+		}
+		names[name] = clean
+	}
+	sorted := make([]string, 0, len(entries))
+	for name := range entries {
+		sorted = append(sorted, name)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return names[sorted[i]] < names[sorted[j]] })
+
+	inputs := &InputSet{}
+	modTime := time.Now()
+	for i, name := range sorted {
+		if i > 0 && names[sorted[i-1]] == names[name] {
+			return nil, NewCoreError(ErrInvalidInput, "duplicate entry name "+names[name])
+		}
+		data, err := io.ReadAll(entries[name])
+		if err != nil {
+			return nil, NewCoreError(ErrInvalidInput, "failed to read entry "+name).Wrap(err)
+		}
+		inputs.Files = append(inputs.Files, InputFile{
+			Path: name,
+			Name: names[name],
+			Info: memoryFileInfo{name: path.Base(names[name]), size: int64(len(data)), modTime: modTime},
+			open: func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil },
+		})
+	}
+	return e.createFromInputs("", inputs, tokens, &createJob{ctx: context.Background(), output: out})
+}
+
+// memoryFileInfo describes an entry of CreateFromReaders.
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi memoryFileInfo) Name() string       { return fi.name }
+func (fi memoryFileInfo) Size() int64        { return fi.size }
+func (fi memoryFileInfo) Mode() fs.FileMode  { return 0644 }
+func (fi memoryFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memoryFileInfo) IsDir() bool        { return false }
+func (fi memoryFileInfo) Sys() interface{}   { return nil }
+
+// streamArchive writes the archive for inputs to w, assembling it in memory first.
+// It returns the size of the archive.
+func (e *Engine) streamArchive(w io.Writer, inputs *InputSet, algo CompressionType, algoCode uint8, job *createJob) (int64, error) {
+	buf := &memoryFile{}
+	if _, _, err := e.writeArchive(buf, inputs, algo, algoCode, job); err != nil {
+		if jobErr := job.err(); jobErr != nil {
+			err = jobErr
+		}
+		return 0, err
+	}
+	if _, err := w.Write(buf.data); err != nil {
+		return 0, NewCoreError(ErrArchiveWrite, "failed to write archive").Wrap(err)
+	}
+	return int64(len(buf.data)), nil
+}
+
+// memoryFile is an io.WriteSeeker backed by memory, for streamArchive.
+type memoryFile struct {
+	data []byte
+	pos  int64
+}
+
+func (m *memoryFile) Write(p []byte) (int, error) {
+	end := m.pos + int64(len(p))
+	if extra := end - int64(len(m.data)); extra > 0 {
+		m.data = append(m.data, make([]byte, extra)...)
+	}
+	copy(m.data[m.pos:], p)
+	m.pos = end
+	return len(p), nil
+}
+
+func (m *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.pos
+	case io.SeekEnd:
+		offset += int64(len(m.data))
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	m.pos = offset
+	return offset, nil
+}
+
+// ExtractFromReader reads a whole archive from r, such as a network stream, and
+// returns the content of its files by path, decompressed into memory and checked
+// against their checksums. Directories are left out. The archive is read into memory
+// first, as its index comes last.
+func (e *Engine) ExtractFromReader(r io.Reader) (map[string]io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, NewCoreError(ErrArchiveRead, "failed to read archive").Wrap(err)
+	}
+	s, err := e.OpenBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	files := make(map[string]io.Reader)
+	for _, entry := range s.a.entries() {
+		var content bytes.Buffer
+		sum := sha256.New()
+		if err := e.decompressEntry(s.a, entry, io.MultiWriter(&content, sum)); err != nil {
+			return nil, err
+		}
+		// Archives written before checksums were recorded have none to check.
+		if entry.Checksum != ([32]byte{}) && !bytes.Equal(sum.Sum(nil), entry.Checksum[:]) {
+			return nil, NewCoreError(ErrChecksumMismatch, "checksum mismatch for "+entry.Path)
+		}
+		files[entry.Path] = bytes.NewReader(content.Bytes())
+	}
+	return files, nil
+}
@@ -0,0 +1,77 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ExtractToTar decompresses every file of an archive and writes them to w as a tar
+// stream, without touching the disk. File modes and modification times are kept in
+// the tar headers; PAX headers preserve sub-second times. Empty directories come
+// first, then the files in data block order, so the archive is read sequentially.
+func (e *Engine) ExtractToTar(archiveFile string, w io.Writer) error {
+	e.log.WithField("archive", archiveFile).Info("Starting extraction to tar")
+
+	a, err := e.openArchive(archiveFile)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	entries := a.entries()
+	// Reject unsafe paths before writing anything, as Extract does.
+	for _, entry := range entries {
+		if _, err := safeJoin(".", entry.Path); err != nil {
+			return err
+		}
+	}
+	for _, dir := range a.index.EmptyDirs {
+		if _, err := safeJoin(".", dir); err != nil {
+			return err
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	for _, dir := range a.index.EmptyDirs {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     path.Clean(dir) + "/",
+			Mode:     0755,
+			ModTime:  time.Unix(0, a.header.Timestamp),
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return NewCoreError(ErrArchiveWrite, "failed to write tar header for "+dir).Wrap(err)
+		}
+	}
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Clean(entry.Path),
+			Size:     entry.UncompressedSize,
+			Mode:     int64(entry.Mode),
+			ModTime:  entry.ModTime,
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return NewCoreError(ErrArchiveWrite, "failed to write tar header for "+entry.Path).Wrap(err)
+		}
+		if err := e.decompressEntry(a, entry, tw); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to finish tar stream").Wrap(err)
+	}
+
+	e.log.WithFields(logrus.Fields{
+		"archive": archiveFile,
+		"files":   len(entries),
+	}).Info("Extraction to tar finished")
+	return nil
+}
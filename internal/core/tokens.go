@@ -0,0 +1,61 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+// TokenSource accounts for the tokens spent by billable operations such as create.
+// The engine depends only on this interface, so the balance lives in one place
+// (for example auth.TokenManager) instead of being mirrored in the engine's config.
+// Implementations must be safe for concurrent use.
+type TokenSource interface {
+	// ConsumeN takes n tokens at once, or none if fewer than n are available.
+	ConsumeN(n int) error
+	// RefundN gives back n tokens taken by ConsumeN for an operation that did not complete.
+	RefundN(n int) error
+}
+
+// UsageLogger is implemented by token sources that keep a history of what tokens were
+// spent on, such as auth.TokenManager. The engine calls LogUsage once tokens taken for
+// an archive are definitely spent, that is once it was created.
+type UsageLogger interface {
+	LogUsage(operation, archive string) error
+}
+
+// NoopTokenSource is a TokenSource that never charges anything. It is meant for
+// token-free operations such as extract and search, and for trusted internal callers.
+type NoopTokenSource struct{}
+
+// ConsumeN always succeeds.
+func (NoopTokenSource) ConsumeN(n int) error { return nil }
+
+// RefundN always succeeds.
+func (NoopTokenSource) RefundN(n int) error { return nil }
+
+// CostPolicy decides how many tokens creating an archive costs.
+// It is consulted before any token is consumed, so the cost can be reported up front.
+type CostPolicy interface {
+	// Cost returns the number of tokens for archiving files totalling totalSize
+	// uncompressed bytes. It must return at least 1.
+	Cost(files int, totalSize int64) int
+}
+
+// CostFunc adapts an ordinary function to the CostPolicy interface.
+type CostFunc func(files int, totalSize int64) int
+
+// Cost calls f(files, totalSize).
+func (f CostFunc) Cost(files int, totalSize int64) int { return f(files, totalSize) }
+
+// SizeCostPolicy charges one token per started BytesPerToken of uncompressed input,
+// with a minimum of one token per archive.
+type SizeCostPolicy struct {
+	BytesPerToken int64
+}
+
+// Cost implements CostPolicy.
+func (p SizeCostPolicy) Cost(files int, totalSize int64) int {
+	if p.BytesPerToken <= 0 || totalSize <= p.BytesPerToken {
+		return 1
+	}
+	return int((totalSize + p.BytesPerToken - 1) / p.BytesPerToken)
+}
+
+// DefaultCostPolicy charges one token per started GiB of input.
+var DefaultCostPolicy CostPolicy = SizeCostPolicy{BytesPerToken: 1 << 30}
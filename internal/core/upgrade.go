@@ -0,0 +1,164 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Upgrade rewrites the index of an archive written with an older format version in
+// the current format. The data block, and therefore the data checksum and any search
+// sidecar, are kept as they are. The new archive is written next to the old one and
+// renamed over it, so an interrupted upgrade leaves the original intact.
+// It reports whether the archive needed upgrading; it does not consume a token.
+func (e *Engine) Upgrade(archiveFile string) (bool, error) {
+	a, err := e.openArchive(archiveFile)
+	if err != nil {
+		return false, err
+	}
+	defer a.Close()
+
+	if a.header.Version == FormatVersion {
+		return false, nil
+	}
+	from := a.header.Version
+
+	if err := replaceArchive(archiveFile, ".upgrade-*", func(out *os.File) error {
+		return e.writeUpgraded(out, a)
+	}); err != nil {
+		return false, err
+	}
+
+	e.log.WithFields(logrus.Fields{
+		"archive": archiveFile,
+		"from":    from,
+		"to":      FormatVersion,
+	}).Info("Archive index upgraded")
+	return true, nil
+}
+
+// Migrate writes the archive oldArchive to newArchive in the current format version,
+// whatever version it was written in, leaving oldArchive as it is. Like Upgrade, the
+// data block is copied unchanged and only the index and header are rewritten; a search
+// sidecar is copied along. newArchive is written to a temporary file first, so it is
+// either complete or left untouched. No token is consumed.
+func (e *Engine) Migrate(oldArchive, newArchive string) error {
+	if out, err := os.Stat(newArchive); err == nil {
+		if src, err := os.Stat(oldArchive); err == nil && os.SameFile(out, src) {
+			return NewCoreError(ErrInvalidInput, "the migrated archive cannot replace the original; use Upgrade to rewrite it in place")
+		}
+	}
+	a, err := e.openArchive(oldArchive)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	info, err := os.Stat(oldArchive)
+	if err != nil {
+		return NewCoreError(ErrArchiveRead, "failed to stat archive "+oldArchive).Wrap(err)
+	}
+
+	// The sidecar matches the data checksum, which the migration keeps.
+	var sidecar []byte
+	if a.header.Flags&FlagSearchSidecar != 0 {
+		if sidecar, err = os.ReadFile(oldArchive + SidecarExtension); err != nil {
+			return NewCoreError(ErrArchiveRead, "search index sidecar not found: "+oldArchive+SidecarExtension).Wrap(err)
+		}
+	}
+	if err := writeArchiveFile(newArchive, info.Mode().Perm(), ".migrate-*", func(out *os.File) error {
+		return e.writeUpgraded(out, a)
+	}); err != nil {
+		return err
+	}
+	if sidecar != nil {
+		if err := os.WriteFile(newArchive+SidecarExtension, sidecar, info.Mode().Perm()); err != nil {
+			return NewCoreError(ErrArchiveWrite, "failed to copy search index sidecar").Wrap(err)
+		}
+	}
+
+	e.log.WithFields(logrus.Fields{
+		"archive": oldArchive,
+		"output":  newArchive,
+		"from":    a.header.Version,
+		"to":      FormatVersion,
+	}).Info("Archive migrated")
+	return nil
+}
+
+// replaceArchive writes a new version of archiveFile with write and renames it over the
+// original. The new file is created next to the original, with its permissions, so an
+// interrupted rewrite leaves the original intact.
+func replaceArchive(archiveFile, tmpSuffix string, write func(out *os.File) error) error {
+	info, err := os.Stat(archiveFile)
+	if err != nil {
+		return NewCoreError(ErrArchiveRead, "failed to stat archive "+archiveFile).Wrap(err)
+	}
+	return writeArchiveFile(archiveFile, info.Mode().Perm(), tmpSuffix, write)
+}
+
+// writeArchiveFile writes archiveFile with write, through a temporary file created next
+// to it and renamed over it once complete, and gives it the permissions perm.
+func writeArchiveFile(archiveFile string, perm os.FileMode, tmpSuffix string, write func(out *os.File) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(archiveFile), filepath.Base(archiveFile)+tmpSuffix)
+	if err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to create temporary archive").Wrap(err)
+	}
+	tmpName := tmp.Name()
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return NewCoreError(ErrArchiveWrite, "failed to set archive permissions").Wrap(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return NewCoreError(ErrArchiveWrite, "failed to close temporary archive").Wrap(err)
+	}
+	if err := os.Rename(tmpName, archiveFile); err != nil {
+		os.Remove(tmpName)
+		return NewCoreError(ErrArchiveWrite, "failed to replace archive "+archiveFile).Wrap(err)
+	}
+	return nil
+}
+
+// writeUpgraded copies the data block of a to out, followed by its index in the
+// current format and an updated header.
+func (e *Engine) writeUpgraded(out *os.File, a *archiveReader) error {
+	header := *a.header
+	header.Version = FormatVersion
+	if err := WriteHeader(out, &header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, io.NewSectionReader(a.r, HeaderSize, a.dataSize())); err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to copy archive data").Wrap(err)
+	}
+	dictLength, err := writeDictionary(out, &header, a.dataSize(), a.dict)
+	if err != nil {
+		return err
+	}
+	indexLength, indexFlags, err := e.writeIndex(out, a.index, &header)
+	if err != nil {
+		return err
+	}
+
+	header.Flags = header.Flags&^(FlagIndexCompressed|FlagIndexEncrypted|FlagIndexPassphrase) | indexFlags
+	header.IndexOffset = HeaderSize + a.dataSize() + dictLength
+	header.IndexLength = indexLength
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to seek to archive header").Wrap(err)
+	}
+	if err := WriteHeader(out, &header); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to sync archive").Wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+)
+
+// VerifyStream validates an archive read from a stream, such as a pipe or a download,
+// in a single forward pass without seeking. It checks:
+//
+//   - the magic number, format version and compression algorithm of the header;
+//   - that the index offset and length are consistent with the header size;
+//   - that the dictionary block, if any, lies between the data block and the index,
+//     and parses;
+//   - the SHA-256 checksum of the data block against the one in the header;
+//   - that the index decodes and every entry lies within the data block, unless the
+//     index is encrypted and no key or passphrase for it is configured;
+//   - that the stream ends right after the index.
+//
+// Checks that need random access are skipped: individual files are not decompressed,
+// because their boundaries are only known from the index, which follows the data. Use
+// CheckArchive on a seekable file for a full per-file check.
+func (e *Engine) VerifyStream(r io.Reader) error {
+	header, err := ReadHeader(r)
+	if err != nil {
+		return err
+	}
+	if _, err := compressionFromCode(header.CompressionType); err != nil {
+		return err
+	}
+	if header.IndexOffset < HeaderSize || header.IndexLength < 0 {
+		return NewCoreError(ErrInvalidFormat, "archive header has an invalid index location")
+	}
+	if header.Flags&FlagDictionary != 0 && (header.DictOffset < HeaderSize || header.DictLength > maxDictionarySize || header.DictOffset+int64(header.DictLength) != header.IndexOffset) {
+		return NewCoreError(ErrInvalidFormat, "archive header has an invalid dictionary location")
+	}
+
+	// The data block is hashed as it streams past; nothing is buffered.
+	dataSize := header.dataEnd() - HeaderSize
+	hasher := sha256.New()
+	if n, err := io.CopyN(hasher, r, dataSize); err != nil {
+		return NewCoreError(ErrArchiveRead, fmt.Sprintf("archive data block is truncated (%d of %d bytes)", n, dataSize)).Wrap(err)
+	}
+	if !bytes.Equal(hasher.Sum(nil), header.DataChecksum[:]) {
+		return NewCoreError(ErrChecksumMismatch, "archive data block checksum mismatch")
+	}
+	if header.Flags&FlagDictionary != 0 {
+		dict := make([]byte, header.DictLength)
+		if _, err := io.ReadFull(r, dict); err != nil {
+			return NewCoreError(ErrArchiveRead, "archive dictionary is truncated").Wrap(err)
+		}
+		if _, err := NewDictionary(dict); err != nil {
+			return NewCoreError(ErrInvalidFormat, "archive dictionary is corrupt").Wrap(err)
+		}
+	}
+
+	indexReader := &readCounter{reader: io.LimitReader(r, header.IndexLength)}
+	indexChecked := false
+	if header.Flags&FlagIndexEncrypted == 0 || e.hasIndexKey(header) {
+		index, err := e.decodeIndex(indexReader, header, "")
+		if err != nil {
+			return err
+		}
+		for _, entry := range index.Files {
+			if entry.Offset < 0 || entry.CompressedSize < 0 || entry.Offset+entry.CompressedSize > dataSize {
+				return NewCoreError(ErrInvalidFormat, "data of "+entry.Path+" lies outside the data block")
+			}
+			for _, c := range entry.Chunks {
+				if c.Offset < 0 || c.CompressedSize < 0 || c.Offset+c.CompressedSize > dataSize {
+					return NewCoreError(ErrInvalidFormat, "a chunk of "+entry.Path+" lies outside the data block")
+				}
+			}
+		}
+		indexChecked = true
+	}
+
+	// The gob decoder may stop short of the index length; drain the rest before
+	// checking for truncation and trailing data.
+	if _, err := io.Copy(io.Discard, indexReader); err != nil {
+		return NewCoreError(ErrArchiveRead, "failed to read archive index").Wrap(err)
+	}
+	if indexReader.total != header.IndexLength {
+		return NewCoreError(ErrArchiveRead, fmt.Sprintf("archive index is truncated (%d of %d bytes)", indexReader.total, header.IndexLength))
+	}
+	if n, _ := io.Copy(io.Discard, r); n > 0 {
+		return NewCoreError(ErrInvalidFormat, fmt.Sprintf("%d unexpected byte(s) after the archive index", n))
+	}
+
+	e.log.WithField("index_checked", indexChecked).Info("Archive stream verified")
+	return nil
+}
+
+// VerifyResult is the detailed outcome of verifying an archive. It is meant to be
+// serialized, for example by 'nsm verify --json', so errors are stored as strings.
+type VerifyResult struct {
+	OK            bool               `json:"ok"`             // Checksum matched and every file verified.
+	ChecksumOK    bool               `json:"checksum_ok"`    // The data block matches the header's SHA-256 checksum.
+	Files         []FileVerifyResult `json:"files"`          // Per-file outcomes, in data block order.
+	BytesVerified int64              `json:"bytes_verified"` // Uncompressed bytes decompressed and checked.
+	Duration      time.Duration      `json:"duration_ns"`
+}
+
+// FileVerifyResult is the outcome of verifying a single file of an archive.
+type FileVerifyResult struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"` // Uncompressed size recorded in the index.
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Verify checks the data block checksum of an archive and decompresses every file,
+// which also checks that its data lies within the data block. It returns nil if the
+// archive is intact, or an ErrChecksumMismatch error describing the first failure; use
+// VerifyDetailed to find out everything that failed.
+func (e *Engine) Verify(archiveFile string) error {
+	result, err := e.VerifyDetailed(archiveFile)
+	if err != nil {
+		return err
+	}
+	if !result.OK {
+		failed := 0
+		var first *FileVerifyResult
+		for i, f := range result.Files {
+			if !f.OK {
+				if first == nil {
+					first = &result.Files[i]
+				}
+				failed++
+			}
+		}
+		msg := fmt.Sprintf("%d of %d files failed verification", failed, len(result.Files))
+		if first != nil {
+			msg += fmt.Sprintf(", first %s (%s)", first.Path, first.Error)
+		}
+		if !result.ChecksumOK {
+			msg = "archive data block checksum mismatch, " + msg
+		}
+		return NewCoreError(ErrChecksumMismatch, msg)
+	}
+	return nil
+}
+
+// VerifyDetailed checks the data block checksum of an archive and decompresses every
+// file, reporting the outcome of each check. The error is only non-nil if the archive
+// can't be read at all; verification failures are reported in the result.
+func (e *Engine) VerifyDetailed(archiveFile string) (*VerifyResult, error) {
+	e.log.WithField("archive", archiveFile).Info("Verifying archive")
+	start := time.Now()
+
+	a, err := e.openArchive(archiveFile)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(a.r, HeaderSize, a.dataSize())); err != nil {
+		return nil, NewCoreError(ErrArchiveRead, "failed to read archive data").Wrap(err)
+	}
+	result := &VerifyResult{
+		ChecksumOK: bytes.Equal(hasher.Sum(nil), a.header.DataChecksum[:]),
+		Files:      []FileVerifyResult{},
+	}
+	result.OK = result.ChecksumOK
+
+	for _, entry := range a.entries() {
+		file := FileVerifyResult{Path: entry.Path, Size: entry.UncompressedSize, OK: true}
+		if err := e.decompressEntry(a, entry, io.Discard); err != nil {
+			file.OK, file.Error = false, err.Error()
+			result.OK = false
+		} else {
+			result.BytesVerified += entry.UncompressedSize
+		}
+		result.Files = append(result.Files, file)
+	}
+
+	result.Duration = time.Since(start)
+	return result, nil
+}
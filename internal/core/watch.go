@@ -0,0 +1,193 @@
+// Package core contains the main business logic for the NSM tool.
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WatchCacheExtension is appended to the archive path to name the cache Watch keeps of
+// the files it archived.
+const WatchCacheExtension = ".watch"
+
+// watchEntry is what the watch cache remembers of an archived file. A file whose
+// modification time and size still match is assumed unchanged without reading it.
+type watchEntry struct {
+	Path     string
+	ModTime  int64 // UnixNano.
+	Size     int64
+	Checksum [32]byte
+}
+
+// watchCache is the content of a watch cache file, by archive name.
+type watchCache struct {
+	Files map[string]watchEntry
+}
+
+// Watch rebuilds outputFile from inputs whenever their content changes, checking every
+// interval until ctx is done (see WatchOnce). Each rebuild is charged to Config.Tokens.
+// A failed rebuild is logged and retried at the next check.
+func (e *Engine) Watch(ctx context.Context, outputFile string, inputs []string, interval time.Duration) error {
+	if interval <= 0 {
+		return NewCoreError(ErrInvalidInput, "the watch interval must be positive")
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := e.WatchOnce(outputFile, inputs); err != nil {
+			e.log.WithError(err).WithField("output", outputFile).Error("Failed to rebuild watched archive")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// WatchOnce rebuilds outputFile from inputs, like Create, if the content of the inputs
+// changed since it was last built, and reports whether it did. Files that were only
+// touched, whose content hash is unchanged, don't trigger a rebuild, which saves tokens
+// and CPU on noisy filesystems. The modification time, size and hash of every archived
+// file are kept in a cache next to the archive (see WatchCacheExtension), so unchanged
+// files aren't read again.
+func (e *Engine) WatchOnce(outputFile string, inputs []string) (bool, error) {
+	tokens := e.config.Tokens
+	if tokens == nil {
+		return false, NewCoreError(ErrInvalidInput, "no token source configured for 'create' operation")
+	}
+	if err := e.validateInputs(inputs); err != nil {
+		return false, err
+	}
+	set, err := e.CollectInputs(inputs)
+	if err != nil {
+		return false, err
+	}
+	cachePath := outputFile + WatchCacheExtension
+	set.Files = withoutFiles(set.Files, outputFile, cachePath, outputFile+SidecarExtension)
+
+	cache, err := readWatchCache(cachePath)
+	if err != nil {
+		return false, err
+	}
+	next := watchCache{Files: make(map[string]watchEntry, len(set.Files))}
+	changed, touched := len(cache.Files) != len(set.Files), false
+	for _, f := range set.Files {
+		prev, ok := cache.Files[f.Name]
+		entry := watchEntry{Path: f.Path, ModTime: f.Info.ModTime().UnixNano(), Size: f.Info.Size()}
+		if ok && prev.Path == entry.Path && prev.ModTime == entry.ModTime && prev.Size == entry.Size {
+			next.Files[f.Name] = prev
+			continue
+		}
+		if entry.Checksum, err = fileChecksum(f.Path); err != nil {
+			return false, err
+		}
+		next.Files[f.Name] = entry
+		if ok && prev.Path == entry.Path && prev.Checksum == entry.Checksum {
+			touched = true
+			continue
+		}
+		changed = true
+	}
+	if _, err := os.Stat(outputFile); os.IsNotExist(err) {
+		changed = true
+	}
+
+	if !changed {
+		if touched {
+			// Remember the new times so the touched files aren't hashed again.
+			if err := writeWatchCache(cachePath, &next); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	e.log.WithFields(logrus.Fields{"output": outputFile, "files": len(set.Files)}).Info("Watched files changed, rebuilding archive")
+	if _, err := e.createFromInputs(outputFile, set, tokens, nil); err != nil {
+		return false, err
+	}
+	return true, writeWatchCache(cachePath, &next)
+}
+
+// withoutFiles returns files without those at the given paths, so an archive written
+// inside a watched directory doesn't trigger its own rebuild.
+func withoutFiles(files []InputFile, paths ...string) []InputFile {
+	skip := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		if abs, err := filepath.Abs(p); err == nil {
+			skip[abs] = true
+		}
+	}
+	kept := files[:0]
+	for _, f := range files {
+		if abs, err := filepath.Abs(f.Path); err == nil && skip[abs] {
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
+
+// fileChecksum returns the SHA-256 of the file at path.
+func fileChecksum(path string) ([32]byte, error) {
+	var sum [32]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, NewCoreError(ErrArchiveRead, "failed to open "+path).Wrap(err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, NewCoreError(ErrArchiveRead, "failed to read "+path).Wrap(err)
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// readWatchCache loads a watch cache. A missing or unreadable cache is empty, which
+// only costs a rebuild.
+func readWatchCache(path string) (*watchCache, error) {
+	cache := &watchCache{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, NewCoreError(ErrArchiveRead, "failed to open watch cache").Wrap(err)
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(cache); err != nil {
+		logrus.WithError(err).WithField("path", path).Warn("Ignoring unreadable watch cache")
+		return &watchCache{}, nil
+	}
+	return cache, nil
+}
+
+// writeWatchCache replaces the watch cache at path.
+func writeWatchCache(path string, cache *watchCache) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return NewCoreError(ErrArchiveWrite, "failed to create watch cache").Wrap(err)
+	}
+	if err := gob.NewEncoder(tmp).Encode(cache); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return NewCoreError(ErrArchiveWrite, "failed to write watch cache").Wrap(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return NewCoreError(ErrArchiveWrite, "failed to write watch cache").Wrap(err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return NewCoreError(ErrArchiveWrite, "failed to replace watch cache").Wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+// Package version exposes build information injected at link time.
+package version
+
+// These variables are set by scripts/build.sh through -ldflags "-X ...".
+// They keep their defaults for plain `go build` and `go test` runs.
+var (
+	Version   = "dev"
+	Commit    = "none"
+	BuildDate = "unknown"
+)
@@ -2,11 +2,17 @@
 package web
 
 import (
-	"context"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/gorilla/mux"
 	// This is a placeholder for the actual PayPal Go SDK.
 	// A popular choice is "github.com/plutov/paypal/v4"
 	"github.com/nexus/nsm/internal/auth" // To access TokenManager or similar
@@ -18,6 +24,9 @@ type PayPalClient struct {
 	ClientID string
 	Secret   string
 	IsProd   bool
+	// WebhookID is the id PayPal assigned to the webhook. Deliveries are signed for it,
+	// so without it every webhook event is rejected.
+	WebhookID string
 	// Add the actual SDK client object here.
 }
 
@@ -26,6 +35,10 @@ type PaymentHandler struct {
 	payPalClient *PayPalClient
 	tokenManager *auth.TokenManager // To credit tokens after successful payment.
 	log          *logrus.Entry
+	httpClient   *http.Client // Downloads webhook signing certificates.
+
+	certMu sync.Mutex
+	certs  map[string]*x509.Certificate // Webhook signing certificates by URL.
 }
 
 // NewPaymentHandler creates a new handler for PayPal interactions.
@@ -34,6 +47,8 @@ func NewPaymentHandler(ppClient *PayPalClient, tm *auth.TokenManager) *PaymentHa
 		payPalClient: ppClient,
 		tokenManager: tm,
 		log:          logrus.WithField("component", "payment_handler"),
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+		certs:        make(map[string]*x509.Certificate),
 	}
 }
 
@@ -47,8 +62,7 @@ const (
 func (h *PaymentHandler) HandleCreateOrder(w http.ResponseWriter, r *http.Request) {
 	// 1. Decode the request from the client (e.g., how many tokens to buy).
 	var req auth.PurchaseRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !DecodeAndValidate(w, r, &req) {
 		return
 	}
 	h.log.WithField("tokens", req.TokenCount).Info("Received request to create PayPal order")
@@ -88,10 +102,16 @@ func (h *PaymentHandler) HandleCreateOrder(w http.ResponseWriter, r *http.Reques
 }
 
 // HandleCaptureOrder captures the payment for an approved order.
-// This is called after the user approves the transaction on PayPal's site.
+// This is called after the user approves the transaction on PayPal's site. Clients
+// retry captures that fail, so capturing an order again must return the result of
+// the first capture instead of charging twice.
 func (h *PaymentHandler) HandleCaptureOrder(w http.ResponseWriter, r *http.Request) {
 	// 1. Get the OrderID from the request.
-	orderID := r.URL.Query().Get("orderID")
+	var req auth.CaptureRequest
+	if !DecodeAndValidate(w, r, &req) {
+		return
+	}
+	orderID := req.OrderID
 	h.log.WithField("orderID", orderID).Info("Received request to capture PayPal order")
 
 	// 2. Use the PayPal SDK to capture the payment.
@@ -110,26 +130,185 @@ func (h *PaymentHandler) HandleCaptureOrder(w http.ResponseWriter, r *http.Reque
 	//    - Credit the user's account with the purchased tokens.
 	//    - Persist the transaction in your database.
 	h.log.Info("Payment captured successfully. Crediting tokens.")
-	// err := h.tokenManager.AddTokens(userID, tokenCount)
+	// credited, err := h.tokenManager.AddTokensForTransaction(capture.ID, tokenCount)
 	// ...
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	// Simulated response: a real implementation reports the order's token count and
+	// the PayPal capture id.
+	json.NewEncoder(w).Encode(auth.CaptureResponse{
+		OrderID:       orderID,
+		Status:        auth.OrderCompleted,
+		TransactionID: "MOCK_PAYPAL_CAPTURE_ID_67890",
+	})
+}
+
+// HandleOrderStatus reports the status of an order, so clients can resume an
+// interrupted purchase. The order id is the "id" route variable.
+func (h *PaymentHandler) HandleOrderStatus(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+	h.log.WithField("orderID", orderID).Info("Received order status request")
+
+	// THIS IS PSEUDOCODE.
+	/*
+		order, err := h.payPalClient.sdk.GetOrder(context.Background(), orderID)
+		...
+	*/
+
+	// Simulated response: the order is still awaiting payment.
+	json.NewEncoder(w).Encode(auth.OrderStatus{
+		OrderID: orderID,
+		Status:  auth.OrderPending,
+	})
+}
+
+// HandleCancelOrder cancels an order that hasn't been paid. The order id is the "id"
+// route variable.
+func (h *PaymentHandler) HandleCancelOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+	h.log.WithField("orderID", orderID).Info("Received order cancellation request")
+
+	// An unapproved PayPal order simply expires, so there is nothing to void upstream;
+	// a real implementation would mark the order as cancelled in its database.
+
+	json.NewEncoder(w).Encode(auth.OrderStatus{
+		OrderID: orderID,
+		Status:  auth.OrderCancelled,
+	})
+}
+
+// EventCaptureCompleted is the type of the webhook event sent once a payment is
+// captured, the only one tokens are credited for.
+const EventCaptureCompleted = "PAYMENT.CAPTURE.COMPLETED"
+
+// WebhookEvent is the part of a PayPal webhook event the handler uses.
+type WebhookEvent struct {
+	ID        string `json:"id"`
+	EventType string `json:"event_type"`
+	Resource  struct {
+		ID     string `json:"id"`
+		Amount struct {
+			CurrencyCode string `json:"currency_code"`
+			Value        string `json:"value"`
+		} `json:"amount"`
+	} `json:"resource"`
 }
 
 // HandleWebhook receives and processes notifications from PayPal.
 // This is critical for handling asynchronous events like e-check clearances or chargebacks.
+// Deliveries whose signature doesn't verify against PayPal's certificate and the
+// configured webhook id are rejected with 400 before anything is processed, and so are
+// deliveries transmitted more than MaxTransmissionSkew from now, to stop replays. A verified
+// PAYMENT.CAPTURE.COMPLETED event credits the tokens its amount pays for; PayPal
+// retries deliveries, so a capture is only credited once. Only failures that may pass,
+// such as saving the tokens, are answered with 500 for PayPal to retry: an amount no
+// tokens can be credited for is logged as an error and acknowledged.
 func (h *PaymentHandler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
 	h.log.Info("Received PayPal webhook")
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxRequestBodyBytes))
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, ErrorResponse{Error: "failed to read webhook body"})
+		return
+	}
+
 	// 1. Verify the webhook signature to ensure it's from PayPal.
-	//    The SDK usually provides a function for this.
-	//    `verified, err := h.payPalClient.sdk.VerifyWebhookSignature(...)`
+	cert, err := h.webhookCert(r.Header.Get(HeaderCertURL))
+	if err == nil {
+		err = VerifyWebhookSignature(r.Header, body, h.payPalClient.WebhookID, cert)
+	}
+	if err != nil {
+		h.log.WithError(err).Warn("Rejected unverified PayPal webhook")
+		WriteError(w, http.StatusBadRequest, ErrorResponse{Error: "webhook signature verification failed"})
+		return
+	}
+	if err := checkTransmissionTime(r.Header, time.Now()); err != nil {
+		h.log.WithError(err).Warn("Rejected replayed PayPal webhook")
+		WriteError(w, http.StatusBadRequest, ErrorResponse{Error: "webhook transmission time out of range"})
+		return
+	}
 
 	// 2. Decode the webhook event payload.
-	//    `var event paypal.WebhookEvent`
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.ID == "" {
+		WriteError(w, http.StatusBadRequest, ErrorResponse{Error: "malformed webhook event"})
+		return
+	}
+	log := h.log.WithFields(logrus.Fields{"event_id": event.ID, "event_type": event.EventType})
+
+	// 3. Process the event based on its type. Other events are acknowledged, so PayPal
+	//    doesn't retry them.
+	if event.EventType != EventCaptureCompleted {
+		log.Info("Ignoring PayPal webhook event")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	amount := event.Resource.Amount
+	tokens, err := tokensForAmount(amount.CurrencyCode, amount.Value)
+	if err != nil {
+		// Delivering the event again won't change its amount, so it is left for
+		// someone to refund or credit by hand.
+		log.WithError(err).WithField("capture_id", event.Resource.ID).Error("Can't credit tokens for captured payment")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := h.creditCapture(&event, tokens); err != nil {
+		// A 5xx makes PayPal deliver the event again later.
+		log.WithError(err).Error("Failed to credit tokens for captured payment")
+		WriteError(w, http.StatusInternalServerError, ErrorResponse{Error: "failed to process event"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	// 3. Process the event based on its type (e.g., CHECKOUT.ORDER.APPROVED).
-	//    This is where you would reliably credit tokens to a user.
+// creditCapture credits tokens for the capture of a PAYMENT.CAPTURE.COMPLETED event,
+// unless it was credited before.
+func (h *PaymentHandler) creditCapture(event *WebhookEvent, tokens int) error {
+	credited, err := h.tokenManager.AddTokensForTransaction(event.Resource.ID, tokens)
+	if err != nil {
+		return err
+	}
+	log := h.log.WithFields(logrus.Fields{
+		"event_id":   event.ID,
+		"capture_id": event.Resource.ID,
+		"tokens":     tokens,
+	})
+	if !credited {
+		log.Info("Payment capture already credited")
+		return nil
+	}
+	log.Info("Payment captured. Tokens credited.")
+	return nil
+}
 
-	w.WriteHeader(http.StatusOK) // Always return 200 to PayPal.
+// tokensForAmount returns the number of tokens a payment of value in currency buys at
+// PricePerTokenUSD. Only whole numbers of tokens paid in USD are accepted.
+func tokensForAmount(currency, value string) (int, error) {
+	if currency != "USD" {
+		return 0, fmt.Errorf("unexpected payment currency %q", currency)
+	}
+	paid, err := parseCents(value)
+	if err != nil {
+		return 0, err
+	}
+	price, err := parseCents(PricePerTokenUSD)
+	if err != nil {
+		return 0, err
+	}
+	if paid <= 0 || paid%price != 0 {
+		return 0, fmt.Errorf("payment of %s USD is not a whole number of tokens", value)
+	}
+	return int(paid / price), nil
+}
+
+// parseCents parses a decimal amount such as "12.50" into cents.
+func parseCents(value string) (int64, error) {
+	whole, frac, _ := strings.Cut(value, ".")
+	if len(frac) > 2 {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+	cents, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil || whole == "" {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	return cents, nil
 }
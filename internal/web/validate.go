@@ -0,0 +1,84 @@
+// Package web contains server-side handlers for web-related functionality like payments.
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// MaxRequestBodyBytes caps the size of JSON request bodies accepted by the API.
+const MaxRequestBodyBytes = 1 << 20
+
+// Validator is implemented by request payloads that can check their own fields.
+// Validate returns a map of JSON field name to problem description, empty when valid.
+type Validator interface {
+	Validate() map[string]string
+}
+
+// ErrorResponse is the JSON body returned for rejected requests.
+type ErrorResponse struct {
+	Error  string            `json:"error"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// DecodeAndValidate decodes the JSON request body into v and, if v implements
+// Validator, validates it. On failure it writes a 400 response with field-level
+// details and returns false; the handler should then return without further work.
+func DecodeAndValidate(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		WriteError(w, http.StatusBadRequest, decodeErrorResponse(err))
+		return false
+	}
+	if decoder.More() {
+		WriteError(w, http.StatusBadRequest, ErrorResponse{Error: "request body must contain a single JSON object"})
+		return false
+	}
+
+	if validator, ok := v.(Validator); ok {
+		if fields := validator.Validate(); len(fields) > 0 {
+			WriteError(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request", Fields: fields})
+			return false
+		}
+	}
+	return true
+}
+
+// WriteError writes a JSON error response with the given status code.
+func WriteError(w http.ResponseWriter, status int, resp ErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// decodeErrorResponse turns a JSON decoding error into a client-facing response,
+// pointing at the offending field where the decoder reports one.
+func decodeErrorResponse(err error) ErrorResponse {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &typeErr):
+		return ErrorResponse{
+			Error:  "invalid request",
+			Fields: map[string]string{typeErr.Field: fmt.Sprintf("must be of type %s", typeErr.Type)},
+		}
+	case errors.As(err, &syntaxErr):
+		return ErrorResponse{Error: fmt.Sprintf("malformed JSON at offset %d", syntaxErr.Offset)}
+	case errors.As(err, &maxBytesErr):
+		return ErrorResponse{Error: fmt.Sprintf("request body must not exceed %d bytes", maxBytesErr.Limit)}
+	case errors.Is(err, io.EOF):
+		return ErrorResponse{Error: "request body must not be empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorResponse{Error: "malformed JSON"}
+	default:
+		// Unknown fields are reported by the decoder as `json: unknown field "x"`.
+		return ErrorResponse{Error: err.Error()}
+	}
+}
@@ -0,0 +1,157 @@
+// Package web contains server-side handlers for web-related functionality like payments.
+package web
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers PayPal signs webhook deliveries with.
+const (
+	HeaderTransmissionID   = "Paypal-Transmission-Id"
+	HeaderTransmissionTime = "Paypal-Transmission-Time"
+	HeaderTransmissionSig  = "Paypal-Transmission-Sig"
+	HeaderCertURL          = "Paypal-Cert-Url"
+	HeaderAuthAlgo         = "Paypal-Auth-Algo"
+)
+
+// WebhookAuthAlgo is the only signature algorithm PayPal uses for webhooks.
+const WebhookAuthAlgo = "SHA256withRSA"
+
+// ErrWebhookSignature means a webhook delivery isn't signed by PayPal for the
+// configured webhook.
+var ErrWebhookSignature = errors.New("invalid PayPal webhook signature")
+
+// MaxTransmissionSkew bounds how far the transmission time of a webhook delivery may be
+// from the server clock. The time is signed, so a recorded delivery can't be replayed
+// once it is older than this.
+const MaxTransmissionSkew = 5 * time.Minute
+
+// checkTransmissionTime returns an error unless the transmission time in h is within
+// MaxTransmissionSkew of now.
+func checkTransmissionTime(h http.Header, now time.Time) error {
+	sent, err := time.Parse(time.RFC3339, h.Get(HeaderTransmissionTime))
+	if err != nil {
+		return fmt.Errorf("malformed transmission time: %w", err)
+	}
+	if skew := now.Sub(sent); skew > MaxTransmissionSkew || skew < -MaxTransmissionSkew {
+		return fmt.Errorf("transmission time %s is %s from now", sent.Format(time.RFC3339), skew.Round(time.Second))
+	}
+	return nil
+}
+
+// VerifyWebhookSignature checks that body was signed by cert for the webhook webhookID,
+// as described by the PayPal transmission headers h. PayPal signs the string
+// "<transmission id>|<transmission time>|<webhook id>|<CRC32 of the body>".
+func VerifyWebhookSignature(h http.Header, body []byte, webhookID string, cert *x509.Certificate) error {
+	transmissionID := h.Get(HeaderTransmissionID)
+	transmissionTime := h.Get(HeaderTransmissionTime)
+	if transmissionID == "" || transmissionTime == "" || webhookID == "" {
+		return fmt.Errorf("%w: missing transmission headers or webhook id", ErrWebhookSignature)
+	}
+	if algo := h.Get(HeaderAuthAlgo); algo != WebhookAuthAlgo {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrWebhookSignature, algo)
+	}
+	sig, err := base64.StdEncoding.DecodeString(h.Get(HeaderTransmissionSig))
+	if err != nil || len(sig) == 0 {
+		return fmt.Errorf("%w: malformed signature", ErrWebhookSignature)
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: certificate has no RSA key", ErrWebhookSignature)
+	}
+
+	message := strings.Join([]string{
+		transmissionID,
+		transmissionTime,
+		webhookID,
+		strconv.FormatUint(uint64(crc32.ChecksumIEEE(body)), 10),
+	}, "|")
+	digest := sha256.Sum256([]byte(message))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		return ErrWebhookSignature
+	}
+	return nil
+}
+
+// maxCertSize caps the size of a downloaded signing certificate.
+const maxCertSize = 64 << 10
+
+// AddWebhookCert caches cert as the certificate at certURL, so deliveries naming that
+// URL are verified against it without downloading it.
+func (h *PaymentHandler) AddWebhookCert(certURL string, cert *x509.Certificate) {
+	h.certMu.Lock()
+	h.certs[certURL] = cert
+	h.certMu.Unlock()
+}
+
+// webhookCert returns the certificate at certURL, which must be served by PayPal over
+// HTTPS: the URL comes with the delivery, so anything else could be a forger's own
+// certificate. Certificates are cached by URL, as PayPal reuses them.
+func (h *PaymentHandler) webhookCert(certURL string) (*x509.Certificate, error) {
+	u, err := url.Parse(certURL)
+	if err != nil || u.Scheme != "https" || !(u.Hostname() == "paypal.com" || strings.HasSuffix(u.Hostname(), ".paypal.com")) {
+		return nil, fmt.Errorf("%w: certificate URL %q is not a PayPal HTTPS URL", ErrWebhookSignature, certURL)
+	}
+
+	h.certMu.Lock()
+	cert, ok := h.certs[certURL]
+	h.certMu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	resp, err := h.httpClient.Get(certURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download PayPal certificate: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download PayPal certificate (status %d)", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCertSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download PayPal certificate: %w", err)
+	}
+
+	// The leaf comes first, followed by the intermediates it is issued by.
+	var chain []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PayPal certificate: %w", err)
+		}
+		chain = append(chain, c)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificate found at %s", certURL)
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := chain[0].Verify(x509.VerifyOptions{Intermediates: intermediates}); err != nil {
+		return nil, fmt.Errorf("%w: untrusted certificate: %v", ErrWebhookSignature, err)
+	}
+
+	h.certMu.Lock()
+	h.certs[certURL] = chain[0]
+	h.certMu.Unlock()
+	return chain[0], nil
+}
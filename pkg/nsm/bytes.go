@@ -0,0 +1,61 @@
+package nsm
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/nexus/nsm/internal/core"
+)
+
+// CompressionType selects the algorithm used by CompressBytes and DecompressBytes.
+type CompressionType = core.CompressionType
+
+// Supported compression algorithms.
+const (
+	ZSTD  = core.ZSTD
+	GZIP  = core.GZIP
+	STORE = core.STORE
+	LZ4   = core.LZ4
+)
+
+// DefaultLevel selects the algorithm's default compression level.
+const DefaultLevel = core.DefaultLevel
+
+var (
+	bytesCompressorOnce sync.Once
+	bytesCompressor     *core.Compressor
+)
+
+// sharedCompressor returns the compressor used by the in-memory helpers. It is shared
+// so repeated calls reuse its pooled encoders.
+func sharedCompressor() *core.Compressor {
+	bytesCompressorOnce.Do(func() {
+		bytesCompressor = core.NewCompressor()
+	})
+	return bytesCompressor
+}
+
+// CompressBytes compresses an in-memory payload with the given algorithm and level.
+// It produces a bare compressed stream, not an archive, and needs no client or tokens.
+// Levels use each algorithm's native scale (1-22 for zstd, -2-9 for gzip);
+// DefaultLevel picks the algorithm's default.
+//
+// Example:
+//
+//	compressed, err := nsm.CompressBytes(payload, nsm.ZSTD, nsm.DefaultLevel)
+func CompressBytes(data []byte, algo CompressionType, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := sharedCompressor().CompressLevel(&buf, bytes.NewReader(data), algo, level); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecompressBytes reverses CompressBytes. algo must match the algorithm used to compress.
+func DecompressBytes(data []byte, algo CompressionType) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := sharedCompressor().Decompress(&buf, bytes.NewReader(data), algo); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -5,9 +5,15 @@
 package nsm
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"runtime"
 	"sync"
+	"time"
 
 	"github.com/nexus/nsm/internal/auth"
 	"github.com/nexus/nsm/internal/core"
@@ -33,10 +39,42 @@ type Config struct {
 	// Defaults to the official NSM marketplace if empty.
 	MarketplaceURL string
 
+	// UserAgent replaces the User-Agent sent to the marketplace, which by default
+	// names the tool and its version.
+	UserAgent string
+
+	// DisableClientID stops sending the anonymous installation id to the marketplace.
+	DisableClientID bool
+
 	// LogLevel sets the verbosity of the client's logging.
 	LogLevel logrus.Level
+
+	// MaxConcurrentCreates bounds how many archives CreateBatch builds at once.
+	// Defaults to half the available CPU cores (minimum 1) if zero.
+	MaxConcurrentCreates int
+}
+
+// CreateJob describes a single archive to be built by CreateBatch.
+type CreateJob struct {
+	OutputFile string
+	InputFiles []string
+}
+
+// CreateResult reports the outcome of a single CreateJob.
+// Err is nil if the archive was created successfully.
+type CreateResult struct {
+	Job   CreateJob
+	Stats *CreateStats // nil if Err is set.
+	Err   error
 }
 
+// CreateStats sums up a created archive: its sizes, the time it took, and what each
+// algorithm compressed.
+type CreateStats = core.CreateResult
+
+// AlgoStats sums up the files of an archive compressed with one algorithm.
+type AlgoStats = core.AlgoStats
+
 // NewClient creates and initializes a new NSM client.
 // It sets up the core engine and token manager based on the provided configuration.
 // It will attempt to load token state from the user's home directory.
@@ -61,7 +99,7 @@ func NewClient(cfg Config) (*Client, error) {
 
 	coreCfg := &core.Config{
 		LicenseKey: cfg.LicenseKey,
-		TokenCount: tm.AvailableTokens(),
+		Tokens:     tm,
 	}
 	engine, err := core.NewEngine(coreCfg)
 	if err != nil {
@@ -76,19 +114,93 @@ func NewClient(cfg Config) (*Client, error) {
 }
 
 // Create compresses a list of input files into a single .nsm archive.
-// This operation consumes one token. If no tokens are available, it will return an error.
-func (c *Client) Create(outputFile string, inputFiles []string) error {
+// This operation consumes tokens by the size of the inputs, at least one. If the
+// balance doesn't cover them, it returns an error wrapping auth.ErrNoTokens.
+// On success, it returns the sizes of the inputs and the archive and how long it took.
+func (c *Client) Create(outputFile string, inputFiles []string) (*CreateStats, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.create(context.Background(), outputFile, inputFiles)
+}
+
+// CreateContext is like Create, and stops once ctx is done, returning ctx.Err(). The
+// partial archive is removed and the tokens refunded.
+func (c *Client) CreateContext(ctx context.Context, outputFile string, inputFiles []string) (*CreateStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.create(ctx, outputFile, inputFiles)
+}
+
+// CreateBatch builds several archives, running at most MaxConcurrentCreates of them
+// at the same time. Each job consumes tokens like Create. A job the remaining balance
+// doesn't cover fails with auth.ErrNoTokens before anything is compressed, while
+// cheaper jobs after it may still fit. Results are returned in the same order as the
+// jobs.
+func (c *Client) CreateBatch(jobs []CreateJob) []CreateResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	limit := c.config.MaxConcurrentCreates
+	if limit <= 0 {
+		limit = runtime.NumCPU() / 2
+		if limit == 0 {
+			limit = 1
+		}
+	}
+
+	results := make([]CreateResult, len(jobs))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+
+	for i, job := range jobs {
+		results[i].Job = job
+		sem <- struct{}{} // Blocks while the maximum number of jobs is running.
+		wg.Add(1)
+		go func(i int, job CreateJob) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			stats, err := c.create(context.Background(), job.OutputFile, job.InputFiles)
+			results[i].Stats, results[i].Err = stats, err
+		}(i, job)
+	}
 
-	// Consume a token before performing the operation.
-	if err := c.tokenManager.ConsumeToken(); err != nil {
+	wg.Wait()
+	return results
+}
+
+// create builds the archive, charging its cost to the token manager. Callers must hold c.mu.
+// The token manager serializes consumption, so it is safe to call concurrently.
+func (c *Client) create(ctx context.Context, outputFile string, inputFiles []string) (*CreateStats, error) {
+	// The engine charges the token manager, which consumes the tokens once the inputs
+	// are validated and refunds them if the archive can't be written.
+	stats, err := c.engine.CreateContext(ctx, outputFile, inputFiles)
+	if errors.Is(err, auth.ErrNoTokens) {
+		return nil, fmt.Errorf("token required for 'create' operation: %w", err)
+	}
+	return stats, err
+}
+
+// CreateFromReaders builds an archive of entries, by archive name, and writes it to
+// output, without going through the disk. Entries and the archive are held in memory
+// while it is built. It consumes tokens like Create.
+func (c *Client) CreateFromReaders(output io.Writer, entries map[string]io.Reader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.engine.CreateFromReaders(output, entries)
+	if errors.Is(err, auth.ErrNoTokens) {
 		return fmt.Errorf("token required for 'create' operation: %w", err)
 	}
+	return err
+}
 
-	// The core engine will perform the actual compression.
-	// In a real implementation, you would pass progress callbacks here.
-	return c.engine.Create(outputFile, inputFiles)
+// ExtractToWriters reads a whole archive from input, such as a network stream, and
+// returns the content of its files by path, held in memory.
+// This operation does not consume any tokens.
+func (c *Client) ExtractToWriters(input io.Reader) (map[string]io.Reader, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.engine.ExtractFromReader(input)
 }
 
 // Extract decompresses a .nsm archive to a specified destination directory.
@@ -99,16 +211,69 @@ func (c *Client) Extract(archiveFile, destinationPath string) error {
 	return c.engine.Extract(archiveFile, destinationPath)
 }
 
+// ExtractContext is like Extract, and stops once ctx is done, returning ctx.Err().
+func (c *Client) ExtractContext(ctx context.Context, archiveFile, destinationPath string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.engine.ExtractContext(ctx, archiveFile, destinationPath)
+}
+
+// Archive is an opened archive that can be listed, read and extracted several times.
+type Archive = core.ArchiveSession
+
+// OpenBytes opens an archive held in memory, such as one embedded with go:embed.
+// This operation does not consume any tokens.
+func (c *Client) OpenBytes(data []byte) (*Archive, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.engine.OpenBytes(data)
+}
+
+// OpenReaderAt opens an archive of the given size read through r, such as an object in
+// S3 read with HTTP range requests. Only the header and index are read up front; each
+// file read, extracted or scanned afterwards only fetches its own byte range.
+// This operation does not consume any tokens.
+func (c *Client) OpenReaderAt(r io.ReaderAt, size int64) (*Archive, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.engine.OpenReader(r, size)
+}
+
+// OpenFS opens the archive name in fsys, such as an embed.FS.
+// This operation does not consume any tokens.
+func (c *Client) OpenFS(fsys fs.FS, name string) (*Archive, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.engine.OpenFS(fsys, name)
+}
+
+// SearchResult is a file matching a search query.
+type SearchResult = core.SearchResult
+
+// FileError records a file that was skipped without failing the whole operation.
+type FileError = core.FileError
+
 // Search performs a full-text search within a .nsm archive.
+// Files that can't be decompressed are skipped and returned as FileErrors alongside
+// the matches from the rest of the archive.
 // This operation does not consume any tokens.
-func (c *Client) Search(archiveFile, query string) ([]string, error) {
+func (c *Client) Search(archiveFile, query string) ([]SearchResult, []FileError, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	return c.engine.Search(archiveFile, query)
 }
 
+// SearchContext is like Search, and stops once ctx is done, returning ctx.Err().
+func (c *Client) SearchContext(ctx context.Context, archiveFile, query string) ([]SearchResult, []FileError, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.engine.SearchContext(ctx, archiveFile, query)
+}
+
 // BuyTokens initiates the token purchase process for a given number of tokens.
 // It returns a payment URL that the user must visit to complete the transaction.
+// The order is remembered until it is paid or cancelled; while it is pending, further
+// purchases fail with auth.ErrPendingOrder (see PendingOrder and CancelPendingOrder).
 //
 // Returns:
 //   - paymentURL: The URL for the user to complete the PayPal payment.
@@ -118,22 +283,88 @@ func (c *Client) BuyTokens(count int) (paymentURL, orderID string, err error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
+	client, err := c.marketplace()
+	if err != nil {
+		return "", "", err
+	}
+	order, err := client.StartPurchase(c.tokenManager, count)
+	if err != nil {
+		return "", "", err
+	}
+
+	return order.PaymentURL, order.OrderID, nil
+}
+
+// PendingOrder returns the token purchase awaiting payment, or nil if there is none.
+func (c *Client) PendingOrder() *auth.PendingOrder {
+	return c.tokenManager.PendingOrder()
+}
+
+// CancelPendingOrder cancels the token purchase awaiting payment, if any.
+func (c *Client) CancelPendingOrder() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	client, err := c.marketplace()
+	if err != nil {
+		return err
+	}
+	return client.CancelPendingOrder(c.tokenManager)
+}
+
+// marketplace returns a marketplace client authenticated with the license key and
+// identified as configured.
+func (c *Client) marketplace() (*auth.MarketplaceClient, error) {
 	if c.config.LicenseKey == "" {
-		return "", "", fmt.Errorf("a license key is required to buy tokens")
+		return nil, fmt.Errorf("a license key is required to use the marketplace")
 	}
 
 	marketplaceURL := c.config.MarketplaceURL
 	if marketplaceURL == "" {
 		marketplaceURL = "https://api.nexus-memory.com" // Default production URL
 	}
-
 	client := auth.NewMarketplaceClient(marketplaceURL, c.config.LicenseKey)
-	resp, err := client.InitiatePurchase(count)
+	if c.config.UserAgent != "" {
+		client.UserAgent = c.config.UserAgent
+	}
+	if !c.config.DisableClientID {
+		id, err := c.tokenManager.ClientID()
+		if err != nil {
+			return nil, err
+		}
+		client.ClientID = id
+	}
+	return client, nil
+}
+
+// LastSync returns when the token balance was last synced with the marketplace; it is
+// the zero time if it never was. Like AvailableTokens, it only reads the local state.
+func (c *Client) LastSync() time.Time {
+	return c.tokenManager.LastSync()
+}
+
+// SyncTokens fetches the token balance of the license key from the marketplace and
+// stores it locally. It fails with auth.ErrInvalidLicense if the marketplace rejects
+// the key.
+func (c *Client) SyncTokens() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	client, err := c.marketplace()
 	if err != nil {
-		return "", "", err
+		return err
 	}
+	_, err = client.SyncTokens(c.tokenManager)
+	return err
+}
+
+// UsageRecord is an entry of the token usage log, see UsageHistory.
+type UsageRecord = auth.UsageRecord
 
-	return resp.PaymentURL, resp.OrderID, nil
+// UsageHistory returns what tokens were spent on, oldest first: a record for every
+// archive created, with the tokens left afterwards.
+func (c *Client) UsageHistory() ([]UsageRecord, error) {
+	return c.tokenManager.UsageHistory()
 }
 
 // AvailableTokens returns the number of currently available tokens.
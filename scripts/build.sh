@@ -11,6 +11,7 @@ set -e # Exit immediately if a command exits with a non-zero status.
 APP_NAME="nsm"
 OUTPUT_DIR="./bin"
 MAIN_PACKAGE="github.com/nexus/nsm/cmd/nsm"
+VERSION_PACKAGE="github.com/nexus/nsm/internal/version"
 
 # --- Versioning ---
 # Essayez d'obtenir la version depuis la dernière étiquette Git. Sinon, utilisez 'dev'.
@@ -19,7 +20,7 @@ COMMIT_HASH=$(git rev-parse --short HEAD)
 BUILD_DATE=$(date -u +'%Y-%m-%dT%H:%M:%SZ')
 
 # LDFLAGS injecte les informations de version dans le binaire au moment de la compilation.
-LDFLAGS="-s -w -X main.Version=${VERSION} -X main.Commit=${COMMIT_HASH} -X main.BuildDate=${BUILD_DATE}"
+LDFLAGS="-s -w -X ${VERSION_PACKAGE}.Version=${VERSION} -X ${VERSION_PACKAGE}.Commit=${COMMIT_HASH} -X ${VERSION_PACKAGE}.BuildDate=${BUILD_DATE}"
 
 # --- Plateformes cibles ---
 # Format: GOOS/GOARCH/Extension
@@ -0,0 +1,376 @@
+// Package tests contains all the tests for the NSM project.
+package tests
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexus/nsm/internal/cli"
+	"github.com/nexus/nsm/internal/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runCLI runs the nsm command line with args.
+func runCLI(t *testing.T, args ...string) error {
+	cmd := cli.NewRootCmd()
+	cmd.SetArgs(args)
+	cmd.SilenceUsage = true
+	return cmd.Execute()
+}
+
+// TestEncryptWithPasswordFile verifies that an archive created with --encrypt and a
+// password file has its data and index encrypted, and is extracted with the same
+// password file, and not without it.
+func TestEncryptWithPasswordFile(t *testing.T) {
+	t.Setenv("HOME", t.TempDir()) // The token state lives in the home directory.
+	t.Setenv(cli.PasswordEnv, "")
+	root := createTestTree(t, "secret.txt", "docs/plan.md")
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("correct horse battery staple\n"), 0600))
+	archivePath := filepath.Join(dir, "secret.nsm")
+
+	require.NoError(t, runCLI(t, "create", archivePath, root, "--encrypt", "--kdf-memory", "1", "--kdf-time", "1", "--password-file", passwordFile))
+	f, err := os.Open(archivePath)
+	require.NoError(t, err)
+	header, err := core.ReadHeader(f)
+	f.Close()
+	require.NoError(t, err)
+	assert.NotZero(t, header.Flags&core.FlagIndexPassphrase)
+	assert.NotZero(t, header.Flags&core.FlagIndexEncrypted)
+	assert.Equal(t, core.KDFParams{Time: 1, Threads: core.DefaultKDFParams.Threads, Memory: 1}, header.KDF)
+	assert.NotEqual(t, core.EncryptionNone, header.EncryptionType, "--encrypt should encrypt the data as well as the index")
+	raw, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "content of secret.txt", "File contents should not be stored in plaintext")
+	assert.NotContains(t, string(raw), "plan.md", "File names should not be stored in plaintext")
+
+	t.Setenv(cli.PasswordEnv, "wrong passphrase")
+	assert.Error(t, runCLI(t, "extract", archivePath, t.TempDir()), "A wrong passphrase should be rejected")
+
+	dest := t.TempDir()
+	require.NoError(t, runCLI(t, "extract", archivePath, dest, "--password-file", passwordFile))
+	data, err := os.ReadFile(filepath.Join(dest, filepath.Base(root), "docs", "plan.md"))
+	require.NoError(t, err)
+	assert.Equal(t, "content of docs/plan.md", string(data))
+}
+
+// TestPasswordFlag verifies that --password encrypts an archive on create without
+// --encrypt, opens it on extract, and can't be empty, and that --kdf-memory is bounded.
+func TestPasswordFlag(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(cli.PasswordEnv, "")
+	root := createTestTree(t, "notes.txt")
+	archivePath := filepath.Join(t.TempDir(), "protected.nsm")
+
+	require.Error(t, runCLI(t, "create", archivePath, root, "--password", ""), "An empty passphrase should be rejected")
+	require.Error(t, runCLI(t, "create", archivePath, root, "--password", "s3cret", "--kdf-memory", "65535"),
+		"More Argon2id memory than MaxKDFMemory should be rejected")
+	require.NoError(t, runCLI(t, "create", archivePath, root, "--password", "s3cret", "--kdf-memory", "1", "--kdf-time", "1"))
+	f, err := os.Open(archivePath)
+	require.NoError(t, err)
+	header, err := core.ReadHeader(f)
+	f.Close()
+	require.NoError(t, err)
+	assert.Equal(t, core.EncryptionAES256GCM, header.EncryptionType)
+
+	assert.Error(t, runCLI(t, "extract", archivePath, t.TempDir(), "--password", "wrong"))
+	dest := t.TempDir()
+	require.NoError(t, runCLI(t, "extract", archivePath, dest, "--password", "s3cret"))
+	data, err := os.ReadFile(filepath.Join(dest, filepath.Base(root), "notes.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "content of notes.txt", string(data))
+}
+
+// TestPasswordPrecedence verifies that --password takes precedence over --password-file,
+// which takes precedence over $NSM_PASSWORD.
+func TestPasswordPrecedence(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := createTestTree(t, "notes.txt")
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "protected.nsm")
+	rightFile := filepath.Join(dir, "right")
+	require.NoError(t, os.WriteFile(rightFile, []byte("s3cret\n"), 0600))
+	wrongFile := filepath.Join(dir, "wrong")
+	require.NoError(t, os.WriteFile(wrongFile, []byte("wrong\n"), 0600))
+
+	t.Setenv(cli.PasswordEnv, "s3cret")
+	require.NoError(t, runCLI(t, "create", archivePath, root, "--encrypt", "--kdf-memory", "1", "--kdf-time", "1"))
+	require.NoError(t, runCLI(t, "extract", archivePath, t.TempDir()), "$NSM_PASSWORD should be used on its own")
+	assert.Error(t, runCLI(t, "extract", archivePath, t.TempDir(), "--password-file", wrongFile),
+		"--password-file should take precedence over $NSM_PASSWORD")
+	assert.Error(t, runCLI(t, "extract", archivePath, t.TempDir(), "--password", "wrong", "--password-file", rightFile),
+		"--password should take precedence over --password-file")
+
+	t.Setenv(cli.PasswordEnv, "wrong")
+	assert.NoError(t, runCLI(t, "extract", archivePath, t.TempDir(), "--password-file", rightFile))
+	assert.NoError(t, runCLI(t, "extract", archivePath, t.TempDir(), "--password", "s3cret", "--password-file", wrongFile))
+}
+
+// captureStdout returns what fn writes to standard output.
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- data
+	}()
+	fn()
+	w.Close()
+	return string(<-out)
+}
+
+// TestSearchOutputFormats verifies the structure of each search output format.
+func TestSearchOutputFormats(t *testing.T) {
+	archivePath := createSearchArchive(t, core.SearchIndexEmbedded)
+	search := func(args ...string) string {
+		return captureStdout(t, func() {
+			require.NoError(t, runCLI(t, append([]string{"search", archivePath, "quarterly report"}, args...)...))
+		})
+	}
+
+	assert.Equal(t,
+		"notes.txt:1:Quarterly report: revenue grew in Q3.\n"+
+			"todo.txt:1:Finish the quarterly REPORT before Friday.\n",
+		search("--format", "grep"))
+
+	lines := strings.Split(strings.TrimSpace(search("--format", "jsonl")), "\n")
+	require.Len(t, lines, 2)
+	var match core.LineMatch
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &match))
+	assert.Equal(t, core.LineMatch{
+		Path:  "todo.txt",
+		Line:  1,
+		Text:  "Finish the quarterly REPORT before Friday.",
+		Spans: []core.Span{{Start: 11, End: 20}, {Start: 21, End: 27}},
+	}, match)
+
+	assert.Equal(t,
+		"notes.txt\n     1: Quarterly report: revenue grew in Q3.\n"+
+			"todo.txt\n     1: Finish the quarterly REPORT before Friday.\n",
+		search("--color", "never"))
+	assert.Contains(t, search("--color", "always"), "the \x1b[1;31mquarterly\x1b[0m \x1b[1;31mREPORT\x1b[0m before")
+}
+
+// TestSearchRequireIndex verifies that search --require-index refuses to scan an
+// archive without a search index but still searches indexed ones.
+func TestSearchRequireIndex(t *testing.T) {
+	indexed := createSearchArchive(t, core.SearchIndexEmbedded)
+	out := captureStdout(t, func() {
+		require.NoError(t, runCLI(t, "search", indexed, "quarterly", "--require-index", "--format", "grep"))
+	})
+	assert.Contains(t, out, "notes.txt:1:")
+
+	unindexed := createSearchArchive(t, core.SearchIndexNone)
+	err := runCLI(t, "search", unindexed, "quarterly", "--require-index")
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrNoSearchIndex, coreErr.Code)
+}
+
+// TestListCommand verifies the table and JSON output of list.
+func TestListCommand(t *testing.T) {
+	archivePath := createSearchArchive(t, core.SearchIndexEmbedded)
+	out := captureStdout(t, func() {
+		require.NoError(t, runCLI(t, "list", archivePath))
+	})
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 5)
+	assert.Regexp(t, `^\s*SIZE\s+COMPRESSED\s+MODIFIED\s+PATH$`, lines[0])
+	assert.Regexp(t, `^\s*37\s+\d+\s+\d{4}-\d\d-\d\d \d\d:\d\d\s+notes\.txt$`, lines[1])
+	assert.Equal(t, "3 file(s), 105 bytes", lines[4])
+
+	out = captureStdout(t, func() {
+		require.NoError(t, runCLI(t, "list", archivePath, "--json"))
+	})
+	var listed []struct {
+		Path             string `json:"path"`
+		UncompressedSize int64  `json:"uncompressed_size"`
+		CompressedSize   int64  `json:"compressed_size"`
+		Checksum         string `json:"checksum"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(out), &listed))
+	require.Len(t, listed, 3)
+	assert.Equal(t, "notes.txt", listed[0].Path)
+	assert.EqualValues(t, 37, listed[0].UncompressedSize)
+	assert.Positive(t, listed[0].CompressedSize)
+	assert.Len(t, listed[0].Checksum, 64)
+}
+
+// TestInfoCommand verifies the text and JSON output of info, which needs no token.
+func TestInfoCommand(t *testing.T) {
+	archivePath := createSearchArchive(t, core.SearchIndexEmbedded)
+	out := captureStdout(t, func() {
+		require.NoError(t, runCLI(t, "info", archivePath))
+	})
+	assert.Contains(t, out, "Compression:       zstd (level default)")
+	assert.Contains(t, out, "Files:             3")
+	assert.Contains(t, out, "Uncompressed size: 105 bytes")
+
+	out = captureStdout(t, func() {
+		require.NoError(t, runCLI(t, "stat", archivePath, "--json"))
+	})
+	var info core.ArchiveInfo
+	require.NoError(t, json.Unmarshal([]byte(out), &info))
+	assert.Equal(t, core.ZSTD, info.Compression)
+	assert.Equal(t, "none", info.Encryption)
+	assert.Equal(t, 3, info.Files)
+	assert.EqualValues(t, 105, info.UncompressedSize)
+	assert.InDelta(t, float64(info.CompressedSize)/105, info.Ratio, 1e-9)
+	assert.WithinDuration(t, time.Now(), info.Created, time.Minute)
+}
+
+// TestExtractToTarCommand verifies that extract writes a tar stream to standard output
+// for a destination of "-", with nothing else mixed in, and to a file with --to-tar.
+func TestExtractToTarCommand(t *testing.T) {
+	archivePath := createSearchArchive(t, core.SearchIndexEmbedded)
+	tarNames := func(r io.Reader) []string {
+		var names []string
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return names
+			}
+			require.NoError(t, err)
+			names = append(names, hdr.Name)
+		}
+	}
+
+	out := captureStdout(t, func() {
+		require.NoError(t, runCLI(t, "extract", archivePath, "-"))
+	})
+	assert.ElementsMatch(t, []string{"notes.txt", "recipe.txt", "todo.txt"}, tarNames(strings.NewReader(out)))
+
+	tarPath := filepath.Join(t.TempDir(), "out.tar")
+	captureStdout(t, func() {
+		require.NoError(t, runCLI(t, "extract", archivePath, tarPath, "--to-tar"))
+	})
+	f, err := os.Open(tarPath)
+	require.NoError(t, err)
+	defer f.Close()
+	assert.Len(t, tarNames(f), 3)
+}
+
+// TestCreateConfigDefaults verifies that create takes its level, cipher and encryption
+// defaults from the config file, and that flags override them.
+func TestCreateConfigDefaults(t *testing.T) {
+	t.Setenv(cli.PasswordEnv, "config passphrase")
+	// Each create spends the only free token of a new home directory.
+	newHome := func() {
+		home := t.TempDir()
+		t.Setenv("HOME", home)
+		require.NoError(t, os.WriteFile(filepath.Join(home, ".nsm.yaml"), []byte(`
+create:
+  level: fastest
+  encrypt: true
+  cipher: chacha20-poly1305
+`), 0600))
+	}
+	root := createTestTree(t, "a.txt")
+	dir := t.TempDir()
+
+	readHeader := func(path string) *core.Header {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+		header, err := core.ReadHeader(f)
+		require.NoError(t, err)
+		return header
+	}
+	newHome()
+	configured := filepath.Join(dir, "configured.nsm")
+	require.NoError(t, runCLI(t, "create", configured, root, "--kdf-memory", "1", "--kdf-time", "1"))
+	header := readHeader(configured)
+	assert.Equal(t, core.EncryptionChaCha20Poly1305, header.EncryptionType)
+	assert.EqualValues(t, 1, header.Level, "The fastest preset is level 1")
+
+	newHome()
+	overridden := filepath.Join(dir, "overridden.nsm")
+	require.NoError(t, runCLI(t, "create", overridden, root, "--encrypt=false", "--level", "3"))
+	header = readHeader(overridden)
+	assert.Equal(t, core.EncryptionNone, header.EncryptionType)
+	assert.EqualValues(t, 3, header.Level)
+}
+
+// TestCreateDryRun verifies that create --dry-run lists the files that would be
+// archived, excludes applied, with an estimate, and writes nothing and spends no token.
+func TestCreateDryRun(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := createTestTree(t, "keep.txt", "skip.tmp", "docs/guide.md")
+	archivePath := filepath.Join(t.TempDir(), "planned.nsm")
+
+	out := captureStdout(t, func() {
+		require.NoError(t, runCLI(t, "create", archivePath, root, "--dry-run", "--exclude", "*.tmp"))
+	})
+	base := filepath.Base(root)
+	assert.Contains(t, out, base+"/keep.txt\n")
+	assert.Contains(t, out, base+"/docs/guide.md\n")
+	assert.NotContains(t, out, "skip.tmp")
+	assert.Contains(t, out, "Would archive 2 file(s)")
+	assert.Contains(t, out, "costing 1 token(s)")
+	assert.Contains(t, out, "1 path(s) excluded")
+	assert.NoFileExists(t, archivePath)
+
+	// The only free token is still there.
+	require.NoError(t, runCLI(t, "create", archivePath, root))
+	assert.FileExists(t, archivePath)
+}
+
+// TestOutputJSON verifies that --output json makes commands print a single JSON value
+// on standard output.
+func TestOutputJSON(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := createTestTree(t, "a.txt", "b/c.txt")
+	archivePath := filepath.Join(t.TempDir(), "out.nsm")
+
+	out := captureStdout(t, func() {
+		require.NoError(t, runCLI(t, "create", archivePath, root, "--output", "json"))
+	})
+	var result core.CreateResult
+	require.NoError(t, json.Unmarshal([]byte(out), &result), out)
+	assert.Equal(t, 2, result.Files)
+	assert.EqualValues(t, len("content of a.txt")+len("content of b/c.txt"), result.InputSize)
+	assert.Positive(t, result.ArchiveSize)
+
+	out = captureStdout(t, func() {
+		require.NoError(t, runCLI(t, "list", archivePath, "--output", "json"))
+	})
+	var listed []struct {
+		Path string `json:"path"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(out), &listed), out)
+	assert.Len(t, listed, 2)
+
+	out = captureStdout(t, func() {
+		require.NoError(t, runCLI(t, "tokens", "status", "--output", "json"))
+	})
+	var status struct {
+		Available *int `json:"available"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(out), &status), out)
+	require.NotNil(t, status.Available)
+	assert.Equal(t, 0, *status.Available, "The free token was spent on the archive")
+
+	dest := t.TempDir()
+	out = captureStdout(t, func() {
+		require.NoError(t, runCLI(t, "extract", archivePath, dest, "--output", "json"))
+	})
+	var extracted map[string]string
+	require.NoError(t, json.Unmarshal([]byte(out), &extracted), out)
+	assert.Equal(t, dest, extracted["destination"])
+
+	assert.Error(t, runCLI(t, "list", archivePath, "--output", "yaml"))
+}
@@ -0,0 +1,129 @@
+// Package tests contains all the tests for the NSM project.
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nexus/nsm/internal/auth"
+	"github.com/nexus/nsm/pkg/nsm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupTestClient creates a client whose token state lives in a temporary home directory
+// seeded with the given number of tokens.
+func setupTestClient(t *testing.T, tokens int, cfg nsm.Config) *nsm.Client {
+	homeDir := t.TempDir()
+	t.Setenv("HOME", homeDir)
+
+	state, err := json.Marshal(auth.TokenState{AvailableTokens: tokens})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(homeDir, auth.TokenFileName), state, 0600))
+
+	client, err := nsm.NewClient(cfg)
+	require.NoError(t, err, "Client initialization should not fail")
+	return client
+}
+
+// TestCreateBatchRunsOutOfTokens verifies that a batch only spends the available tokens
+// and reports ErrNoTokens for every other job.
+func TestCreateBatchRunsOutOfTokens(t *testing.T) {
+	client := setupTestClient(t, 2, nsm.Config{MaxConcurrentCreates: 3})
+	outDir := t.TempDir()
+
+	var jobs []nsm.CreateJob
+	for i := 0; i < 5; i++ {
+		inputPath, _ := createTestFile(t, 256)
+		jobs = append(jobs, nsm.CreateJob{
+			OutputFile: filepath.Join(outDir, fmt.Sprintf("batch_%d.nsm", i)),
+			InputFiles: []string{inputPath},
+		})
+	}
+
+	results := client.CreateBatch(jobs)
+	require.Len(t, results, len(jobs))
+
+	succeeded, noToken := 0, 0
+	for i, res := range results {
+		assert.Equal(t, jobs[i].OutputFile, res.Job.OutputFile, "Results should keep job order")
+		if res.Err == nil {
+			succeeded++
+			assert.FileExists(t, res.Job.OutputFile)
+		} else if errors.Is(res.Err, auth.ErrNoTokens) {
+			noToken++
+			assert.NoFileExists(t, res.Job.OutputFile)
+		}
+	}
+	assert.Equal(t, 2, succeeded, "Exactly two jobs should succeed")
+	assert.Equal(t, 3, noToken, "The remaining jobs should report ErrNoTokens")
+	assert.Equal(t, 0, client.AvailableTokens(), "All tokens should be spent")
+}
+
+// TestCreateBatchCheaperJobAfterShortfall verifies that a job the balance can't cover
+// doesn't stop a cheaper job after it from running.
+func TestCreateBatchCheaperJobAfterShortfall(t *testing.T) {
+	client := setupTestClient(t, 1, nsm.Config{MaxConcurrentCreates: 1})
+	outDir := t.TempDir()
+
+	// A sparse file costs 3 tokens by its size, without taking the space.
+	large := filepath.Join(t.TempDir(), "large.bin")
+	require.NoError(t, os.WriteFile(large, nil, 0644))
+	require.NoError(t, os.Truncate(large, 3<<30))
+	small, _ := createTestFile(t, 256)
+
+	results := client.CreateBatch([]nsm.CreateJob{
+		{OutputFile: filepath.Join(outDir, "large.nsm"), InputFiles: []string{large}},
+		{OutputFile: filepath.Join(outDir, "small.nsm"), InputFiles: []string{small}},
+	})
+	require.Len(t, results, 2)
+	assert.ErrorIs(t, results[0].Err, auth.ErrNoTokens)
+	assert.NoFileExists(t, results[0].Job.OutputFile)
+	require.NoError(t, results[1].Err, "A job the balance still covers should run")
+	assert.FileExists(t, results[1].Job.OutputFile)
+	assert.Equal(t, 0, client.AvailableTokens())
+}
+
+// TestInMemoryArchives verifies that archives can be built from readers and read back
+// without files, charging tokens like Create.
+func TestInMemoryArchives(t *testing.T) {
+	client := setupTestClient(t, 1, nsm.Config{})
+	entries := map[string]io.Reader{
+		"docs/readme.txt": strings.NewReader(strings.Repeat("in memory ", 1000)),
+		"/data.bin":       bytes.NewReader([]byte{0, 1, 2, 3}),
+		"empty":           strings.NewReader(""),
+	}
+
+	var archive bytes.Buffer
+	require.NoError(t, client.CreateFromReaders(&archive, entries))
+	assert.Equal(t, 0, client.AvailableTokens())
+
+	files, err := client.ExtractToWriters(bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	for name, want := range map[string]string{
+		"docs/readme.txt": strings.Repeat("in memory ", 1000),
+		"data.bin":        "\x00\x01\x02\x03",
+		"empty":           "",
+	} {
+		require.Contains(t, files, name)
+		data, err := io.ReadAll(files[name])
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data), name)
+	}
+
+	var more bytes.Buffer
+	err = client.CreateFromReaders(&more, map[string]io.Reader{"a": strings.NewReader("a")})
+	assert.ErrorIs(t, err, auth.ErrNoTokens)
+	assert.Zero(t, more.Len(), "Nothing should be written without a token")
+
+	_, err = client.ExtractToWriters(bytes.NewReader(archive.Bytes()[:archive.Len()/2]))
+	assert.Error(t, err, "A truncated archive should fail")
+}
@@ -0,0 +1,122 @@
+// Package tests contains all the tests for the NSM project.
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nexus/nsm/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeConfig writes a YAML config file and returns its path.
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+// TestConfigMerge verifies that later config files override earlier ones for scalar
+// and nested values, that unrelated nested keys are kept, and that lists are replaced.
+func TestConfigMerge(t *testing.T) {
+	team := writeConfig(t, "team.yaml", `
+license_key: TEAM-KEY
+temp_dir: /srv/tmp
+create:
+  algorithm: gzip
+  creator: team-backups
+  exclude_vcs: true
+  store_extensions: [".jpg", ".png"]
+`)
+	personal := writeConfig(t, "personal.yaml", `
+license_key: MY-KEY
+create:
+  algorithm: zstd
+  store_extensions: [".mp4"]
+`)
+
+	cfg, err := config.Load(team, personal)
+	require.NoError(t, err)
+	assert.Equal(t, "MY-KEY", cfg.LicenseKey, "A later scalar should override")
+	assert.Equal(t, "/srv/tmp", cfg.TempDir, "Keys missing from the override should be kept")
+	assert.Equal(t, "zstd", cfg.Create.Algorithm, "A later nested value should override")
+	assert.Equal(t, "team-backups", cfg.Create.Creator, "Sibling nested keys should be kept")
+	assert.True(t, cfg.Create.ExcludeVCS)
+	assert.Equal(t, []string{".mp4"}, cfg.Create.StoreExtensions, "Lists should be replaced, not appended")
+
+	cfg, err = config.Load(personal, team)
+	require.NoError(t, err)
+	assert.Equal(t, "TEAM-KEY", cfg.LicenseKey, "Precedence should follow the file order")
+	assert.Equal(t, "gzip", cfg.Create.Algorithm)
+
+	_, err = config.Load(team, filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err, "An explicitly given file must exist")
+}
+
+// TestConfigEnvironment verifies that environment variables fill in the settings no
+// config file sets, and that the files take precedence over them.
+func TestConfigEnvironment(t *testing.T) {
+	t.Setenv(config.EnvLicenseKey, "ENV-KEY")
+	t.Setenv(config.EnvMarketplaceURL, "https://env.example")
+	t.Setenv(config.EnvLevel, "best")
+	path := writeConfig(t, "nsm.yaml", `
+license_key: FILE-KEY
+create:
+  level: "3"
+`)
+
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "FILE-KEY", cfg.LicenseKey, "The file should win over the environment")
+	assert.Equal(t, "3", cfg.Create.Level)
+	assert.Equal(t, "https://env.example", cfg.Marketplace.URL, "The environment should fill in unset keys")
+
+	cfg, err = config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, "ENV-KEY", cfg.LicenseKey)
+	assert.Equal(t, "best", cfg.Create.Level)
+}
+
+// TestConfigEncryptEnvironment verifies that NSM_ENCRYPT turns encryption on unless a
+// config file sets it, even to false, and that values other than booleans are rejected.
+func TestConfigEncryptEnvironment(t *testing.T) {
+	t.Setenv(config.EnvEncrypt, "true")
+	cfg, err := config.Load(writeConfig(t, "nsm.yaml", "create:\n  level: \"3\"\n"))
+	require.NoError(t, err)
+	assert.True(t, cfg.Create.Encrypt, "The environment should fill in an unset key")
+
+	cfg, err = config.Load(writeConfig(t, "off.yaml", "create:\n  encrypt: false\n"))
+	require.NoError(t, err)
+	assert.False(t, cfg.Create.Encrypt, "An explicit false in a file should win over the environment")
+
+	t.Setenv(config.EnvEncrypt, "0")
+	cfg, err = config.Load()
+	require.NoError(t, err)
+	assert.False(t, cfg.Create.Encrypt)
+
+	t.Setenv(config.EnvEncrypt, "sometimes")
+	_, err = config.Load()
+	assert.Error(t, err)
+}
+
+// TestConfigInit verifies that the config file written by Init is valid and changes
+// nothing until edited, and that an existing file is only replaced when asked.
+func TestConfigInit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conf", ".nsm.yaml")
+	require.NoError(t, config.Init(path, false))
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, &config.Config{}, cfg, "Every setting of the template should be commented out")
+
+	require.NoError(t, os.WriteFile(path, []byte("license_key: MINE\n"), 0600))
+	assert.Error(t, config.Init(path, false), "An existing file should be kept")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "license_key: MINE\n", string(data))
+	require.NoError(t, config.Init(path, true))
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, config.Template, string(data))
+}
@@ -2,27 +2,75 @@
 package tests
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/nexus/nsm/internal/auth"
 	"github.com/nexus/nsm/internal/core"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-// setupTestEngine creates a new core engine with a default configuration for testing.
-func setupTestEngine(t *testing.T, tokens int) (*core.Engine, *core.Config) {
+// mockTokenSource is an in-memory core.TokenSource that records how it was used.
+type mockTokenSource struct {
+	mu        sync.Mutex
+	available int
+	consumed  int
+	refunded  int
+}
+
+func (m *mockTokenSource) ConsumeN(n int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.available < n {
+		return auth.ErrNoTokens
+	}
+	m.available -= n
+	m.consumed += n
+	return nil
+}
+
+func (m *mockTokenSource) RefundN(n int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.available += n
+	m.refunded += n
+	return nil
+}
+
+// Available returns the current balance.
+func (m *mockTokenSource) Available() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.available
+}
+
+// setupTestEngine creates a new core engine with a default configuration for testing,
+// charging creates to a mock token source holding the given number of tokens.
+func setupTestEngine(t *testing.T, tokens int) (*core.Engine, *mockTokenSource) {
+	source := &mockTokenSource{available: tokens}
 	cfg := &core.Config{
 		LicenseKey: "test-license-key",
-		TokenCount: tokens,
+		Tokens:     source,
 	}
 	engine, err := core.NewEngine(cfg)
 	require.NoError(t, err, "Engine initialization should not fail")
-	return engine, cfg
+	return engine, source
 }
 
 // createTestFile creates a temporary file with random data for testing.
@@ -48,50 +96,204 @@ func TestCreateAndExtract(t *testing.T) {
 	archivePath := filepath.Join(tmpDir, "test.nsm")
 
 	// 2. Create the archive.
-	err := engine.Create(archivePath, []string{testFilePath})
-	// This is expected to fail because the core methods are placeholders.
-	// In a real test, we would expect assert.NoError(t, err).
-	assert.Error(t, err, "Create should be implemented")
-	if err == nil {
-		// The following tests will only run if Create is implemented.
-		// 3. Check if the archive file exists.
-		_, err = os.Stat(archivePath)
-		assert.NoError(t, err, "Archive file should be created")
+	_, err := engine.Create(archivePath, []string{testFilePath})
+	require.NoError(t, err, "Create should not fail")
 
-		// 4. Extract the archive.
-		extractDir := filepath.Join(tmpDir, "extracted")
-		err = os.Mkdir(extractDir, 0755)
-		require.NoError(t, err)
+	// 3. Check if the archive file exists.
+	_, err = os.Stat(archivePath)
+	assert.NoError(t, err, "Archive file should be created")
 
-		err = engine.Extract(archivePath, extractDir)
-		assert.NoError(t, err, "Extraction should not fail")
+	// 4. Extract the archive.
+	extractDir := filepath.Join(tmpDir, "extracted")
+	err = os.Mkdir(extractDir, 0755)
+	require.NoError(t, err)
 
-		// 5. Verify the extracted file's content.
-		extractedFilePath := filepath.Join(extractDir, filepath.Base(testFilePath))
-		extractedData, err := os.ReadFile(extractedFilePath)
-		require.NoError(t, err)
-		assert.Equal(t, originalData, extractedData, "Extracted data should match original data")
+	err = engine.Extract(archivePath, extractDir)
+	assert.NoError(t, err, "Extraction should not fail")
+
+	// 5. Verify the extracted file's content.
+	extractedFilePath := filepath.Join(extractDir, filepath.Base(testFilePath))
+	extractedData, err := os.ReadFile(extractedFilePath)
+	require.NoError(t, err)
+	assert.Equal(t, originalData, extractedData, "Extracted data should match original data")
+}
+
+// TestCreateHeaderRoundTrip verifies that the header written by Create locates the
+// index, checksums the data block, and that the index has an entry per input.
+func TestCreateHeaderRoundTrip(t *testing.T) {
+	engine, _ := setupTestEngine(t, 1)
+	root := createTestTree(t, "a.txt", "b.txt", "sub/c.txt")
+	archivePath := filepath.Join(t.TempDir(), "header.nsm")
+	_, err := engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	header, idx := readArchiveIndex(t, archivePath)
+	assert.Equal(t, core.MagicNumber, header.Magic)
+	assert.Equal(t, core.FormatVersion, header.Version)
+	assert.Equal(t, int64(len(data)), header.IndexOffset+header.IndexLength, "The index should end the file")
+	assert.Equal(t, sha256.Sum256(data[core.HeaderSize:header.IndexOffset]), header.DataChecksum)
+
+	base := filepath.Base(root)
+	require.Len(t, idx.Files, 3)
+	for _, name := range []string{"a.txt", "b.txt", "sub/c.txt"} {
+		entry, ok := idx.Files[base+"/"+name]
+		require.True(t, ok, "missing index entry for %s", name)
+		assert.Equal(t, int64(len("content of "+name)), entry.UncompressedSize)
+		assert.LessOrEqual(t, core.HeaderSize+entry.Offset+entry.CompressedSize, header.IndexOffset)
 	}
 }
 
+// TestEmptyFileRoundTrip verifies that zero-byte files are archived and recreated exactly.
+func TestEmptyFileRoundTrip(t *testing.T) {
+	engine, _ := setupTestEngine(t, 1)
+	root := createTestTree(t, "data.txt")
+	require.NoError(t, os.WriteFile(filepath.Join(root, "empty.txt"), nil, 0640))
+	archivePath := filepath.Join(t.TempDir(), "empty.nsm")
+	_, err := engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+
+	extractDir := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, extractDir))
+	info, err := os.Stat(filepath.Join(extractDir, filepath.Base(root), "empty.txt"))
+	require.NoError(t, err, "The empty file should be recreated")
+	assert.Equal(t, int64(0), info.Size())
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm(), "The file mode should be restored")
+}
+
 // TestTokenConsumption verifies that creating an archive consumes a token.
 func TestTokenConsumption(t *testing.T) {
-	engine, cfg := setupTestEngine(t, 1) // Start with 1 token
-	assert.Equal(t, 1, cfg.TokenCount, "Should start with 1 token")
+	engine, tokens := setupTestEngine(t, 1) // Start with 1 token
 
 	// Create a dummy file for the test
 	testFilePath, _ := createTestFile(t, 100)
 	archivePath := filepath.Join(t.TempDir(), "token_test.nsm")
 
 	// This call should consume the token.
-	// We expect it to fail because Create is a stub, but we check the token count after.
-	_ = engine.Create(archivePath, []string{testFilePath})
-	assert.Equal(t, 0, cfg.TokenCount, "Token count should be 0 after one create operation")
+	_, err := engine.Create(archivePath, []string{testFilePath})
+	require.NoError(t, err)
+	assert.Equal(t, 0, tokens.Available(), "Token count should be 0 after one create operation")
+	assert.Equal(t, 1, tokens.consumed)
 
 	// This second call should fail because there are no tokens left.
-	err := engine.Create(archivePath, []string{testFilePath})
-	assert.Error(t, err, "Create should fail when no tokens are available")
-	assert.Contains(t, err.Error(), "no tokens available", "Error message should indicate no tokens")
+	_, err = engine.Create(archivePath, []string{testFilePath})
+	assert.ErrorIs(t, err, auth.ErrNoTokens, "Create should fail when no tokens are available")
+}
+
+// TestSizeBasedTokenCost verifies that the cost policy prices creates by input size,
+// and that an insufficient balance is rejected without consuming anything.
+func TestSizeBasedTokenCost(t *testing.T) {
+	tokens := &mockTokenSource{available: 5}
+	engine, err := core.NewEngine(&core.Config{
+		Tokens:     tokens,
+		CostPolicy: core.SizeCostPolicy{BytesPerToken: 1024},
+	})
+	require.NoError(t, err)
+	outDir := t.TempDir()
+
+	small, _ := createTestFile(t, 100)
+	_, err = engine.Create(filepath.Join(outDir, "small.nsm"), []string{small})
+	require.NoError(t, err)
+	assert.Equal(t, 1, tokens.consumed, "A small input should cost one token")
+
+	large, _ := createTestFile(t, 3*1024+1)
+	_, err = engine.Create(filepath.Join(outDir, "large.nsm"), []string{large})
+	require.NoError(t, err)
+	assert.Equal(t, 5, tokens.consumed, "Four started KiB should cost four tokens")
+	assert.Equal(t, 0, tokens.Available())
+
+	tokens.available = 2
+	archivePath := filepath.Join(outDir, "too_expensive.nsm")
+	_, err = engine.Create(archivePath, []string{large})
+	require.ErrorIs(t, err, auth.ErrNoTokens, "Create should fail when the balance can't cover the cost")
+	assert.Contains(t, err.Error(), "4 token(s)", "The error should report the cost")
+	assert.Equal(t, 2, tokens.Available(), "A rejected create should not consume anything")
+	assert.NoFileExists(t, archivePath)
+
+	est, err := engine.EstimateCreate(1, 3*1024+1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 4, est.Tokens, "Estimates should use the same cost policy")
+}
+
+// TestCreateFailureRefundsToken verifies that a token is given back through the
+// token source when the archive can't be written.
+func TestCreateFailureRefundsToken(t *testing.T) {
+	engine, tokens := setupTestEngine(t, 1)
+
+	testFilePath, _ := createTestFile(t, 100)
+	archivePath := filepath.Join(t.TempDir(), "missing-dir", "refund.nsm")
+
+	_, err := engine.Create(archivePath, []string{testFilePath})
+	require.Error(t, err, "Create should fail when the output can't be created")
+	assert.Equal(t, 1, tokens.consumed, "The token should have been consumed")
+	assert.Equal(t, 1, tokens.refunded, "The token should have been refunded")
+	assert.Equal(t, 1, tokens.Available())
+}
+
+// TestCreateMissingInputKeepsToken verifies that a missing input file is reported
+// before any token is consumed.
+func TestCreateMissingInputKeepsToken(t *testing.T) {
+	engine, tokens := setupTestEngine(t, 1)
+
+	testFilePath, _ := createTestFile(t, 100)
+	missingPath := filepath.Join(t.TempDir(), "does-not-exist.dat")
+	archivePath := filepath.Join(t.TempDir(), "missing_input.nsm")
+
+	_, err := engine.Create(archivePath, []string{testFilePath, missingPath})
+	require.Error(t, err, "Create should fail when an input file is missing")
+	assert.Contains(t, err.Error(), missingPath, "Error should list the missing file")
+	assert.NotContains(t, err.Error(), testFilePath, "Error should not list valid files")
+	assert.Equal(t, 0, tokens.consumed, "No token should be consumed after a validation failure")
+}
+
+// TestSharedEngineConcurrentCreates hammers a single engine with concurrent creates,
+// each charged to its own account, and checks every archive and token count.
+// Run with -race to catch unsynchronized state in the shared engine.
+func TestSharedEngineConcurrentCreates(t *testing.T) {
+	engine, tokens := setupTestEngine(t, 1)
+
+	const accounts, perAccount = 4, 5
+	var charged [accounts]mockTokenSource
+	for a := range charged {
+		charged[a].available = perAccount
+	}
+	outDir := t.TempDir()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, accounts*perAccount)
+	for a := 0; a < accounts; a++ {
+		for i := 0; i < perAccount; i++ {
+			inputPath, data := createTestFile(t, 4096)
+			archivePath := filepath.Join(outDir, fmt.Sprintf("acct%d_%d.nsm", a, i))
+			wg.Add(1)
+			go func(a int) {
+				defer wg.Done()
+				_, err := engine.CreateWithTokens(archivePath, []string{inputPath}, &charged[a])
+				if err == nil {
+					err = engine.Extract(archivePath, archivePath+".out")
+				}
+				if err == nil {
+					var got []byte
+					got, err = os.ReadFile(filepath.Join(archivePath+".out", filepath.Base(inputPath)))
+					if err == nil && !bytes.Equal(data, got) {
+						err = fmt.Errorf("%s: extracted data differs from the input", archivePath)
+					}
+				}
+				errs <- err
+			}(a)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	for a := range charged {
+		assert.Equal(t, perAccount, charged[a].consumed, "Each account should be charged once per create")
+	}
+	assert.Equal(t, 0, tokens.consumed, "Injected accounting should leave the engine's own tokens untouched")
 }
 
 // TestInvalidFormat tests that the engine correctly identifies non-nsm files.
@@ -102,12 +304,65 @@ func TestInvalidFormat(t *testing.T) {
 	invalidFile, _ := createTestFile(t, 128)
 
 	err := engine.Extract(invalidFile, t.TempDir())
-	// The core Extract function needs to be implemented to check for the magic number.
-	assert.Error(t, err, "Extract should fail for a non-nsm file")
-	if err != nil {
-		// In a real implementation, we'd check for a specific error type.
-		// assert.ErrorIs(t, err, core.ErrInvalidFormat)
-	}
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr, "Extract should fail for a non-nsm file")
+	assert.Equal(t, core.ErrInvalidFormat, coreErr.Code)
+	assert.ErrorIs(t, err, core.ErrInvalidFormat)
+	assert.NotErrorIs(t, err, core.ErrChecksumMismatch)
+}
+
+// TestCoreErrorWrap verifies that a wrapped CoreError matches both its code and its
+// cause with errors.Is, and unwraps to the cause.
+func TestCoreErrorWrap(t *testing.T) {
+	cause := os.ErrNotExist
+	err := fmt.Errorf("opening archive: %w", core.NewCoreError(core.ErrArchiveRead, "failed to open").Wrap(cause))
+	assert.ErrorIs(t, err, core.ErrArchiveRead)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.NotErrorIs(t, err, core.ErrArchiveWrite)
+	assert.ErrorIs(t, err, core.NewCoreError(core.ErrArchiveRead, "another message"))
+
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, cause, errors.Unwrap(coreErr))
+	assert.Nil(t, errors.Unwrap(core.NewCoreError(core.ErrInvalidInput, "no cause")))
+	assert.Equal(t, "failed to open: "+cause.Error(), coreErr.Error())
+}
+
+// TestExtractRejectsEscapingPaths verifies that an entry whose path climbs out of the
+// destination with "../" is rejected instead of being written outside of it.
+func TestExtractRejectsEscapingPaths(t *testing.T) {
+	engine, _ := setupTestEngine(t, 1)
+	inputPath, _ := createTestFile(t, 100)
+	archivePath := filepath.Join(t.TempDir(), "escape.nsm")
+	_, err := engine.Create(archivePath, []string{inputPath})
+	require.NoError(t, err)
+
+	// Rename the entry in the index.
+	header, idx := readArchiveIndex(t, archivePath)
+	entry := idx.Files["testfile.dat"]
+	delete(idx.Files, "testfile.dat")
+	entry.Path = "../evil.txt"
+	idx.Files[entry.Path] = entry
+	f, err := os.OpenFile(archivePath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(header.IndexOffset))
+	_, err = f.Seek(header.IndexOffset, io.SeekStart)
+	require.NoError(t, err)
+	header.IndexLength, err = core.WriteIndex(f, idx)
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	require.NoError(t, core.WriteHeader(f, header))
+	require.NoError(t, f.Close())
+
+	parent := t.TempDir()
+	dest := filepath.Join(parent, "dest")
+	require.NoError(t, os.Mkdir(dest, 0755))
+	err = engine.Extract(archivePath, dest)
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrInvalidFormat, coreErr.Code)
+	assert.NoFileExists(t, filepath.Join(parent, "evil.txt"))
 }
 
 // BenchmarkCompressor provides a performance benchmark for the compression logic.
@@ -127,3 +382,1632 @@ func BenchmarkCompressor(b *testing.B) {
 		require.NoError(b, err)
 	}
 }
+
+// createSmallFiles writes n small text files to a new directory and returns it.
+func createSmallFiles(t testing.TB, n int) string {
+	root := t.TempDir()
+	for i := 0; i < n; i++ {
+		content := strings.Repeat(fmt.Sprintf("line %d of file %d\n", i%7, i), 40)
+		require.NoError(t, os.WriteFile(filepath.Join(root, fmt.Sprintf("f%04d.txt", i)), []byte(content), 0644))
+	}
+	return root
+}
+
+// TestParallelCompression verifies that compressing several files at the same time
+// writes the same data block and index as compressing them one at a time.
+func TestParallelCompression(t *testing.T) {
+	root := createSmallFiles(t, 200)
+	large := bytes.Repeat([]byte("streamed on its own "), 100000)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "large.log"), large, 0644))
+
+	create := func(workers int) (*core.Header, *core.Index) {
+		engine, err := core.NewEngine(&core.Config{
+			Tokens:             core.NoopTokenSource{},
+			Reproducible:       true,
+			CompressionWorkers: workers,
+		})
+		require.NoError(t, err)
+		archivePath := filepath.Join(t.TempDir(), "parallel.nsm")
+		_, err = engine.Create(archivePath, []string{root})
+		require.NoError(t, err)
+		require.NoError(t, engine.Verify(archivePath))
+		return readArchiveIndex(t, archivePath)
+	}
+	sequential, seqIdx := create(1)
+	parallel, parIdx := create(8)
+	assert.Equal(t, sequential.DataChecksum, parallel.DataChecksum)
+	assert.Equal(t, seqIdx.Files, parIdx.Files)
+	assert.Equal(t, seqIdx.SearchData, parIdx.SearchData)
+
+	// Frames compressed ahead are encrypted like the others.
+	engine, err := core.NewEngine(&core.Config{
+		Tokens:             core.NoopTokenSource{},
+		EncryptionKey:      bytes.Repeat([]byte{0x42}, core.EncryptionKeySize),
+		CompressionWorkers: 8,
+	})
+	require.NoError(t, err)
+	archivePath := filepath.Join(t.TempDir(), "encrypted.nsm")
+	_, err = engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+	data, err := os.ReadFile(filepath.Join(dest, filepath.Base(root), "f0123.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("line 4 of file 123\n", 40), string(data))
+}
+
+// BenchmarkCreateSmallFiles compares compressing 1,000 small files one at a time with
+// compressing them in parallel.
+func BenchmarkCreateSmallFiles(b *testing.B) {
+	root := createSmallFiles(b, 1000)
+	for _, bm := range []struct {
+		name    string
+		workers int
+	}{{"sequential", 1}, {"parallel", 0}} {
+		bm := bm
+		b.Run(bm.name, func(b *testing.B) {
+			engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, CompressionWorkers: bm.workers})
+			require.NoError(b, err)
+			archivePath := filepath.Join(b.TempDir(), "bench.nsm")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := engine.Create(archivePath, []string{root})
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+// TestCheckArchiveDetectsCorruption verifies that the check mode reports a corrupted
+// file without writing anything to disk.
+func TestCheckArchiveDetectsCorruption(t *testing.T) {
+	engine, _ := setupTestEngine(t, 5)
+	root := createTestTree(t, "a.txt", "b.txt", "c.txt")
+	archiveDir := t.TempDir()
+	archivePath := filepath.Join(archiveDir, "check.nsm")
+	_, err := engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+
+	results, err := engine.CheckArchive(archivePath)
+	require.NoError(t, err, "An intact archive should pass the check")
+	assert.Len(t, results, 3)
+
+	// Flip a byte in the middle of b.txt's compressed frame.
+	header, idx := readArchiveIndex(t, archivePath)
+	f, err := os.OpenFile(archivePath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	entry := idx.Files[filepath.Base(root)+"/b.txt"]
+	pos := core.HeaderSize + entry.Offset + entry.CompressedSize/2
+	buf := make([]byte, 1)
+	_, err = f.ReadAt(buf, pos)
+	require.NoError(t, err)
+	buf[0] ^= 0xFF
+	_, err = f.WriteAt(buf, pos)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Greater(t, header.IndexOffset, pos)
+
+	results, err = engine.CheckArchive(archivePath)
+	require.Error(t, err, "The corrupted file should fail the check")
+	require.Len(t, results, 3)
+	for _, res := range results {
+		if res.Path == entry.Path {
+			assert.Error(t, res.Err, "The corrupted file should be reported")
+		} else {
+			assert.NoError(t, res.Err, "Intact files should still pass")
+		}
+	}
+
+	dirEntries, err := os.ReadDir(archiveDir)
+	require.NoError(t, err)
+	assert.Len(t, dirEntries, 1, "Checking should not write any files")
+}
+
+// TestGroupSmallFiles verifies that grouping many tiny files into shared frames
+// produces a much smaller archive that still extracts every file intact.
+func TestGroupSmallFiles(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 1000; i++ {
+		content := fmt.Sprintf("config entry %d: enabled=true\n", i)
+		require.NoError(t, os.WriteFile(filepath.Join(root, fmt.Sprintf("f%04d.conf", i)), []byte(content), 0644))
+	}
+	large := bytes.Repeat([]byte("large file "), 10000)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "large.bin"), large, 0644))
+	name := filepath.Base(root)
+
+	create := func(group bool) (string, int64) {
+		engine, err := core.NewEngine(&core.Config{
+			Tokens:          core.NoopTokenSource{},
+			SearchIndex:     core.SearchIndexNone,
+			GroupSmallFiles: group,
+		})
+		require.NoError(t, err)
+		archivePath := filepath.Join(t.TempDir(), "small.nsm")
+		_, err = engine.Create(archivePath, []string{root})
+		require.NoError(t, err)
+		info, err := os.Stat(archivePath)
+		require.NoError(t, err)
+		return archivePath, info.Size()
+	}
+
+	_, perFileSize := create(false)
+	archivePath, groupedSize := create(true)
+	assert.Less(t, groupedSize, perFileSize*2/3, "Grouping should save the per-frame overhead")
+
+	_, idx := readArchiveIndex(t, archivePath)
+	assert.NotZero(t, idx.Files[name+"/f0000.conf"].Group, "Tiny files should be grouped")
+	assert.Zero(t, idx.Files[name+"/large.bin"].Group, "Large files should keep their own frame")
+
+	engine, _ := setupTestEngine(t, 0)
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+	for _, i := range []int{0, 1, 500, 999} {
+		data, err := os.ReadFile(filepath.Join(dest, name, fmt.Sprintf("f%04d.conf", i)))
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("config entry %d: enabled=true\n", i), string(data))
+	}
+	data, err := os.ReadFile(filepath.Join(dest, name, "large.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, large, data)
+	require.NoError(t, engine.Verify(archivePath))
+}
+
+// corruptEntry flips a byte in the middle of a file's compressed frame.
+func corruptEntry(t *testing.T, archivePath, path string) {
+	_, idx := readArchiveIndex(t, archivePath)
+	entry, ok := idx.Files[path]
+	require.True(t, ok, "no entry %s", path)
+
+	f, err := os.OpenFile(archivePath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	pos := core.HeaderSize + entry.Offset + entry.CompressedSize/2
+	buf := make([]byte, 1)
+	_, err = f.ReadAt(buf, pos)
+	require.NoError(t, err)
+	buf[0] ^= 0xFF
+	_, err = f.WriteAt(buf, pos)
+	require.NoError(t, err)
+}
+
+// TestVerifyDetailedJSON verifies that the JSON verification result marks the corrupted
+// file as failed and the others as intact.
+func TestVerifyDetailedJSON(t *testing.T) {
+	engine, _ := setupTestEngine(t, 5)
+	root := createTestTree(t, "a.txt", "b.txt", "c.txt")
+	archivePath := filepath.Join(t.TempDir(), "verify.nsm")
+	_, err := engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+	require.NoError(t, engine.Verify(archivePath))
+
+	corrupted := filepath.Base(root) + "/b.txt"
+	corruptEntry(t, archivePath, corrupted)
+	err = engine.Verify(archivePath)
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrChecksumMismatch, coreErr.Code)
+	assert.Contains(t, err.Error(), "first "+corrupted, "the first failing file is named")
+
+	result, err := engine.VerifyDetailed(archivePath)
+	require.NoError(t, err)
+	data, err := json.Marshal(result)
+	require.NoError(t, err)
+
+	var decoded struct {
+		OK         bool `json:"ok"`
+		ChecksumOK bool `json:"checksum_ok"`
+		Files      []struct {
+			Path  string `json:"path"`
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		} `json:"files"`
+		BytesVerified int64 `json:"bytes_verified"`
+	}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.False(t, decoded.OK)
+	assert.False(t, decoded.ChecksumOK)
+	require.Len(t, decoded.Files, 3)
+	for _, f := range decoded.Files {
+		if f.Path == corrupted {
+			assert.False(t, f.OK, "The corrupted file should be marked as failed")
+			assert.NotEmpty(t, f.Error)
+		} else {
+			assert.True(t, f.OK, "%s should verify", f.Path)
+			assert.Empty(t, f.Error)
+		}
+	}
+	assert.Equal(t, int64(len("content of a.txt")+len("content of c.txt")), decoded.BytesVerified)
+}
+
+// TestStoreExtensions verifies that files with an already-compressed extension are
+// stored as is under the default list, while other files are compressed.
+func TestStoreExtensions(t *testing.T) {
+	root := t.TempDir()
+	content := bytes.Repeat([]byte("highly repetitive content "), 200)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "clip.MP4"), content, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "notes.txt"), content, 0644))
+	name := filepath.Base(root)
+
+	create := func(cfg *core.Config) *core.Index {
+		cfg.Tokens = core.NoopTokenSource{}
+		engine, err := core.NewEngine(cfg)
+		require.NoError(t, err)
+		archivePath := filepath.Join(t.TempDir(), "media.nsm")
+		_, err = engine.Create(archivePath, []string{root})
+		require.NoError(t, err)
+
+		dest := t.TempDir()
+		require.NoError(t, engine.Extract(archivePath, dest))
+		data, err := os.ReadFile(filepath.Join(dest, name, "clip.MP4"))
+		require.NoError(t, err)
+		assert.Equal(t, content, data)
+
+		_, idx := readArchiveIndex(t, archivePath)
+		return idx
+	}
+
+	idx := create(&core.Config{})
+	video, text := idx.Files[name+"/clip.MP4"], idx.Files[name+"/notes.txt"]
+	assert.NotZero(t, video.Compression, "The video should record its own algorithm")
+	assert.Equal(t, video.UncompressedSize, video.CompressedSize, "The video should be stored")
+	assert.Zero(t, text.Compression, "The text file should use the archive's algorithm")
+	assert.Less(t, text.CompressedSize, text.UncompressedSize, "The text file should be compressed")
+
+	idx = create(&core.Config{StoreExtensions: []string{}, ExtraStoreExtensions: []string{"txt"}})
+	video, text = idx.Files[name+"/clip.MP4"], idx.Files[name+"/notes.txt"]
+	assert.Less(t, video.CompressedSize, video.UncompressedSize, "An empty list should compress the video")
+	assert.Equal(t, text.UncompressedSize, text.CompressedSize, "An extra extension should be stored")
+}
+
+// pipeFile streams data through an io.Pipe, so the reader can't seek.
+func pipeFile(data []byte) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := pw.Write(data)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// TestVerifyStream verifies that an archive piped through the streaming validator
+// passes intact and fails when corrupted or truncated.
+func TestVerifyStream(t *testing.T) {
+	engine, _ := setupTestEngine(t, 5)
+	root := createTestTree(t, "a.txt", "b.txt", "c.txt")
+	archivePath := filepath.Join(t.TempDir(), "stream.nsm")
+	_, err := engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+	data, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+
+	require.NoError(t, engine.VerifyStream(pipeFile(data)), "An intact archive should verify")
+
+	header, idx := readArchiveIndex(t, archivePath)
+	entry := idx.Files[filepath.Base(root)+"/b.txt"]
+	corrupted := append([]byte(nil), data...)
+	corrupted[core.HeaderSize+entry.Offset+entry.CompressedSize/2] ^= 0xFF
+	err = engine.VerifyStream(pipeFile(corrupted))
+	require.Error(t, err)
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrChecksumMismatch, coreErr.Code)
+
+	truncated := data[:header.IndexOffset+header.IndexLength/2]
+	assert.Error(t, engine.VerifyStream(pipeFile(truncated)), "A truncated index should be detected")
+
+	trailing := append(append([]byte(nil), data...), "junk"...)
+	assert.Error(t, engine.VerifyStream(pipeFile(trailing)), "Trailing data should be detected")
+}
+
+// dirWatchingReader streams data and records the entries of dir once it reaches EOF.
+type dirWatchingReader struct {
+	r       io.Reader
+	dir     string
+	entries []string
+}
+
+func (d *dirWatchingReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err == io.EOF && d.entries == nil {
+		list, _ := os.ReadDir(d.dir)
+		d.entries = []string{}
+		for _, e := range list {
+			d.entries = append(d.entries, e.Name())
+		}
+	}
+	return n, err
+}
+
+// TestCreateFromReaderUsesTempDir verifies that streamed input is buffered in the
+// configured temp directory and that the buffer is removed on success and on failure.
+func TestCreateFromReaderUsesTempDir(t *testing.T) {
+	tempDir := t.TempDir()
+	tokens := &mockTokenSource{available: 5}
+	engine, err := core.NewEngine(&core.Config{Tokens: tokens, TempDir: tempDir})
+	require.NoError(t, err)
+
+	content := bytes.Repeat([]byte("streamed input "), 1000)
+	src := &dirWatchingReader{r: bytes.NewReader(content), dir: tempDir}
+	archivePath := filepath.Join(t.TempDir(), "stream.nsm")
+	_, err = engine.CreateFromReader(archivePath, "data/stream.txt", src)
+	require.NoError(t, err)
+	assert.Len(t, src.entries, 1, "The stream should be buffered in the configured temp dir")
+
+	left, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, left, "The temp buffer should be removed after create")
+
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+	data, err := os.ReadFile(filepath.Join(dest, "data", "stream.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	badOutput := filepath.Join(t.TempDir(), "missing", "stream.nsm")
+	_, err = engine.CreateFromReader(badOutput, "stream.txt", bytes.NewReader(content))
+	require.Error(t, err)
+	left, err = os.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, left, "The temp buffer should be removed when create fails")
+	assert.Equal(t, 4, tokens.Available(), "A failed create should be refunded")
+}
+
+// readArchiveIndex decodes the header and index of an archive for inspection in tests.
+func readArchiveIndex(t *testing.T, archivePath string) (*core.Header, *core.Index) {
+	f, err := os.Open(archivePath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	header, err := core.ReadHeader(f)
+	require.NoError(t, err)
+	_, err = f.Seek(header.IndexOffset, io.SeekStart)
+	require.NoError(t, err)
+	idx, err := core.ReadIndex(io.LimitReader(f, header.IndexLength), header)
+	require.NoError(t, err)
+	return header, idx
+}
+
+// TestWindowLog verifies that a larger zstd window finds repetitions further apart than
+// the default window, and that the archive records it and still extracts.
+func TestWindowLog(t *testing.T) {
+	// A random block repeated at a distance beyond the default 8 MiB window.
+	block := make([]byte, 9<<20)
+	_, err := rand.Read(block)
+	require.NoError(t, err)
+	data := append(append([]byte{}, block...), block...)
+	inputPath := filepath.Join(t.TempDir(), "repeated.bin")
+	require.NoError(t, os.WriteFile(inputPath, data, 0644))
+
+	create := func(windowLog int) (string, int64) {
+		engine, err := core.NewEngine(&core.Config{
+			Tokens:      core.NoopTokenSource{},
+			SearchIndex: core.SearchIndexNone,
+			WindowLog:   windowLog,
+		})
+		require.NoError(t, err)
+		archivePath := filepath.Join(t.TempDir(), "window.nsm")
+		_, err = engine.Create(archivePath, []string{inputPath})
+		require.NoError(t, err)
+		info, err := os.Stat(archivePath)
+		require.NoError(t, err)
+		return archivePath, info.Size()
+	}
+
+	_, defaultSize := create(0)
+	archivePath, largeSize := create(25)
+	assert.Less(t, largeSize, defaultSize*2/3, "A 32 MiB window should find the repeated block")
+
+	header, _ := readArchiveIndex(t, archivePath)
+	assert.Equal(t, uint8(25), header.WindowLog)
+
+	engine, _ := setupTestEngine(t, 0)
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+	extracted, err := os.ReadFile(filepath.Join(dest, "repeated.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, extracted), "Extracted data should match the input")
+
+	for _, invalid := range []int{core.MinWindowLog - 1, core.MaxWindowLog + 1} {
+		engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, WindowLog: invalid})
+		require.NoError(t, err)
+		_, err = engine.Create(filepath.Join(t.TempDir(), "invalid.nsm"), []string{inputPath})
+		assert.Error(t, err, "Window log %d should be rejected", invalid)
+	}
+}
+
+// TestLongDistance verifies that long-distance matching finds a block repeated further
+// apart than the default window, and that the archive records it.
+func TestLongDistance(t *testing.T) {
+	// A block, 8 MiB of unrelated data, then the block again.
+	block := make([]byte, 3<<20)
+	filler := make([]byte, 8<<20)
+	_, err := rand.Read(block)
+	require.NoError(t, err)
+	_, err = rand.Read(filler)
+	require.NoError(t, err)
+	data := bytes.Join([][]byte{block, filler, block}, nil)
+	inputPath := filepath.Join(t.TempDir(), "distant.bin")
+	require.NoError(t, os.WriteFile(inputPath, data, 0644))
+
+	create := func(long bool) (string, int64) {
+		engine, err := core.NewEngine(&core.Config{
+			Tokens:       core.NoopTokenSource{},
+			SearchIndex:  core.SearchIndexNone,
+			LongDistance: long,
+		})
+		require.NoError(t, err)
+		archivePath := filepath.Join(t.TempDir(), "long.nsm")
+		_, err = engine.Create(archivePath, []string{inputPath})
+		require.NoError(t, err)
+		info, err := os.Stat(archivePath)
+		require.NoError(t, err)
+		return archivePath, info.Size()
+	}
+
+	_, defaultSize := create(false)
+	archivePath, longSize := create(true)
+	assert.Less(t, longSize, defaultSize-int64(len(block))*9/10, "Long-distance matching should find the repeated block")
+
+	header, _ := readArchiveIndex(t, archivePath)
+	assert.NotZero(t, header.Flags&core.FlagLongDistance)
+	assert.Equal(t, uint8(core.LongWindowLog), header.WindowLog)
+
+	engine, _ := setupTestEngine(t, 0)
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+	extracted, err := os.ReadFile(filepath.Join(dest, "distant.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, extracted), "Extracted data should match the input")
+}
+
+// TestExtractToTar verifies that an archive streams out as a tar with the files'
+// contents, modes and modification times, and its empty directories.
+func TestExtractToTar(t *testing.T) {
+	root := t.TempDir()
+	modTime := time.Date(2023, 5, 17, 10, 30, 0, 123456789, time.UTC)
+	files := map[string]struct {
+		content string
+		mode    os.FileMode
+	}{
+		"readme.txt":     {"hello tar\n", 0644},
+		"bin/run.sh":     {"#!/bin/sh\necho run\n", 0755},
+		"data/empty.dat": {"", 0600},
+	}
+	for name, f := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(f.content), f.mode))
+		require.NoError(t, os.Chmod(p, f.mode))
+		require.NoError(t, os.Chtimes(p, modTime, modTime))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(root, "logs"), 0755))
+	engine, _ := setupTestEngine(t, 1)
+	archivePath := filepath.Join(t.TempDir(), "tar.nsm")
+	_, err := engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, engine.ExtractToTar(archivePath, &buf))
+
+	prefix := filepath.Base(root) + "/"
+	seen := map[string]bool{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		name := strings.TrimPrefix(hdr.Name, prefix)
+		if hdr.Typeflag == tar.TypeDir {
+			assert.Equal(t, "logs/", name, "only empty directories get an entry")
+			seen[name] = true
+			continue
+		}
+		want, ok := files[name]
+		require.True(t, ok, "unexpected tar entry %s", hdr.Name)
+		seen[name] = true
+
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		assert.Equal(t, want.content, string(data), name)
+		assert.Equal(t, int64(want.mode), hdr.Mode, name)
+		assert.True(t, modTime.Equal(hdr.ModTime), "%s: mod time %v", name, hdr.ModTime)
+	}
+	assert.Len(t, seen, len(files)+1)
+}
+
+// TestCreateFromArchive verifies that tar, tar.gz and zip archives are re-packed with
+// their paths, contents, modes, modification times and empty directories.
+func TestCreateFromArchive(t *testing.T) {
+	modTime := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	files := []struct {
+		name    string
+		content string
+		mode    int64
+	}{
+		{"docs/readme.txt", "imported readme\n", 0644},
+		{"bin/run.sh", "#!/bin/sh\necho run\n", 0755},
+		{"data/empty.dat", "", 0600},
+		{"data/stale.txt", "overwritten by the copy below", 0644},
+		{"data/stale.txt", "last copy wins", 0640},
+	}
+	want := map[string]string{
+		"docs/readme.txt": "imported readme\n",
+		"bin/run.sh":      "#!/bin/sh\necho run\n",
+		"data/empty.dat":  "",
+		"data/stale.txt":  "last copy wins",
+	}
+	wantModes := map[string]os.FileMode{"docs/readme.txt": 0644, "bin/run.sh": 0755, "data/empty.dat": 0600, "data/stale.txt": 0640}
+
+	writeTar := func(w io.Writer) {
+		tw := tar.NewWriter(w)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./logs/", Mode: 0755, ModTime: modTime}))
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "docs/readme.txt", ModTime: modTime}))
+		for _, f := range files {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./" + f.name, Size: int64(len(f.content)), Mode: f.mode, ModTime: modTime}))
+			_, err := tw.Write([]byte(f.content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+	}
+	sources := map[string]func(w io.Writer){
+		"backup.tar": writeTar,
+		"backup.tgz": func(w io.Writer) {
+			zw := gzip.NewWriter(w)
+			writeTar(zw)
+			require.NoError(t, zw.Close())
+		},
+		"backup.zip": func(w io.Writer) {
+			zw := zip.NewWriter(w)
+			_, err := zw.CreateHeader(&zip.FileHeader{Name: "logs/", Modified: modTime})
+			require.NoError(t, err)
+			for _, f := range files[:4] {
+				if f.name == "data/stale.txt" {
+					f = files[4]
+				}
+				hdr := &zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: modTime}
+				hdr.SetMode(os.FileMode(f.mode))
+				fw, err := zw.CreateHeader(hdr)
+				require.NoError(t, err)
+				_, err = fw.Write([]byte(f.content))
+				require.NoError(t, err)
+			}
+			require.NoError(t, zw.Close())
+		},
+	}
+
+	for name, write := range sources {
+		name, write := name, write
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			write(&buf)
+			source := filepath.Join(t.TempDir(), name)
+			require.NoError(t, os.WriteFile(source, buf.Bytes(), 0644))
+
+			// Several workers would read a tar file out of order if it were compressed ahead.
+			engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, CompressionWorkers: 4})
+			require.NoError(t, err)
+			archivePath := filepath.Join(t.TempDir(), "imported.nsm")
+			_, err = engine.CreateFromArchive(archivePath, source)
+			require.NoError(t, err)
+
+			_, idx := readArchiveIndex(t, archivePath)
+			assert.Len(t, idx.Files, len(want))
+			assert.Equal(t, []string{"logs"}, idx.EmptyDirs)
+
+			dest := t.TempDir()
+			require.NoError(t, engine.Extract(archivePath, dest))
+			for path, content := range want {
+				p := filepath.Join(dest, filepath.FromSlash(path))
+				data, err := os.ReadFile(p)
+				require.NoError(t, err)
+				assert.Equal(t, content, string(data), path)
+				info, err := os.Stat(p)
+				require.NoError(t, err)
+				assert.Equal(t, wantModes[path], info.Mode().Perm(), path)
+				assert.True(t, modTime.Equal(info.ModTime()), "%s: mod time %v", path, info.ModTime())
+			}
+			assert.DirExists(t, filepath.Join(dest, "logs"))
+		})
+	}
+
+	t.Run("unsafe path", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "../escape.txt", Mode: 0644}))
+		require.NoError(t, tw.Close())
+		source := filepath.Join(t.TempDir(), "evil.tar")
+		require.NoError(t, os.WriteFile(source, buf.Bytes(), 0644))
+
+		engine, tokens := setupTestEngine(t, 1)
+		_, err := engine.CreateFromArchive(filepath.Join(t.TempDir(), "evil.nsm"), source)
+		var coreErr *core.CoreError
+		require.ErrorAs(t, err, &coreErr)
+		assert.Equal(t, core.ErrInvalidInput, coreErr.Code)
+		assert.Equal(t, 0, tokens.consumed, "a rejected import should not cost a token")
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		source := filepath.Join(t.TempDir(), "notes.txt")
+		require.NoError(t, os.WriteFile(source, []byte("not an archive"), 0644))
+		engine, _ := setupTestEngine(t, 1)
+		_, err := engine.CreateFromArchive(filepath.Join(t.TempDir(), "out.nsm"), source)
+		var coreErr *core.CoreError
+		require.ErrorAs(t, err, &coreErr)
+		assert.Equal(t, core.ErrInvalidInput, coreErr.Code)
+	})
+}
+
+func TestCompareDirectory(t *testing.T) {
+	root := createTestTree(t, "a.txt", "b.txt", "sub/c.txt", "sub/d.txt")
+	engine, _ := setupTestEngine(t, 1)
+	archivePath := filepath.Join(t.TempDir(), "compare.nsm")
+	_, err := engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+	result, err := engine.Compare(archivePath, dest)
+	require.NoError(t, err)
+	assert.True(t, result.Equal())
+	assert.Equal(t, 4, result.Matching)
+
+	base := filepath.Join(dest, filepath.Base(root))
+	// Same size, different content: only the checksum can tell them apart.
+	require.NoError(t, os.WriteFile(filepath.Join(base, "a.txt"), []byte("CONTENT OF a.txt"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "sub", "c.txt"), []byte("longer content of sub/c.txt"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(base, "b.txt")))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "new.txt"), []byte("new"), 0644))
+
+	result, err = engine.Compare(archivePath, dest)
+	require.NoError(t, err)
+	prefix := filepath.Base(root) + "/"
+	assert.False(t, result.Equal())
+	assert.Equal(t, []string{prefix + "b.txt"}, result.Missing)
+	assert.Equal(t, []string{prefix + "new.txt"}, result.Extra)
+	assert.Equal(t, []core.FileDifference{
+		{Path: prefix + "a.txt", Reason: core.DiffContent},
+		{Path: prefix + "sub/c.txt", Reason: core.DiffSize},
+	}, result.Differing)
+	assert.Equal(t, 1, result.Matching)
+}
+
+// TestCompressionMemoryBudget verifies that compressions whose estimated memory exceeds
+// the budget are queued instead of all running at once, and run once memory is freed.
+func TestCompressionMemoryBudget(t *testing.T) {
+	perJob := core.EstimateCompressionMemory(core.ZSTD, core.CompressOptions{})
+	c := core.NewCompressor()
+	c.SetMemoryBudget(perJob*2 + perJob/2) // Room for two jobs.
+
+	const jobs = 4
+	writers := make([]*io.PipeWriter, jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		r, w := io.Pipe()
+		writers[i] = w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.Compress(io.Discard, r, core.ZSTD)
+			assert.NoError(t, err)
+		}()
+	}
+
+	// The first two jobs block reading their input while holding their memory.
+	require.Eventually(t, func() bool {
+		reserved, queued := c.MemoryUsage()
+		return reserved == 2*perJob && queued == jobs-2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, w := range writers {
+		w.Close()
+	}
+	wg.Wait()
+	reserved, queued := c.MemoryUsage()
+	assert.Zero(t, reserved)
+	assert.Zero(t, queued)
+}
+
+// TestExtractLimits verifies that extraction aborts, without leaving a partial file
+// behind, when an archive expands beyond the configured size or ratio limits.
+func TestExtractLimits(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "zeros.dat")
+	require.NoError(t, os.WriteFile(src, make([]byte, 8<<20), 0644))
+	engine, _ := setupTestEngine(t, 1)
+	archivePath := filepath.Join(t.TempDir(), "bomb.nsm")
+	_, err := engine.Create(archivePath, []string{src})
+	require.NoError(t, err)
+
+	for name, cfg := range map[string]core.Config{
+		"ratio": {MaxExtractRatio: 100},
+		"size":  {MaxExtractSize: 4 << 20},
+	} {
+		t.Run(name, func(t *testing.T) {
+			limited, err := core.NewEngine(&cfg)
+			require.NoError(t, err)
+			dest := t.TempDir()
+			err = limited.Extract(archivePath, dest)
+			var coreErr *core.CoreError
+			require.ErrorAs(t, err, &coreErr)
+			assert.Equal(t, core.ErrLimitExceeded, coreErr.Code)
+			assert.NoFileExists(t, filepath.Join(dest, "zeros.dat"))
+		})
+	}
+
+	relaxed, err := core.NewEngine(&core.Config{MaxExtractRatio: 1e6, MaxExtractSize: 16 << 20})
+	require.NoError(t, err)
+	dest := t.TempDir()
+	require.NoError(t, relaxed.Extract(archivePath, dest))
+	assert.FileExists(t, filepath.Join(dest, "zeros.dat"))
+}
+
+// slowWriter simulates a slow downstream consumer by pausing on every write.
+type slowWriter struct {
+	w     io.Writer
+	delay time.Duration
+}
+
+func (s *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.w.Write(p)
+}
+
+// TestAdaptiveCompression verifies that adaptive compression lowers the zstd level
+// while the output can't keep up with the target rate, keeps it when it can, and that
+// the varying frames decompress as one stream.
+func TestAdaptiveCompression(t *testing.T) {
+	data := make([]byte, 4<<20)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	c := core.NewCompressor()
+
+	var out bytes.Buffer
+	slow := &slowWriter{w: &out, delay: 2 * time.Millisecond}
+	_, levels, err := c.CompressAdaptive(slow, bytes.NewReader(data), core.CompressOptions{Level: 10}, 1e9)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 3, 6, 10}, levels, "the level should step down on every chunk")
+
+	var restored bytes.Buffer
+	_, err = c.Decompress(&restored, &out, core.ZSTD)
+	require.NoError(t, err)
+	assert.Equal(t, data, restored.Bytes())
+
+	_, levels, err = c.CompressAdaptive(io.Discard, bytes.NewReader(data), core.CompressOptions{Level: 10}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{10}, levels, "the level should stay put when the target is met")
+
+	// Archives record the levels they were compressed with.
+	inputPath, _ := createTestFile(t, 3<<20)
+	engine, err := core.NewEngine(&core.Config{Tokens: &mockTokenSource{available: 1}, CompressionLevel: 6, TargetRate: 1e15})
+	require.NoError(t, err)
+	archivePath := filepath.Join(t.TempDir(), "adaptive.nsm")
+	_, err = engine.Create(archivePath, []string{inputPath})
+	require.NoError(t, err)
+	_, idx := readArchiveIndex(t, archivePath)
+	assert.Equal(t, []int{1, 3, 6}, idx.Metadata.Levels)
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+
+	engine, err = core.NewEngine(&core.Config{Tokens: &mockTokenSource{available: 1}, TargetRate: 1e6, Reproducible: true})
+	require.NoError(t, err)
+	_, err = engine.Create(filepath.Join(t.TempDir(), "reproducible.nsm"), []string{inputPath})
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrInvalidInput, coreErr.Code)
+}
+
+// TestCompressorStats verifies that compressions and decompressions are counted with
+// the bytes they read and wrote, failed calls included.
+func TestCompressorStats(t *testing.T) {
+	c := core.NewCompressor()
+	assert.Equal(t, core.CompressorStats{}, c.Stats())
+	assert.Zero(t, c.Stats().CompressThroughput())
+
+	data := bytes.Repeat([]byte("throughput "), 10000)
+	var compressed bytes.Buffer
+	n, err := c.Compress(&compressed, bytes.NewReader(data), core.ZSTD)
+	require.NoError(t, err)
+	frame := compressed.Bytes()
+	_, err = c.Decompress(io.Discard, bytes.NewReader(frame), core.ZSTD)
+	require.NoError(t, err)
+	_, err = c.Decompress(io.Discard, strings.NewReader("not zstd"), core.ZSTD)
+	require.Error(t, err)
+
+	stats := c.Stats()
+	assert.EqualValues(t, 1, stats.Compress.Calls)
+	assert.Zero(t, stats.Compress.Errors)
+	assert.EqualValues(t, len(data), stats.Compress.BytesIn)
+	assert.Equal(t, n, stats.Compress.BytesOut)
+	assert.Positive(t, stats.Compress.Duration)
+	assert.Positive(t, stats.CompressThroughput())
+
+	assert.EqualValues(t, 2, stats.Decompress.Calls)
+	assert.EqualValues(t, 1, stats.Decompress.Errors)
+	assert.GreaterOrEqual(t, stats.Decompress.BytesIn, int64(len(frame)))
+	assert.EqualValues(t, len(data), stats.Decompress.BytesOut)
+	assert.Positive(t, stats.DecompressThroughput())
+
+	// The engine reports the statistics of its own compressor.
+	engine, _ := setupTestEngine(t, 1)
+	root := createTestTree(t, "a.txt")
+	_, err = engine.Create(filepath.Join(t.TempDir(), "stats.nsm"), []string{root})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, engine.CompressorStats().Compress.Calls)
+}
+
+// TestCompressionLevel verifies that the configured level is parsed from preset names,
+// recorded in the header, and that a higher level compresses at least as well.
+func TestCompressionLevel(t *testing.T) {
+	level, err := core.ParseCompressionLevel("best")
+	require.NoError(t, err)
+	assert.Equal(t, 11, level)
+	level, err = core.ParseCompressionLevel("5")
+	require.NoError(t, err)
+	assert.Equal(t, 5, level)
+	_, err = core.ParseCompressionLevel("slowest")
+	assert.Error(t, err)
+
+	root := t.TempDir()
+	inputPath := filepath.Join(root, "log.txt")
+	var content strings.Builder
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&content, "%d GET /api/items/%d 200 %dms\n", i, i%97, i%13)
+	}
+	require.NoError(t, os.WriteFile(inputPath, []byte(content.String()), 0644))
+
+	sizes := map[int]int64{}
+	for _, name := range []string{"fastest", "best"} {
+		level, err := core.ParseCompressionLevel(name)
+		require.NoError(t, err)
+		engine, err := core.NewEngine(&core.Config{Tokens: &mockTokenSource{available: 1}, CompressionLevel: level})
+		require.NoError(t, err)
+		archivePath := filepath.Join(t.TempDir(), name+".nsm")
+		_, err = engine.Create(archivePath, []string{inputPath})
+		require.NoError(t, err)
+
+		header, idx := readArchiveIndex(t, archivePath)
+		assert.EqualValues(t, level, header.Level)
+		sizes[level] = idx.Files["log.txt"].CompressedSize
+		dest := t.TempDir()
+		require.NoError(t, engine.Extract(archivePath, dest))
+		data, err := os.ReadFile(filepath.Join(dest, "log.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, content.String(), string(data))
+	}
+	assert.LessOrEqual(t, sizes[11], sizes[1])
+}
+
+// TestProgressCallbacks verifies that Create and Extract report their progress against
+// the total size of the files, ending with everything processed.
+func TestProgressCallbacks(t *testing.T) {
+	root := createTestTree(t, "a.txt", "dir/b.txt")
+	large := bytes.Repeat([]byte("progress "), 100000)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "large.log"), large, 0644))
+	total := int64(len("content of a.txt") + len("content of dir/b.txt") + len(large))
+
+	type report struct{ done, total int64 }
+	var reports []report
+	engine, err := core.NewEngine(&core.Config{
+		Tokens:   core.NoopTokenSource{},
+		Progress: func(done, total int64) { reports = append(reports, report{done, total}) },
+	})
+	require.NoError(t, err)
+	checkReports := func(op string) {
+		require.NotEmpty(t, reports, op)
+		assert.Equal(t, report{total, total}, reports[len(reports)-1], op)
+		for i := 1; i < len(reports); i++ {
+			assert.LessOrEqual(t, reports[i-1].done, reports[i].done, op)
+		}
+		reports = nil
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "progress.nsm")
+	_, err = engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+	checkReports("create")
+	require.NoError(t, engine.Extract(archivePath, t.TempDir()))
+	checkReports("extract")
+
+	// The callback is optional.
+	plain, _ := setupTestEngine(t, 1)
+	_, err = plain.Create(filepath.Join(t.TempDir(), "plain.nsm"), []string{root})
+	require.NoError(t, err)
+}
+
+// TestWatchSkipsTouchedFiles verifies that watching rebuilds the archive when a file's
+// content changes, but not when a file is only touched.
+func TestWatchSkipsTouchedFiles(t *testing.T) {
+	root := createTestTree(t, "a.txt", "sub/b.txt")
+	engine, tokens := setupTestEngine(t, 10)
+	archivePath := filepath.Join(t.TempDir(), "watched.nsm")
+
+	rebuilt, err := engine.WatchOnce(archivePath, []string{root})
+	require.NoError(t, err)
+	assert.True(t, rebuilt, "the first check should build the archive")
+	assert.FileExists(t, archivePath+core.WatchCacheExtension)
+	built, err := os.Stat(archivePath)
+	require.NoError(t, err)
+
+	rebuilt, err = engine.WatchOnce(archivePath, []string{root})
+	require.NoError(t, err)
+	assert.False(t, rebuilt)
+
+	// Touched, same content.
+	target := filepath.Join(root, "sub", "b.txt")
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(target, later, later))
+	rebuilt, err = engine.WatchOnce(archivePath, []string{root})
+	require.NoError(t, err)
+	assert.False(t, rebuilt, "touching a file should not rebuild the archive")
+	info, err := os.Stat(archivePath)
+	require.NoError(t, err)
+	assert.Equal(t, built.ModTime(), info.ModTime())
+	assert.Equal(t, 9, tokens.Available())
+
+	// Edited.
+	require.NoError(t, os.WriteFile(target, []byte("new content of sub/b.txt"), 0644))
+	rebuilt, err = engine.WatchOnce(archivePath, []string{root})
+	require.NoError(t, err)
+	assert.True(t, rebuilt, "an edit should rebuild the archive")
+	assert.Equal(t, 8, tokens.Available())
+
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+	data, err := os.ReadFile(filepath.Join(dest, filepath.Base(root), "sub", "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "new content of sub/b.txt", string(data))
+}
+
+// TestCreateJob verifies that a create job streams one complete result per file and
+// reports the outcome once the archive is written.
+func TestCreateJob(t *testing.T) {
+	root := t.TempDir()
+	sizes := map[string]int{"a.txt": 10 << 10, "b.txt": 20 << 10, "c.jpg": 5 << 10}
+	var inputs []string
+	for name, size := range sizes {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.WriteFile(path, bytes.Repeat([]byte(name), size/len(name)), 0644))
+		inputs = append(inputs, path)
+	}
+	engine, tokens := setupTestEngine(t, 1)
+	archivePath := filepath.Join(t.TempDir(), "job.nsm")
+
+	results, done := engine.CreateJob(context.Background(), core.CreateSpec{OutputFile: archivePath, Inputs: inputs})
+	got := make(map[string]core.FileResult)
+	for r := range results {
+		got[r.Path] = r
+	}
+	require.NoError(t, <-done)
+	assert.Equal(t, 0, tokens.Available())
+
+	entries, err := engine.List(archivePath)
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	for _, entry := range entries {
+		r, ok := got[entry.Path]
+		require.True(t, ok, "missing result for %s", entry.Path)
+		assert.NoError(t, r.Err)
+		assert.Equal(t, entry.UncompressedSize, r.UncompressedSize)
+		assert.Equal(t, entry.CompressedSize, r.CompressedSize)
+		assert.InDelta(t, float64(entry.CompressedSize)/float64(entry.UncompressedSize), r.Ratio, 1e-9)
+	}
+	assert.Equal(t, core.ZSTD, got["a.txt"].Algorithm)
+	assert.Less(t, got["a.txt"].Ratio, 0.1)
+	assert.Equal(t, core.STORE, got["c.jpg"].Algorithm, "already-compressed files are stored")
+
+	// A cancelled job writes no archive and charges nothing.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	engine, tokens = setupTestEngine(t, 1)
+	cancelledPath := filepath.Join(t.TempDir(), "cancelled.nsm")
+	results, done = engine.CreateJob(ctx, core.CreateSpec{OutputFile: cancelledPath, Inputs: inputs})
+	for range results {
+	}
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.NoFileExists(t, cancelledPath)
+	assert.Equal(t, 1, tokens.Available())
+}
+
+// TestContextCancellation verifies that the context variants stop in the middle of a
+// file, leave nothing half-written behind and return the context's error.
+func TestContextCancellation(t *testing.T) {
+	inputPath, _ := createTestFile(t, 4<<20)
+
+	// The first progress report cancels the create while the file is being compressed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tokens := &mockTokenSource{available: 1}
+	engine, err := core.NewEngine(&core.Config{
+		Tokens:   tokens,
+		Progress: func(done, total int64) { cancel() },
+	})
+	require.NoError(t, err)
+	archivePath := filepath.Join(t.TempDir(), "cancelled.nsm")
+	_, err = engine.CreateContext(ctx, archivePath, []string{inputPath})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NoFileExists(t, archivePath)
+	assert.Equal(t, 1, tokens.Available())
+
+	engine, _ = setupTestEngine(t, 1)
+	_, err = engine.CreateContext(context.Background(), archivePath, []string{inputPath})
+	require.NoError(t, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	engine, err = core.NewEngine(&core.Config{Progress: func(done, total int64) { cancel() }})
+	require.NoError(t, err)
+	dest := t.TempDir()
+	assert.ErrorIs(t, engine.ExtractContext(ctx, archivePath, dest), context.Canceled)
+	assert.NoFileExists(t, filepath.Join(dest, "testfile.dat"), "the partial file is removed")
+
+	// Archives without a search index are scanned, which stops between files.
+	searchArchive := createSearchArchive(t, core.SearchIndexNone)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = engine.SearchContext(cancelled, searchArchive, "report")
+	assert.ErrorIs(t, err, context.Canceled)
+	results, _, err := engine.SearchContext(context.Background(), searchArchive, "report")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"notes.txt", "todo.txt"}, resultPaths(results))
+}
+
+// TestExtractChecksumMismatch verifies that a file whose content no longer matches its
+// recorded checksum fails extraction, even when its frame still decodes.
+func TestExtractChecksumMismatch(t *testing.T) {
+	// Stored frames have no checksum of their own, so corruption decodes silently.
+	engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, DefaultAlgo: string(core.STORE)})
+	require.NoError(t, err)
+	root := createTestTree(t, "a.txt", "b.txt")
+	archivePath := filepath.Join(t.TempDir(), "stored.nsm")
+	_, err = engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+	base := filepath.Base(root)
+	corruptEntry(t, archivePath, base+"/b.txt")
+
+	dest := t.TempDir()
+	err = engine.Extract(archivePath, dest)
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrChecksumMismatch, coreErr.Code)
+	assert.Contains(t, err.Error(), base+"/b.txt")
+	assert.NoFileExists(t, filepath.Join(dest, base, "b.txt"), "the corrupted file is removed")
+
+	require.NoError(t, engine.ExtractFile(archivePath, base+"/a.txt", filepath.Join(dest, "a.txt")))
+}
+
+// TestExtractFile verifies that a single file is extracted without reading the others,
+// and that a missing path is reported as such.
+func TestExtractFile(t *testing.T) {
+	engine, _ := setupTestEngine(t, 1)
+	root := createTestTree(t, "a.txt", "sub/b.txt")
+	archivePath := filepath.Join(t.TempDir(), "single.nsm")
+	_, err := engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+	base := filepath.Base(root)
+	// Only the requested file's data may be read.
+	corruptEntry(t, archivePath, base+"/a.txt")
+
+	dst := filepath.Join(t.TempDir(), "out", "b.txt")
+	require.NoError(t, engine.ExtractFile(archivePath, base+"/sub/b.txt", dst))
+	data, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "content of sub/b.txt", string(data))
+	entries, err := os.ReadDir(filepath.Dir(dst))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	err = engine.ExtractFile(archivePath, base+"/missing.txt", filepath.Join(t.TempDir(), "missing.txt"))
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrFileNotFound, coreErr.Code)
+}
+
+// TestDictionaryCompression verifies that a trained dictionary shrinks archives of many
+// small similar files, is stored in the archive, and is used to read it back.
+func TestDictionaryCompression(t *testing.T) {
+	root := t.TempDir()
+	var inputs []string
+	contents := map[string]string{}
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("event-%03d.json", i)
+		content := fmt.Sprintf(`{"id": %d, "type": "order.created", "source": "checkout-service", "customer": {"name": "customer-%d", "tier": "gold"}, "total": %d.%02d, "currency": "EUR", "status": "pending"}`+"\n", i, i%17, i*7, i%100)
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(content), 0644))
+		inputs = append(inputs, filepath.Join(root, name))
+		contents[name] = content
+	}
+
+	plain, _ := setupTestEngine(t, 5)
+	dict, err := plain.TrainDictionary([]string{root})
+	require.NoError(t, err)
+	require.NotEmpty(t, dict)
+
+	out := t.TempDir()
+	plainPath := filepath.Join(out, "plain.nsm")
+	_, err = plain.Create(plainPath, inputs)
+	require.NoError(t, err)
+	engine, err := core.NewEngine(&core.Config{Tokens: &mockTokenSource{available: 5}, Dictionary: dict})
+	require.NoError(t, err)
+	dictPath := filepath.Join(out, "dict.nsm")
+	_, err = engine.Create(dictPath, inputs)
+	require.NoError(t, err)
+
+	header, _ := readArchiveIndex(t, dictPath)
+	assert.NotZero(t, header.Flags&core.FlagDictionary)
+	assert.EqualValues(t, len(dict), header.DictLength)
+	withDict, err := engine.Info(dictPath)
+	require.NoError(t, err)
+	withoutDict, err := engine.Info(plainPath)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(dict), withDict.DictionarySize)
+	assert.Zero(t, withoutDict.DictionarySize)
+	assert.Less(t, withDict.CompressedSize, withoutDict.CompressedSize/2, "The dictionary should shrink the data block")
+
+	// Any engine reads the dictionary from the archive; archives without one still read.
+	for _, archive := range []string{dictPath, plainPath} {
+		dest := t.TempDir()
+		require.NoError(t, plain.Extract(archive, dest))
+		for name, content := range contents {
+			data, err := os.ReadFile(filepath.Join(dest, name))
+			require.NoError(t, err)
+			require.Equal(t, content, string(data))
+		}
+		require.NoError(t, plain.Verify(archive))
+		data, err := os.ReadFile(archive)
+		require.NoError(t, err)
+		require.NoError(t, plain.VerifyStream(pipeFile(data)))
+	}
+
+	// Rewriting the archive keeps the dictionary its frames need.
+	require.NoError(t, plain.Remove(dictPath, []string{"event-000.json"}))
+	require.NoError(t, plain.Recompress(dictPath, core.ZSTD, 9))
+	header, idx := readArchiveIndex(t, dictPath)
+	assert.NotZero(t, header.Flags&core.FlagDictionary)
+	assert.Len(t, idx.Files, 299)
+	dest := t.TempDir()
+	require.NoError(t, plain.Extract(dictPath, dest))
+	data, err := os.ReadFile(filepath.Join(dest, "event-001.json"))
+	require.NoError(t, err)
+	assert.Equal(t, contents["event-001.json"], string(data))
+	require.NoError(t, plain.Recompress(dictPath, core.GZIP, 0))
+	header, _ = readArchiveIndex(t, dictPath)
+	assert.Zero(t, header.Flags&core.FlagDictionary, "Only zstd uses the dictionary")
+	require.NoError(t, plain.Verify(dictPath))
+
+	var coreErr *core.CoreError
+	_, err = plain.TrainDictionary([]string{inputs[0]})
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrInvalidInput, coreErr.Code, "One small file is too little to train on")
+	gzipEngine, err := core.NewEngine(&core.Config{Tokens: &mockTokenSource{available: 5}, Dictionary: dict, DefaultAlgo: string(core.GZIP)})
+	require.NoError(t, err)
+	_, err = gzipEngine.Create(filepath.Join(out, "gzip.nsm"), inputs)
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrInvalidInput, coreErr.Code)
+}
+
+// TestAdaptiveAlgorithm verifies that each file is compressed with the algorithm its
+// content calls for, and extracted with the one recorded for it.
+func TestAdaptiveAlgorithm(t *testing.T) {
+	random := make([]byte, 256<<10)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 5000))
+	// About 6.6 bits of entropy per byte, in 64-byte runs appearing twice: LZ4 halves
+	// it. Without the repeats, nothing shrinks it.
+	binary := make([]byte, len(random))
+	noise := make([]byte, len(random))
+	for i, b := range random {
+		binary[i] = random[i/128*64+i%64] % 100
+		noise[i] = b % 100
+	}
+
+	c := core.NewCompressor()
+	assert.Equal(t, core.STORE, c.ChooseAlgo(random[:core.AlgoSampleSize]))
+	assert.Equal(t, core.LZ4, c.ChooseAlgo(binary[:core.AlgoSampleSize]))
+	assert.Equal(t, core.STORE, c.ChooseAlgo(noise[:core.AlgoSampleSize]), "Content LZ4 can't shrink should be stored")
+	assert.Equal(t, core.ZSTD, c.ChooseAlgo(text[:core.AlgoSampleSize]))
+	assert.Equal(t, core.ZSTD, c.ChooseAlgo([]byte("tiny")), "Too small a sample keeps the default")
+
+	dir := t.TempDir()
+	contents := map[string][]byte{"random.bin": random, "binary.dat": binary, "notes.txt": text}
+	var inputs []string
+	for name, content := range contents {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, content, 0644))
+		inputs = append(inputs, path)
+	}
+	for _, workers := range []int{1, 4} {
+		engine, err := core.NewEngine(&core.Config{Tokens: &mockTokenSource{available: 5}, AdaptiveAlgo: true, CompressionWorkers: workers})
+		require.NoError(t, err)
+		archive := filepath.Join(t.TempDir(), "adaptive.nsm")
+		_, err = engine.Create(archive, inputs)
+		require.NoError(t, err)
+
+		_, idx := readArchiveIndex(t, archive)
+		codes := map[string]uint8{}
+		for _, f := range idx.Files {
+			codes[f.Path] = f.Compression
+		}
+		assert.EqualValues(t, 3, codes["random.bin"], "Random data should be stored")
+		assert.EqualValues(t, 4, codes["binary.dat"], "Binary data should use LZ4")
+		assert.EqualValues(t, 0, codes["notes.txt"], "Text should use the archive's zstd")
+
+		dest := t.TempDir()
+		require.NoError(t, engine.Extract(archive, dest))
+		for name, content := range contents {
+			data, err := os.ReadFile(filepath.Join(dest, name))
+			require.NoError(t, err)
+			assert.Equal(t, content, data, name)
+		}
+		require.NoError(t, engine.Verify(archive))
+	}
+}
+
+// TestCreateResult verifies the totals Create returns.
+func TestCreateResult(t *testing.T) {
+	root := t.TempDir()
+	content := bytes.Repeat([]byte("highly repetitive content "), 2000)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "clip.mp4"), content, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "notes.txt"), content, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "empty.txt"), nil, 0644))
+
+	engine, _ := setupTestEngine(t, 1)
+	archivePath := filepath.Join(t.TempDir(), "result.nsm")
+	result, err := engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+
+	info, err := os.Stat(archivePath)
+	require.NoError(t, err)
+	assert.Equal(t, 3, result.Files)
+	assert.EqualValues(t, 2*len(content), result.InputSize)
+	assert.Equal(t, info.Size(), result.ArchiveSize)
+	assert.InDelta(t, float64(info.Size())/float64(2*len(content)), result.Ratio, 1e-9)
+	assert.Positive(t, result.Elapsed)
+
+	stored, compressed := result.Algorithms[core.STORE], result.Algorithms[core.ZSTD]
+	assert.Equal(t, core.AlgoStats{Files: 1, UncompressedSize: int64(len(content)), CompressedSize: int64(len(content))}, stored, "The video should be stored")
+	assert.Equal(t, 2, compressed.Files)
+	assert.EqualValues(t, len(content), compressed.UncompressedSize)
+	assert.Less(t, compressed.CompressedSize, compressed.UncompressedSize/10)
+}
+
+// TestCreateFromReadersErrors verifies that invalid entries are rejected before any
+// token is consumed.
+func TestCreateFromReadersErrors(t *testing.T) {
+	engine, tokens := setupTestEngine(t, 5)
+	var coreErr *core.CoreError
+	for name, entries := range map[string]map[string]io.Reader{
+		"no entries": {},
+		"empty name": {"/": strings.NewReader("x")},
+		"duplicate":  {"a/b": strings.NewReader("x"), "/a//b": strings.NewReader("y")},
+	} {
+		var out bytes.Buffer
+		_, err := engine.CreateFromReaders(&out, entries)
+		require.ErrorAs(t, err, &coreErr, name)
+		assert.Equal(t, core.ErrInvalidInput, coreErr.Code, name)
+		assert.Zero(t, out.Len(), name)
+	}
+	assert.Equal(t, 0, tokens.consumed)
+
+	sidecar, err := core.NewEngine(&core.Config{Tokens: tokens, SearchIndex: core.SearchIndexSidecar})
+	require.NoError(t, err)
+	_, err = sidecar.CreateFromReaders(io.Discard, map[string]io.Reader{"a": strings.NewReader("a")})
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrInvalidInput, coreErr.Code)
+	assert.Equal(t, 0, tokens.consumed)
+
+	var out bytes.Buffer
+	result, err := engine.CreateFromReaders(&out, map[string]io.Reader{"a": strings.NewReader("a")})
+	require.NoError(t, err)
+	assert.EqualValues(t, out.Len(), result.ArchiveSize)
+	s, err := engine.OpenBytes(out.Bytes())
+	require.NoError(t, err)
+	defer s.Close()
+	var content bytes.Buffer
+	require.NoError(t, s.Cat("a", &content))
+	assert.Equal(t, "a", content.String())
+}
+
+// TestDedup verifies that identical files share one frame, which extraction, search,
+// removal and recompression handle.
+func TestDedup(t *testing.T) {
+	root := t.TempDir()
+	large := make([]byte, 200<<10)
+	_, err := rand.Read(large)
+	require.NoError(t, err)
+	small := []byte("a small note about backups")
+	contents := map[string][]byte{
+		"a/large.bin":     large,
+		"b/large.bin":     large,
+		"c/copy.bin":      large,
+		"a/note.txt":      small,
+		"b/note.txt":      small,
+		"other.bin":       append([]byte{1}, large[1:]...), // Same size, different content.
+		"a/empty.txt":     nil,
+		"b/also-empty.md": nil,
+	}
+	for name, content := range contents {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, content, 0644))
+	}
+	entries := []string{}
+	for name := range contents {
+		entries = append(entries, name)
+	}
+	inputs := []string{filepath.Join(root, "a"), filepath.Join(root, "b"), filepath.Join(root, "c"), filepath.Join(root, "other.bin")}
+
+	for _, grouped := range []bool{false, true} {
+		create := func(dedup bool) (string, *core.CreateResult) {
+			engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, Dedup: dedup, GroupSmallFiles: grouped, CompressionWorkers: 2})
+			require.NoError(t, err)
+			archivePath := filepath.Join(t.TempDir(), "dedup.nsm")
+			result, err := engine.Create(archivePath, inputs)
+			require.NoError(t, err)
+			return archivePath, result
+		}
+		plainPath, plain := create(false)
+		archivePath, result := create(true)
+		assert.Equal(t, 3, result.Duplicates)
+		assert.EqualValues(t, 2*len(large)+len(small), result.DedupSaved)
+		assert.Equal(t, len(contents), result.Files)
+		assert.Equal(t, plain.InputSize, result.InputSize)
+		assert.Less(t, result.ArchiveSize, plain.ArchiveSize-int64(len(large)), "The copies shouldn't be stored again")
+
+		_, idx := readArchiveIndex(t, archivePath)
+		original, dup := idx.Files["a/large.bin"], idx.Files["c/copy.bin"]
+		assert.Equal(t, original.Offset, dup.Offset)
+		assert.Equal(t, original.CompressedSize, dup.CompressedSize)
+		assert.NotEqual(t, original.Offset, idx.Files["other.bin"].Offset)
+		assert.Equal(t, idx.Files["a/note.txt"].Offset, idx.Files["b/note.txt"].Offset)
+		assert.Equal(t, idx.Files["a/note.txt"].GroupOffset, idx.Files["b/note.txt"].GroupOffset)
+
+		engine, _ := setupTestEngine(t, 0)
+		check := func(archivePath string, names ...string) {
+			require.NoError(t, engine.Verify(archivePath))
+			dest := t.TempDir()
+			require.NoError(t, engine.Extract(archivePath, dest))
+			for _, name := range names {
+				data, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+				require.NoError(t, err, name)
+				assert.Equal(t, len(contents[name]), len(data), name)
+				assert.True(t, bytes.Equal(contents[name], data), name)
+			}
+		}
+		check(archivePath, entries...)
+		matches, _, err := engine.Search(archivePath, "backups")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a/note.txt", "b/note.txt"}, resultPaths(matches))
+
+		// Rewriting keeps one copy of each frame, even once the original is gone.
+		require.NoError(t, engine.Remove(archivePath, []string{"a/large.bin", "a/note.txt"}))
+		check(archivePath, "b/large.bin", "c/copy.bin", "b/note.txt", "other.bin")
+		require.NoError(t, engine.Recompress(archivePath, core.GZIP, 0))
+		check(archivePath, "b/large.bin", "c/copy.bin", "b/note.txt", "other.bin")
+		_, idx = readArchiveIndex(t, archivePath)
+		assert.Equal(t, idx.Files["b/large.bin"].Offset, idx.Files["c/copy.bin"].Offset)
+		info, err := os.Stat(archivePath)
+		require.NoError(t, err)
+		plainInfo, err := os.Stat(plainPath)
+		require.NoError(t, err)
+		assert.Less(t, info.Size(), plainInfo.Size()-int64(len(large)))
+	}
+}
+
+// editedCopy returns data with a few bytes inserted near the start and a few changed
+// near the end, like a new version of a large file.
+func editedCopy(data []byte) []byte {
+	edited := append([]byte(nil), data[:len(data)/4]...)
+	edited = append(edited, "inserted line\n"...)
+	edited = append(edited, data[len(data)/4:]...)
+	copy(edited[len(edited)*3/4:], "changed")
+	return edited
+}
+
+func TestChunking(t *testing.T) {
+	root := t.TempDir()
+	v1 := make([]byte, 4<<20)
+	_, err := rand.Read(v1)
+	require.NoError(t, err)
+	contents := map[string][]byte{
+		"v1.bin":    v1,
+		"v2.bin":    editedCopy(v1),
+		"copy.bin":  v1,
+		"small.txt": []byte("too small to be chunked"),
+		"empty.txt": nil,
+	}
+	inputs := []string{}
+	for name, content := range contents {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), content, 0644))
+		inputs = append(inputs, filepath.Join(root, name))
+	}
+
+	engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, Chunking: true, Dedup: true})
+	require.NoError(t, err)
+	archivePath := filepath.Join(t.TempDir(), "chunked.nsm")
+	result, err := engine.Create(archivePath, inputs)
+	require.NoError(t, err)
+	assert.Less(t, result.ArchiveSize, int64(len(v1))*5/4, "The second version should share most chunks with the first")
+
+	_, idx := readArchiveIndex(t, archivePath)
+	first, second := idx.Files["v1.bin"], idx.Files["v2.bin"]
+	require.NotEmpty(t, first.Chunks)
+	require.NotEmpty(t, second.Chunks)
+	shared := map[core.ChunkRef]bool{}
+	for _, c := range first.Chunks {
+		shared[c] = true
+	}
+	reused := 0
+	for _, c := range second.Chunks {
+		if shared[c] {
+			reused++
+		}
+	}
+	assert.GreaterOrEqual(t, reused, len(second.Chunks)-4, "Only the chunks around the edits should differ")
+	assert.Equal(t, first.Chunks, idx.Files["copy.bin"].Chunks)
+	assert.Empty(t, idx.Files["small.txt"].Chunks)
+
+	check := func(names ...string) {
+		require.NoError(t, engine.Verify(archivePath))
+		dest := t.TempDir()
+		require.NoError(t, engine.Extract(archivePath, dest))
+		for _, name := range names {
+			data, err := os.ReadFile(filepath.Join(dest, name))
+			require.NoError(t, err, name)
+			assert.True(t, bytes.Equal(contents[name], data), name)
+		}
+	}
+	check("v1.bin", "v2.bin", "copy.bin", "small.txt", "empty.txt")
+
+	// Rewriting keeps the chunks the remaining files use, once.
+	require.NoError(t, engine.Remove(archivePath, []string{"v1.bin"}))
+	check("v2.bin", "copy.bin", "small.txt", "empty.txt")
+	require.NoError(t, engine.Recompress(archivePath, core.GZIP, 0))
+	check("v2.bin", "copy.bin", "small.txt", "empty.txt")
+	info, err := os.Stat(archivePath)
+	require.NoError(t, err)
+	assert.Less(t, info.Size(), int64(len(v1))*5/4)
+}
+
+// BenchmarkChunkedRearchive archives a large file along with a slightly edited copy,
+// and reports how many bytes the copy adds to the archive with and without chunking.
+func BenchmarkChunkedRearchive(b *testing.B) {
+	root := b.TempDir()
+	v1 := make([]byte, 16<<20)
+	_, err := rand.Read(v1)
+	require.NoError(b, err)
+	v1Path, v2Path := filepath.Join(root, "v1.bin"), filepath.Join(root, "v2.bin")
+	require.NoError(b, os.WriteFile(v1Path, v1, 0644))
+	require.NoError(b, os.WriteFile(v2Path, editedCopy(v1), 0644))
+
+	for _, chunking := range []bool{false, true} {
+		chunking := chunking
+		b.Run(fmt.Sprintf("chunking=%v", chunking), func(b *testing.B) {
+			engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, Chunking: chunking})
+			require.NoError(b, err)
+			archivePath := filepath.Join(b.TempDir(), "bench.nsm")
+			var added int64
+			b.SetBytes(int64(2 * len(v1)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				once, err := engine.Create(archivePath, []string{v1Path})
+				require.NoError(b, err)
+				both, err := engine.Create(archivePath, []string{v1Path, v2Path})
+				require.NoError(b, err)
+				added = both.ArchiveSize - once.ArchiveSize
+			}
+			b.ReportMetric(float64(added), "added-bytes")
+		})
+	}
+}
+
+// TestEstimateInputs verifies that an estimate sampled from the inputs themselves
+// predicts compressible data to shrink and random data not to.
+func TestEstimateInputs(t *testing.T) {
+	engine, tokens := setupTestEngine(t, 1)
+	text := createTestTree(t)
+	require.NoError(t, os.WriteFile(filepath.Join(text, "log.txt"), []byte(strings.Repeat("GET /index.html 200\n", 10000)), 0644))
+	random, _ := createTestFile(t, 200*1024)
+
+	inputs, err := engine.CollectInputs([]string{text})
+	require.NoError(t, err)
+	est, err := engine.EstimateInputs(inputs)
+	require.NoError(t, err)
+	assert.Equal(t, 1, est.Files)
+	assert.EqualValues(t, 200000, est.UncompressedSize)
+	assert.Less(t, est.Ratio, 0.1, "Repetitive text should be estimated to compress well")
+
+	inputs, err = engine.CollectInputs([]string{random})
+	require.NoError(t, err)
+	est, err = engine.EstimateInputs(inputs)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, est.Ratio, "Random data should be estimated incompressible")
+	assert.Zero(t, tokens.consumed, "Estimating should not charge anything")
+}
+
+// TestExtractResume verifies that resuming an extraction keeps the files already
+// extracted intact, without reading them from the archive again, and extracts again
+// the ones missing, cut short or changed.
+func TestExtractResume(t *testing.T) {
+	engine, _ := setupTestEngine(t, 1)
+	root := createTestTree(t, "done.txt", "partial.txt", "changed.txt", "missing.txt")
+	archivePath := filepath.Join(t.TempDir(), "resume.nsm")
+	_, err := engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+
+	base := filepath.Join(dest, filepath.Base(root))
+	require.NoError(t, os.Truncate(filepath.Join(base, "partial.txt"), 4))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "changed.txt"), []byte("CONTENT of changed.txt"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(base, "missing.txt")))
+	require.NoError(t, os.Chmod(filepath.Join(base, "done.txt"), 0600))
+	// Reading done.txt from the archive again would now fail its checksum.
+	corruptEntry(t, archivePath, filepath.Base(root)+"/done.txt")
+
+	require.NoError(t, engine.ExtractResume(archivePath, dest))
+	for _, name := range []string{"done.txt", "partial.txt", "changed.txt", "missing.txt"} {
+		data, err := os.ReadFile(filepath.Join(base, name))
+		require.NoError(t, err)
+		assert.Equal(t, "content of "+name, string(data))
+	}
+	info, err := os.Stat(filepath.Join(base, "done.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm(), "The mode of kept files should be restored")
+
+	require.NoError(t, os.Truncate(filepath.Join(base, "done.txt"), 0))
+	assert.Error(t, engine.ExtractResume(archivePath, dest), "A file cut short should be extracted again, from the corrupt data")
+}
+
+// TestParallelExtraction verifies that extracting several files at the same time
+// restores every file, including from encrypted and dictionary archives, and that a
+// file failing to extract fails the whole extraction.
+func TestParallelExtraction(t *testing.T) {
+	root := createSmallFiles(t, 200)
+	trainer, _ := setupTestEngine(t, 1)
+	dict, err := trainer.TrainDictionary([]string{root})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name   string
+		config core.Config
+	}{
+		{"plain", core.Config{}},
+		{"encrypted", core.Config{EncryptionKey: bytes.Repeat([]byte{0x42}, core.EncryptionKeySize)}},
+		{"dictionary", core.Config{Dictionary: dict}},
+		{"grouped", core.Config{GroupSmallFiles: true}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var last, total int64
+			config := tc.config
+			config.Tokens = core.NoopTokenSource{}
+			config.ExtractWorkers = 8
+			config.Progress = func(done, of int64) { last, total = done, of }
+			engine, err := core.NewEngine(&config)
+			require.NoError(t, err)
+			archivePath := filepath.Join(t.TempDir(), "parallel.nsm")
+			_, err = engine.Create(archivePath, []string{root})
+			require.NoError(t, err)
+
+			dest := t.TempDir()
+			require.NoError(t, engine.Extract(archivePath, dest))
+			for i := 0; i < 200; i++ {
+				name := fmt.Sprintf("f%04d.txt", i)
+				data, err := os.ReadFile(filepath.Join(dest, filepath.Base(root), name))
+				require.NoError(t, err)
+				assert.Equal(t, strings.Repeat(fmt.Sprintf("line %d of file %d\n", i%7, i), 40), string(data))
+			}
+			assert.Equal(t, total, last, "The last progress report should cover every file")
+		})
+	}
+
+	engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, ExtractWorkers: 8})
+	require.NoError(t, err)
+	archivePath := filepath.Join(t.TempDir(), "corrupt.nsm")
+	_, err = engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+	corruptEntry(t, archivePath, filepath.Base(root)+"/f0100.txt")
+	dest := t.TempDir()
+	assert.Error(t, engine.Extract(archivePath, dest))
+	assert.NoFileExists(t, filepath.Join(dest, filepath.Base(root), "f0100.txt"), "The corrupt file should not be left behind")
+}
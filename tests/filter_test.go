@@ -0,0 +1,270 @@
+// Package tests contains all the tests for the NSM project.
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexus/nsm/internal/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createTestTree creates the given files (relative paths) under a new temporary
+// directory and returns the directory.
+func createTestTree(t *testing.T, files ...string) string {
+	root := t.TempDir()
+	for _, name := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("content of "+name), 0644))
+	}
+	return root
+}
+
+// relativePaths converts collected files back to slash-separated paths relative to root.
+func relativePaths(t *testing.T, root string, files []core.InputFile) []string {
+	var rel []string
+	for _, f := range files {
+		r, err := filepath.Rel(root, f.Path)
+		require.NoError(t, err)
+		rel = append(rel, filepath.ToSlash(r))
+	}
+	return rel
+}
+
+// TestCollectInputsExcludeVCS verifies that --exclude-vcs leaves out VCS directories.
+func TestCollectInputsExcludeVCS(t *testing.T) {
+	root := createTestTree(t,
+		".git/HEAD",
+		".git/objects/ab/cdef",
+		"src/main.go",
+		"src/.DS_Store",
+		"README.md",
+	)
+
+	engine, err := core.NewEngine(&core.Config{ExcludeVCS: true})
+	require.NoError(t, err)
+	files, err := engine.CollectInputs([]string{root})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"README.md", "src/main.go"}, relativePaths(t, root, files.Files),
+		".git contents and OS artifacts should be absent")
+}
+
+// TestCollectInputsDefaultIgnores verifies the default ignore list and how to disable it.
+func TestCollectInputsDefaultIgnores(t *testing.T) {
+	root := createTestTree(t, ".git/HEAD", "src/.DS_Store", "src/main.go")
+
+	engine, err := core.NewEngine(&core.Config{})
+	require.NoError(t, err)
+	files, err := engine.CollectInputs([]string{root})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{".git/HEAD", "src/main.go"}, relativePaths(t, root, files.Files),
+		"Only the default ignores should apply without --exclude-vcs")
+
+	engine, err = core.NewEngine(&core.Config{NoDefaultIgnores: true})
+	require.NoError(t, err)
+	files, err = engine.CollectInputs([]string{root})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{".git/HEAD", "src/.DS_Store", "src/main.go"}, relativePaths(t, root, files.Files),
+		"Nothing should be skipped with --no-default-ignores")
+}
+
+// TestCollectInputsExclude verifies that --exclude patterns without a slash match any
+// path component, that patterns with one match the relative path with "**" spanning
+// directories, that exclude files are read like .gitignore, and that the skipped paths
+// are counted.
+func TestCollectInputsExclude(t *testing.T) {
+	root := createTestTree(t,
+		"README.md",
+		"notes.tmp",
+		"node_modules/lib/index.js",
+		"src/main.go",
+		"src/cache.tmp",
+		"build/main.o",
+		"build/deep/dir/util.o",
+		"build/deep/keep.txt",
+	)
+	patternFile := filepath.Join(t.TempDir(), "exclude")
+	require.NoError(t, os.WriteFile(patternFile, []byte("# Build outputs\n\nbuild/**/*.o\n  node_modules  \n"), 0644))
+	fromFile, err := core.ReadExcludeFile(patternFile)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"build/**/*.o", "node_modules"}, fromFile)
+
+	engine, err := core.NewEngine(&core.Config{Exclude: append([]string{"*.tmp"}, fromFile...)})
+	require.NoError(t, err)
+	files, err := engine.CollectInputs([]string{root})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"README.md", "src/main.go", "build/deep/keep.txt"}, relativePaths(t, root, files.Files))
+	assert.Equal(t, 5, files.Excluded, "node_modules should count once")
+
+	_, err = core.NewEngine(&core.Config{Exclude: []string{"[unclosed"}})
+	assert.Error(t, err, "A malformed pattern should be rejected")
+	require.NoError(t, os.WriteFile(patternFile, []byte("*.log\n!keep.log\n"), 0644))
+	_, err = core.ReadExcludeFile(patternFile)
+	assert.Error(t, err, "Negated patterns are not supported")
+
+	engine, err = core.NewEngine(&core.Config{Tokens: &mockTokenSource{available: 1}, Exclude: []string{"build"}})
+	require.NoError(t, err)
+	result, err := engine.Create(filepath.Join(t.TempDir(), "out.nsm"), []string{root})
+	require.NoError(t, err)
+	assert.Equal(t, 5, result.Files)
+	assert.Equal(t, 1, result.Excluded)
+}
+
+// TestCollectInputsEmptyAndUnreadable verifies that empty files are kept and unreadable
+// files are reported rather than crashing the operation.
+func TestCollectInputsEmptyAndUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("file permissions are not enforced for root")
+	}
+	root := createTestTree(t, "readable.txt")
+	emptyPath := filepath.Join(root, "empty.txt")
+	require.NoError(t, os.WriteFile(emptyPath, nil, 0644))
+	lockedPath := filepath.Join(root, "locked.txt")
+	require.NoError(t, os.WriteFile(lockedPath, []byte("secret"), 0000))
+
+	engine, err := core.NewEngine(&core.Config{})
+	require.NoError(t, err)
+	_, err = engine.CollectInputs([]string{root})
+	require.Error(t, err, "An unreadable file should fail the operation by default")
+	assert.Contains(t, err.Error(), lockedPath)
+
+	engine, err = core.NewEngine(&core.Config{KeepGoing: true})
+	require.NoError(t, err)
+	files, err := engine.CollectInputs([]string{root})
+	require.NoError(t, err, "An unreadable file should be skipped with --keep-going")
+	assert.ElementsMatch(t, []string{"empty.txt", "readable.txt"}, relativePaths(t, root, files.Files),
+		"The empty file should be archived")
+	require.Len(t, files.Skipped, 1)
+	assert.Equal(t, lockedPath, files.Skipped[0].Path, "The unreadable file should be reported")
+}
+
+// TestCollectInputsOnlyNewer verifies that an incremental create only picks up files
+// modified after the reference archive was written.
+func TestCollectInputsOnlyNewer(t *testing.T) {
+	root := createTestTree(t, "a.txt", "b.txt", "sub/c.txt")
+	created := time.Now().Add(-time.Minute)
+
+	// A reference archive only needs a valid header for its creation time.
+	refPath := filepath.Join(t.TempDir(), "reference.nsm")
+	ref, err := os.Create(refPath)
+	require.NoError(t, err)
+	require.NoError(t, core.WriteHeader(ref, &core.Header{Magic: core.MagicNumber, Version: 1, Timestamp: created.UnixNano()}))
+	require.NoError(t, ref.Close())
+
+	old := created.Add(-time.Hour)
+	for _, name := range []string{"a.txt", "b.txt", "sub/c.txt"} {
+		require.NoError(t, os.Chtimes(filepath.Join(root, filepath.FromSlash(name)), old, old))
+	}
+	touched := filepath.Join(root, "sub", "c.txt")
+	require.NoError(t, os.Chtimes(touched, time.Now(), time.Now()))
+
+	onlyNewer, err := core.ParseReferenceTime(refPath)
+	require.NoError(t, err)
+	assert.Equal(t, created.UnixNano(), onlyNewer.UnixNano(), "Reference time should come from the archive header")
+
+	engine, err := core.NewEngine(&core.Config{OnlyNewer: onlyNewer})
+	require.NoError(t, err)
+	files, err := engine.CollectInputs([]string{root})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sub/c.txt"}, relativePaths(t, root, files.Files), "Only the touched file should be included")
+	assert.Equal(t, 2, files.Unchanged)
+
+	_, err = core.ParseReferenceTime("2024-01-02T15:04:05Z")
+	assert.NoError(t, err, "RFC 3339 timestamps should be accepted")
+}
+
+// TestCreateFromFileList verifies that the files of a newline- or NUL-separated list are
+// all archived under their listed paths, and that missing entries are reported.
+func TestCreateFromFileList(t *testing.T) {
+	root := createTestTree(t, "src/main.go", "docs/main.go", "README.md", "src/.DS_Store")
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(root))
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	for _, nul := range []bool{false, true} {
+		manifest := "src/main.go\ndocs/main.go\r\n\nREADME.md\nsrc/.DS_Store\n"
+		if nul {
+			manifest = "src/main.go\x00docs/main.go\x00README.md\x00src/.DS_Store"
+		}
+		paths, err := core.ReadFileList(strings.NewReader(manifest), nul)
+		require.NoError(t, err)
+		require.Len(t, paths, 4)
+
+		engine, tokens := setupTestEngine(t, 1)
+		archivePath := filepath.Join(t.TempDir(), "list.nsm")
+		_, err = engine.CreateFromList(archivePath, paths)
+		require.NoError(t, err)
+		assert.Equal(t, 1, tokens.consumed)
+
+		entries, err := engine.List(archivePath)
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Path)
+		}
+		assert.Equal(t, []string{"README.md", "docs/main.go", "src/main.go"}, names,
+			"Listed files should keep their paths and the default filters should apply")
+	}
+
+	engine, tokens := setupTestEngine(t, 1)
+	_, err = engine.CreateFromList(filepath.Join(t.TempDir(), "missing.nsm"), []string{"README.md", "gone.txt", "nope/x.go"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "gone.txt")
+	assert.Contains(t, err.Error(), "nope/x.go")
+	assert.Zero(t, tokens.consumed, "Missing files should be reported before a token is consumed")
+}
+
+// TestCollectInputsSymlinks verifies that symbolic links are skipped by default, and
+// followed with FollowSymlinks without looping on a link to an enclosing directory.
+func TestCollectInputsSymlinks(t *testing.T) {
+	root := createTestTree(t, "a.txt")
+	outside := createTestTree(t, "linked/b.txt")
+	require.NoError(t, os.Symlink(filepath.Join(outside, "linked", "b.txt"), filepath.Join(root, "file-link")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "linked"), filepath.Join(root, "dir-link")))
+	require.NoError(t, os.Symlink(root, filepath.Join(root, "loop")))
+
+	engine, err := core.NewEngine(&core.Config{})
+	require.NoError(t, err)
+	files, err := engine.CollectInputs([]string{root})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.txt"}, relativePaths(t, root, files.Files))
+
+	engine, err = core.NewEngine(&core.Config{FollowSymlinks: true})
+	require.NoError(t, err)
+	files, err = engine.CollectInputs([]string{root})
+	require.NoError(t, err)
+	var names []string
+	for _, f := range files.Files {
+		names = append(names, strings.TrimPrefix(f.Name, filepath.Base(root)+"/"))
+	}
+	assert.ElementsMatch(t, []string{"a.txt", "file-link", "dir-link/b.txt"}, names)
+}
+
+// TestEmptyDirectories verifies that empty directories below an input are recorded and
+// recreated on extraction.
+func TestEmptyDirectories(t *testing.T) {
+	root := createTestTree(t, "full/a.txt")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "empty", "nested"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "full", "also-empty"), 0755))
+
+	engine, _ := setupTestEngine(t, 1)
+	base := filepath.Base(root)
+	inputs, err := engine.CollectInputs([]string{root})
+	require.NoError(t, err)
+	assert.Equal(t, []string{base + "/empty/nested", base + "/full/also-empty"}, inputs.EmptyDirs)
+
+	archivePath := filepath.Join(t.TempDir(), "dirs.nsm")
+	_, err = engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+	assert.DirExists(t, filepath.Join(dest, base, "empty", "nested"))
+	assert.DirExists(t, filepath.Join(dest, base, "full", "also-empty"))
+	assert.FileExists(t, filepath.Join(dest, base, "full", "a.txt"))
+}
@@ -0,0 +1,800 @@
+// Package tests contains all the tests for the NSM project.
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/nexus/nsm/internal/core"
+	"github.com/nexus/nsm/internal/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+)
+
+// TestHeaderSize verifies that the header encodes to exactly HeaderSize bytes, with
+// its fields at their documented offsets, so the data block starts where the offsets
+// in existing archives say it does.
+func TestHeaderSize(t *testing.T) {
+	assert.Equal(t, core.HeaderSize, binary.Size(core.Header{}))
+
+	header := &core.Header{
+		Magic:       core.MagicNumber,
+		Version:     core.FormatVersion,
+		Timestamp:   1,
+		IndexOffset: 0x0102030405060708,
+		IndexLength: 42,
+		Flags:       0xAABBCCDD,
+	}
+	var buf bytes.Buffer
+	require.NoError(t, core.WriteHeader(&buf, header))
+	require.Equal(t, core.HeaderSize, buf.Len())
+	encoded := buf.Bytes()
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, encoded[16:24], "IndexOffset should follow the magic, version, types and timestamp")
+	assert.Equal(t, []byte{0xAA, 0xBB, 0xCC, 0xDD}, encoded[64:68], "Flags should follow the data checksum")
+	assert.Equal(t, make([]byte, len(header.Reserved)), encoded[core.HeaderSize-len(header.Reserved):], "The reserved bytes should be zero")
+
+	read, err := core.ReadHeader(bytes.NewReader(encoded))
+	require.NoError(t, err)
+	assert.Equal(t, header, read)
+}
+
+// TestMetadataRoundTrip verifies that archive metadata survives index serialization.
+func TestMetadataRoundTrip(t *testing.T) {
+	meta := core.NewArchiveMetadata("nightly-backup", false)
+	assert.Equal(t, version.Version, meta.ToolVersion)
+	assert.Equal(t, runtime.GOOS, meta.OS)
+	assert.Equal(t, runtime.GOARCH, meta.Arch)
+	meta.Levels = []int{1, 3, 19}
+
+	idx := &core.Index{
+		Files:    map[string]core.FileMetadata{},
+		Metadata: meta,
+	}
+	var buf bytes.Buffer
+	_, err := core.WriteIndex(&buf, idx)
+	require.NoError(t, err)
+
+	decoded, err := core.ReadIndex(&buf, &core.Header{Version: core.FormatVersion})
+	require.NoError(t, err)
+	require.NotNil(t, decoded.Metadata, "Metadata should be present after decoding")
+	assert.Equal(t, *meta, *decoded.Metadata, "Metadata should round-trip unchanged")
+}
+
+// TestMetadataReproducible verifies that reproducible mode strips host and user details.
+func TestMetadataReproducible(t *testing.T) {
+	meta := core.NewArchiveMetadata("nightly-backup", true)
+	assert.Empty(t, meta.Hostname, "Hostname should be stripped in reproducible mode")
+	assert.Empty(t, meta.User, "User should be stripped in reproducible mode")
+	assert.Equal(t, "nightly-backup", meta.Creator, "Creator label should be kept")
+	assert.Equal(t, version.Version, meta.ToolVersion, "Tool version should be kept")
+}
+
+// downgradeArchive rewrites an archive's index in the given older format version,
+// reproducing an archive written by an earlier build.
+func downgradeArchive(t *testing.T, archivePath string, version uint16) {
+	header, idx := readArchiveIndex(t, archivePath)
+
+	f, err := os.OpenFile(archivePath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, f.Truncate(header.IndexOffset))
+	_, err = f.Seek(header.IndexOffset, io.SeekStart)
+	require.NoError(t, err)
+	header.IndexLength, err = core.WriteIndexVersion(f, idx, version)
+	require.NoError(t, err)
+
+	header.Version = version
+	header.Flags &^= core.FlagIndexCompressed
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	require.NoError(t, core.WriteHeader(f, header))
+}
+
+// TestIndexFormatsRoundTrip verifies that the gob and protobuf encodings decode to
+// the same index through ReadIndex.
+func TestIndexFormatsRoundTrip(t *testing.T) {
+	idx := &core.Index{
+		Files: map[string]core.FileMetadata{
+			"a.txt":     {Path: "a.txt", UncompressedSize: 12, CompressedSize: 20, Offset: 0, ModTime: time.Unix(1700000000, 5), Mode: 0644, Group: 1, GroupOffset: 7},
+			"dir/b.bin": {Path: "dir/b.bin", UncompressedSize: 0, CompressedSize: 9, Offset: 20, Mode: 0600, Compression: 3},
+		},
+		SearchData: map[string][]string{"hello": {"a.txt"}, "world": {"a.txt", "dir/b.bin"}},
+		Metadata:   core.NewArchiveMetadata("compat", true),
+	}
+
+	for _, v := range []uint16{core.FormatVersionGob, core.FormatVersionProto} {
+		var buf bytes.Buffer
+		n, err := core.WriteIndexVersion(&buf, idx, v)
+		require.NoError(t, err)
+		assert.Equal(t, int64(buf.Len()), n)
+
+		decoded, err := core.ReadIndex(&buf, &core.Header{Version: v})
+		require.NoError(t, err, "format version %d", v)
+		assert.Equal(t, idx.SearchData, decoded.SearchData, "format version %d", v)
+		assert.Equal(t, *idx.Metadata, *decoded.Metadata, "format version %d", v)
+		require.Len(t, decoded.Files, len(idx.Files))
+		for name, want := range idx.Files {
+			got := decoded.Files[name]
+			assert.True(t, want.ModTime.Equal(got.ModTime), "format version %d: %s mod time", v, name)
+			want.ModTime, got.ModTime = time.Time{}, time.Time{}
+			assert.Equal(t, want, got, "format version %d: %s", v, name)
+		}
+	}
+}
+
+// TestLegacyArchiveListExtractUpgrade verifies that an archive with a gob index can
+// still be listed, searched and extracted, and that upgrading it in place keeps it readable.
+func TestLegacyArchiveListExtractUpgrade(t *testing.T) {
+	archivePath := createSearchArchive(t, core.SearchIndexEmbedded)
+	downgradeArchive(t, archivePath, core.FormatVersionGob)
+	engine, _ := setupTestEngine(t, 0)
+
+	check := func(label string) {
+		entries, err := engine.List(archivePath)
+		require.NoError(t, err, label)
+		var paths []string
+		for _, e := range entries {
+			paths = append(paths, e.Path)
+		}
+		assert.Equal(t, []string{"notes.txt", "recipe.txt", "todo.txt"}, paths, label)
+
+		matches, _, err := engine.Search(archivePath, "eggs")
+		require.NoError(t, err, label)
+		assert.Equal(t, []string{"recipe.txt"}, resultPaths(matches), label)
+
+		dest := t.TempDir()
+		require.NoError(t, engine.Extract(archivePath, dest), label)
+		data, err := os.ReadFile(filepath.Join(dest, "recipe.txt"))
+		require.NoError(t, err, label)
+		assert.Equal(t, "Mix flour, sugar and eggs.", string(data), label)
+	}
+
+	header, _ := readArchiveIndex(t, archivePath)
+	require.Equal(t, core.FormatVersionGob, header.Version)
+	check("legacy archive")
+
+	upgraded, err := engine.Upgrade(archivePath)
+	require.NoError(t, err)
+	assert.True(t, upgraded)
+	newHeader, _ := readArchiveIndex(t, archivePath)
+	assert.Equal(t, core.FormatVersion, newHeader.Version)
+	assert.Equal(t, header.DataChecksum, newHeader.DataChecksum, "The data block should be untouched")
+	check("upgraded archive")
+
+	results, err := engine.CheckArchive(archivePath)
+	require.NoError(t, err)
+	assert.Len(t, results, 3)
+
+	upgraded, err = engine.Upgrade(archivePath)
+	require.NoError(t, err)
+	assert.False(t, upgraded, "A current archive should not be rewritten")
+}
+
+// TestMigrate verifies that a legacy archive is copied in the current format, with
+// its sidecar, while the original is left as it is.
+func TestMigrate(t *testing.T) {
+	archivePath := createSearchArchive(t, core.SearchIndexSidecar)
+	downgradeArchive(t, archivePath, core.FormatVersionGob)
+	engine, _ := setupTestEngine(t, 0)
+
+	migrated := filepath.Join(t.TempDir(), "migrated.nsm")
+	require.NoError(t, engine.Migrate(archivePath, migrated))
+	header, _ := readArchiveIndex(t, archivePath)
+	assert.Equal(t, core.FormatVersionGob, header.Version, "The original should be left as it is")
+	newHeader, _ := readArchiveIndex(t, migrated)
+	assert.Equal(t, core.FormatVersion, newHeader.Version)
+	assert.Equal(t, header.DataChecksum, newHeader.DataChecksum, "The data block should be untouched")
+
+	matches, _, err := engine.Search(migrated, "eggs")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"recipe.txt"}, resultPaths(matches))
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(migrated, dest))
+	data, err := os.ReadFile(filepath.Join(dest, "recipe.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "Mix flour, sugar and eggs.", string(data))
+
+	err = engine.Migrate(archivePath, archivePath)
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrInvalidInput, coreErr.Code)
+}
+
+// TestUnsupportedVersion verifies that an archive from a newer format version is
+// rejected with a clear error.
+func TestUnsupportedVersion(t *testing.T) {
+	archivePath := createSearchArchive(t, core.SearchIndexEmbedded)
+	header, _ := readArchiveIndex(t, archivePath)
+	header.Version = core.FormatVersion + 1
+	f, err := os.OpenFile(archivePath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	require.NoError(t, core.WriteHeader(f, header))
+	require.NoError(t, f.Close())
+
+	engine, _ := setupTestEngine(t, 0)
+	_, err = engine.List(archivePath)
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrInvalidFormat, coreErr.Code)
+	assert.Contains(t, err.Error(), fmt.Sprintf("archive version %d not supported by this build", core.FormatVersion+1))
+	assert.Error(t, engine.Migrate(archivePath, filepath.Join(t.TempDir(), "migrated.nsm")))
+}
+
+// TestLargeIndexCompressed verifies that a large index is stored compressed by default
+// and still round-trips, while a small one is stored as is.
+func TestLargeIndexCompressed(t *testing.T) {
+	root := t.TempDir()
+	var words bytes.Buffer
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&words, "keyword%05d ", i)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(root, "words.txt"), words.Bytes(), 0644))
+
+	create := func(mode core.IndexCompressionMode) string {
+		engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, IndexCompression: mode})
+		require.NoError(t, err)
+		archivePath := filepath.Join(t.TempDir(), "words.nsm")
+		_, err = engine.Create(archivePath, []string{root})
+		require.NoError(t, err)
+		return archivePath
+	}
+
+	archivePath := create("")
+	header, idx := readArchiveIndex(t, archivePath)
+	require.NotZero(t, header.Flags&core.FlagIndexCompressed, "A large index should be compressed by default")
+	assert.Len(t, idx.SearchData, 20000)
+	var raw bytes.Buffer
+	rawLength, err := core.WriteIndex(&raw, idx)
+	require.NoError(t, err)
+	assert.Less(t, header.IndexLength, rawLength/2, "The compressed index should be much smaller")
+
+	engine, _ := setupTestEngine(t, 0)
+	matches, _, err := engine.Search(archivePath, "keyword12345")
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Base(root) + "/words.txt"}, resultPaths(matches))
+	data, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	require.NoError(t, engine.VerifyStream(bytes.NewReader(data)))
+
+	header, _ = readArchiveIndex(t, create(core.IndexCompressionNever))
+	assert.Zero(t, header.Flags&core.FlagIndexCompressed, "Index compression can be disabled")
+
+	header, _ = readArchiveIndex(t, createSearchArchive(t, core.SearchIndexEmbedded))
+	assert.Zero(t, header.Flags&core.FlagIndexCompressed, "A small index should be stored as is")
+}
+
+// TestRewrapIndex verifies that rewrapping an encrypted index makes it readable with
+// the new key only, while the data block is left untouched and still extracts, and that
+// it replaces the archive only once the rewrap succeeded.
+func TestRewrapIndex(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, core.IndexKeySize)
+	newKey := bytes.Repeat([]byte{2}, core.IndexKeySize)
+	withKey := func(key []byte) *core.Engine {
+		engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, IndexKey: key})
+		require.NoError(t, err)
+		return engine
+	}
+
+	root := createTestTree(t, "a.txt", "dir/b.txt")
+	archivePath := filepath.Join(t.TempDir(), "secret.nsm")
+	_, err := withKey(oldKey).Create(archivePath, []string{root})
+	require.NoError(t, err)
+	before, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+
+	_, err = withKey(nil).List(archivePath)
+	require.Error(t, err, "An encrypted index should not be readable without a key")
+	_, err = withKey(oldKey).List(archivePath)
+	require.NoError(t, err)
+
+	require.NoError(t, withKey(nil).RewrapIndex(archivePath, oldKey, newKey))
+	after, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	header, err := core.ReadHeader(bytes.NewReader(after))
+	require.NoError(t, err)
+	assert.NotZero(t, header.Flags&core.FlagIndexEncrypted)
+	assert.Equal(t, before[core.HeaderSize:header.IndexOffset], after[core.HeaderSize:header.IndexOffset], "The data block should be untouched")
+
+	entries, err := withKey(newKey).List(archivePath)
+	require.NoError(t, err, "The new key should read the index")
+	assert.Len(t, entries, 2)
+	_, err = withKey(oldKey).List(archivePath)
+	assert.Error(t, err, "The old key should no longer read the index")
+
+	dest := t.TempDir()
+	require.NoError(t, withKey(newKey).Extract(archivePath, dest))
+	data, err := os.ReadFile(filepath.Join(dest, filepath.Base(root), "dir", "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "content of dir/b.txt", string(data))
+
+	assert.Error(t, withKey(nil).RewrapIndex(archivePath, oldKey, nil), "Rewrapping with the wrong old key should fail")
+	unchanged, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	assert.Equal(t, after, unchanged, "A failed rewrap should leave the archive untouched")
+	require.NoError(t, withKey(nil).RewrapIndex(archivePath, newKey, nil))
+	dirEntries, err := os.ReadDir(filepath.Dir(archivePath))
+	require.NoError(t, err)
+	assert.Len(t, dirEntries, 1, "No temporary archive should be left behind")
+	_, err = withKey(nil).List(archivePath)
+	assert.NoError(t, err, "A rewrapped index without a new key should be readable by anyone")
+}
+
+// TestRecompressGzipToZstd verifies that recompressing a gzip archive to zstd keeps its
+// contents, including grouped and stored files, without consuming a token.
+func TestRecompressGzipToZstd(t *testing.T) {
+	root := createTestTree(t, "a.txt", "dir/b.txt", "photo.jpg")
+	large := bytes.Repeat([]byte("recompress me "), 20000)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "large.log"), large, 0644))
+	gzipEngine, err := core.NewEngine(&core.Config{
+		Tokens:          core.NoopTokenSource{},
+		DefaultAlgo:     string(core.GZIP),
+		GroupSmallFiles: true,
+	})
+	require.NoError(t, err)
+	archivePath := filepath.Join(t.TempDir(), "old.nsm")
+	_, err = gzipEngine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+	before, _ := readArchiveIndex(t, archivePath)
+
+	engine, tokens := setupTestEngine(t, 0)
+	require.NoError(t, engine.Recompress(archivePath, core.ZSTD, 19))
+	assert.Zero(t, tokens.consumed, "Recompressing should not consume a token")
+
+	after, idx := readArchiveIndex(t, archivePath)
+	assert.NotEqual(t, before.CompressionType, after.CompressionType)
+	assert.NotEqual(t, before.DataChecksum, after.DataChecksum)
+	assert.Len(t, idx.Files, 4)
+	require.NoError(t, engine.Verify(archivePath))
+
+	name := filepath.Base(root)
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+	for _, file := range []string{"a.txt", "dir/b.txt", "photo.jpg"} {
+		data, err := os.ReadFile(filepath.Join(dest, name, filepath.FromSlash(file)))
+		require.NoError(t, err)
+		assert.Equal(t, "content of "+file, string(data))
+	}
+	data, err := os.ReadFile(filepath.Join(dest, name, "large.log"))
+	require.NoError(t, err)
+	assert.Equal(t, large, data)
+}
+
+// TestRemove verifies that removed files leave the archive, its data block and its
+// search index, including from a file group shared with surviving files.
+func TestRemove(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"keep.txt":   "kept apples",
+		"drop.txt":   "dropped bananas and cherries",
+		"shared.txt": "apples and bananas",
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(content), 0644))
+	}
+	// Random data doesn't compress, so removing it visibly shrinks the archive.
+	largePath, _ := createTestFile(t, 256<<10)
+	require.NoError(t, os.Rename(largePath, filepath.Join(root, "large.bin")))
+	key := bytes.Repeat([]byte{0x42}, core.EncryptionKeySize)
+	engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, EncryptionKey: key, GroupSmallFiles: true})
+	require.NoError(t, err)
+	archivePath := filepath.Join(t.TempDir(), "remove.nsm")
+	_, err = engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+	before, err := os.Stat(archivePath)
+	require.NoError(t, err)
+
+	name := filepath.Base(root)
+	err = engine.Remove(archivePath, []string{name + "/missing.txt"})
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrFileNotFound, coreErr.Code)
+
+	require.NoError(t, engine.Remove(archivePath, []string{name + "/drop.txt", name + "/large.bin"}))
+	after, err := os.Stat(archivePath)
+	require.NoError(t, err)
+	assert.Less(t, after.Size(), before.Size()/4, "the removed data should be gone")
+	require.NoError(t, engine.Verify(archivePath))
+
+	_, idx := readArchiveIndex(t, archivePath)
+	assert.Len(t, idx.Files, 2)
+	assert.NotContains(t, idx.SearchData, "cherries", "keywords of removed files only are dropped")
+	assert.Equal(t, []string{name + "/shared.txt"}, idx.SearchData["bananas"])
+
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+	for _, file := range []string{"keep.txt", "shared.txt"} {
+		data, err := os.ReadFile(filepath.Join(dest, name, file))
+		require.NoError(t, err)
+		assert.Equal(t, files[file], string(data))
+	}
+	assert.NoFileExists(t, filepath.Join(dest, name, "drop.txt"))
+}
+
+// TestLZ4Archive verifies that an LZ4 archive records its algorithm in the header and
+// is extracted by an engine configured for another algorithm.
+func TestLZ4Archive(t *testing.T) {
+	root := createTestTree(t, "a.txt", "dir/b.txt")
+	large := bytes.Repeat([]byte("fast compression for large files "), 10000)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "large.log"), large, 0644))
+	lz4Engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, DefaultAlgo: string(core.LZ4)})
+	require.NoError(t, err)
+	archivePath := filepath.Join(t.TempDir(), "fast.nsm")
+	_, err = lz4Engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+
+	header, idx := readArchiveIndex(t, archivePath)
+	assert.EqualValues(t, 4, header.CompressionType)
+	name := filepath.Base(root)
+	assert.Less(t, idx.Files[name+"/large.log"].CompressedSize, int64(len(large)/10))
+
+	engine, _ := setupTestEngine(t, 0)
+	require.NoError(t, engine.Verify(archivePath))
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+	data, err := os.ReadFile(filepath.Join(dest, name, "large.log"))
+	require.NoError(t, err)
+	assert.Equal(t, large, data)
+	data, err = os.ReadFile(filepath.Join(dest, name, "dir", "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "content of dir/b.txt", string(data))
+}
+
+// countingKeySource hands out copies of a key and keeps them for inspection.
+type countingKeySource struct {
+	key    []byte
+	handed [][]byte
+	calls  int
+}
+
+func (s *countingKeySource) IndexKey(string) ([]byte, error) {
+	s.calls++
+	key := append([]byte(nil), s.key...)
+	s.handed = append(s.handed, key)
+	return key, nil
+}
+
+// TestSessionFetchesKeyOnce verifies that a session asks for the index key once across
+// several extractions, and that the key buffer is wiped.
+func TestSessionFetchesKeyOnce(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, core.IndexKeySize)
+	writer, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, IndexKey: key})
+	require.NoError(t, err)
+	root := createTestTree(t, "a.txt", "b.txt", "dir/c.txt")
+	archivePath := filepath.Join(t.TempDir(), "session.nsm")
+	_, err = writer.Create(archivePath, []string{root})
+	require.NoError(t, err)
+
+	source := &countingKeySource{key: key}
+	engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, IndexKeySource: source})
+	require.NoError(t, err)
+	session, err := engine.OpenSession(archivePath)
+	require.NoError(t, err)
+
+	name := filepath.Base(root)
+	dest := t.TempDir()
+	require.NoError(t, session.ExtractFiles(dest, name+"/a.txt"))
+	require.NoError(t, session.ExtractFiles(dest, name+"/b.txt", name+"/dir/c.txt"))
+	assert.Error(t, session.ExtractFiles(dest, name+"/missing.txt"))
+	require.NoError(t, session.Close())
+
+	assert.Equal(t, 1, source.calls, "The key should be fetched once per session")
+	assert.Equal(t, make([]byte, core.IndexKeySize), source.handed[0], "The key buffer should be wiped")
+	data, err := os.ReadFile(filepath.Join(dest, name, "dir", "c.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "content of dir/c.txt", string(data))
+}
+
+// TestOpenInMemoryArchive verifies that an archive held entirely in memory can be
+// listed, read and extracted, directly or through an fs.FS.
+func TestOpenInMemoryArchive(t *testing.T) {
+	root := createTestTree(t, "a.txt", "dir/b.txt")
+	engine, _ := setupTestEngine(t, 1)
+	archivePath := filepath.Join(t.TempDir(), "embedded.nsm")
+	_, err := engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+	data, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	name := filepath.Base(root)
+
+	session, err := engine.OpenReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	defer session.Close()
+	entries := session.List()
+	require.Len(t, entries, 2)
+	assert.Equal(t, name+"/a.txt", entries[0].Path)
+
+	// Random access: read the second file before the first.
+	var buf bytes.Buffer
+	require.NoError(t, session.Cat(name+"/dir/b.txt", &buf))
+	assert.Equal(t, "content of dir/b.txt", buf.String())
+	buf.Reset()
+	require.NoError(t, session.Cat(name+"/a.txt", &buf))
+	assert.Equal(t, "content of a.txt", buf.String())
+	assert.Error(t, session.Cat(name+"/missing.txt", &buf))
+
+	fsys := fstest.MapFS{"assets/embedded.nsm": &fstest.MapFile{Data: data}}
+	fsSession, err := engine.OpenFS(fsys, "assets/embedded.nsm")
+	require.NoError(t, err)
+	defer fsSession.Close()
+	dest := t.TempDir()
+	require.NoError(t, fsSession.ExtractFiles(dest))
+	extracted, err := os.ReadFile(filepath.Join(dest, name, "dir", "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "content of dir/b.txt", string(extracted))
+}
+
+// fastKDF are the cheapest Argon2id parameters, so tests of passphrases stay fast.
+var fastKDF = core.KDFParams{Time: 1, Threads: 1, Memory: 1}
+
+// TestDeriveKey checks that passphrase keys are derived with Argon2id and the
+// parameters of the engine, and that more memory than MaxKDFMemory is rejected, both
+// when creating an archive and, before deriving anything, when opening one.
+func TestDeriveKey(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	engine, _ := setupTestEngine(t, 0)
+	want := argon2.IDKey([]byte("password"), salt, 3, 64*1024, 4, 32)
+	assert.Equal(t, want, engine.DeriveKey("password", salt))
+
+	fast, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, KDF: fastKDF})
+	require.NoError(t, err)
+	key := fast.DeriveKey("password", salt)
+	assert.Equal(t, argon2.IDKey([]byte("password"), salt, 1, 1024, 1, 32), key)
+	assert.NotEqual(t, key, fast.DeriveKey("password", []byte("fedcba9876543210")), "The salt should change the key")
+
+	passphrase := []byte("correct horse")
+	protected, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, Passphrase: passphrase, KDF: fastKDF})
+	require.NoError(t, err)
+	archivePath := filepath.Join(t.TempDir(), "protected.nsm")
+	_, err = protected.Create(archivePath, []string{createTestTree(t, "a.txt")})
+	require.NoError(t, err)
+	f, err := os.OpenFile(archivePath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	header, err := core.ReadHeader(f)
+	require.NoError(t, err)
+	header.KDF.Memory = core.MaxKDFMemory + 1
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	require.NoError(t, core.WriteHeader(f, header))
+	require.NoError(t, f.Close())
+	_, err = protected.List(archivePath)
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrInvalidFormat, coreErr.Code)
+
+	greedy, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, Passphrase: passphrase,
+		KDF: core.KDFParams{Time: 1, Threads: 1, Memory: core.MaxKDFMemory + 1}})
+	require.NoError(t, err)
+	_, err = greedy.Create(filepath.Join(t.TempDir(), "greedy.nsm"), []string{createTestTree(t, "a.txt")})
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrInvalidInput, coreErr.Code, "Creating an archive that needs more than MaxKDFMemory to open should fail")
+}
+
+// TestDataEncryption verifies that archives created with an encryption key extract with
+// that key only, and that altering a single byte of encrypted data fails
+// authentication rather than yielding corrupted content.
+func TestDataEncryption(t *testing.T) {
+	root := createTestTree(t, "a.txt", "dir/b.txt")
+	large := bytes.Repeat([]byte("encrypted in several chunks "), 20000)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "large.log"), large, 0644))
+	key := bytes.Repeat([]byte{0x42}, core.EncryptionKeySize)
+	withKey := func(key []byte) *core.Engine {
+		engine, err := core.NewEngine(&core.Config{Tokens: core.NoopTokenSource{}, EncryptionKey: key, GroupSmallFiles: true})
+		require.NoError(t, err)
+		return engine
+	}
+	archivePath := filepath.Join(t.TempDir(), "encrypted.nsm")
+	_, err := withKey(key).Create(archivePath, []string{root})
+	require.NoError(t, err)
+	header, _ := readArchiveIndex(t, archivePath)
+	assert.Equal(t, core.EncryptionAES256GCM, header.EncryptionType)
+
+	name := filepath.Base(root)
+	dest := t.TempDir()
+	require.NoError(t, withKey(key).Extract(archivePath, dest))
+	data, err := os.ReadFile(filepath.Join(dest, name, "large.log"))
+	require.NoError(t, err)
+	assert.Equal(t, large, data)
+	data, err = os.ReadFile(filepath.Join(dest, name, "dir", "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "content of dir/b.txt", string(data))
+
+	// Recompressing keeps the data encrypted with the same key.
+	require.NoError(t, withKey(key).Recompress(archivePath, core.GZIP, core.DefaultLevel))
+	header, _ = readArchiveIndex(t, archivePath)
+	assert.Equal(t, core.EncryptionAES256GCM, header.EncryptionType)
+	require.NoError(t, withKey(key).Extract(archivePath, t.TempDir()))
+
+	var coreErr *core.CoreError
+	for _, engine := range []*core.Engine{withKey(nil), withKey(bytes.Repeat([]byte{0x24}, core.EncryptionKeySize))} {
+		err := engine.Extract(archivePath, t.TempDir())
+		require.ErrorAs(t, err, &coreErr)
+		assert.Equal(t, core.ErrDecryption, coreErr.Code)
+	}
+
+	corruptEntry(t, archivePath, name+"/large.log")
+	err = withKey(key).Extract(archivePath, t.TempDir())
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrDecryption, coreErr.Code)
+	assert.Contains(t, err.Error(), "failed to authenticate")
+
+	_, err = withKey(key[:16]).Create(filepath.Join(t.TempDir(), "short.nsm"), []string{root})
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrInvalidInput, coreErr.Code)
+}
+
+// TestChaCha20Encryption verifies that data encrypted with ChaCha20-Poly1305 is
+// recorded as such and read back without naming the cipher, including after the
+// archive is rewritten.
+func TestChaCha20Encryption(t *testing.T) {
+	root := createTestTree(t, "a.txt", "dir/b.txt")
+	large := bytes.Repeat([]byte("encrypted in several chunks "), 20000)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "large.log"), large, 0644))
+	withConfig := func(config core.Config) *core.Engine {
+		config.Tokens = core.NoopTokenSource{}
+		config.EncryptionKey = bytes.Repeat([]byte{0x42}, core.EncryptionKeySize)
+		engine, err := core.NewEngine(&config)
+		require.NoError(t, err)
+		return engine
+	}
+	archivePath := filepath.Join(t.TempDir(), "chacha.nsm")
+	_, err := withConfig(core.Config{EncryptionAlgo: core.CipherChaCha20Poly1305}).Create(archivePath, []string{root})
+	require.NoError(t, err)
+
+	reader := withConfig(core.Config{})
+	name := filepath.Base(root)
+	check := func() {
+		info, err := reader.Info(archivePath)
+		require.NoError(t, err)
+		assert.Equal(t, core.CipherChaCha20Poly1305, info.Encryption)
+		dest := t.TempDir()
+		require.NoError(t, reader.Extract(archivePath, dest))
+		data, err := os.ReadFile(filepath.Join(dest, name, "large.log"))
+		require.NoError(t, err)
+		assert.Equal(t, large, data)
+	}
+	check()
+
+	require.NoError(t, reader.Remove(archivePath, []string{name + "/a.txt"}))
+	check()
+	require.NoError(t, reader.Recompress(archivePath, core.GZIP, core.DefaultLevel))
+	check()
+
+	corruptEntry(t, archivePath, name+"/large.log")
+	err = reader.Extract(archivePath, t.TempDir())
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrDecryption, coreErr.Code)
+
+	_, err = withConfig(core.Config{EncryptionAlgo: "rot13"}).Create(filepath.Join(t.TempDir(), "bad.nsm"), []string{root})
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrInvalidInput, coreErr.Code)
+}
+
+// TestPassphraseEncryptsData verifies that a passphrase encrypts the data with a key
+// of its own, which still needs the passphrase after the index is rewrapped with a
+// key, and that an empty passphrase is rejected.
+func TestPassphraseEncryptsData(t *testing.T) {
+	root := createTestTree(t, "a.txt", "dir/b.txt")
+	withConfig := func(config core.Config) *core.Engine {
+		config.Tokens = core.NoopTokenSource{}
+		config.KDF = fastKDF
+		engine, err := core.NewEngine(&config)
+		require.NoError(t, err)
+		return engine
+	}
+	passphrase := []byte("correct horse battery staple")
+	archivePath := filepath.Join(t.TempDir(), "protected.nsm")
+	_, err := withConfig(core.Config{Passphrase: passphrase}).Create(archivePath, []string{root})
+	require.NoError(t, err)
+
+	f, err := os.Open(archivePath)
+	require.NoError(t, err)
+	header, err := core.ReadHeader(f)
+	f.Close()
+	require.NoError(t, err)
+	assert.Equal(t, core.EncryptionAES256GCM, header.EncryptionType)
+	assert.Equal(t, fastKDF, header.DataKDF)
+	assert.NotEqual(t, [16]byte{}, header.DataKDFSalt)
+	assert.NotEqual(t, header.KDFSalt, header.DataKDFSalt)
+
+	indexKey := bytes.Repeat([]byte{7}, core.IndexKeySize)
+	require.NoError(t, withConfig(core.Config{Passphrase: passphrase}).RewrapIndex(archivePath, nil, indexKey))
+	var coreErr *core.CoreError
+	err = withConfig(core.Config{IndexKey: indexKey}).Extract(archivePath, t.TempDir())
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrDecryption, coreErr.Code)
+
+	dest := t.TempDir()
+	require.NoError(t, withConfig(core.Config{IndexKey: indexKey, Passphrase: passphrase}).Extract(archivePath, dest))
+	data, err := os.ReadFile(filepath.Join(dest, filepath.Base(root), "dir", "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "content of dir/b.txt", string(data))
+
+	_, err = withConfig(core.Config{Passphrase: []byte{}}).Create(filepath.Join(t.TempDir(), "empty.nsm"), []string{root})
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrInvalidInput, coreErr.Code)
+}
+
+// TestKeyFile verifies that a key file encrypts the data on its own, and together with
+// a passphrase so that the data needs both, and that key files of the wrong size are
+// rejected.
+func TestKeyFile(t *testing.T) {
+	root := createTestTree(t, "a.txt", "dir/b.txt")
+	keyDir := t.TempDir()
+	writeKey := func(name string, size int, fill byte) string {
+		path := filepath.Join(keyDir, name)
+		require.NoError(t, os.WriteFile(path, bytes.Repeat([]byte{fill}, size), 0600))
+		return path
+	}
+	keyFile, otherKeyFile := writeKey("key", core.EncryptionKeySize, 1), writeKey("other", core.EncryptionKeySize, 2)
+	passphrase := []byte("correct horse")
+	var coreErr *core.CoreError
+	engine := func(config core.Config) *core.Engine {
+		config.Tokens = core.NoopTokenSource{}
+		config.KDF = fastKDF
+		engine, err := core.NewEngine(&config)
+		require.NoError(t, err)
+		return engine
+	}
+	extracts := func(archivePath string, config core.Config) {
+		dest := t.TempDir()
+		require.NoError(t, engine(config).Extract(archivePath, dest))
+		data, err := os.ReadFile(filepath.Join(dest, filepath.Base(root), "dir", "b.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "content of dir/b.txt", string(data))
+	}
+	fails := func(archivePath string, config core.Config) {
+		err := engine(config).Extract(archivePath, t.TempDir())
+		require.ErrorAs(t, err, &coreErr)
+		assert.Equal(t, core.ErrDecryption, coreErr.Code)
+	}
+
+	keyOnly := filepath.Join(t.TempDir(), "key.nsm")
+	_, err := engine(core.Config{KeyFile: keyFile}).Create(keyOnly, []string{root})
+	require.NoError(t, err)
+	header, _ := readArchiveIndex(t, keyOnly)
+	assert.Equal(t, core.EncryptionAES256GCM, header.EncryptionType)
+	extracts(keyOnly, core.Config{KeyFile: keyFile})
+	extracts(keyOnly, core.Config{EncryptionKey: bytes.Repeat([]byte{1}, core.EncryptionKeySize)})
+	fails(keyOnly, core.Config{})
+	fails(keyOnly, core.Config{KeyFile: otherKeyFile})
+
+	// Both factors are needed for the data; the passphrase alone opens the index.
+	twoFactor := filepath.Join(t.TempDir(), "two-factor.nsm")
+	_, err = engine(core.Config{KeyFile: keyFile, Passphrase: passphrase}).Create(twoFactor, []string{root})
+	require.NoError(t, err)
+	f, err := os.Open(twoFactor)
+	require.NoError(t, err)
+	header, err = core.ReadHeader(f)
+	f.Close()
+	require.NoError(t, err)
+	assert.NotZero(t, header.Flags&core.FlagDataKeyFile)
+	extracts(twoFactor, core.Config{KeyFile: keyFile, Passphrase: passphrase})
+	fails(twoFactor, core.Config{Passphrase: passphrase})
+	fails(twoFactor, core.Config{KeyFile: otherKeyFile, Passphrase: passphrase})
+	entries, err := engine(core.Config{Passphrase: passphrase}).List(twoFactor)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	require.NoError(t, engine(core.Config{KeyFile: keyFile, Passphrase: passphrase}).Recompress(twoFactor, core.GZIP, core.DefaultLevel))
+	extracts(twoFactor, core.Config{KeyFile: keyFile, Passphrase: passphrase})
+
+	for _, config := range []core.Config{
+		{KeyFile: writeKey("short", core.EncryptionKeySize-1, 1)},
+		{KeyFile: writeKey("long", core.EncryptionKeySize+1, 1)},
+		{KeyFile: filepath.Join(keyDir, "missing")},
+		{KeyFile: keyFile, EncryptionKey: bytes.Repeat([]byte{1}, core.EncryptionKeySize)},
+	} {
+		_, err := core.NewEngine(&config)
+		require.ErrorAs(t, err, &coreErr)
+		assert.Equal(t, core.ErrInvalidInput, coreErr.Code)
+	}
+}
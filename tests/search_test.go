@@ -0,0 +1,312 @@
+// Package tests contains all the tests for the NSM project.
+package tests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nexus/nsm/internal/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createSearchArchive builds an archive of a few text files using the given search index mode.
+func createSearchArchive(t *testing.T, mode core.SearchIndexMode) string {
+	root := t.TempDir()
+	files := map[string]string{
+		"notes.txt":  "Quarterly report: revenue grew in Q3.",
+		"todo.txt":   "Finish the quarterly REPORT before Friday.",
+		"recipe.txt": "Mix flour, sugar and eggs.",
+	}
+	var inputs []string
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		inputs = append(inputs, path)
+	}
+
+	engine, err := core.NewEngine(&core.Config{SearchIndex: mode, Tokens: core.NoopTokenSource{}})
+	require.NoError(t, err)
+	archivePath := filepath.Join(t.TempDir(), "search.nsm")
+	_, err = engine.Create(archivePath, inputs)
+	require.NoError(t, err)
+	return archivePath
+}
+
+// resultPaths returns the paths of search results, in order.
+func resultPaths(results []core.SearchResult) []string {
+	paths := []string{}
+	for _, r := range results {
+		paths = append(paths, r.Path)
+	}
+	return paths
+}
+
+// TestSearchEmbeddedIndex verifies keyword search against an index stored inside the archive.
+func TestSearchEmbeddedIndex(t *testing.T) {
+	archivePath := createSearchArchive(t, core.SearchIndexEmbedded)
+
+	header, idx := readArchiveIndex(t, archivePath)
+	assert.NotZero(t, header.Flags&core.FlagSearchEmbedded)
+	assert.NotEmpty(t, idx.SearchData)
+	assert.NoFileExists(t, archivePath+core.SidecarExtension)
+
+	engine, _ := setupTestEngine(t, 0)
+	matches, skipped, err := engine.Search(archivePath, "quarterly report")
+	require.NoError(t, err)
+	assert.Empty(t, skipped)
+	assert.Equal(t, []string{"notes.txt", "todo.txt"}, resultPaths(matches))
+	assert.Equal(t, int64(len("Quarterly report: revenue grew in Q3.")), matches[0].Size)
+
+	matches, _, err = engine.Search(archivePath, "report flour")
+	require.NoError(t, err)
+	assert.Empty(t, matches, "All query keywords must match")
+}
+
+// TestSearchSkipsBinaryFiles verifies that content that isn't valid UTF-8 is left out
+// of the search index, and that a query without matches returns an empty slice.
+func TestSearchSkipsBinaryFiles(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "text.txt"), []byte("hello from the text file"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "blob.bin"), []byte("hello \xff\xfe garbage"), 0644))
+	engine, _ := setupTestEngine(t, 1)
+	archivePath := filepath.Join(t.TempDir(), "binary.nsm")
+	_, err := engine.Create(archivePath, []string{root})
+	require.NoError(t, err)
+
+	base := filepath.Base(root)
+	_, idx := readArchiveIndex(t, archivePath)
+	assert.Equal(t, []string{base + "/text.txt"}, idx.SearchData["hello"])
+	assert.NotContains(t, idx.SearchData, "garbage", "Binary files should not be indexed")
+
+	matches, _, err := engine.Search(archivePath, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, []string{base + "/text.txt"}, resultPaths(matches))
+	matches, skipped, err := engine.Search(archivePath, "absent")
+	require.NoError(t, err)
+	assert.Empty(t, skipped)
+	assert.NotNil(t, matches, "No match should yield an empty slice, not nil")
+	assert.Empty(t, matches)
+}
+
+// TestSidecarIndexRejectedWhenEncrypted verifies that an encrypted archive can't have a
+// sidecar index, whose keywords would be readable by anyone.
+func TestSidecarIndexRejectedWhenEncrypted(t *testing.T) {
+	plainPath := createSearchArchive(t, core.SearchIndexSidecar)
+	data, err := os.ReadFile(plainPath + core.SidecarExtension)
+	require.NoError(t, err)
+	require.True(t, bytes.Contains(data, []byte("quarterly")), "The sidecar of a plain archive holds its keywords")
+
+	root := createTestTree(t, "quarterly.txt")
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyFile, bytes.Repeat([]byte{7}, core.EncryptionKeySize), 0600))
+	for name, config := range map[string]core.Config{
+		"index key":      {IndexKey: bytes.Repeat([]byte{1}, core.IndexKeySize)},
+		"passphrase":     {Passphrase: []byte("secret"), KDF: fastKDF},
+		"encryption key": {EncryptionKey: bytes.Repeat([]byte{2}, core.EncryptionKeySize)},
+		"key file":       {Passphrase: []byte("secret"), KDF: fastKDF, KeyFile: keyFile},
+	} {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			config.Tokens = core.NoopTokenSource{}
+			config.SearchIndex = core.SearchIndexSidecar
+			engine, err := core.NewEngine(&config)
+			require.NoError(t, err)
+			archivePath := filepath.Join(t.TempDir(), "secret.nsm")
+			_, err = engine.Create(archivePath, []string{root})
+			var coreErr *core.CoreError
+			require.ErrorAs(t, err, &coreErr)
+			assert.Equal(t, core.ErrInvalidInput, coreErr.Code)
+
+			data, err := os.ReadFile(archivePath + core.SidecarExtension)
+			if err == nil {
+				assert.False(t, bytes.Contains(data, []byte("quarterly")), "The sidecar leaks the keywords of an encrypted archive")
+			}
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
+
+// TestSearchSidecarIndex verifies that --index-sidecar moves the index next to the archive
+// and that search still works through it.
+func TestSearchSidecarIndex(t *testing.T) {
+	archivePath := createSearchArchive(t, core.SearchIndexSidecar)
+
+	header, idx := readArchiveIndex(t, archivePath)
+	assert.NotZero(t, header.Flags&core.FlagSearchSidecar)
+	assert.Empty(t, idx.SearchData, "The archive should not embed the search index")
+	assert.FileExists(t, archivePath+core.SidecarExtension)
+
+	engine, _ := setupTestEngine(t, 0)
+	matches, _, err := engine.Search(archivePath, "Eggs")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"recipe.txt"}, resultPaths(matches))
+
+	require.NoError(t, os.Remove(archivePath+core.SidecarExtension))
+	_, _, err = engine.Search(archivePath, "eggs")
+	assert.Error(t, err, "Search should fail when the sidecar is missing")
+}
+
+// TestSearchWithoutIndex verifies that archives built without an index are searched
+// by scanning their content.
+func TestSearchWithoutIndex(t *testing.T) {
+	archivePath := createSearchArchive(t, core.SearchIndexNone)
+
+	engine, _ := setupTestEngine(t, 0)
+	matches, skipped, err := engine.Search(archivePath, "quarterly report")
+	require.NoError(t, err)
+	assert.Empty(t, skipped)
+	assert.Equal(t, []string{"notes.txt", "todo.txt"}, resultPaths(matches))
+}
+
+// TestSearchStats verifies that searches report whether they used the search index
+// and how many files they decompressed, and that RequireSearchIndex rejects archives
+// that would have to be scanned.
+func TestSearchStats(t *testing.T) {
+	engine, _ := setupTestEngine(t, 0)
+	indexed := createSearchArchive(t, core.SearchIndexEmbedded)
+	_, _, stats, err := engine.SearchWithStats(indexed, "quarterly report")
+	require.NoError(t, err)
+	assert.Equal(t, core.SearchStats{Method: core.SearchMethodIndex, FilesDecompressed: 0}, stats)
+	_, _, stats, err = engine.SearchLinesWithStats(indexed, "quarterly report")
+	require.NoError(t, err)
+	assert.Equal(t, core.SearchStats{Method: core.SearchMethodIndex, FilesDecompressed: 2}, stats)
+
+	unindexed := createSearchArchive(t, core.SearchIndexNone)
+	_, _, stats, err = engine.SearchWithStats(unindexed, "quarterly report")
+	require.NoError(t, err)
+	assert.Equal(t, core.SearchStats{Method: core.SearchMethodScan, FilesDecompressed: 3}, stats)
+
+	strict, err := core.NewEngine(&core.Config{RequireSearchIndex: true})
+	require.NoError(t, err)
+	matches, _, err := strict.Search(indexed, "quarterly report")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"notes.txt", "todo.txt"}, resultPaths(matches))
+	_, _, err = strict.Search(unindexed, "quarterly report")
+	var coreErr *core.CoreError
+	require.ErrorAs(t, err, &coreErr)
+	assert.Equal(t, core.ErrNoSearchIndex, coreErr.Code)
+}
+
+// TestSearchSkipsCorruptFile verifies that a file that fails to decompress is reported
+// and skipped while matches from the other files are still returned.
+func TestSearchSkipsCorruptFile(t *testing.T) {
+	archivePath := createSearchArchive(t, core.SearchIndexNone)
+	corruptEntry(t, archivePath, "todo.txt")
+
+	engine, _ := setupTestEngine(t, 0)
+	matches, skipped, err := engine.Search(archivePath, "quarterly")
+	require.NoError(t, err, "A corrupt file should not fail the whole search")
+	assert.Equal(t, []string{"notes.txt"}, resultPaths(matches))
+	require.Len(t, skipped, 1)
+	assert.Equal(t, "todo.txt", skipped[0].Path)
+	assert.Error(t, skipped[0].Err)
+}
+
+// TestSearchLines verifies that line matches carry the line number, text and the
+// positions of the matched words.
+func TestSearchLines(t *testing.T) {
+	root := t.TempDir()
+	content := "Intro\r\nthe Quarterly report is late\nno match here\nreports and quarterly figures"
+	path := filepath.Join(root, "report.txt")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	engine, _ := setupTestEngine(t, 1)
+	archivePath := filepath.Join(t.TempDir(), "lines.nsm")
+	_, err := engine.Create(archivePath, []string{path})
+	require.NoError(t, err)
+
+	matches, skipped, err := engine.SearchLines(archivePath, "quarterly report")
+	require.NoError(t, err)
+	assert.Empty(t, skipped)
+	assert.Equal(t, []core.LineMatch{
+		{Path: "report.txt", Line: 2, Text: "the Quarterly report is late", Spans: []core.Span{{Start: 4, End: 13}, {Start: 14, End: 20}}},
+		{Path: "report.txt", Line: 4, Text: "reports and quarterly figures", Spans: []core.Span{{Start: 12, End: 21}}},
+	}, matches)
+}
+
+// TestExtractMatching verifies that only the files matching the query are extracted.
+func TestExtractMatching(t *testing.T) {
+	archivePath := createSearchArchive(t, core.SearchIndexEmbedded)
+	engine, _ := setupTestEngine(t, 0)
+
+	dest := t.TempDir()
+	extracted, skipped, err := engine.ExtractMatching(archivePath, dest, "quarterly report")
+	require.NoError(t, err)
+	assert.Empty(t, skipped)
+	assert.Equal(t, []string{"notes.txt", "todo.txt"}, extracted)
+	assert.FileExists(t, filepath.Join(dest, "notes.txt"))
+	assert.FileExists(t, filepath.Join(dest, "todo.txt"))
+	assert.NoFileExists(t, filepath.Join(dest, "recipe.txt"))
+
+	empty := t.TempDir()
+	extracted, _, err = engine.ExtractMatching(archivePath, empty, "nothing matches this")
+	require.NoError(t, err)
+	assert.Empty(t, extracted)
+	entries, err := os.ReadDir(empty)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "Nothing should be extracted without matches")
+}
+
+// countingReaderAt is an io.ReaderAt, like a remote object read with range requests,
+// that counts the bytes read.
+type countingReaderAt struct {
+	r    io.ReaderAt
+	read int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+// TestSearchReaderAt verifies that an archive opened through an io.ReaderAt is searched
+// and read by fetching only the ranges needed.
+func TestSearchReaderAt(t *testing.T) {
+	engine, _ := setupTestEngine(t, 1)
+	for _, mode := range []core.SearchIndexMode{core.SearchIndexEmbedded, core.SearchIndexSidecar} {
+		data, err := os.ReadFile(createSearchArchive(t, mode))
+		require.NoError(t, err)
+		session, err := engine.OpenReader(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		matches, skipped, err := session.Search("quarterly report")
+		require.NoError(t, err, mode)
+		assert.Empty(t, skipped)
+		assert.Equal(t, []string{"notes.txt", "todo.txt"}, resultPaths(matches), "A sidecar index can't be found, so %s is scanned", mode)
+		require.NoError(t, session.Close())
+	}
+
+	root := t.TempDir()
+	large := make([]byte, 1<<20)
+	_, err := rand.Read(large)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "large.bin"), large, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "small.txt"), []byte("a small remote file"), 0644))
+	archivePath := filepath.Join(t.TempDir(), "remote.nsm")
+	_, err = engine.Create(archivePath, []string{filepath.Join(root, "large.bin"), filepath.Join(root, "small.txt")})
+	require.NoError(t, err)
+	data, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+
+	remote := &countingReaderAt{r: bytes.NewReader(data)}
+	session, err := engine.OpenReader(remote, int64(len(data)))
+	require.NoError(t, err)
+	defer session.Close()
+	opened := atomic.LoadInt64(&remote.read)
+	assert.Less(t, opened, int64(64<<10), "Opening should only read the header and index")
+
+	matches, _, err := session.Search("remote")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"small.txt"}, resultPaths(matches))
+	assert.Equal(t, opened, atomic.LoadInt64(&remote.read), "The embedded index needs no more reads")
+
+	var content bytes.Buffer
+	require.NoError(t, session.Cat("small.txt", &content))
+	assert.Equal(t, "a small remote file", content.String())
+	assert.Less(t, atomic.LoadInt64(&remote.read), int64(128<<10), "Reading the small file shouldn't fetch the large one")
+}
@@ -0,0 +1,809 @@
+// Package tests contains all the tests for the NSM project.
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nexus/nsm/internal/api"
+	"github.com/nexus/nsm/internal/auth"
+	"github.com/nexus/nsm/internal/core"
+	"github.com/nexus/nsm/internal/web"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAPIKey is the API key accepted by servers configured with testServerConfig.
+const testAPIKey = "test-api-key"
+
+// testServerConfig returns a minimal valid server configuration using temporary directories.
+func testServerConfig(t *testing.T) api.ServerConfig {
+	return api.ServerConfig{
+		APIKeys:        []string{testAPIKey},
+		PayPalClientID: "test-client-id",
+		PayPalSecret:   "test-secret",
+		StorageBackend: "local",
+		ArchiveDir:     t.TempDir(),
+		StateDir:       t.TempDir(),
+	}
+}
+
+// setupTestServer creates an API server backed by a temporary archive directory
+// holding a single archive with random content.
+func setupTestServer(t *testing.T, id string, size int) (*api.Server, []byte) {
+	cfg := testServerConfig(t)
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.ArchiveDir, id+".nsm"), data, 0644))
+
+	server, err := api.NewServer(cfg)
+	require.NoError(t, err, "Server initialization should not fail")
+	return server, data
+}
+
+// truncatingWriter aborts the response after limit bytes, simulating a dropped connection.
+type truncatingWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *truncatingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n, _ := w.ResponseWriter.Write(p[:w.limit])
+		w.limit -= n
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	}
+	w.limit -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// TestExtractRangeRequests verifies the extract endpoint's Range handling.
+func TestExtractRangeRequests(t *testing.T) {
+	server, data := setupTestServer(t, "archive-1", 4096)
+
+	req := newRequest("GET", "/api/v1/extract/archive-1", nil)
+	req.Header.Set("Range", "bytes=100-199")
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+	assert.Equal(t, data[100:200], rec.Body.Bytes(), "Partial body should match the requested range")
+
+	req = newRequest("GET", "/api/v1/extract/archive-1", nil)
+	req.Header.Set("Range", "bytes=5000-")
+	rec = httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code)
+
+	req = newRequest("GET", "/api/v1/extract/missing", nil)
+	rec = httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// TestExtractAsTar verifies that the extract endpoint streams the files of an archive
+// as a tar when asked to.
+func TestExtractAsTar(t *testing.T) {
+	cfg := testServerConfig(t)
+	archivePath := createSearchArchive(t, core.SearchIndexEmbedded)
+	data, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.ArchiveDir, "notes.nsm"), data, 0644))
+	server, err := api.NewServer(cfg)
+	require.NoError(t, err)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, newRequest("GET", path, nil))
+		return rec
+	}
+
+	rec := get("/api/v1/extract/notes?format=tar")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "application/x-tar", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), `filename="notes.tar"`)
+	var names []string
+	tr := tar.NewReader(rec.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	assert.ElementsMatch(t, []string{"notes.txt", "todo.txt", "recipe.txt"}, names)
+
+	assert.Equal(t, http.StatusNotFound, get("/api/v1/extract/missing?format=tar").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/extract/notes?format=zip").Code)
+}
+
+// TestDownloadResumesAfterDisconnect verifies that an interrupted download is resumed
+// and yields the complete archive.
+func TestDownloadResumesAfterDisconnect(t *testing.T) {
+	server, data := setupTestServer(t, "archive-1", 256*1024)
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first response is cut off part way through the body.
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w = &truncatingWriter{ResponseWriter: w, limit: 100 * 1024}
+		}
+		server.Handler().ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	client := auth.NewMarketplaceClient(ts.URL, testAPIKey)
+	client.RetryDelay = 0
+
+	var buf bytes.Buffer
+	require.NoError(t, client.Download("archive-1", &buf), "Download should resume and succeed")
+	assert.Equal(t, data, buf.Bytes(), "Resumed download should match the stored archive")
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&requests), int32(2), "Download should have been resumed")
+}
+
+// corruptingWriter flips the first byte of the response body.
+type corruptingWriter struct {
+	http.ResponseWriter
+	done bool
+}
+
+func (w *corruptingWriter) Write(p []byte) (int, error) {
+	if !w.done && len(p) > 0 {
+		w.done = true
+		p = append([]byte{p[0] ^ 0xFF}, p[1:]...)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// TestDownloadDetectsCorruption verifies that the server advertises the archive's
+// digest and that a download corrupted in transit is rejected.
+func TestDownloadDetectsCorruption(t *testing.T) {
+	server, data := setupTestServer(t, "archive-1", 64*1024)
+
+	req := newRequest("GET", "/api/v1/extract/archive-1", nil)
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	sum := sha256.Sum256(data)
+	assert.Equal(t, "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]), rec.Header().Get("Digest"))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.Handler().ServeHTTP(&corruptingWriter{ResponseWriter: w}, r)
+	}))
+	defer ts.Close()
+
+	client := auth.NewMarketplaceClient(ts.URL, testAPIKey)
+	var buf bytes.Buffer
+	err := client.Download("archive-1", &buf)
+	assert.ErrorIs(t, err, auth.ErrDigestMismatch)
+}
+
+// newRequest returns a test request carrying testAPIKey, as endpoints requiring an API
+// key expect.
+func newRequest(method, path string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, path, body)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	return req
+}
+
+// postJSON sends a POST request with the given raw body through the server's handler.
+func postJSON(server *api.Server, path, body string) *httptest.ResponseRecorder {
+	req := newRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+// TestInvalidPayloadsRejected verifies that malformed request bodies get structured 400 responses.
+func TestInvalidPayloadsRejected(t *testing.T) {
+	server, _ := setupTestServer(t, "archive-1", 16)
+
+	tests := []struct {
+		name  string
+		path  string
+		body  string
+		field string // Expected field in the error details, if any.
+	}{
+		{"negative token count", "/api/v1/tokens/purchase", `{"token_count": -3}`, "token_count"},
+		{"missing token count", "/api/v1/tokens/purchase", `{}`, "token_count"},
+		{"wrong type", "/api/v1/tokens/purchase", `{"token_count": "five"}`, "token_count"},
+		{"unknown field", "/api/v1/tokens/purchase", `{"token_count": 1, "price": 0}`, ""},
+		{"malformed JSON", "/api/v1/tokens/purchase", `{"token_count": `, ""},
+		{"empty body", "/api/v1/tokens/purchase", ``, ""},
+		{"missing query", "/api/v1/search", `{"archive_id": "archive-1"}`, "query"},
+		{"bad archive id", "/api/v1/search", `{"archive_id": "../etc", "query": "x"}`, "archive_id"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := postJSON(server, tc.path, tc.body)
+			require.Equal(t, http.StatusBadRequest, rec.Code)
+
+			var resp web.ErrorResponse
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), "Error body should be JSON")
+			assert.NotEmpty(t, resp.Error)
+			if tc.field != "" {
+				assert.Contains(t, resp.Fields, tc.field, "Error should point at the invalid field")
+			}
+		})
+	}
+
+	rec := postJSON(server, "/api/v1/tokens/purchase", `{"token_count": 5}`)
+	assert.Equal(t, http.StatusOK, rec.Code, "A valid purchase request should be accepted")
+}
+
+// TestServerConfig verifies loading the configuration from the environment, failing
+// fast on missing settings and wiring the routes of a configured server.
+func TestServerConfig(t *testing.T) {
+	t.Setenv(api.EnvPayPalClientID, "")
+	t.Setenv(api.EnvPayPalSecret, "")
+	cfg, err := api.LoadServerConfig()
+	require.NoError(t, err)
+	_, err = api.NewServer(cfg)
+	require.Error(t, err, "Missing PayPal credentials should be rejected")
+	assert.Contains(t, err.Error(), api.EnvPayPalClientID)
+	assert.Contains(t, err.Error(), api.EnvPayPalSecret)
+
+	t.Setenv(api.EnvPayPalClientID, "env-client-id")
+	t.Setenv(api.EnvPayPalSecret, "env-secret")
+	t.Setenv(api.EnvArchiveDir, t.TempDir())
+	t.Setenv(api.EnvRateLimitRPS, "2.5")
+	t.Setenv(api.EnvCORSOrigins, "https://a.example, https://b.example")
+	t.Setenv(api.EnvShutdownTimeout, "1m30s")
+	cfg, err = api.LoadServerConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Second, cfg.ShutdownTimeout)
+	assert.Equal(t, "env-client-id", cfg.PayPalClientID)
+	assert.Equal(t, 2.5, cfg.RateLimitRPS)
+	assert.Equal(t, []string{"https://a.example", "https://b.example"}, cfg.CORSOrigins)
+
+	server, err := api.NewServer(cfg)
+	require.NoError(t, err, "A complete configuration should produce a server")
+
+	routes := []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/api/v1/tokens/validate", http.StatusOK},
+		{"POST", "/webhooks/paypal", http.StatusBadRequest}, // Unsigned.
+		{"GET", "/api/v1/extract/unknown", http.StatusUnauthorized},
+		{"GET", "/api/v1/no-such-route", http.StatusNotFound},
+	}
+	for _, rt := range routes {
+		req := httptest.NewRequest(rt.method, rt.path, nil)
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		assert.Equal(t, rt.want, rec.Code, "%s %s", rt.method, rt.path)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/tokens/validate", nil)
+	req.Header.Set("Origin", "https://a.example")
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	assert.Equal(t, "https://a.example", rec.Header().Get("Access-Control-Allow-Origin"), "Configured origins should be allowed")
+
+	rec = postJSON(server, "/api/v1/tokens/purchase", `{"token_count": 2}`)
+	assert.Equal(t, http.StatusOK, rec.Code, "Purchase route should be wired to the payment handler")
+}
+
+// TestSearchEndpoint verifies that the search endpoint queries stored archives through
+// the server's shared engine.
+func TestSearchEndpoint(t *testing.T) {
+	cfg := testServerConfig(t)
+	archivePath := createSearchArchive(t, core.SearchIndexEmbedded)
+	data, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.ArchiveDir, "notes.nsm"), data, 0644))
+
+	server, err := api.NewServer(cfg)
+	require.NoError(t, err)
+
+	rec := postJSON(server, "/api/v1/search", `{"archive_id": "notes", "query": "quarterly"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp api.SearchResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.Matches, 2)
+	assert.Equal(t, "notes.txt", resp.Matches[0].Path)
+	assert.Equal(t, "todo.txt", resp.Matches[1].Path)
+	assert.Empty(t, resp.Skipped)
+
+	rec = postJSON(server, "/api/v1/search", `{"archive_id": "missing", "query": "quarterly"}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Pages cover the matches in order, and report the total.
+	var paged []string
+	for offset := 0; offset < 3; offset++ {
+		rec = postJSON(server, fmt.Sprintf("/api/v1/search?limit=1&offset=%d", offset), `{"archive_id": "notes", "query": "quarterly"}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var page api.SearchResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		assert.Equal(t, 2, page.Total)
+		assert.Equal(t, 1, page.Limit)
+		for _, m := range page.Matches {
+			paged = append(paged, m.Path)
+		}
+	}
+	assert.Equal(t, []string{"notes.txt", "todo.txt"}, paged)
+
+	for _, params := range []string{"limit=0", "limit=abc", "offset=-1"} {
+		rec = postJSON(server, "/api/v1/search?"+params, `{"archive_id": "notes", "query": "quarterly"}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, params)
+	}
+}
+
+// TestEstimateEndpoint verifies that the estimate endpoint predicts a plausible cost
+// and size without charging tokens, and that it requires an API key.
+func TestEstimateEndpoint(t *testing.T) {
+	cfg := testServerConfig(t)
+	cfg.APIKeys = []string{"test-key"}
+	server, err := api.NewServer(cfg)
+	require.NoError(t, err)
+
+	tokenFile := filepath.Join(cfg.StateDir, auth.TokenFileName)
+	before, err := os.ReadFile(tokenFile)
+	require.NoError(t, err)
+
+	sample := bytes.Repeat([]byte("the same log line, over and over\n"), 2000)
+	body, err := json.Marshal(api.EstimateRequest{
+		Files:  []api.EstimateFile{{Path: "app.log", Size: 10 << 20}, {Path: "old.log", Size: 6 << 20}},
+		Sample: sample,
+	})
+	require.NoError(t, err)
+
+	estimate := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/estimate", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, estimate("").Code, "A missing API key should be rejected")
+	assert.Equal(t, http.StatusUnauthorized, estimate("wrong-key").Code, "An unknown API key should be rejected")
+
+	rec := estimate("test-key")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp api.EstimateResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 2, resp.Files)
+	assert.Equal(t, int64(16<<20), resp.UncompressedSize)
+	assert.Equal(t, 1, resp.Tokens)
+	assert.Greater(t, resp.EstimatedSize, int64(0))
+	assert.Less(t, resp.EstimatedSize, resp.UncompressedSize/10, "A repetitive sample should predict strong compression")
+
+	after, err := os.ReadFile(tokenFile)
+	require.NoError(t, err)
+	assert.Equal(t, before, after, "Estimating must not change the token balance")
+	entries, err := os.ReadDir(cfg.ArchiveDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "Estimating must not create anything")
+}
+
+// TestRateLimit verifies that requests beyond the burst of an API key are answered with
+// 429 and a Retry-After header, that other keys keep their own budget, and that a
+// burst of zero is rejected when limiting is enabled.
+func TestRateLimit(t *testing.T) {
+	cfg := testServerConfig(t)
+	cfg.APIKeys = []string{"key-a", "key-b"}
+	cfg.RateLimitRPS = 0.5
+	cfg.RateLimitBurst = 2
+	server, err := api.NewServer(cfg)
+	require.NoError(t, err)
+
+	estimate := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/estimate", strings.NewReader(`{"files": [{"path": "a.txt", "size": 10}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < 2; i++ {
+		rec := estimate("key-a")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+	rec := estimate("key-a")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"), "At 0.5 requests per second the next one is 2 seconds away")
+	assert.Equal(t, http.StatusOK, estimate("key-b").Code, "Each API key should have its own limiter")
+
+	cfg.RateLimitBurst = 0
+	_, err = api.NewServer(cfg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), api.EnvRateLimitBurst)
+}
+
+// TestRateLimiterDropsIdleKeys verifies that the limiters of keys idle long enough to
+// have their burst back are dropped at the next sweep, and that a dropped key starts
+// again with its full burst.
+func TestRateLimiterDropsIdleKeys(t *testing.T) {
+	limiter := api.NewRateLimiter(1, 2)
+	start := time.Now()
+	assert.Zero(t, limiter.Reserve("idle", start))
+	assert.Zero(t, limiter.Reserve("idle", start))
+	assert.Equal(t, time.Second, limiter.Reserve("idle", start), "The burst of 2 is used up")
+	assert.Zero(t, limiter.Reserve("busy", start))
+	assert.Equal(t, 2, limiter.Keys())
+
+	// Before the sweep interval has passed, nothing is dropped.
+	assert.Zero(t, limiter.Reserve("busy", start.Add(api.LimiterSweepInterval/2)))
+	assert.Equal(t, 2, limiter.Keys())
+
+	// A key seen within the refill time of 2 seconds is kept.
+	sweep := start.Add(api.LimiterSweepInterval)
+	assert.Zero(t, limiter.Reserve("busy", sweep.Add(-time.Second)))
+	assert.Zero(t, limiter.Reserve("new", sweep))
+	assert.Equal(t, 2, limiter.Keys(), "The idle key should be dropped, the busy one kept")
+
+	assert.Zero(t, limiter.Reserve("idle", sweep))
+	assert.Zero(t, limiter.Reserve("idle", sweep), "A dropped key should start with its full burst")
+	assert.Equal(t, 3, limiter.Keys())
+}
+
+// postFiles uploads files, by name, to the create endpoint as multipart/form-data.
+func postFiles(t *testing.T, server *api.Server, files map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range files {
+		fw, err := mw.CreateFormFile("files", name)
+		require.NoError(t, err)
+		_, err = fw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+	req := newRequest("POST", "/api/v1/create", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+// TestArchiveEndpointsRequireAPIKey verifies that creating, extracting and searching
+// archives is refused without a valid API key, before any upload is read.
+func TestArchiveEndpointsRequireAPIKey(t *testing.T) {
+	cfg := testServerConfig(t)
+	server, err := api.NewServer(cfg)
+	require.NoError(t, err)
+
+	for _, rt := range []struct{ method, path, body string }{
+		{"POST", "/api/v1/create", "--boundary--"},
+		{"GET", "/api/v1/extract/archive-1", ""},
+		{"POST", "/api/v1/search", `{"archive_id": "archive-1", "query": "x"}`},
+	} {
+		for _, key := range []string{"", "wrong-key"} {
+			req := httptest.NewRequest(rt.method, rt.path, strings.NewReader(rt.body))
+			if key != "" {
+				req.Header.Set("Authorization", "Bearer "+key)
+			}
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusUnauthorized, rec.Code, "%s %s with key %q", rt.method, rt.path, key)
+			assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+	entries, err := os.ReadDir(cfg.ArchiveDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "No archive should be created without an API key")
+}
+
+// TestCreateEndpoint verifies that uploaded files are archived and stored under a new
+// id, charging the server's tokens, and that oversized uploads and callers without
+// tokens are turned away.
+func TestCreateEndpoint(t *testing.T) {
+	cfg := testServerConfig(t)
+	cfg.MaxUploadSize = 64 * 1024
+	server, err := api.NewServer(cfg)
+	require.NoError(t, err)
+
+	rec := postFiles(t, server, map[string]string{"big.bin": strings.Repeat("x", 128*1024)})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, rec.Body.String())
+
+	files := map[string]string{"a.txt": "first upload", "b.txt": "second upload"}
+	rec = postFiles(t, server, files)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var resp api.CreateResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 2, resp.Files)
+	assert.Equal(t, "/api/v1/extract/"+resp.ArchiveID, rec.Header().Get("Location"))
+
+	archivePath := filepath.Join(cfg.ArchiveDir, resp.ArchiveID+".nsm")
+	info, err := os.Stat(archivePath)
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), resp.Size)
+	engine, _ := setupTestEngine(t, 0)
+	dest := t.TempDir()
+	require.NoError(t, engine.Extract(archivePath, dest))
+	for name, content := range files {
+		data, err := os.ReadFile(filepath.Join(dest, name))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	}
+
+	// The only free token is spent.
+	rec = postFiles(t, server, files)
+	assert.Equal(t, http.StatusPaymentRequired, rec.Code, rec.Body.String())
+	entries, err := os.ReadDir(cfg.ArchiveDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "Only the paid archive should be stored")
+}
+
+// webhookSigner returns a self-signed certificate and a function signing webhook
+// deliveries of body for webhookID, transmitted at sent, with its key, as PayPal does.
+func webhookSigner(t *testing.T) (*x509.Certificate, func(webhookID string, body []byte, sent time.Time) http.Header) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, func(webhookID string, body []byte, sent time.Time) http.Header {
+		transmissionTime := sent.UTC().Format(time.RFC3339)
+		message := fmt.Sprintf("tx-1|%s|%s|%d", transmissionTime, webhookID, crc32.ChecksumIEEE(body))
+		digest := sha256.Sum256([]byte(message))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+		h := http.Header{}
+		h.Set(web.HeaderTransmissionID, "tx-1")
+		h.Set(web.HeaderTransmissionTime, transmissionTime)
+		h.Set(web.HeaderTransmissionSig, base64.StdEncoding.EncodeToString(sig))
+		h.Set(web.HeaderAuthAlgo, web.WebhookAuthAlgo)
+		h.Set(web.HeaderCertURL, "https://api.paypal.com/v1/notifications/certs/CERT-1")
+		return h
+	}
+}
+
+// TestWebhookSignature verifies that PayPal webhook signatures are checked against the
+// body, transmission headers and webhook id, and that unverified deliveries are
+// rejected without crediting tokens.
+func TestWebhookSignature(t *testing.T) {
+	cert, sign := webhookSigner(t)
+	body := []byte(`{"id":"WH-1","event_type":"PAYMENT.CAPTURE.COMPLETED","resource":{"id":"CAP-1","amount":{"currency_code":"USD","value":"400.00"}}}`)
+
+	headers := sign("WH-ID", body, time.Now())
+	assert.NoError(t, web.VerifyWebhookSignature(headers, body, "WH-ID", cert))
+	assert.ErrorIs(t, web.VerifyWebhookSignature(headers, []byte(strings.Replace(string(body), "400.00", "4000.00", 1)), "WH-ID", cert), web.ErrWebhookSignature, "a tampered body should be rejected")
+	assert.ErrorIs(t, web.VerifyWebhookSignature(headers, body, "OTHER-ID", cert), web.ErrWebhookSignature, "a delivery for another webhook should be rejected")
+	headers.Set(web.HeaderAuthAlgo, "SHA1withRSA")
+	assert.ErrorIs(t, web.VerifyWebhookSignature(headers, body, "WH-ID", cert), web.ErrWebhookSignature)
+
+	// A forger can sign with their own certificate, but it isn't served by PayPal.
+	cfg := testServerConfig(t)
+	cfg.PayPalWebhookID = "WH-ID"
+	server, err := api.NewServer(cfg)
+	require.NoError(t, err)
+	tokenFile := filepath.Join(cfg.StateDir, auth.TokenFileName)
+	before, err := os.ReadFile(tokenFile)
+	require.NoError(t, err)
+	for _, certURL := range []string{"https://evil.example/cert.pem", "http://api.paypal.com/cert.pem", ""} {
+		req := httptest.NewRequest("POST", "/webhooks/paypal", bytes.NewReader(body))
+		req.Header = sign("WH-ID", body, time.Now())
+		req.Header.Set(web.HeaderCertURL, certURL)
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, certURL)
+	}
+	after, err := os.ReadFile(tokenFile)
+	require.NoError(t, err)
+	assert.Equal(t, before, after, "Forged events must not credit tokens")
+}
+
+// TestWebhookCapture verifies that a verified capture event credits the tokens it pays
+// for once, and that amounts no tokens can be credited for are acknowledged, so PayPal
+// doesn't retry them, without crediting anything.
+func TestWebhookCapture(t *testing.T) {
+	cert, sign := webhookSigner(t)
+	tm, err := auth.NewTokenManager(t.TempDir(), "test-license-key")
+	require.NoError(t, err)
+	handler := web.NewPaymentHandler(&web.PayPalClient{WebhookID: "WH-ID"}, tm)
+	handler.AddWebhookCert("https://api.paypal.com/v1/notifications/certs/CERT-1", cert)
+	deliver := func(currency, value string) int {
+		body := []byte(fmt.Sprintf(`{"id":"WH-1","event_type":"PAYMENT.CAPTURE.COMPLETED","resource":{"id":"CAP-1","amount":{"currency_code":%q,"value":%q}}}`, currency, value))
+		req := httptest.NewRequest("POST", "/webhooks/paypal", bytes.NewReader(body))
+		req.Header = sign("WH-ID", body, time.Now())
+		rec := httptest.NewRecorder()
+		handler.HandleWebhook(rec, req)
+		return rec.Code
+	}
+	before := tm.AvailableTokens()
+
+	assert.Equal(t, http.StatusOK, deliver("EUR", "400.00"), "A payment in another currency should be acknowledged")
+	assert.Equal(t, http.StatusOK, deliver("USD", "5.00"), "A payment of a fraction of a token should be acknowledged")
+	assert.Equal(t, before, tm.AvailableTokens(), "No tokens should be credited for those payments")
+
+	assert.Equal(t, http.StatusOK, deliver("USD", "400.00"))
+	assert.Equal(t, before+100, tm.AvailableTokens())
+	assert.Equal(t, http.StatusOK, deliver("USD", "400.00"), "A redelivery should be acknowledged")
+	assert.Equal(t, before+100, tm.AvailableTokens(), "A capture should only be credited once")
+}
+
+// TestWebhookReplay verifies that a signed delivery transmitted too long ago, or too far
+// in the future, is rejected without crediting tokens.
+func TestWebhookReplay(t *testing.T) {
+	cert, sign := webhookSigner(t)
+	tm, err := auth.NewTokenManager(t.TempDir(), "test-license-key")
+	require.NoError(t, err)
+	handler := web.NewPaymentHandler(&web.PayPalClient{WebhookID: "WH-ID"}, tm)
+	handler.AddWebhookCert("https://api.paypal.com/v1/notifications/certs/CERT-1", cert)
+	body := []byte(`{"id":"WH-1","event_type":"PAYMENT.CAPTURE.COMPLETED","resource":{"id":"CAP-1","amount":{"currency_code":"USD","value":"400.00"}}}`)
+	deliver := func(sent time.Time) int {
+		req := httptest.NewRequest("POST", "/webhooks/paypal", bytes.NewReader(body))
+		req.Header = sign("WH-ID", body, sent)
+		rec := httptest.NewRecorder()
+		handler.HandleWebhook(rec, req)
+		return rec.Code
+	}
+	before := tm.AvailableTokens()
+
+	skew := web.MaxTransmissionSkew + time.Minute
+	assert.Equal(t, http.StatusBadRequest, deliver(time.Now().Add(-skew)), "A delivery sent too long ago should be rejected")
+	assert.Equal(t, http.StatusBadRequest, deliver(time.Now().Add(skew)), "A delivery sent in the future should be rejected")
+	assert.Equal(t, before, tm.AvailableTokens(), "Rejected deliveries must not credit tokens")
+	assert.Equal(t, http.StatusOK, deliver(time.Now().Add(-time.Minute)))
+	assert.Equal(t, before+100, tm.AvailableTokens())
+}
+
+// scrapeMetrics returns the metrics served by handler.
+func scrapeMetrics(t *testing.T, handler http.Handler) string {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", api.MetricsPath, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+	return rec.Body.String()
+}
+
+// TestMetricsEndpoint verifies that requests, archive operations, token consumption
+// and compressor statistics are exposed as Prometheus metrics, labelled by route
+// template, and that the endpoint can be moved off the API router.
+func TestMetricsEndpoint(t *testing.T) {
+	cfg := testServerConfig(t)
+	server, err := api.NewServer(cfg)
+	require.NoError(t, err)
+
+	rec := postFiles(t, server, map[string]string{"a.txt": "metered upload"})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var resp api.CreateResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	for _, id := range []string{resp.ArchiveID, "missing"} {
+		rec = httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, newRequest("GET", "/api/v1/extract/"+id+"?format=tar", nil))
+	}
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	body := scrapeMetrics(t, server.Handler())
+	for _, line := range []string{
+		`nsm_http_requests_total{method="POST",route="/api/v1/create",status="201"} 1`,
+		`nsm_http_requests_total{method="GET",route="/api/v1/extract/{id}",status="200"} 1`,
+		`nsm_http_requests_total{method="GET",route="/api/v1/extract/{id}",status="404"} 1`,
+		`nsm_http_request_duration_seconds_bucket{method="GET",route="/api/v1/extract/{id}",le="+Inf"} 2`,
+		`nsm_http_request_duration_seconds_count{method="POST",route="/api/v1/create"} 1`,
+		`nsm_http_requests_in_flight 1`, // The scrape itself.
+		`nsm_archive_operations_total{operation="create",result="success"} 1`,
+		`nsm_archive_operations_total{operation="extract",result="success"} 1`,
+		`nsm_tokens_consumed_total 1`,
+		`nsm_tokens_available 0`,
+		`nsm_compressor_calls_total{operation="compress"} 1`,
+		`# TYPE nsm_http_request_duration_seconds histogram`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+
+	cfg = testServerConfig(t)
+	cfg.MetricsAddr = "127.0.0.1:0"
+	server, err = api.NewServer(cfg)
+	require.NoError(t, err)
+	rec = httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest("GET", api.MetricsPath, nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "Metrics should only be served on their own address")
+	assert.Contains(t, scrapeMetrics(t, server.MetricsHandler()), "nsm_tokens_consumed_total 0\n")
+}
+
+// stalledUpload starts uploading a file to the create endpoint at url and returns once
+// the server is reading it, so the create is in progress. The upload then stalls until
+// finish is called, which completes it or, with an error, aborts it; the status it was
+// answered with, or 0 if it failed, is sent on the channel.
+func stalledUpload(t *testing.T, url string) (finish func(err error), status <-chan int) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	req, err := http.NewRequest("POST", url+"/api/v1/create", pr)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	statusc := make(chan int, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			statusc <- 0
+			return
+		}
+		resp.Body.Close()
+		statusc <- resp.StatusCode
+	}()
+	fw, err := mw.CreateFormFile("files", "big.bin")
+	require.NoError(t, err)
+	// More than the connection buffers: the write only returns once the handler reads.
+	_, err = fw.Write(make([]byte, 32<<20))
+	require.NoError(t, err)
+	return func(err error) {
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		require.NoError(t, mw.Close())
+		pw.Close()
+	}, statusc
+}
+
+// TestGracefulShutdown verifies that shutting down turns away new archive operations,
+// waits for the ones in progress, and once out of time cancels them and removes the
+// archives they left half written.
+func TestGracefulShutdown(t *testing.T) {
+	cfg := testServerConfig(t)
+	server, err := api.NewServer(cfg)
+	require.NoError(t, err)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	finish, status := stalledUpload(t, ts.URL)
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	require.Eventually(t, func() bool {
+		rec := postFiles(t, server, map[string]string{"late.txt": "too late"})
+		return rec.Code == http.StatusServiceUnavailable
+	}, 5*time.Second, 10*time.Millisecond, "New creates should be refused once shutdown began")
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned with a create in progress: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	finish(nil)
+	assert.Equal(t, http.StatusCreated, <-status, "The create in progress should complete")
+	require.NoError(t, <-shutdown)
+
+	cfg = testServerConfig(t)
+	server, err = api.NewServer(cfg)
+	require.NoError(t, err)
+	ts2 := httptest.NewServer(server.Handler())
+	defer ts2.Close()
+	partial := filepath.Join(cfg.ArchiveDir, "interrupted.nsm.part")
+	require.NoError(t, os.WriteFile(partial, []byte("half written"), 0600))
+
+	finish, status = stalledUpload(t, ts2.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go func() { shutdown <- server.Shutdown(ctx) }()
+	time.Sleep(300 * time.Millisecond) // Past the timeout: the create is cancelled.
+	finish(io.ErrUnexpectedEOF)
+	<-status
+	assert.ErrorIs(t, <-shutdown, context.DeadlineExceeded)
+	assert.NoFileExists(t, partial, "Partial archives should be removed on a forced shutdown")
+}
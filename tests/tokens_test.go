@@ -0,0 +1,488 @@
+// Package tests contains all the tests for the NSM project.
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nexus/nsm/internal/auth"
+	"github.com/nexus/nsm/internal/core"
+	"github.com/nexus/nsm/internal/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupTokenManager creates a token manager in a temporary directory seeded with
+// the given balance. It returns the manager and its state directory.
+func setupTokenManager(t *testing.T, tokens int) (*auth.TokenManager, string) {
+	dir := t.TempDir()
+	state, err := json.Marshal(auth.TokenState{AvailableTokens: tokens})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, auth.TokenFileName), state, 0600))
+
+	tm, err := auth.NewTokenManager(dir, "")
+	require.NoError(t, err)
+	return tm, dir
+}
+
+// TestConsumeN verifies that ConsumeN takes tokens all at once or not at all.
+func TestConsumeN(t *testing.T) {
+	tm, dir := setupTokenManager(t, 5)
+
+	require.NoError(t, tm.ConsumeN(3))
+	assert.Equal(t, 2, tm.AvailableTokens())
+
+	assert.ErrorIs(t, tm.ConsumeN(3), auth.ErrNoTokens, "Consuming more than the balance should fail")
+	assert.Equal(t, 2, tm.AvailableTokens(), "A failed ConsumeN should not consume anything")
+
+	assert.Error(t, tm.ConsumeN(0), "Non-positive counts should be rejected")
+	assert.Error(t, tm.RefundN(-1), "Non-positive counts should be rejected")
+
+	require.NoError(t, tm.RefundN(3))
+	require.NoError(t, tm.ConsumeToken())
+	assert.Equal(t, 4, tm.AvailableTokens())
+
+	// The balance must have been persisted.
+	reloaded, err := auth.NewTokenManager(dir, "")
+	require.NoError(t, err)
+	assert.Equal(t, 4, reloaded.AvailableTokens())
+}
+
+// TestConsumeNConcurrent verifies that concurrent batch consumption never overdraws.
+func TestConsumeNConcurrent(t *testing.T) {
+	tm, _ := setupTokenManager(t, 10)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tm.ConsumeN(3) == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 3, succeeded, "Only three batches of 3 fit in a balance of 10")
+	assert.Equal(t, 1, tm.AvailableTokens())
+}
+
+// TestAvailableTokensConcurrentReads polls the balance from many goroutines while
+// tokens are consumed and refunded. Run with -race to check the lock-free read path.
+func TestAvailableTokensConcurrentReads(t *testing.T) {
+	tm, _ := setupTokenManager(t, 50)
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				n := tm.AvailableTokens()
+				assert.True(t, n >= 10 && n <= 50, "Balance %d out of range", n)
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for j := 0; j < 5; j++ {
+				assert.NoError(t, tm.ConsumeN(2))
+				if j%2 == 0 {
+					assert.NoError(t, tm.RefundN(1))
+				}
+			}
+		}()
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+
+	// Each writer consumed 10 and got 3 back.
+	assert.Equal(t, 50-4*7, tm.AvailableTokens())
+}
+
+// TestTokenFileSharedByProcesses verifies that managers sharing a token file, as
+// separate processes do, see each other's changes and never overdraw it together.
+func TestTokenFileSharedByProcesses(t *testing.T) {
+	first, dir := setupTokenManager(t, 20)
+	second, err := auth.NewTokenManager(dir, "")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	var succeeded atomic.Int32
+	for i, tm := range []*auth.TokenManager{first, second, first, second} {
+		tm := tm
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 4; j++ {
+				err := tm.ConsumeN(2)
+				if err == nil {
+					succeeded.Add(1)
+				} else {
+					assert.ErrorIs(t, err, auth.ErrNoTokens, "worker %d", i)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(10), succeeded.Load(), "Only ten batches of 2 fit in a balance of 20")
+	reloaded, err := auth.NewTokenManager(dir, "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, reloaded.AvailableTokens())
+	assert.ErrorIs(t, first.ConsumeToken(), auth.ErrNoTokens)
+
+	require.NoError(t, first.AddTokens(3))
+	require.NoError(t, second.ConsumeToken())
+	assert.Equal(t, 2, second.AvailableTokens(), "Tokens added by another manager should be seen")
+}
+
+// TestInterruptedTokenFileWrite verifies that a write interrupted before the token file
+// was replaced leaves it intact.
+func TestInterruptedTokenFileWrite(t *testing.T) {
+	tm, dir := setupTokenManager(t, 5)
+	require.NoError(t, tm.ConsumeToken())
+
+	// What a crash halfway through writing the new state leaves behind.
+	stray := filepath.Join(dir, auth.TokenFileName+"-12345.tmp")
+	require.NoError(t, os.WriteFile(stray, []byte(`{"available_tok`), 0600))
+
+	tm, err := auth.NewTokenManager(dir, "")
+	require.NoError(t, err)
+	assert.Equal(t, 4, tm.AvailableTokens())
+	require.NoError(t, tm.ConsumeToken())
+
+	data, err := os.ReadFile(filepath.Join(dir, auth.TokenFileName))
+	require.NoError(t, err)
+	var state auth.TokenState
+	require.NoError(t, json.Unmarshal(data, &state))
+	assert.Equal(t, 3, state.AvailableTokens)
+
+	matches, err := filepath.Glob(filepath.Join(dir, auth.TokenFileName+"-*.tmp"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{stray}, matches, "Writes should not leave temporary files behind")
+}
+
+// TestAddTokensForTransaction verifies that a payment transaction is credited once,
+// even across restarts.
+func TestAddTokensForTransaction(t *testing.T) {
+	tm, dir := setupTokenManager(t, 1)
+	require.NoError(t, tm.AddTokens(2))
+	assert.Equal(t, 3, tm.AvailableTokens())
+
+	credited, err := tm.AddTokensForTransaction("CAP-1", 10)
+	require.NoError(t, err)
+	assert.True(t, credited)
+	credited, err = tm.AddTokensForTransaction("CAP-1", 10)
+	require.NoError(t, err)
+	assert.False(t, credited, "A repeated transaction should not be credited")
+	assert.Equal(t, 13, tm.AvailableTokens())
+
+	tm, err = auth.NewTokenManager(dir, "")
+	require.NoError(t, err)
+	credited, err = tm.AddTokensForTransaction("CAP-1", 10)
+	require.NoError(t, err)
+	assert.False(t, credited, "Credited transactions should be remembered across runs")
+	credited, err = tm.AddTokensForTransaction("CAP-2", 1)
+	require.NoError(t, err)
+	assert.True(t, credited)
+	assert.Equal(t, 14, tm.AvailableTokens())
+}
+
+// TestUsageHistory verifies that every archive charged for is recorded in the usage
+// log, and failed creates aren't.
+func TestUsageHistory(t *testing.T) {
+	tm, dir := setupTokenManager(t, 2)
+	history, err := tm.UsageHistory()
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	engine, err := core.NewEngine(&core.Config{Tokens: tm})
+	require.NoError(t, err)
+	root := createTestTree(t, "a.txt")
+	out := t.TempDir()
+	first := filepath.Join(out, "first.nsm")
+	_, err = engine.Create(first, []string{filepath.Join(root, "a.txt")})
+	require.NoError(t, err)
+	_, err = engine.Create(filepath.Join(out, "failed.nsm"), []string{filepath.Join(root, "missing.txt")})
+	require.Error(t, err)
+	_, err = engine.Create(filepath.Join(out, "second.nsm"), []string{filepath.Join(root, "a.txt")})
+	require.NoError(t, err)
+
+	// A record cut short by a crash is skipped.
+	f, err := os.OpenFile(filepath.Join(dir, auth.UsageLogFileName), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"timestamp":`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	history, err = tm.UsageHistory()
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, "create", history[0].Operation)
+	assert.Equal(t, first, history[0].Archive)
+	assert.Equal(t, 1, history[0].TokensRemaining)
+	assert.Equal(t, filepath.Join(out, "second.nsm"), history[1].Archive)
+	assert.Equal(t, 0, history[1].TokensRemaining)
+	assert.False(t, history[1].Timestamp.Before(history[0].Timestamp))
+}
+
+// TestSyncTokens verifies that syncing replaces the local balance with the one the
+// marketplace reports, and leaves it alone when the key is rejected.
+func TestSyncTokens(t *testing.T) {
+	var rejected atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/tokens/validate", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(auth.ValidationResponse{IsValid: !rejected.Load(), AvailableTokens: 7})
+	}))
+	defer ts.Close()
+
+	tm, dir := setupTokenManager(t, 1)
+	assert.True(t, tm.LastSync().IsZero())
+	client := auth.NewMarketplaceClient(ts.URL, "test-api-key")
+
+	before := time.Now()
+	resp, err := client.SyncTokens(tm)
+	require.NoError(t, err)
+	assert.Equal(t, 7, resp.AvailableTokens)
+	assert.Equal(t, 7, tm.AvailableTokens())
+	assert.False(t, tm.LastSync().Before(before))
+
+	reloaded, err := auth.NewTokenManager(dir, "")
+	require.NoError(t, err)
+	assert.Equal(t, 7, reloaded.AvailableTokens(), "The synced balance should be persisted")
+	assert.True(t, reloaded.LastSync().Equal(tm.LastSync()))
+
+	rejected.Store(true)
+	require.NoError(t, tm.ConsumeToken())
+	_, err = client.SyncTokens(tm)
+	assert.ErrorIs(t, err, auth.ErrInvalidLicense)
+	assert.Equal(t, 6, tm.AvailableTokens(), "A rejected key should leave the balance alone")
+}
+
+// TestValidateOnline verifies that online validation takes the balance from the
+// marketplace, and keeps the cached one when the response is unusable.
+func TestValidateOnline(t *testing.T) {
+	var body atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch b := body.Load().(string); b {
+		case "":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(b))
+		}
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	tm, err := auth.NewTokenManager(dir, "test-license-key")
+	require.NoError(t, err)
+	require.NoError(t, tm.AddTokens(3))
+	client := auth.NewMarketplaceClient(ts.URL, "test-license-key")
+	lastSync := tm.LastSync()
+
+	body.Store("")
+	assert.ErrorIs(t, tm.ValidateOnline(client), auth.ErrValidationFailed)
+	body.Store(`{"is_valid": tr`)
+	assert.ErrorIs(t, tm.ValidateOnline(client), auth.ErrValidationFailed)
+	assert.Equal(t, auth.DefaultFreeTokens+3, tm.AvailableTokens(), "A bad response should keep the cached balance")
+	assert.True(t, tm.LastSync().Equal(lastSync))
+
+	body.Store(`{"is_valid": true, "available_tokens": 42}`)
+	before := time.Now()
+	require.NoError(t, tm.ValidateOnline(client))
+	assert.Equal(t, 42, tm.AvailableTokens())
+	assert.False(t, tm.LastSync().Before(before))
+
+	reloaded, err := auth.NewTokenManager(dir, "")
+	require.NoError(t, err)
+	assert.Equal(t, 42, reloaded.AvailableTokens())
+
+	// Without a license key there is nothing to validate.
+	unlicensed, _ := setupTokenManager(t, 2)
+	require.NoError(t, unlicensed.ValidateOnline(client))
+	assert.Equal(t, 2, unlicensed.AvailableTokens())
+}
+
+// TestInterruptedPurchaseIsResumable verifies that a purchase interrupted before payment
+// is surfaced by the next run instead of a duplicate order being created.
+func TestInterruptedPurchaseIsResumable(t *testing.T) {
+	server, _ := setupTestServer(t, "archive-1", 16)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	client := auth.NewMarketplaceClient(ts.URL, "test-api-key")
+
+	tm, dir := setupTokenManager(t, 0)
+	order, err := client.StartPurchase(tm, 10)
+	require.NoError(t, err)
+	require.NotEmpty(t, order.OrderID)
+
+	// The run is interrupted before the payment; the next one reloads the state.
+	tm, err = auth.NewTokenManager(dir, "")
+	require.NoError(t, err)
+	pending := tm.PendingOrder()
+	require.NotNil(t, pending, "The pending order should survive the interruption")
+	assert.Equal(t, order.OrderID, pending.OrderID)
+	assert.Equal(t, 10, pending.TokenCount)
+
+	_, err = client.StartPurchase(tm, 5)
+	assert.ErrorIs(t, err, auth.ErrPendingOrder)
+	assert.Contains(t, err.Error(), order.OrderID)
+
+	status, err := client.CheckPendingOrder(tm)
+	require.NoError(t, err)
+	assert.Equal(t, auth.OrderPending, status.Status)
+	assert.NotNil(t, tm.PendingOrder(), "An unpaid order should stay pending")
+
+	require.NoError(t, client.CancelPendingOrder(tm))
+	assert.Nil(t, tm.PendingOrder())
+	tm, err = auth.NewTokenManager(dir, "")
+	require.NoError(t, err)
+	assert.Nil(t, tm.PendingOrder(), "The cancellation should be persisted")
+}
+
+// TestCaptureApprovedOrder verifies that checking an approved order captures its
+// payment, retrying server errors, and that client errors aren't retried.
+func TestCaptureApprovedOrder(t *testing.T) {
+	var captures int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/tokens/purchase":
+			json.NewEncoder(w).Encode(auth.PurchaseResponse{OrderID: "order-1", PaymentURL: "https://pay.example/order-1"})
+		case "/api/v1/tokens/orders/order-1":
+			json.NewEncoder(w).Encode(auth.OrderStatus{OrderID: "order-1", Status: auth.OrderApproved, TokenCount: 3})
+		case "/api/v1/tokens/capture":
+			n := atomic.AddInt32(&captures, 1)
+			var req auth.CaptureRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			if req.OrderID != "order-1" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			// The first two attempts hit a transient failure.
+			if n <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(w).Encode(auth.CaptureResponse{OrderID: "order-1", Status: auth.OrderCompleted, TokensCredited: 3, TransactionID: "tx-42"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	client := auth.NewMarketplaceClient(ts.URL, "test-api-key")
+	client.RetryDelay = time.Millisecond
+
+	tm, _ := setupTokenManager(t, 0)
+	_, err := client.StartPurchase(tm, 3)
+	require.NoError(t, err)
+	status, err := client.CheckPendingOrder(tm)
+	require.NoError(t, err)
+	assert.Equal(t, auth.OrderCompleted, status.Status)
+	assert.Equal(t, "tx-42", status.TransactionID)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&captures))
+	assert.Nil(t, tm.PendingOrder(), "A captured order should be cleared")
+
+	_, err = client.CaptureOrder("unknown")
+	require.Error(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&captures), "A client error should not be retried")
+}
+
+// TestCaptureIncompleteOrder verifies that a capture answered with any status but
+// completed is an error, and that the order stays pending until a capture completes it.
+func TestCaptureIncompleteOrder(t *testing.T) {
+	captureStatus := auth.OrderPending
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/tokens/purchase":
+			json.NewEncoder(w).Encode(auth.PurchaseResponse{OrderID: "order-1", PaymentURL: "https://pay.example/order-1"})
+		case "/api/v1/tokens/orders/order-1":
+			json.NewEncoder(w).Encode(auth.OrderStatus{OrderID: "order-1", Status: auth.OrderApproved, TokenCount: 3})
+		case "/api/v1/tokens/capture":
+			json.NewEncoder(w).Encode(auth.CaptureResponse{OrderID: "order-1", Status: captureStatus, TransactionID: "tx-42"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	client := auth.NewMarketplaceClient(ts.URL, "test-api-key")
+	client.RetryDelay = time.Millisecond
+
+	tm, _ := setupTokenManager(t, 0)
+	_, err := client.StartPurchase(tm, 3)
+	require.NoError(t, err)
+	for _, status := range []string{auth.OrderPending, auth.OrderApproved, ""} {
+		captureStatus = status
+		_, err = client.CheckPendingOrder(tm)
+		assert.ErrorIs(t, err, auth.ErrCaptureIncomplete, "A %q capture should not complete the order", status)
+		assert.NotNil(t, tm.PendingOrder(), "An order whose capture didn't complete should stay pending")
+	}
+
+	captureStatus = auth.OrderCompleted
+	status, err := client.CheckPendingOrder(tm)
+	require.NoError(t, err)
+	assert.Equal(t, auth.OrderCompleted, status.Status)
+	assert.Nil(t, tm.PendingOrder())
+}
+
+// TestMarketplaceClientIdentification verifies that requests carry the tool version in
+// their User-Agent and the installation's stable client id.
+func TestMarketplaceClientIdentification(t *testing.T) {
+	var headers http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"is_valid":true,"available_tokens":3}`))
+	}))
+	defer ts.Close()
+
+	tm, dir := setupTokenManager(t, 1)
+	id, err := tm.ClientID()
+	require.NoError(t, err)
+	assert.Len(t, id, 32)
+
+	client := auth.NewMarketplaceClient(ts.URL, "test-api-key")
+	client.ClientID = id
+	_, err = client.ValidateAPIKey()
+	require.NoError(t, err)
+	assert.Contains(t, headers.Get("User-Agent"), "nsm/"+version.Version)
+	assert.Equal(t, id, headers.Get(auth.ClientIDHeader))
+
+	reloaded, err := auth.NewTokenManager(dir, "")
+	require.NoError(t, err)
+	again, err := reloaded.ClientID()
+	require.NoError(t, err)
+	assert.Equal(t, id, again, "The client id should persist across runs")
+
+	client.UserAgent = "custom-agent/1.0"
+	client.ClientID = ""
+	_, err = client.ValidateAPIKey()
+	require.NoError(t, err)
+	assert.Equal(t, "custom-agent/1.0", headers.Get("User-Agent"))
+	assert.Empty(t, headers.Get(auth.ClientIDHeader), "No client id should be sent when disabled")
+}